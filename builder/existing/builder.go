@@ -0,0 +1,160 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package existing implements the existing-psrp builder, which provisions
+// a Windows machine that already exists over PSRP. It has no machine
+// lifecycle of its own: it connects, runs the build's provisioners and
+// produces an artifact naming the machine. It doubles as the reference for
+// wiring the communicator into a builder.
+package existing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// BuilderID identifies artifacts made by this builder.
+const BuilderID = "smnsjas.psrp-existing"
+
+// Config is the builder configuration: the psrp_* options naming the
+// machine. communicator, which psrp.Config also decodes, must be "psrp".
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	ctx interpolate.Context
+}
+
+// Builder provisions an existing machine over PSRP.
+type Builder struct {
+	config Config
+	comm   communicator.Config
+	runner multistep.Runner
+}
+
+// ConfigSpec returns the HCL2 spec of the builder's configuration.
+func (b *Builder) ConfigSpec() hcldec.ObjectSpec { return b.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration. The communicator is
+// prepared with psrp.PrepareCommunicator, as the SDK's own Prepare rejects
+// the "psrp" type.
+func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
+	err := config.Decode(&b.config, &config.DecodeOpts{
+		PluginType:         "existing-psrp",
+		Interpolate:        true,
+		InterpolateContext: &b.config.ctx,
+	}, raws...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b.config.Type == "" {
+		b.config.Type = psrp.CommunicatorType
+	}
+	if b.config.Type != psrp.CommunicatorType {
+		return nil, nil, fmt.Errorf("communicator must be %q", psrp.CommunicatorType)
+	}
+
+	b.comm = communicator.Config{Type: b.config.Type}
+	warnings, errs := psrp.PrepareCommunicator(&b.comm, &b.config.Config, &b.config.ctx)
+	if len(errs) > 0 {
+		return nil, warnings, packersdk.MultiErrorAppend(nil, errs...)
+	}
+	return psrp.GeneratedDataKeys, warnings, nil
+}
+
+// Run connects to the machine and runs the provisioners.
+func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook) (packersdk.Artifact, error) {
+	target := b.config.PSRPHost
+	if target == "" {
+		target = b.config.PSRPVMName
+	}
+	if target == "" {
+		target = b.config.PSRPContainerID
+	}
+	if target == "" {
+		target = b.config.PSRPVMID
+	}
+	if target == "" {
+		target = b.config.PSRPPipeName
+	}
+	if target == "" && b.config.PSRPPipeProcessID != 0 {
+		target = fmt.Sprintf("process %d", b.config.PSRPPipeProcessID)
+	}
+
+	host := func(multistep.StateBag) (string, error) { return b.config.PSRPHost, nil }
+	steps := []multistep.Step{
+		psrp.WrapStepConnect(&communicator.StepConnect{
+			Config: &b.comm,
+			Host:   host,
+		}, &b.config.Config, nil),
+		&commonsteps.StepProvision{},
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("config", &b.config)
+	state.Put("instance_id", target)
+	state.Put("hook", hook)
+	state.Put("ui", ui)
+
+	b.runner = &multistep.BasicRunner{Steps: steps}
+	b.runner.Run(ctx, state)
+
+	// Close the session psrp_keep_session left open; no later step uses it
+	if err := psrp.CloseSessions(); err != nil {
+		ui.Error(fmt.Sprintf("Error closing PSRP session: %s", err))
+	}
+
+	if err, ok := state.GetOk("error"); ok {
+		return nil, err.(error)
+	}
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return nil, errors.New("build was cancelled")
+	}
+	if _, ok := state.GetOk(multistep.StateHalted); ok {
+		return nil, errors.New("build was halted")
+	}
+
+	generated, _ := state.Get("generated_data").(map[string]interface{})
+	return &Artifact{target: target, generated: generated}, nil
+}
+
+// Artifact names the provisioned machine. Nothing is destroyed with it:
+// the machine existed before the build.
+type Artifact struct {
+	target    string
+	generated map[string]interface{}
+}
+
+// BuilderId returns BuilderID.
+func (a *Artifact) BuilderId() string { return BuilderID }
+
+// Files returns nil; the artifact is the machine itself.
+func (a *Artifact) Files() []string { return nil }
+
+// Id returns the machine's address or VM name.
+func (a *Artifact) Id() string { return a.target }
+
+func (a *Artifact) String() string { return fmt.Sprintf("Provisioned %s over PSRP", a.target) }
+
+// State returns the build's generated data for "generated_data".
+func (a *Artifact) State(name string) interface{} {
+	if name == "generated_data" {
+		return a.generated
+	}
+	return nil
+}
+
+// Destroy does nothing.
+func (a *Artifact) Destroy() error { return nil }
@@ -0,0 +1,51 @@
+package existing
+
+import (
+	"context"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+func TestBuilderRun(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+
+	var b Builder
+	_, _, err := b.Prepare(map[string]interface{}{
+		"psrp_host":                 srv.Host(),
+		"psrp_port":                 srv.Port(),
+		"psrp_auth_type":            "basic",
+		"psrp_allow_insecure_basic": true,
+		"psrp_flight_recorder_dir":  t.TempDir(),
+		"psrp_username":             testutil.ServerUsername,
+		"psrp_password":             testutil.ServerPassword,
+		"psrp_skip_tcp_probe":       true,
+	})
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	hook := new(packersdk.MockHook)
+	artifact, err := b.Run(context.Background(), packersdk.TestUi(t), hook)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if !hook.RunCalled || hook.RunName != packersdk.HookProvision {
+		t.Fatalf("provision hook not run (called %v, name %q)", hook.RunCalled, hook.RunName)
+	}
+	if _, ok := hook.RunComm.(*psrp.Communicator); !ok {
+		t.Errorf("provisioners got %T, want *psrp.Communicator", hook.RunComm)
+	}
+	data, _ := hook.RunData.(map[string]interface{})
+	if data["ID"] != srv.Host() {
+		t.Errorf("generated ID = %v, want %q", data["ID"], srv.Host())
+	}
+	if artifact.Id() != srv.Host() {
+		t.Errorf("artifact ID = %q, want %q", artifact.Id(), srv.Host())
+	}
+}
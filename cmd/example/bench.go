@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// benchRemoteDir is where bench writes on the remote machine. It is
+// removed afterwards.
+const benchRemoteDir = `C:\Windows\Temp\packer-psrp-bench`
+
+// runBench measures Upload, Download and UploadDir throughput for a range
+// of file sizes and upload chunk sizes. Without connection flags it runs
+// against an in-process fake server, which isolates the communicator's
+// own overhead (encoding, chunking, round trips) from the network and the
+// remote disk.
+func runBench(ctx context.Context, args []string) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	f := newConnFlags("bench")
+	sizes := f.fs.String("sizes", "64KiB,1MiB,16MiB", "comma-separated file sizes to transfer")
+	chunks := f.fs.String("chunk-sizes", "0", "comma-separated upload chunk sizes to compare (0 derives it from the envelope size)")
+	files := f.fs.Int("dir-files", 16, "files per directory for UploadDir, each of the benchmarked size")
+	iterations := f.fs.Int("n", 3, "iterations per measurement")
+	f.fs.Usage = func() {
+		fmt.Fprintf(f.fs.Output(), "Usage: %s bench [flags]\n\n"+
+			"Measures transfer throughput. Without -host, -vmid or -vm-name it runs\n"+
+			"against an in-process fake server. Against a real host, files are written\n"+
+			"under %s and removed afterwards.\n\nFlags:\n", progName(), benchRemoteDir)
+		f.fs.PrintDefaults()
+	}
+	if err := f.fs.Parse(args); err != nil {
+		return 2
+	}
+
+	sizeList, err := parseSizes(*sizes)
+	if err == nil && *iterations < 1 {
+		err = errors.New("-n must be at least 1")
+	}
+	var chunkList []int64
+	if err == nil {
+		chunkList, err = parseSizes(*chunks)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 2
+	}
+
+	var cfg *psrp.Config
+	var srv *testutil.Server
+	if f.remote() {
+		if cfg, err = f.config(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+	} else {
+		srv = testutil.NewServer()
+		defer srv.Close()
+		cfg = srv.Config()
+		fmt.Fprintln(os.Stderr, "No host given; benchmarking against an in-process fake server.")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tsize\tchunk\tfiles\ttime/op\tMB/s\t")
+	for _, chunk := range chunkList {
+		run := *cfg
+		run.PSRPUploadChunkSize = int(chunk)
+		if err := benchChunkSize(ctx, tw, srv, &run, sizeList, *files, *iterations); err != nil {
+			tw.Flush()
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+// benchChunkSize runs every measurement over one session configured with
+// cfg.
+func benchChunkSize(ctx context.Context, w io.Writer, srv *testutil.Server, cfg *psrp.Config, sizes []int64, files, iterations int) error {
+	var comm *psrp.Communicator
+	if srv != nil {
+		c, err := psrp.New(srv.Host(), cfg)
+		if err != nil {
+			return err
+		}
+		if err := c.Connect(ctx); err != nil {
+			return err
+		}
+		defer c.Close()
+		comm = c
+	} else {
+		c, done, err := connect(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer done()
+		comm = c
+		defer removeBenchDir(comm)
+	}
+
+	chunk := strconv.Itoa(cfg.UploadChunkSize())
+	for _, size := range sizes {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			return err
+		}
+		remote := benchRemoteDir + `\file.bin`
+
+		elapsed, err := measure(ctx, iterations, func() error {
+			return comm.Upload(remote, bytes.NewReader(data), nil)
+		})
+		if err != nil {
+			return fmt.Errorf("upload of %s: %w", formatSize(size), err)
+		}
+		report(w, "upload", size, chunk, 1, elapsed)
+
+		elapsed, err = measure(ctx, iterations, func() error {
+			var out bytes.Buffer
+			if err := comm.Download(remote, &out); err != nil {
+				return err
+			}
+			if int64(out.Len()) != size {
+				return fmt.Errorf("downloaded %d bytes, want %d", out.Len(), size)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("download of %s: %w", formatSize(size), err)
+		}
+		report(w, "download", size, "-", 1, elapsed)
+
+		if files > 0 {
+			dir, err := os.MkdirTemp("", "psrp-bench-")
+			if err != nil {
+				return err
+			}
+			for i := 0; i < files; i++ {
+				if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%03d.bin", i)), data, 0o644); err != nil {
+					os.RemoveAll(dir)
+					return err
+				}
+			}
+			elapsed, err = measure(ctx, iterations, func() error {
+				return comm.UploadDir(benchRemoteDir+`\dir`, dir, nil)
+			})
+			os.RemoveAll(dir)
+			if err != nil {
+				return fmt.Errorf("upload of directory of %s files: %w", formatSize(size), err)
+			}
+			report(w, "upload-dir", size*int64(files), chunk, files, elapsed)
+		}
+	}
+	return nil
+}
+
+// removeBenchDir deletes what bench wrote on a real host. It runs even if
+// the benchmark was interrupted.
+func removeBenchDir(comm *psrp.Communicator) {
+	cmd := &packersdk.RemoteCmd{
+		Command: fmt.Sprintf("Remove-Item -LiteralPath '%s' -Recurse -Force -ErrorAction SilentlyContinue", benchRemoteDir),
+	}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to remove %s: %s\n", benchRemoteDir, err)
+		return
+	}
+	cmd.Wait()
+}
+
+// measure runs op iterations times and returns the mean duration.
+func measure(ctx context.Context, iterations int, op func() error) (time.Duration, error) {
+	var total time.Duration
+	for i := 0; i < iterations; i++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		if err := op(); err != nil {
+			return 0, err
+		}
+		total += time.Since(start)
+	}
+	return total / time.Duration(iterations), nil
+}
+
+func report(w io.Writer, op string, size int64, chunk string, files int, elapsed time.Duration) {
+	rate := float64(size) / elapsed.Seconds() / (1 << 20)
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%v\t%.2f\t\n", op, formatSize(size), chunk, files, elapsed.Round(time.Millisecond), rate)
+}
+
+// parseSizes parses a comma-separated list of sizes such as "64KiB,1MiB".
+func parseSizes(list string) ([]int64, error) {
+	var sizes []int64
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		n, err := parseSize(s)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func parseSize(s string) (int64, error) {
+	scale := int64(1)
+	num := s
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, scale = strings.TrimSuffix(s, u.suffix), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * scale, nil
+}
+
+func formatSize(n int64) string {
+	for _, u := range sizeUnits[:3] {
+		if n >= u.scale && n%u.scale == 0 {
+			return fmt.Sprintf("%d%s", n/u.scale, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// remote reports whether the flags name a host to benchmark against.
+func (f *connFlags) remote() bool {
+	if f.varFile != "" {
+		return true
+	}
+	set := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "host", "vmid", "vm-name", "container", "pipe":
+			set = true
+		}
+	})
+	return set
+}
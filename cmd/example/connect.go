@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// connFlags are the connection flags the subcommands share. Each maps to a
+// psrp_* option; anything else can be set in a var file.
+type connFlags struct {
+	fs      *flag.FlagSet
+	varFile string
+}
+
+// connOptions maps flag names to the psrp_* options they set.
+var connOptions = []struct {
+	flag, option, usage string
+	isBool              bool
+}{
+	{"host", "psrp_host", "remote host", false},
+	{"port", "psrp_port", "remote port (default 5985, or 5986 with -tls)", false},
+	{"user", "psrp_username", "username", false},
+	{"password", "psrp_password", `password, or an "env://NAME" / "file://PATH" reference`, false},
+	{"auth", "psrp_auth_type", "auth type: negotiate, kerberos, ntlm or basic", false},
+	{"tls", "psrp_use_tls", "use HTTPS", true},
+	{"insecure", "psrp_insecure", "skip TLS certificate verification", true},
+	{"allow-insecure-basic", "psrp_allow_insecure_basic", "allow basic auth without -tls", true},
+	{"transport", "psrp_transport", "transport: wsman, hvsock, namedpipe or ssh", false},
+	{"vmid", "psrp_vmid", "Hyper-V VM ID (hvsock)", false},
+	{"vm-name", "psrp_vm_name", "Hyper-V VM name (hvsock)", false},
+	{"container", "psrp_container_id", "Hyper-V-isolated container ID (hvsock)", false},
+	{"pipe", "psrp_pipe_name", "named pipe (namedpipe)", false},
+	{"timeout", "psrp_timeout", "connection timeout, e.g. 1m", false},
+}
+
+func newConnFlags(name string) *connFlags {
+	f := &connFlags{fs: flag.NewFlagSet(name, flag.ContinueOnError)}
+	f.fs.StringVar(&f.varFile, "var-file", "", "HCL or JSON file of psrp_* options, as in a template")
+	for _, o := range connOptions {
+		if o.isBool {
+			f.fs.Bool(o.flag, false, o.usage)
+		} else {
+			f.fs.String(o.flag, "", o.usage)
+		}
+	}
+	return f
+}
+
+// config builds a prepared communicator config from the var file, then the
+// flags that were set.
+func (f *connFlags) config() (*psrp.Config, error) {
+	var raws []interface{}
+	if f.varFile != "" {
+		vars, err := readVarFile(f.varFile)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, vars)
+	}
+
+	// Flags are passed as strings; Decode converts them like template values
+	set := make(map[string]interface{})
+	f.fs.Visit(func(fl *flag.Flag) {
+		for _, o := range connOptions {
+			if o.flag == fl.Name {
+				set[o.option] = fl.Value.String()
+			}
+		}
+	})
+	raws = append(raws, set)
+
+	var cfg struct {
+		psrp.Config `mapstructure:",squash"`
+	}
+	if err := config.Decode(&cfg, nil, raws...); err != nil {
+		return nil, err
+	}
+	if !provisioner.Dials(&cfg.Config) {
+		return nil, errors.New("one of -host, -vmid, -vm-name, -container or -pipe (or psrp_host, psrp_vmid, psrp_vm_name, psrp_container_id or psrp_pipe_name) is required")
+	}
+	if errs := cfg.Config.Prepare(nil); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, w := range cfg.Config.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	return &cfg.Config, nil
+}
+
+// readVarFile reads psrp_* options from an HCL or JSON file.
+func readVarFile(path string) (map[string]interface{}, error) {
+	parser := hclparse.NewParser()
+	var file *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(path, ".json") {
+		file, diags = parser.ParseJSONFile(path)
+	} else {
+		file, diags = parser.ParseHCLFile(path)
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	attrs, diags := file.Body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	vars := make(map[string]interface{}, len(attrs))
+	for name, attr := range attrs {
+		value, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		data, err := ctyjson.Marshal(value, value.Type())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		vars[name] = v
+	}
+	return vars, nil
+}
+
+// connect opens a session the way a build would, through StepConnect, so
+// the retry policy, credential helpers and TLS checks all apply.
+func connect(ctx context.Context, cfg *psrp.Config) (*psrp.Communicator, func(), error) {
+	ui := &packersdk.BasicUi{
+		Reader:      os.Stdin,
+		Writer:      os.Stderr,
+		ErrorWriter: os.Stderr,
+	}
+	return provisioner.Session(ctx, ui, cfg)
+}
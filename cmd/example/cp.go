@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// remotePrefix marks the remote side of a cp. A prefix is used instead of
+// scp's "host:path" because Windows paths have colons of their own.
+const remotePrefix = "remote:"
+
+// runCp copies files or directories between the local machine and the
+// remote one with the communicator's Upload/Download and
+// UploadDir/DownloadDir.
+func runCp(ctx context.Context, args []string) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	f := newConnFlags("cp")
+	recursive := f.fs.Bool("r", false, "copy directories recursively")
+	var excludes []string
+	f.fs.Func("exclude", "file name pattern to skip when copying a directory (repeatable)", func(s string) error {
+		excludes = append(excludes, s)
+		return nil
+	})
+	f.fs.Usage = func() {
+		fmt.Fprintf(f.fs.Output(), "Usage: %s cp [flags] <src> <dst>\n\n"+
+			"Copies between the local machine and the remote one. Prefix the remote\n"+
+			"path with %q, e.g. %sC:/Windows/Temp/app.zip.\n\nFlags:\n", progName(), remotePrefix, remotePrefix)
+		f.fs.PrintDefaults()
+	}
+	if err := f.fs.Parse(args); err != nil {
+		return 2
+	}
+	if f.fs.NArg() != 2 {
+		f.fs.Usage()
+		return 2
+	}
+
+	src, dst := f.fs.Arg(0), f.fs.Arg(1)
+	srcRemote, dstRemote := strings.HasPrefix(src, remotePrefix), strings.HasPrefix(dst, remotePrefix)
+	if srcRemote == dstRemote {
+		fmt.Fprintf(os.Stderr, "error: exactly one of <src> and <dst> must start with %q\n", remotePrefix)
+		return 2
+	}
+	src, dst = strings.TrimPrefix(src, remotePrefix), strings.TrimPrefix(dst, remotePrefix)
+
+	cfg, err := f.config()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	comm, done, err := connect(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	defer done()
+
+	if dstRemote {
+		err = upload(ctx, comm, src, dst, *recursive, excludes)
+	} else {
+		err = download(ctx, comm, src, dst, *recursive, excludes)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func upload(ctx context.Context, comm *psrp.Communicator, src, dst string, recursive bool, excludes []string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if !recursive {
+			return fmt.Errorf("%s is a directory (use -r)", src)
+		}
+		return comm.UploadDirContext(ctx, dst, src, excludes)
+	}
+
+	if strings.HasSuffix(dst, "/") || strings.HasSuffix(dst, "\\") {
+		dst += filepath.Base(src)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return comm.UploadContext(ctx, dst, file, &info)
+}
+
+func download(ctx context.Context, comm *psrp.Communicator, src, dst string, recursive bool, excludes []string) error {
+	stat, err := comm.StatFile(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !stat.Exists {
+		return fmt.Errorf("remote path %s does not exist", src)
+	}
+	if stat.Dir {
+		if !recursive {
+			return fmt.Errorf("remote path %s is a directory (use -r)", src)
+		}
+		return comm.DownloadDirContext(ctx, src, dst, excludes)
+	}
+
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, path.Base(strings.ReplaceAll(src, "\\", "/")))
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := comm.DownloadContext(ctx, src, file); err != nil {
+		file.Close()
+		return errors.Join(err, os.Remove(dst))
+	}
+	return file.Close()
+}
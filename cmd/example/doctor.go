@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// runDoctor runs psrp.Diagnose against the target and prints a report. It
+// exits non-zero if any check failed.
+func runDoctor(ctx context.Context, args []string) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	f := newConnFlags("doctor")
+	f.fs.Usage = func() {
+		fmt.Fprintf(f.fs.Output(), "Usage: %s doctor [flags]\n\n"+
+			"Checks DNS, TCP, TLS, each auth mechanism, envelope size, the session\n"+
+			"configuration and a transfer round-trip, and suggests fixes.\n\nFlags:\n", progName())
+		f.fs.PrintDefaults()
+	}
+	if err := f.fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := f.config()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	failed := 0
+	for _, check := range psrp.Diagnose(ctx, cfg) {
+		fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(check.Status)), check.Name, check.Detail)
+		if check.Status == psrp.CheckFail {
+			failed++
+		}
+		if check.Hint != "" && (check.Status == psrp.CheckFail || check.Status == psrp.CheckWarn) {
+			fmt.Printf("       hint: %s\n", check.Hint)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("\nAll checks passed")
+	return 0
+}
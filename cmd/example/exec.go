@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// runExec runs one command over PSRP, streaming its output, and exits with
+// the command's exit code.
+func runExec(ctx context.Context, args []string) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	f := newConnFlags("exec")
+	f.fs.Usage = func() {
+		fmt.Fprintf(f.fs.Output(), "Usage: %s exec [flags] <command>...\n\n"+
+			"Runs a PowerShell command over PSRP and exits with its exit code.\n\nFlags:\n", progName())
+		f.fs.PrintDefaults()
+	}
+	if err := f.fs.Parse(args); err != nil {
+		return 2
+	}
+	if f.fs.NArg() == 0 {
+		f.fs.Usage()
+		return 2
+	}
+
+	cfg, err := f.config()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	comm, done, err := connect(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	defer done()
+
+	cmd := &packersdk.RemoteCmd{
+		Command: strings.Join(f.fs.Args(), " "),
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+	}
+	if err := comm.Start(ctx, cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	status := cmd.Wait()
+	fmt.Fprintf(os.Stderr, "exit code: %d\n", status)
+	return status
+}
@@ -1,23 +1,98 @@
-// Command example demonstrates that the PSRP communicator package compiles
-// and can be wired into a Packer plugin binary. It is NOT a usable standalone
-// plugin — Packer's plugin system has no RegisterCommunicator hook, so this
-// binary advertises zero components. Real usage requires a builder plugin
-// that imports the communicator/psrp package and registers it via
-// communicator.StepConnect.CustomConnect["psrp"].
+// Command example is a Packer plugin binary for this repository, and a
+// small CLI for debugging PSRP connections outside a build.
+//
+// Packer's plugin system has no RegisterCommunicator hook, so the
+// communicator itself can't be advertised here: a builder plugin has to
+// import the communicator/psrp package and register it via
+// communicator.StepConnect.CustomConnect["psrp"]. What this binary does
+// register is the existing-psrp builder, which does exactly that to
+// provision a machine that already exists, and the provisioners that run
+// over a PSRP session:
+//
+//   - powershell-psrp: runs PowerShell scripts, like the stock powershell
+//     provisioner
+//   - file-psrp: transfers files and directories with checksum verification,
+//     like the stock file provisioner
+//   - dsc-psrp: applies a DSC configuration and waits for it to converge
+//   - pester-psrp: runs Pester tests and fails the build if any fail
+//   - windows-update-psrp: installs Windows updates, restarting as needed
+//   - packages-psrp: installs Chocolatey or winget packages
+//   - manifest-psrp: records installed updates, features and software
+//
+// the manifest-psrp post-processor, which attaches that record to the
+// build's artifact, and the psrp-query data source, which runs a script on
+// a live machine and exposes its output to the template.
+//
+// Run directly, it also takes subcommands that connect with the same code
+// paths a build uses:
+//
+//   - exec: runs a one-off command and prints its output and exit code
+//   - shell: an interactive PowerShell prompt
+//   - cp: copies files and directories to or from the remote machine
+//   - doctor: checks connectivity step by step and suggests fixes
+//   - bench: measures upload and download throughput
 //
 // See the project README for integration instructions.
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 
 	"github.com/hashicorp/packer-plugin-sdk/plugin"
+	"github.com/smnsjas/packer-psrp-communicator/builder/existing"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/datasource/query"
+	manifestpp "github.com/smnsjas/packer-psrp-communicator/post-processor/manifest"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/dsc"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/file"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/manifest"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/packages"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/pester"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/powershell"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner/windowsupdate"
 	"github.com/smnsjas/packer-psrp-communicator/version"
 )
 
+// commands are the CLI subcommands. Anything else is handed to the plugin
+// set, which is how Packer runs the binary.
+var commands = map[string]func(ctx context.Context, args []string) int{
+	"bench":  runBench,
+	"cp":     runCp,
+	"doctor": runDoctor,
+	"exec":   runExec,
+	"shell":  runShell,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+			usage()
+			return
+		}
+		if run, ok := commands[os.Args[1]]; ok {
+			code := run(context.Background(), os.Args[2:])
+			if err := psrp.ShutdownTracing(context.Background()); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: exporting traces failed: %s\n", err)
+			}
+			os.Exit(code)
+		}
+	}
+
 	pps := plugin.NewSet()
+	pps.RegisterBuilder("existing-psrp", new(existing.Builder))
+	pps.RegisterProvisioner("powershell-psrp", new(powershell.Provisioner))
+	pps.RegisterProvisioner("file-psrp", new(file.Provisioner))
+	pps.RegisterProvisioner("dsc-psrp", new(dsc.Provisioner))
+	pps.RegisterProvisioner("pester-psrp", new(pester.Provisioner))
+	pps.RegisterProvisioner("windows-update-psrp", new(windowsupdate.Provisioner))
+	pps.RegisterProvisioner("packages-psrp", new(packages.Provisioner))
+	pps.RegisterProvisioner("manifest-psrp", new(manifest.Provisioner))
+	pps.RegisterPostProcessor("manifest-psrp", new(manifestpp.PostProcessor))
+	pps.RegisterDatasource("psrp-query", new(query.Datasource))
 	pps.SetVersion(version.PluginVersion)
 
 	err := pps.Run()
@@ -26,3 +101,21 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", progName())
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for a command's flags.\n", progName())
+}
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
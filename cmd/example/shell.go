@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// runShell is an interactive prompt: each input line (or block, for input
+// with open brackets or quotes) runs as a command over the session, just as
+// a provisioner's commands would. Ctrl-C cancels the running command; EOF
+// or "exit" quits.
+func runShell(ctx context.Context, args []string) int {
+	f := newConnFlags("shell")
+	f.fs.Usage = func() {
+		fmt.Fprintf(f.fs.Output(), "Usage: %s shell [flags]\n\n"+
+			"Opens an interactive PowerShell prompt over PSRP.\n\nFlags:\n", progName())
+		f.fs.PrintDefaults()
+	}
+	if err := f.fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := f.config()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	// Ctrl-C cancels the running command rather than the shell, so connect
+	// under a context that only the first interrupt cancels.
+	connectCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	comm, done, err := connect(connectCtx, cfg)
+	stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	defer done()
+
+	var mu sync.Mutex
+	var cancel context.CancelFunc
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			mu.Lock()
+			if cancel != nil {
+				cancel()
+			}
+			mu.Unlock()
+		}
+	}()
+
+	target := cfg.PSRPHost
+	if target == "" {
+		target = cfg.PSRPVMName + cfg.PSRPVMID
+	}
+	if cfg.PSRPContainerID != "" {
+		target = "container " + cfg.PSRPContainerID
+	}
+	fmt.Fprintf(os.Stderr, "Connected to %s. Type \"exit\" or press Ctrl-D to quit.\n", target)
+
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 1024*1024)
+	status := 0
+	for {
+		command, ok := readCommand(in, fmt.Sprintf("PS %s> ", target))
+		if !ok {
+			fmt.Fprintln(os.Stderr)
+			return status
+		}
+		switch strings.TrimSpace(command) {
+		case "":
+			continue
+		case "exit":
+			return status
+		}
+
+		cmdCtx, cmdCancel := context.WithCancel(ctx)
+		mu.Lock()
+		cancel = cmdCancel
+		mu.Unlock()
+
+		cmd := &packersdk.RemoteCmd{Command: command, Stdout: os.Stdout, Stderr: os.Stderr}
+		if err := comm.Start(cmdCtx, cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		} else {
+			status = cmd.Wait()
+			if cmdCtx.Err() != nil {
+				fmt.Fprintln(os.Stderr, "^C")
+			}
+		}
+
+		mu.Lock()
+		cancel = nil
+		mu.Unlock()
+		cmdCancel()
+	}
+}
+
+// readCommand reads one command, prompting for more lines while the input
+// is incomplete. It returns false at EOF.
+func readCommand(in *bufio.Scanner, prompt string) (string, bool) {
+	var lines []string
+	fmt.Fprint(os.Stderr, prompt)
+	for in.Scan() {
+		lines = append(lines, in.Text())
+		command := strings.Join(lines, "\n")
+		if !incomplete(command) {
+			return command, true
+		}
+		fmt.Fprint(os.Stderr, ">> ")
+	}
+	if len(lines) > 0 {
+		return strings.Join(lines, "\n"), true
+	}
+	return "", false
+}
+
+// incomplete reports whether s needs more lines: it ends with a line
+// continuation backtick, or leaves a bracket, quote or here-string open.
+// It is a heuristic, not a parser; PowerShell reports anything it misses.
+func incomplete(s string) bool {
+	if strings.HasSuffix(strings.TrimRight(s, " \t"), "`") {
+		return true
+	}
+
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '@':
+			if (c == '\'' || c == '"') && i+1 < len(s) && s[i+1] == '@' && (i == 0 || s[i-1] == '\n') {
+				quote = 0
+				i++
+			}
+		case quote != 0:
+			if c == '`' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '@' && i+1 < len(s) && (s[i+1] == '\'' || s[i+1] == '"'):
+			quote = '@'
+			i++
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '`':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '(' || c == '[':
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+		}
+	}
+	return depth > 0 || quote != 0
+}
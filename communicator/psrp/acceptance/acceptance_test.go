@@ -0,0 +1,276 @@
+//go:build acceptance
+
+// Package acceptance runs the communicator end to end against a real
+// Windows target: a connection and command for each auth type with TLS on
+// and off, transfers, a long-running command, cancellation and optionally
+// a restart. The target comes from the PSRP_TEST_* environment variables
+// (see testutil.EndpointConfig); without PSRP_TEST_HOST every test skips.
+// Files are written under accRemoteDir and removed afterwards.
+//
+//	PSRP_TEST_HOST=win.example.com PSRP_TEST_USERNAME=Administrator \
+//	PSRP_TEST_PASSWORD=... go test -tags acceptance -v ./communicator/psrp/acceptance
+package acceptance
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// accRemoteDir is where the tests write on the target.
+const accRemoteDir = `C:\Windows\Temp\packer-psrp-acceptance`
+
+// Environment variables tuning the suite, on top of testutil's endpoint
+// variables.
+const (
+	// envAuthTypes lists the auth types TestConnectMatrix tries
+	// (default "negotiate,ntlm,kerberos,basic").
+	envAuthTypes = "PSRP_TEST_AUTH_TYPES"
+
+	// envLong is how long TestLongRunning's command runs (default 2m; 0
+	// skips it).
+	envLong = "PSRP_TEST_LONG"
+
+	// envReboot enables TestRebootReconnect, which restarts the target.
+	envReboot = "PSRP_TEST_REBOOT"
+)
+
+// endpointConfig returns the target's config after configure adjusts it,
+// skipping the test if no target is set.
+func endpointConfig(t *testing.T, configure func(*psrp.Config)) *psrp.Config {
+	t.Helper()
+	if os.Getenv(testutil.EnvHost) == "" {
+		t.Skipf("%s not set", testutil.EnvHost)
+	}
+	cfg, err := testutil.EndpointConfig(configure)
+	if err != nil {
+		t.Fatalf("endpoint config: %v", err)
+	}
+	return cfg
+}
+
+// connect returns a communicator connected with cfg, closed with the test.
+func connect(t *testing.T, cfg *psrp.Config) *psrp.Communicator {
+	t.Helper()
+	comm, err := psrp.New(cfg.PSRPHost, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { comm.Close() })
+	if err := comm.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return comm
+}
+
+// suite returns a communicator over the endpoint's configured auth type,
+// removing what the test wrote on the target when it ends.
+func suite(t *testing.T) *psrp.Communicator {
+	t.Helper()
+	comm := connect(t, endpointConfig(t, nil))
+	t.Cleanup(func() {
+		run(t, context.Background(), comm, fmt.Sprintf("Remove-Item -LiteralPath '%s' -Recurse -Force -ErrorAction SilentlyContinue", accRemoteDir))
+	})
+	return comm
+}
+
+// run runs a script and returns its exit code and combined output.
+func run(t *testing.T, ctx context.Context, comm *psrp.Communicator, script string) (int, string) {
+	t.Helper()
+	var out bytes.Buffer
+	cmd := &packersdk.RemoteCmd{Command: script, Stdout: &out, Stderr: &out}
+	if err := comm.Start(ctx, cmd); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return cmd.Wait(), out.String()
+}
+
+func TestConnectMatrix(t *testing.T) {
+	if os.Getenv(testutil.EnvHost) == "" {
+		t.Skipf("%s not set", testutil.EnvHost)
+	}
+	auths := os.Getenv(envAuthTypes)
+	if auths == "" {
+		auths = "negotiate,ntlm,kerberos,basic"
+	}
+	for _, auth := range strings.Split(auths, ",") {
+		for _, useTLS := range []bool{false, true} {
+			auth := strings.TrimSpace(auth)
+			t.Run(fmt.Sprintf("%s/tls=%v", auth, useTLS), func(t *testing.T) {
+				cfg, err := testutil.EndpointConfig(func(c *psrp.Config) {
+					c.PSRPAuthType = psrp.AuthType(auth)
+					c.PSRPUseTLS = useTLS
+					if c.PSRPPort == 5986 && !useTLS {
+						c.PSRPPort = 5985
+					}
+				})
+				if err != nil {
+					// e.g. Basic over HTTP, or Kerberos without a realm
+					t.Skipf("configuration rejected: %v", err)
+				}
+				comm := connect(t, cfg)
+				code, out := run(t, context.Background(), comm, "Write-Output 'acceptance'; exit 3")
+				if code != 3 || strings.TrimSpace(out) != "acceptance" {
+					t.Errorf("got exit code %d and output %q, want 3 and \"acceptance\"", code, out)
+				}
+			})
+		}
+	}
+}
+
+// TestTransfer uploads a file spanning several chunks, checks its hash on
+// the target, and downloads it again.
+func TestTransfer(t *testing.T) {
+	comm := suite(t)
+	data := make([]byte, 3<<20+17)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	remote := accRemoteDir + `\file.bin`
+	if err := comm.Upload(remote, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	_, out := run(t, context.Background(), comm, fmt.Sprintf("(Get-FileHash -Algorithm SHA256 -LiteralPath '%s').Hash", remote))
+	if got := strings.ToLower(strings.TrimSpace(out)); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("remote SHA-256 is %s, want %s", got, hex.EncodeToString(sum[:]))
+	}
+
+	var back bytes.Buffer
+	if err := comm.Download(remote, &back); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(back.Bytes(), data) {
+		t.Errorf("downloaded %d bytes that differ from the %d uploaded", back.Len(), len(data))
+	}
+}
+
+// TestTransferDir round-trips a small directory tree with UploadDir and
+// DownloadDir.
+func TestTransferDir(t *testing.T) {
+	comm := suite(t)
+	src, dst := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"a.txt":           "alpha",
+		"sub/b.txt":       "bravo",
+		"sub/deep/c.txt":  "charlie",
+		"with space/d.ps": "Write-Output 'delta'",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote := accRemoteDir + `\tree`
+	if err := comm.UploadDir(remote, src, nil); err != nil {
+		t.Fatalf("UploadDir: %v", err)
+	}
+	if err := comm.DownloadDir(remote, dst, nil); err != nil {
+		t.Fatalf("DownloadDir: %v", err)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s came back as %q, want %q", name, got, content)
+		}
+	}
+}
+
+// TestLongRunning runs a command that writes a line every 10s and checks
+// that every line arrives: idle and operation timeouts must not cut it
+// short.
+func TestLongRunning(t *testing.T) {
+	long := 2 * time.Minute
+	if v := os.Getenv(envLong); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			t.Fatalf("%s: %v", envLong, err)
+		}
+		long = d
+	}
+	if long <= 0 {
+		t.Skipf("%s is 0", envLong)
+	}
+	comm := suite(t)
+
+	ticks := int(long / (10 * time.Second))
+	if ticks < 1 {
+		ticks = 1
+	}
+	code, out := run(t, context.Background(), comm,
+		fmt.Sprintf("1..%d | ForEach-Object { Start-Sleep -Seconds 10; Write-Output \"tick $_\" }", ticks))
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, out)
+	}
+	if got := strings.Count(out, "tick "); got != ticks {
+		t.Errorf("got %d of %d lines", got, ticks)
+	}
+}
+
+// TestCancellation cancels a command that would run for ten minutes and
+// checks that it returns promptly and the session still works.
+func TestCancellation(t *testing.T) {
+	comm := suite(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := &packersdk.RemoteCmd{Command: "Start-Sleep -Seconds 600"}
+	if err := comm.Start(ctx, cmd); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	time.Sleep(3 * time.Second)
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("command still running a minute after being cancelled")
+	}
+
+	if code, out := run(t, context.Background(), comm, "exit 0"); code != 0 {
+		t.Errorf("command after cancellation exited with %d: %s", code, out)
+	}
+}
+
+// TestRebootReconnect restarts the target through Communicator.Restart and
+// runs a command over the reconnected session. It only runs with
+// PSRP_TEST_REBOOT set.
+func TestRebootReconnect(t *testing.T) {
+	if os.Getenv(envReboot) == "" {
+		t.Skipf("%s not set", envReboot)
+	}
+	comm := suite(t)
+	if err := comm.Restart(context.Background(), 15*time.Minute); err != nil {
+		t.Fatalf("Restart: %v", err)
+	}
+	if code, out := run(t, context.Background(), comm, "exit 0"); code != 0 {
+		t.Errorf("command after restart exited with %d: %s", code, out)
+	}
+}
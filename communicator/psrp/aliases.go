@@ -0,0 +1,82 @@
+package psrp
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// configAlias maps an alternative option name onto its canonical option.
+// Alias fields are ordinary Config fields (so HCL2 specs accept them); Prepare
+// folds their values into the canonical field and records a warning for
+// deprecated names.
+type configAlias struct {
+	Alias      string
+	Canonical  string
+	Deprecated bool
+}
+
+// configAliases lists accepted alternative option names. To rename an
+// option, keep the old field, add it here with Deprecated set, and point
+// Canonical at the new name.
+var configAliases = []configAlias{
+	// WinRM-communicator style names
+	{Alias: "psrp_use_ssl", Canonical: "psrp_use_tls"},
+	{Alias: "psrp_user", Canonical: "psrp_username"},
+
+	// SSH-communicator style bastion names
+	{Alias: "psrp_bastion_host", Canonical: "psrp_ssh_tunnel_host"},
+	{Alias: "psrp_bastion_port", Canonical: "psrp_ssh_tunnel_port"},
+	{Alias: "psrp_bastion_username", Canonical: "psrp_ssh_tunnel_username"},
+	{Alias: "psrp_bastion_password", Canonical: "psrp_ssh_tunnel_password"},
+	{Alias: "psrp_bastion_private_key_file", Canonical: "psrp_ssh_tunnel_private_key_file"},
+	{Alias: "psrp_bastion_agent_auth", Canonical: "psrp_ssh_tunnel_agent_auth"},
+}
+
+// applyAliases copies values set under alias names into their canonical
+// fields. It returns deprecation warnings and conflict errors.
+func (c *Config) applyAliases() (warnings []string, errs []error) {
+	defaults := reflect.ValueOf(NewConfig()).Elem()
+	v := reflect.ValueOf(c).Elem()
+
+	for _, a := range configAliases {
+		aliasIdx, ok := fieldByTag(v.Type(), a.Alias)
+		if !ok {
+			continue
+		}
+		canonicalIdx, ok := fieldByTag(v.Type(), a.Canonical)
+		if !ok {
+			continue
+		}
+
+		aliasField := v.Field(aliasIdx)
+		if aliasField.IsZero() {
+			continue
+		}
+		canonicalField := v.Field(canonicalIdx)
+
+		if !canonicalField.IsZero() &&
+			!canonicalField.Equal(defaults.Field(canonicalIdx)) &&
+			!canonicalField.Equal(aliasField) {
+			errs = append(errs, fmt.Errorf("%s and %s are aliases and must not both be set", a.Alias, a.Canonical))
+			continue
+		}
+
+		canonicalField.Set(aliasField)
+		aliasField.SetZero()
+
+		if a.Deprecated {
+			warnings = append(warnings, fmt.Sprintf("%s is deprecated and will be removed in a future release; use %s instead", a.Alias, a.Canonical))
+		}
+	}
+	return warnings, errs
+}
+
+// fieldByTag returns the index of the field with the given mapstructure tag.
+func fieldByTag(t reflect.Type, tag string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("mapstructure") == tag {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,80 @@
+package psrp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyAliases(t *testing.T) {
+	cases := []struct {
+		name     string
+		set      func(c *Config)
+		want     func(c *Config) bool
+		errMatch string
+	}{
+		{
+			name: "alias only",
+			set:  func(c *Config) { c.PSRPUser = "admin" },
+			want: func(c *Config) bool { return c.PSRPUsername == "admin" && c.PSRPUser == "" },
+		},
+		{
+			name: "same value under both names",
+			set:  func(c *Config) { c.PSRPUser, c.PSRPUsername = "admin", "admin" },
+			want: func(c *Config) bool { return c.PSRPUsername == "admin" },
+		},
+		{
+			name:     "conflicting values",
+			set:      func(c *Config) { c.PSRPUser, c.PSRPUsername = "admin", "other" },
+			errMatch: "psrp_user and psrp_username are aliases",
+		},
+		{
+			name: "canonical left at its default",
+			set:  func(c *Config) { c.PSRPUseSSL = true },
+			want: func(c *Config) bool { return c.PSRPUseTLS && !c.PSRPUseSSL },
+		},
+		{
+			name: "nothing set",
+			set:  func(c *Config) {},
+			want: func(c *Config) bool { return reflect.DeepEqual(c, NewConfig()) },
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewConfig()
+			tc.set(c)
+			warnings, errs := c.applyAliases()
+			if len(warnings) > 0 {
+				t.Errorf("unexpected warnings: %v", warnings)
+			}
+			if tc.errMatch != "" {
+				if !hasError(errs, tc.errMatch) {
+					t.Errorf("errors %v, want one matching %q", errs, tc.errMatch)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if !tc.want(c) {
+				t.Errorf("aliases not applied: %+v", c)
+			}
+		})
+	}
+}
+
+func TestApplyAliasesDeprecated(t *testing.T) {
+	saved := configAliases
+	defer func() { configAliases = saved }()
+	configAliases = []configAlias{{Alias: "psrp_user", Canonical: "psrp_username", Deprecated: true}}
+
+	c := NewConfig()
+	c.PSRPUser = "admin"
+	warnings, errs := c.applyAliases()
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "psrp_user is deprecated") {
+		t.Errorf("warnings = %v, want a deprecation warning for psrp_user", warnings)
+	}
+}
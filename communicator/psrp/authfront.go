@@ -0,0 +1,716 @@
+package psrp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bodgit/ntlmssp"
+	"github.com/hashicorp/go-hclog"
+	"github.com/smnsjas/go-psrp/wsman/auth"
+)
+
+// frontDialTimeout bounds connecting to the WSMan endpoint from the auth
+// front.
+const frontDialTimeout = 30 * time.Second
+
+// maxAuthLegs bounds the round trips of a Kerberos/Negotiate handshake.
+const maxAuthLegs = 5
+
+// frontUsername is the user go-psrp presents to the auth front, with the
+// front's secret as the password.
+const frontUsername = "packer"
+
+// errIdleClosed marks a failure on a kept-alive connection before the
+// endpoint read the request, which is safe to retry on a new one.
+var errIdleClosed = errors.New("connection closed by the endpoint")
+
+// errKerberosStep marks a Kerberos handshake that failed on the Packer
+// host, e.g. with no ticket or no reachable KDC, rather than at the
+// endpoint.
+var errKerberosStep = errors.New("negotiate step failed")
+
+// authFront authenticates go-psrp's requests in its place. go-psrp owns
+// its HTTP transport and only offers a skip-verify switch for TLS, so it
+// can't send channel binding tokens, or check the certificate against
+// another name or a fingerprint. With the front, go-psrp connects over
+// plain HTTP to a loopback listener; each of its connections gets its own
+// connection to the endpoint, which the front opens, secures with TLS and
+// authenticates once, as WinRM expects, binding NTLM to the TLS channel.
+// The listener is reachable by any local process, so go-psrp presents a
+// random secret with basic auth on every request, and the front serves no
+// request without it.
+type authFront struct {
+	url      *url.URL // the WSMan endpoint
+	addr     string   // host:port dialed for it; the SSH tunnel's local end when tunnelling
+	secret   string   // the password go-psrp presents to the front
+	listener net.Listener
+	server   *http.Server
+	log      hclog.Logger
+
+	mu      sync.Mutex // guards config, trusted and conns
+	config  *Config
+	trusted string // certificate fingerprint trusted on first use
+	conns   map[net.Conn]*frontConn
+}
+
+// frontConn is the endpoint side of one go-psrp connection.
+type frontConn struct {
+	mu sync.Mutex // guards up
+	up *upstream
+}
+
+// upstream is an open connection to the endpoint.
+type upstream struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	bindings *ntlmssp.ChannelBindings // tls-server-end-point; nil without TLS
+	authed   bool
+	used     bool
+}
+
+type frontConnKey struct{}
+
+// useAuthFront reports whether go-psrp connects through an authFront: over
+// TLS with NTLM or Negotiate, which need channel binding tokens on
+// listeners with CbtHardeningLevel Strict, or with psrp_tls_server_name,
+// psrp_tls_fingerprint or psrp_tls_tofu, which go-psrp can't check. It
+// also does for Kerberos and Negotiate with a custom psrp_wsman_path,
+// where go-psrp would build the service name from the whole URL.
+func (c *Config) useAuthFront() bool {
+	if c.PSRPTransport != TransportWSMan {
+		return false
+	}
+	if (c.PSRPWSManPath != "" && c.PSRPWSManPath != DefaultWSManPath) || c.PSRPForceGokrb5 {
+		switch c.effectiveAuthType() {
+		case AuthKerberos, AuthNegotiate:
+			return true
+		}
+	}
+	if !c.PSRPUseTLS {
+		return false
+	}
+	if c.PSRPTLSServerName != "" || c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse {
+		return true
+	}
+	switch c.effectiveAuthType() {
+	case AuthNTLM, AuthNegotiate:
+		return !c.PSRPSkipChannelBinding
+	}
+	return false
+}
+
+// openAuthFront starts the front for target's endpoint, dialing addr.
+func openAuthFront(c *Config, target, addr string) (*authFront, error) {
+	u, err := url.Parse(c.EndpointURL(target))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint for %s: %w", target, err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate authentication secret: %w", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open authentication listener: %w", err)
+	}
+
+	f := &authFront{
+		url:      u,
+		addr:     addr,
+		secret:   hex.EncodeToString(secret),
+		listener: listener,
+		config:   c,
+		conns:    make(map[net.Conn]*frontConn),
+	}
+	RegisterSecret(f.secret)
+	f.log = logger.With("endpoint", u.Redacted(), "local", listener.Addr().String())
+	f.server = &http.Server{
+		Handler:           f,
+		ReadHeaderTimeout: frontDialTimeout,
+		ConnContext:       f.connContext,
+		ConnState:         f.connState,
+		ErrorLog:          f.log.StandardLogger(&hclog.StandardLoggerOptions{ForceLevel: hclog.Debug}),
+	}
+	f.log.Debug("authentication front listening")
+
+	go func() { _ = f.server.Serve(listener) }()
+	return f, nil
+}
+
+// port returns the local port go-psrp should connect to.
+func (f *authFront) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+// clientFactory wraps factory so clients connect through the front. The
+// front authenticates with the config the client is created with.
+func (f *authFront) clientFactory(factory ClientFactory) ClientFactory {
+	return func(_ string, config *Config) (PSRPClient, error) {
+		f.mu.Lock()
+		f.config = config
+		f.mu.Unlock()
+
+		local := *config
+		local.PSRPPort = f.port()
+		local.PSRPWSManPath = ""
+		local.PSRPUseTLS = false
+		local.PSRPInsecureSkipVerify = false
+		local.PSRPTLSFingerprint = ""
+		local.PSRPTLSTrustOnFirstUse = false
+		local.PSRPTLSServerName = ""
+		local.PSRPAuthType = AuthBasic
+		local.PSRPAllowInsecureBasic = true // loopback only
+		local.PSRPNegotiateMechanisms = nil
+		local.PSRPUseMachineCredentials = false
+		local.PSRPUsername = frontUsername
+		local.PSRPPassword = f.secret
+		local.PSRPDomain = ""
+		local.PSRPRealm = ""
+		local.PSRPKrb5ConfPath = ""
+		local.PSRPKeytabPath = ""
+		local.PSRPCCachePath = ""
+		return factory("127.0.0.1", &local)
+	}
+}
+
+// trust sets the fingerprint psrp_tls_tofu accepts, as verifyCertificate
+// recorded it. Until then the first connection records it.
+func (f *authFront) trust(fingerprint string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fingerprint != "" {
+		f.trusted = fingerprint
+	}
+}
+
+// trustCertificate passes the fingerprint trusted on first use to the
+// front, if any.
+func (c *Communicator) trustCertificate(fingerprint string) {
+	if c.front != nil {
+		c.front.trust(fingerprint)
+	}
+}
+
+func (f *authFront) currentConfig() *Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.config
+}
+
+func (f *authFront) connContext(ctx context.Context, conn net.Conn) context.Context {
+	fc := &frontConn{}
+	f.mu.Lock()
+	f.conns[conn] = fc
+	f.mu.Unlock()
+	return context.WithValue(ctx, frontConnKey{}, fc)
+}
+
+func (f *authFront) connState(conn net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	f.mu.Lock()
+	fc := f.conns[conn]
+	delete(f.conns, conn)
+	f.mu.Unlock()
+	if fc != nil {
+		fc.drop()
+	}
+}
+
+// ServeHTTP forwards one go-psrp request to the endpoint. Requests
+// without the front's secret are refused.
+func (f *authFront) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		f.log.Warn("refused an unauthenticated request on the authentication front", "remote", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	fc, _ := r.Context().Value(frontConnKey{}).(*frontConn)
+	if fc == nil {
+		http.Error(w, "no connection state", http.StatusInternalServerError)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// go-psrp giving up on the request (its timeout, or the session being
+	// closed) closes the loopback connection; abandon the endpoint's too
+	stop := context.AfterFunc(r.Context(), fc.abort)
+	defer stop()
+
+	resp, err := f.forward(r.Context(), fc, r, body)
+	if err != nil {
+		f.log.Debug("forwarding request failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		if hopHeader(name) {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Don't let go-psrp try to answer the challenge itself
+		w.Header().Del("WWW-Authenticate")
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fc.drop()
+		return
+	}
+	if resp.Close {
+		fc.drop()
+	}
+}
+
+// authorized reports whether r carries the front's secret.
+func (f *authFront) authorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && username == frontUsername &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(f.secret)) == 1
+}
+
+// forward sends the request on fc's endpoint connection, opening and
+// authenticating one if needed. A kept-alive connection the endpoint has
+// closed is replaced once.
+func (f *authFront) forward(ctx context.Context, fc *frontConn, r *http.Request, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		up, err := fc.upstream(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		reused := up.used
+		up.used = true
+
+		resp, err := f.send(ctx, up, r.Method, r.Header, body)
+		if err == nil {
+			return resp, nil
+		}
+		fc.drop()
+		if !reused || attempt > 0 || !errors.Is(err, errIdleClosed) || ctx.Err() != nil {
+			return nil, err
+		}
+		f.log.Debug("endpoint closed a kept-alive connection; reconnecting", "error", err)
+	}
+}
+
+// send sends one request on up, authenticating the connection first if
+// it isn't yet. A connection whose authentication the endpoint has
+// dropped is authenticated again.
+func (f *authFront) send(ctx context.Context, up *upstream, method string, header http.Header, body []byte) (*http.Response, error) {
+	config := f.currentConfig()
+	if !up.authed {
+		return f.authenticate(ctx, up, config, method, header, body)
+	}
+	resp, err := up.roundTrip(f.request(ctx, config, method, header, body, nil))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || config.effectiveAuthType() == AuthBasic {
+		return resp, err
+	}
+	if err := discard(resp); err != nil {
+		return nil, err
+	}
+	up.authed = false
+	return f.authenticate(ctx, up, config, method, header, body)
+}
+
+// authenticate sends the request on up as part of the configured auth
+// type's handshake, and returns the endpoint's response to it.
+func (f *authFront) authenticate(ctx context.Context, up *upstream, config *Config, method string, header http.Header, body []byte) (*http.Response, error) {
+	switch config.effectiveAuthType() {
+	case AuthNTLM:
+		return f.authenticateNTLM(ctx, up, config, method, header, body)
+	case AuthKerberos:
+		provider, err := f.kerberosProvider(config)
+		if err != nil {
+			return nil, fmt.Errorf("create kerberos provider: %w", err)
+		}
+		return f.authenticateNegotiate(ctx, up, config, provider, method, header, body)
+	case AuthNegotiate:
+		// Like go-psrp: Kerberos if it can be set up and get a ticket,
+		// NTLM if not
+		provider, err := f.kerberosProvider(config)
+		if err != nil {
+			f.log.Debug("kerberos unavailable; using NTLM", "error", err)
+			return f.authenticateNTLM(ctx, up, config, method, header, body)
+		}
+		resp, err := f.authenticateNegotiate(ctx, up, config, provider, method, header, body)
+		if errors.Is(err, errKerberosStep) {
+			f.log.Debug("kerberos failed; using NTLM", "error", err)
+			return f.authenticateNTLM(ctx, up, config, method, header, body)
+		}
+		return resp, err
+	default:
+		resp, err := up.roundTrip(f.request(ctx, config, method, header, body, nil))
+		if err == nil && resp.StatusCode != http.StatusUnauthorized {
+			up.authed = true
+		}
+		return resp, err
+	}
+}
+
+// authenticateNTLM runs the NTLM handshake: the negotiate message with an
+// empty body, then the authenticate message, carrying the channel
+// binding token, with the request.
+func (f *authFront) authenticateNTLM(ctx context.Context, up *upstream, config *Config, method string, header http.Header, body []byte) (*http.Response, error) {
+	username, domain := ntlmUser(config)
+	ntlm, err := ntlmssp.NewClient(
+		ntlmssp.SetUserInfo(username, config.PSRPPassword),
+		ntlmssp.SetDomain(domain),
+		ntlmssp.SetVersion(ntlmssp.DefaultVersion()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ntlm: %w", err)
+	}
+	negotiate, err := ntlm.Authenticate(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ntlm: %w", err)
+	}
+	resp, err := up.roundTrip(f.request(ctx, config, method, header, nil, negotiate))
+	if err != nil {
+		return nil, err
+	}
+	challenge, ok := negotiateToken(resp)
+	if !ok {
+		return resp, nil
+	}
+	if err := discard(resp); err != nil {
+		return nil, err
+	}
+
+	bindings := up.bindings
+	if config.PSRPSkipChannelBinding {
+		bindings = nil
+	}
+	authenticate, err := ntlm.Authenticate(challenge, bindings)
+	if err != nil {
+		return nil, fmt.Errorf("ntlm: %w", err)
+	}
+	resp, err = up.roundTrip(f.request(ctx, config, method, header, body, authenticate))
+	if err == nil && resp.StatusCode != http.StatusUnauthorized {
+		up.authed = true
+	}
+	return resp, err
+}
+
+// authenticateNegotiate runs a Kerberos/SPNEGO handshake with provider,
+// sending the request with each token until the endpoint stops
+// challenging.
+func (f *authFront) authenticateNegotiate(ctx context.Context, up *upstream, config *Config, provider auth.SecurityProvider, method string, header http.Header, body []byte) (*http.Response, error) {
+	defer provider.Close()
+
+	var input []byte
+	for leg := 0; leg < maxAuthLegs; leg++ {
+		token, _, err := provider.Step(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errKerberosStep, err)
+		}
+		resp, err := up.roundTrip(f.request(ctx, config, method, header, body, token))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			up.authed = true
+			return resp, nil
+		}
+		var ok bool
+		if input, ok = negotiateToken(resp); !ok {
+			return resp, nil
+		}
+		if err := discard(resp); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("negotiate authentication failed after %d attempts", maxAuthLegs)
+}
+
+// kerberosProvider returns go-psrp's Kerberos provider for the endpoint,
+// as go-psrp would create it, or its gokrb5 provider with psrp_force_gokrb5.
+func (f *authFront) kerberosProvider(config *Config) (auth.SecurityProvider, error) {
+	spn := "HTTP/" + f.url.Hostname()
+	creds := &auth.Credentials{
+		Username: config.PSRPUsername,
+		Password: config.PSRPPassword,
+		Domain:   config.PSRPDomain,
+	}
+	if config.PSRPForceGokrb5 {
+		return auth.NewPureKerberosProvider(auth.PureKerberosConfig{
+			Realm:        config.PSRPRealm,
+			Krb5ConfPath: config.PSRPKrb5ConfPath,
+			KeytabPath:   config.PSRPKeytabPath,
+			CCachePath:   config.PSRPCCachePath,
+			Credentials:  creds,
+		}, spn)
+	}
+	if config.PSRPUseMachineCredentials {
+		creds.Username, creds.Password = "", ""
+	}
+	return auth.NewKerberosProvider(auth.KerberosProviderConfig{
+		TargetSPN:    spn,
+		Realm:        config.PSRPRealm,
+		Krb5ConfPath: config.PSRPKrb5ConfPath,
+		KeytabPath:   config.PSRPKeytabPath,
+		CCachePath:   config.PSRPCCachePath,
+		Credentials:  creds,
+		UseSSO:       auth.SupportsSSO() && creds.Username == "",
+	})
+}
+
+// request builds the request to the endpoint from go-psrp's, with token
+// as a Negotiate authorization, or basic credentials for basic auth.
+func (f *authFront) request(ctx context.Context, config *Config, method string, header http.Header, body, token []byte) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, method, f.url.String(), bytes.NewReader(body))
+	for name, values := range header {
+		if hopHeader(name) || strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Content-Length") {
+			continue
+		}
+		req.Header[name] = values
+	}
+	switch {
+	case token != nil:
+		req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	case config.effectiveAuthType() == AuthBasic:
+		username := config.PSRPUsername
+		if config.PSRPDomain != "" {
+			username = config.PSRPDomain + `\` + username
+		}
+		req.SetBasicAuth(username, config.PSRPPassword)
+	}
+	return req
+}
+
+// upstream returns fc's endpoint connection, opening one if needed.
+func (fc *frontConn) upstream(ctx context.Context, f *authFront) (*upstream, error) {
+	fc.mu.Lock()
+	up := fc.up
+	fc.mu.Unlock()
+	if up != nil {
+		return up, nil
+	}
+	up, err := f.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fc.mu.Lock()
+	fc.up = up
+	fc.mu.Unlock()
+	return up, nil
+}
+
+// abort fails the request in flight on fc's endpoint connection.
+func (fc *frontConn) abort() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.up != nil {
+		_ = fc.up.conn.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+// drop closes fc's endpoint connection; the next request opens another.
+func (fc *frontConn) drop() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.up != nil {
+		fc.up.conn.Close()
+		fc.up = nil
+	}
+}
+
+// dial opens a connection to the endpoint, with TLS if it uses https.
+func (f *authFront) dial(ctx context.Context) (*upstream, error) {
+	dialer := &net.Dialer{Timeout: frontDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return nil, err
+	}
+	up := &upstream{conn: conn}
+	if f.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, f.tlsConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", f.addr, err)
+		}
+		up.conn = tlsConn
+		up.bindings = channelBindings(tlsConn.ConnectionState().PeerCertificates[0])
+	}
+	up.br = bufio.NewReader(up.conn)
+	return up, nil
+}
+
+// tlsConfig returns the TLS settings for the endpoint: those go-psrp would
+// have used, verifying against psrp_tls_server_name if set, and the pinned
+// or first-seen fingerprint instead of the chain with psrp_tls_fingerprint
+// or psrp_tls_tofu.
+func (f *authFront) tlsConfig() *tls.Config {
+	config := f.currentConfig()
+	serverName := config.PSRPTLSServerName
+	if serverName == "" {
+		serverName = f.url.Hostname()
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.ToGoPSRPConfig().InsecureSkipVerify, //nolint:gosec // psrp_insecure, or verified by fingerprint below
+	}
+	if config.PSRPTLSFingerprint != "" || config.PSRPTLSTrustOnFirstUse {
+		pinned := normalizeFingerprint(config.PSRPTLSFingerprint)
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return f.verifyFingerprint(cs, pinned)
+		}
+	}
+	return tlsConfig
+}
+
+// verifyFingerprint checks the certificate the endpoint presented against
+// pinned, or else the one trusted on first use, recording it if there is
+// none yet.
+func (f *authFront) verifyFingerprint(cs tls.ConnectionState, pinned string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%s presented no certificate", f.addr)
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	got := hex.EncodeToString(sum[:])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	want := pinned
+	if want == "" {
+		want = f.trusted
+	}
+	if want == "" {
+		f.trusted = got
+		return nil
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s presented %s, expected %s", errFingerprintMismatch, f.addr, got, want)
+	}
+	return nil
+}
+
+// roundTrip writes req and reads the response header. A connection that
+// fails before any response byte arrives reports errIdleClosed.
+func (up *upstream) roundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Write(up.conn); err != nil {
+		return nil, fmt.Errorf("%w: %w", errIdleClosed, err)
+	}
+	resp, err := http.ReadResponse(up.br, req)
+	if err != nil {
+		if errors.Is(err, io.EOF) && up.br.Buffered() == 0 {
+			return nil, fmt.Errorf("%w: %w", errIdleClosed, err)
+		}
+		return nil, fmt.Errorf("failed to read response from endpoint: %w", err)
+	}
+	return resp, nil
+}
+
+// Close stops the front and closes its connections to the endpoint.
+func (f *authFront) Close() error {
+	err := f.server.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn, fc := range f.conns {
+		fc.drop()
+		delete(f.conns, conn)
+	}
+	return err
+}
+
+// channelBindings returns the tls-server-end-point channel binding token
+// for the server certificate (RFC 5929): its hash with the algorithm of
+// its signature, SHA-256 for MD5 and SHA-1. It is nil for signatures the
+// RFC defines no binding for, such as Ed25519.
+func channelBindings(cert *x509.Certificate) *ntlmssp.ChannelBindings {
+	var hash crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.DSAWithSHA256, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	default:
+		return nil
+	}
+	h := hash.New()
+	h.Write(cert.Raw)
+	return &ntlmssp.ChannelBindings{
+		ApplicationData: append([]byte(ntlmssp.TLSServerEndPoint+":"), h.Sum(nil)...),
+	}
+}
+
+// ntlmUser splits a DOMAIN\user name, falling back to psrp_domain.
+// A user@domain name is passed whole, which NTLM accepts.
+func ntlmUser(config *Config) (username, domain string) {
+	if d, u, ok := strings.Cut(config.PSRPUsername, `\`); ok {
+		return u, d
+	}
+	return config.PSRPUsername, config.PSRPDomain
+}
+
+// negotiateToken returns the token of a 401's Negotiate challenge.
+func negotiateToken(resp *http.Response) ([]byte, bool) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, false
+	}
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		scheme, token, _ := strings.Cut(value, " ")
+		if !strings.EqualFold(scheme, "Negotiate") || strings.TrimSpace(token) == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token)); err == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// discard reads and closes a response body so the connection can be
+// reused.
+func discard(resp *http.Response) error {
+	_, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response from endpoint: %w", err)
+	}
+	return nil
+}
+
+// hopHeader reports whether name is a hop-by-hop header, which applies
+// to one connection and isn't forwarded.
+func hopHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package psrp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// ntlmChallenge is the challenge message from the NTLMv2 example in
+// MS-NLMP 4.2.4, without NTLMSSP_NEGOTIATE_KEY_EXCH, which go-psrp's own
+// NTLM (used with psrp_skip_channel_binding) doesn't support.
+const ntlmChallenge = "4e544c4d53535000020000000c000c003800000033828aa20123456789abcdef" +
+	"00000000000000002400240044000000060070170000000f5300650072007600" +
+	"6500720002000c0044006f006d00610069006e0001000c005300650072007600" +
+	"6500720000000000"
+
+// ntlmListener is an HTTPS front for a fake server that requires NTLM,
+// as a WinRM listener does. It records whether each authenticate message
+// carried the channel binding token for its certificate. The credentials
+// aren't checked: the fake server behind it takes basic auth.
+type ntlmListener struct {
+	*httptest.Server
+	backend *testutil.Server
+	binding []byte // MD5 of the expected channel bindings
+
+	mu       sync.Mutex
+	authed   map[string]bool // by remote address
+	bindings []bool
+}
+
+func newNTLMListener(t *testing.T, backend *testutil.Server) *ntlmListener {
+	l := &ntlmListener{backend: backend, authed: make(map[string]bool)}
+	l.Server = httptest.NewTLSServer(http.HandlerFunc(l.serveHTTP))
+	t.Cleanup(l.Close)
+
+	cert := l.Certificate()
+	if cert.SignatureAlgorithm != x509.SHA256WithRSA {
+		t.Fatalf("test certificate is signed with %v, want SHA256-RSA", cert.SignatureAlgorithm)
+	}
+	app := sha256.Sum256(cert.Raw)
+	data := append([]byte("tls-server-end-point:"), app[:]...)
+	var b bytes.Buffer
+	for _, v := range []uint32{0, 0, 0, 0, uint32(len(data))} {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.Write(data)
+	sum := md5.Sum(b.Bytes())
+	l.binding = sum[:]
+	return l
+}
+
+func (l *ntlmListener) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Negotiate ")
+	msg, _ := base64.StdEncoding.DecodeString(token)
+
+	l.mu.Lock()
+	authed := l.authed[r.RemoteAddr]
+	switch {
+	case len(msg) > 12 && msg[8] == 1:
+		l.mu.Unlock()
+		challenge, _ := hex.DecodeString(ntlmChallenge)
+		w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(challenge))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case len(msg) > 12 && msg[8] == 3:
+		l.authed[r.RemoteAddr] = true
+		l.bindings = append(l.bindings, bytes.Contains(msg, l.binding))
+	case !authed:
+		l.mu.Unlock()
+		w.Header().Add("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	l.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(l.backend.Host(), strconv.Itoa(l.backend.Port())), r.URL.Path)
+	req, _ := http.NewRequestWithContext(r.Context(), r.Method, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	req.SetBasicAuth(testutil.ServerUsername, testutil.ServerPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// authentications returns, for each authenticate message seen, whether
+// it carried the channel binding token.
+func (l *ntlmListener) authentications() []bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]bool(nil), l.bindings...)
+}
+
+func TestNTLMChannelBinding(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			srv := testutil.NewServer()
+			defer srv.Close()
+			srv.Handler = func(string) testutil.Response { return testutil.Exit(2, "bound") }
+			listener := newNTLMListener(t, srv)
+
+			config := srv.Config()
+			_, port, _ := net.SplitHostPort(listener.Listener.Addr().String())
+			config.PSRPPort, _ = strconv.Atoi(port)
+			config.PSRPUseTLS = true
+			config.PSRPInsecureSkipVerify = true
+			config.PSRPAuthType = psrp.AuthNTLM
+			config.PSRPSkipChannelBinding = skip
+
+			comm := connect(t, srv, config)
+			if code, stdout, _ := run(t, comm, "Write-Output 'bound'; exit 2"); code != 2 || !strings.Contains(stdout, "bound") {
+				t.Errorf("got exit code %d and output %q, want 2 and \"bound\"", code, stdout)
+			}
+
+			auths := listener.authentications()
+			if len(auths) == 0 {
+				t.Fatal("no NTLM authenticate message reached the listener")
+			}
+			for i, bound := range auths {
+				if bound == skip {
+					t.Errorf("authenticate message %d: carried channel binding token = %v, want %v", i, bound, !skip)
+				}
+			}
+		})
+	}
+}
+
+// TestFingerprintPinnedInHandshake connects without StepConnect's
+// up-front check, so only the session's own TLS handshakes see the
+// fingerprint.
+func TestFingerprintPinnedInHandshake(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+	srv.Handler = func(string) testutil.Response { return testutil.Exit(0) }
+	listener := newNTLMListener(t, srv)
+	sum := sha256.Sum256(listener.Certificate().Raw)
+
+	for _, tc := range []struct {
+		name        string
+		fingerprint string
+		wantErr     bool
+	}{
+		{"match", hex.EncodeToString(sum[:]), false},
+		{"mismatch", strings.Repeat("ab", sha256.Size), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := srv.Config()
+			_, port, _ := net.SplitHostPort(listener.Listener.Addr().String())
+			config.PSRPPort, _ = strconv.Atoi(port)
+			config.PSRPUseTLS = true
+			config.PSRPAuthType = psrp.AuthNTLM
+			config.PSRPTLSFingerprint = tc.fingerprint
+			config.PSRPFlightRecorderDir = t.TempDir()
+
+			comm, err := psrp.New(srv.Host(), config)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			defer comm.Close()
+			err = comm.Connect(context.Background())
+			switch {
+			case tc.wantErr && err == nil:
+				t.Fatal("Connect succeeded with the wrong fingerprint pinned")
+			case tc.wantErr && !strings.Contains(err.Error(), "fingerprint mismatch"):
+				t.Errorf("Connect: %v, want a fingerprint mismatch", err)
+			case !tc.wantErr && err != nil:
+				t.Fatalf("Connect: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AzureRunPowerShellCommand is the Azure Run Command ID for PowerShell
+// scripts on Windows VMs.
+const AzureRunPowerShellCommand = "RunPowerShellScript"
+
+// AzureRunCommandFunc runs script through Azure Run Command
+// (virtualMachines/runCommand) with the given command ID and returns what
+// the script wrote to its output and error streams, which Run Command
+// reports as the StdOut and StdErr status messages. Builders implement it
+// with their own Azure client, so this plugin takes no dependency on the
+// Azure SDK.
+type AzureRunCommandFunc func(ctx context.Context, commandID string, script []string) (stdout, stderr string, err error)
+
+// AzureRunCommandChannel returns a BootstrapChannel that runs scripts with
+// Azure Run Command. Run Command has no exit code, so anything the script
+// writes to its error stream fails the bootstrap; BootstrapScript stops at
+// its first error.
+func AzureRunCommandChannel(run AzureRunCommandFunc) BootstrapChannel {
+	return BootstrapFunc(func(ctx context.Context, script string) error {
+		stdout, stderr, err := run(ctx, AzureRunPowerShellCommand, strings.Split(script, "\n"))
+		if err != nil {
+			return fmt.Errorf("azure run command failed: %w", err)
+		}
+		logger.Debug("bootstrap ran through Azure Run Command", "stdout", strings.TrimSpace(stdout))
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			return fmt.Errorf("bootstrap script failed on the VM: %s", stderr)
+		}
+		return nil
+	})
+}
+
+// NewAzureRunCommandBootstrap returns a StepBootstrap that enables remoting
+// for cfg through Azure Run Command. Azure builders place it before the
+// connect step, typically with psrp_use_tls set so the VM gets an HTTPS
+// listener; the network security group must still allow the port.
+func NewAzureRunCommandBootstrap(cfg *Config, run AzureRunCommandFunc) *StepBootstrap {
+	return &StepBootstrap{Config: cfg, Channel: AzureRunCommandChannel(run)}
+}
@@ -0,0 +1,151 @@
+package psrp
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/smnsjas/go-psrp/client"
+)
+
+// BackoffStrategy selects how retry delays grow between attempts.
+type BackoffStrategy string
+
+const (
+	// BackoffConstant waits psrp_retry_interval between every attempt.
+	BackoffConstant BackoffStrategy = "constant"
+	// BackoffExponential doubles the delay after each attempt.
+	BackoffExponential BackoffStrategy = "exponential"
+	// BackoffFibonacci grows the delay along the Fibonacci sequence
+	// (1, 1, 2, 3, 5, ... times psrp_retry_interval), more gently than
+	// exponential.
+	BackoffFibonacci BackoffStrategy = "fibonacci"
+)
+
+// backoff produces successive retry delays for a strategy, capped at max
+// and randomized by jitter.
+type backoff struct {
+	strategy BackoffStrategy
+	max      time.Duration
+	jitter   float64
+
+	prev, cur time.Duration
+}
+
+// newBackoff returns a backoff using the configured retry policy.
+func (c *Config) newBackoff() *backoff {
+	initial := c.PSRPRetryInterval
+	if initial <= 0 {
+		initial = 5 * time.Second
+	}
+	max := c.PSRPRetryMaxInterval
+	if max < initial {
+		max = initial
+	}
+	strategy := c.PSRPRetryBackoff
+	if strategy == "" {
+		strategy = BackoffExponential
+	}
+	return &backoff{strategy: strategy, max: max, jitter: c.PSRPRetryJitter, cur: initial}
+}
+
+// next returns the delay before the next attempt and advances the sequence.
+func (b *backoff) next() time.Duration {
+	d := b.cur
+
+	switch b.strategy {
+	case BackoffExponential:
+		b.cur *= 2
+	case BackoffFibonacci:
+		if b.prev == 0 {
+			b.prev = b.cur
+		} else {
+			b.prev, b.cur = b.cur, b.prev+b.cur
+		}
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+
+	return jitter(d, b.jitter)
+}
+
+// jitter randomizes d by up to +/- fraction of its value so parallel builds
+// don't retry in lockstep. A fraction of 0 returns d unchanged.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * fraction * float64(d)
+	if j := d + time.Duration(delta); j > 0 {
+		return j
+	}
+	return d
+}
+
+// queryRetries is how many times read-only queries the communicator runs
+// itself (listings, downloads, hashes, status polls, health probes) are
+// retried on transient faults, or psrp_transfer_retries if higher. Running
+// them again is always safe, and a single dropped response shouldn't fail
+// a long build.
+const queryRetries = 3
+
+// executeWithRetry runs a file-transfer script, retrying transport failures
+// up to psrp_transfer_retries times using the configured backoff. Scripts
+// must be safe to run again: a failure may be reported for a request the
+// server did process.
+func (c *Communicator) executeWithRetry(ctx context.Context, script string) (*client.Result, error) {
+	retries := 0
+	if c.config != nil {
+		retries = c.config.PSRPTransferRetries
+	}
+	var result *client.Result
+	err := c.retryTransient(ctx, "transfer", retries, func() (err error) {
+		result, err = c.execute(ctx, script)
+		return err
+	})
+	return result, err
+}
+
+// executeQuery runs a read-only script, retrying transport failures up to
+// queryRetries times.
+func (c *Communicator) executeQuery(ctx context.Context, script string) (*client.Result, error) {
+	retries := queryRetries
+	if c.config != nil && c.config.PSRPTransferRetries > retries {
+		retries = c.config.PSRPTransferRetries
+	}
+	var result *client.Result
+	err := c.retryTransient(ctx, "query", retries, func() (err error) {
+		result, err = c.execute(ctx, script)
+		return err
+	})
+	return result, err
+}
+
+// retryTransient calls fn until it succeeds, fails in a way retrying can't
+// help, or has been retried retries times, waiting between attempts per
+// the configured backoff. op names the operation in the log.
+func (c *Communicator) retryTransient(ctx context.Context, op string, retries int, fn func() error) error {
+	cfg := c.config
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	b := cfg.newBackoff()
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !classifyConnectError(err).retryable() {
+			return err
+		}
+
+		delay := b.next()
+		c.stats.retries.Add(1)
+		c.logger().Warn(op+" request failed, retrying", "op", op,
+			"attempt", attempt+1, "attempts", retries+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package psrp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffSequence(t *testing.T) {
+	cases := []struct {
+		strategy BackoffStrategy
+		max      time.Duration
+		want     []time.Duration
+	}{
+		{BackoffConstant, time.Minute, []time.Duration{1, 1, 1, 1, 1}},
+		{BackoffExponential, time.Minute, []time.Duration{1, 2, 4, 8, 16}},
+		{BackoffExponential, 5 * time.Second, []time.Duration{1, 2, 4, 5, 5}},
+		{BackoffFibonacci, time.Minute, []time.Duration{1, 1, 2, 3, 5, 8}},
+		{BackoffFibonacci, 4 * time.Second, []time.Duration{1, 1, 2, 3, 4, 4}},
+		{"", time.Minute, []time.Duration{1, 2, 4}},
+	}
+	for _, tc := range cases {
+		c := NewConfig()
+		c.PSRPRetryInterval = time.Second
+		c.PSRPRetryMaxInterval = tc.max
+		c.PSRPRetryBackoff = tc.strategy
+		c.PSRPRetryJitter = 0
+
+		b := c.newBackoff()
+		for i, want := range tc.want {
+			if got := b.next(); got != want*time.Second {
+				t.Errorf("%q (max %v): delay %d = %v, want %v", tc.strategy, tc.max, i, got, want*time.Second)
+			}
+		}
+	}
+}
+
+func TestBackoffMaxBelowInitial(t *testing.T) {
+	c := NewConfig()
+	c.PSRPRetryInterval = 10 * time.Second
+	c.PSRPRetryMaxInterval = time.Second
+	c.PSRPRetryJitter = 0
+
+	b := c.newBackoff()
+	for i := 0; i < 3; i++ {
+		if got := b.next(); got != 10*time.Second {
+			t.Errorf("delay %d = %v, want the initial 10s", i, got)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 10 * time.Second
+	if got := jitter(d, 0); got != d {
+		t.Errorf("jitter(%v, 0) = %v", d, got)
+	}
+	for i := 0; i < 100; i++ {
+		got := jitter(d, 0.2)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("jitter(%v, 0.2) = %v, outside +/-20%%", d, got)
+		}
+	}
+	if got := jitter(d, 5); got <= 0 {
+		t.Errorf("jitter(%v, 5) = %v, want a positive delay", d, got)
+	}
+}
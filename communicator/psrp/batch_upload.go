@@ -0,0 +1,170 @@
+package psrp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// batchFileOverhead is what each file costs a batch besides its data, in
+// upload chunk bytes: its path and the hashtable around it.
+const batchFileOverhead = 64
+
+// uploadBatchScript writes the files listed in $files, creating their
+// parent directories. The caller prepends the opening of the list.
+const uploadBatchScript = `)
+$ErrorActionPreference = 'Stop'
+foreach ($f in $files) {
+	try {
+		$parentDir = Split-Path -Parent $f.Path
+		if ($parentDir -and !(Test-Path $parentDir)) {
+			New-Item -ItemType Directory -Path $parentDir -Force | Out-Null
+		}
+		[System.IO.File]::WriteAllBytes($f.Path, [System.Convert]::FromBase64String($f.Data))
+	} catch {
+		throw "failed to write $($f.Path): $_"
+	}
+}
+`
+
+// localFile is a local file to upload and where it goes.
+type localFile struct {
+	local, remote string
+	size          int64
+}
+
+// batchEntry is a file read into a batch.
+type batchEntry struct {
+	localFile
+	data []byte
+}
+
+// uploadFiles uploads files, packing the small ones into batches that
+// each take one request, since a request per file dominates the time to
+// upload a tree of scripts. A batch fills at most one upload chunk; larger
+// files are uploaded on their own. done is called for each file uploaded.
+func (c *Communicator) uploadFiles(ctx context.Context, files []localFile, done func(localFile)) error {
+	budget := int64(defaultUploadChunkSize)
+	batching := true
+	if c.config != nil {
+		budget = int64(c.config.UploadChunkSize())
+		batching = !c.config.PSRPSkipUploadBatching
+	}
+	cost := func(f localFile) int64 { return f.size + int64(len(f.remote)) + batchFileOverhead }
+
+	var batch []batchEntry
+	var batchCost int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := c.uploadBatch(ctx, batch); err != nil {
+			return err
+		}
+		for _, e := range batch {
+			done(e.localFile)
+		}
+		batch, batchCost = nil, 0
+		return nil
+	}
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !batching || cost(f) > budget {
+			if err := c.uploadLocalFile(ctx, f); err != nil {
+				return err
+			}
+			done(f)
+			continue
+		}
+
+		data, err := os.ReadFile(f.local)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", f.local, err)
+		}
+		f.size = int64(len(data))
+		if cost(f) > budget {
+			// It grew since it was listed
+			if err := c.upload(ctx, f.remote, bytes.NewReader(data)); err != nil {
+				return err
+			}
+			done(f)
+			continue
+		}
+		if batchCost+cost(f) > budget {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, batchEntry{localFile: f, data: data})
+		batchCost += cost(f)
+	}
+	return flush()
+}
+
+// uploadLocalFile uploads one file in chunks.
+func (c *Communicator) uploadLocalFile(ctx context.Context, f localFile) error {
+	file, err := os.Open(f.local)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", f.local, err)
+	}
+	defer file.Close()
+	return c.upload(ctx, f.remote, file)
+}
+
+// uploadBatch writes a batch of files in one request. Each file is written
+// whole, so a retried request just writes them again.
+func (c *Communicator) uploadBatch(ctx context.Context, batch []batchEntry) (err error) {
+	ctx, span := startSpan(ctx, "psrp.upload_batch", attribute.Int("psrp.files", len(batch)))
+	var size int64
+	for _, e := range batch {
+		size += e.size
+	}
+	started := time.Now()
+	defer func() {
+		elapsed := time.Since(started)
+		c.stats.uploadTime.Add(int64(elapsed))
+		if err == nil {
+			c.stats.bytesUploaded.Add(size)
+			for _, e := range batch {
+				c.logger().Debug("uploaded file", "op", "transfer", "path", e.remote, "bytes", e.size,
+					"batch_files", len(batch))
+			}
+			c.logger().Debug("uploaded batch", "op", "transfer", "files", len(batch), "bytes", size,
+				"elapsed", elapsed, "bytes_per_sec", bytesPerSecond(size, elapsed))
+		}
+		for _, e := range batch {
+			c.events.transfer("upload", e.remote, e.size, elapsed, err, "batch_files", len(batch))
+		}
+		span.SetAttributes(attribute.Int64("psrp.bytes", size))
+		endSpan(span, err)
+	}()
+
+	var script strings.Builder
+	script.WriteString("$files = @(\n")
+	for _, e := range batch {
+		fmt.Fprintf(&script, "\t@{ Path = '%s'; Data = '%s' }\n",
+			strings.ReplaceAll(e.remote, "'", "''"), base64.StdEncoding.EncodeToString(e.data))
+	}
+	script.WriteString(uploadBatchScript)
+
+	ctx, cancel := c.opContextFrom(ctx)
+	defer cancel()
+	c.trace.event("upload.batch", "files", len(batch), "bytes", size)
+	result, err := c.executeWithRetry(ctx, script.String())
+	if err != nil {
+		return fmt.Errorf("failed to upload %d files: %w", len(batch), err)
+	}
+	if result.HadErrors {
+		return fmt.Errorf("upload failed: %s", formatResultErrors(result))
+	}
+	return nil
+}
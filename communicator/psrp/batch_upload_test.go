@@ -0,0 +1,76 @@
+package psrp_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// TestUploadDirBatches checks that UploadDir packs small files into batches
+// of at most one upload chunk, uploads larger ones on their own, and sends
+// each file in a request of its own with psrp_skip_upload_batching.
+func TestUploadDirBatches(t *testing.T) {
+	src := t.TempDir()
+	files := map[string][]byte{
+		"big.bin": bytes.Repeat([]byte("0123456789abcdef"), 200),
+	}
+	for i := 0; i < 12; i++ {
+		files[fmt.Sprintf("scripts/%02d.ps1", i)] = bytes.Repeat([]byte{byte('a' + i)}, 100)
+	}
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, skip := range []bool{false, true} {
+		srv := testutil.NewServer()
+		defer srv.Close()
+
+		config := srv.Config()
+		config.PSRPUploadChunkSize = 1024
+		config.PSRPSkipUploadBatching = skip
+		comm := connect(t, srv, config)
+
+		dst := `C:\Windows\Temp\dir`
+		before := len(srv.Scripts())
+		if err := comm.UploadDir(dst, src, nil); err != nil {
+			t.Fatalf("skip %v: UploadDir: %v", skip, err)
+		}
+		for name, data := range files {
+			path := config.RemoteJoin(dst, name)
+			if got, ok := srv.File(path); !ok || !bytes.Equal(got, data) {
+				t.Errorf("skip %v: server has %d bytes at %s (%v), want %d", skip, len(got), path, ok, len(data))
+			}
+		}
+
+		var batches int
+		for _, script := range srv.Scripts()[before:] {
+			n := strings.Count(script, "@{ Path = ")
+			if n > 0 {
+				batches++
+			}
+			if strings.Contains(script, "big.bin'; Data") {
+				t.Errorf("skip %v: big.bin went into a batch", skip)
+			}
+			if len(script) > 2*config.PSRPUploadChunkSize+1024 {
+				t.Errorf("skip %v: a %d byte request is over a chunk", skip, len(script))
+			}
+		}
+		switch {
+		case skip && batches > 0:
+			t.Errorf("psrp_skip_upload_batching sent %d batches", batches)
+		case !skip && (batches < 2 || batches > 4):
+			t.Errorf("12 small files took %d batches of a 1 KB chunk, want 2-4", batches)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package psrp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// BootstrapChannel runs a PowerShell script on a guest that is not yet
+// reachable over PSRP, using whatever out-of-band channel the builder has
+// (hypervisor guest agent, cloud run-command API, serial console, ...).
+type BootstrapChannel interface {
+	RunScript(ctx context.Context, script string) error
+}
+
+// BootstrapFunc adapts a function to a BootstrapChannel.
+type BootstrapFunc func(ctx context.Context, script string) error
+
+// RunScript calls f(ctx, script).
+func (f BootstrapFunc) RunScript(ctx context.Context, script string) error {
+	return f(ctx, script)
+}
+
+// BootstrapScript returns a PowerShell script that enables remoting so that
+// the given configuration can connect: the WinRM service and listener
+// (HTTPS with a self-signed certificate when psrp_use_tls is set), a
+// firewall rule for the port, Basic auth and unencrypted traffic when the
+// configuration needs them, and the envelope size.
+func BootstrapScript(c *Config) string {
+	var b strings.Builder
+
+	b.WriteString("$ErrorActionPreference = 'Stop'\n")
+	b.WriteString("Enable-PSRemoting -Force -SkipNetworkProfileCheck | Out-Null\n")
+	b.WriteString("Set-Service -Name WinRM -StartupType Automatic\n")
+
+	if c.PSRPUseTLS {
+		fmt.Fprintf(&b, `$port = %d
+$listener = Get-ChildItem WSMan:\localhost\Listener | Where-Object { $_.Keys -contains 'Transport=HTTPS' }
+if (-not $listener) {
+	$cert = New-SelfSignedCertificate -DnsName $env:COMPUTERNAME -CertStoreLocation Cert:\LocalMachine\My
+	New-Item -Path WSMan:\localhost\Listener -Transport HTTPS -Address * -CertificateThumbPrint $cert.Thumbprint -Port $port -Force | Out-Null
+}
+`, c.PSRPPort)
+	} else if c.PSRPPort != 5985 {
+		fmt.Fprintf(&b, "Set-Item -Path (Get-ChildItem WSMan:\\localhost\\Listener | Where-Object { $_.Keys -contains 'Transport=HTTP' }).PSPath\\Port -Value %d -Force\n", c.PSRPPort)
+	}
+
+	fmt.Fprintf(&b, `if (-not (Get-NetFirewallRule -Name 'Packer-PSRP-%[1]d' -ErrorAction SilentlyContinue)) {
+	New-NetFirewallRule -Name 'Packer-PSRP-%[1]d' -DisplayName 'Packer PSRP (TCP %[1]d)' -Direction Inbound -Protocol TCP -LocalPort %[1]d -Action Allow -Profile Any | Out-Null
+}
+`, c.PSRPPort)
+
+	if c.PSRPAuthType == AuthBasic {
+		b.WriteString("Set-Item -Path WSMan:\\localhost\\Service\\Auth\\Basic -Value $true\n")
+	}
+	if !c.PSRPUseTLS && c.PSRPTransport == TransportWSMan &&
+		(c.effectiveAuthType() == AuthBasic || c.effectiveAuthType() == AuthNTLM) {
+		b.WriteString("Set-Item -Path WSMan:\\localhost\\Service\\AllowUnencrypted -Value $true\n")
+	}
+	if c.PSRPMaxEnvelopeSize > 0 && c.PSRPMaxEnvelopeSize != DefaultMaxEnvelopeSize {
+		fmt.Fprintf(&b, "Set-Item -Path WSMan:\\localhost\\MaxEnvelopeSizekb -Value %d\n", c.PSRPMaxEnvelopeSize)
+	}
+
+	b.WriteString("Restart-Service -Name WinRM\n")
+	return b.String()
+}
+
+// BootstrapCommand returns BootstrapScript as a single powershell.exe
+// command line using -EncodedCommand, suitable for answer files
+// (FirstLogonCommands), cloud user data or a guest agent that takes a plain
+// command line.
+func BootstrapCommand(c *Config) string {
+	return "powershell.exe " + encodedCommandArgs(BootstrapScript(c))
+}
+
+// encodedCommandArgs returns the powershell.exe arguments that run script.
+func encodedCommandArgs(script string) string {
+	return "-NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand " + encodeCommand(script)
+}
+
+// EncodeCommand encodes script for powershell.exe -EncodedCommand, for
+// callers that start PowerShell through a plain command line.
+func EncodeCommand(script string) string {
+	return encodeCommand(script)
+}
+
+// encodeCommand encodes script as UTF-16LE base64 for -EncodedCommand.
+func encodeCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, len(units)*2)
+	for i, u := range units {
+		buf[i*2] = byte(u)
+		buf[i*2+1] = byte(u >> 8)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// StepBootstrap is a multistep Step that enables PowerShell remoting on the
+// guest through a builder-provided BootstrapChannel. Place it before
+// StepConnect for images that ship with remoting disabled.
+type StepBootstrap struct {
+	Config  *Config
+	Channel BootstrapChannel
+}
+
+// Run sends the bootstrap script through the channel.
+func (s *StepBootstrap) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := RedactUi(state.Get("ui").(packersdk.Ui))
+
+	if s.Channel == nil {
+		return multistep.ActionContinue
+	}
+
+	timeout := s.Config.PSRPTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ui.Say("Enabling PowerShell remoting on the guest...")
+	if err := s.Channel.RunScript(ctx, BootstrapScript(s.Config)); err != nil {
+		err = RedactError(fmt.Errorf("error enabling PowerShell remoting: %w", err))
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// Cleanup does nothing; the listener is left for provisioning.
+func (s *StepBootstrap) Cleanup(multistep.StateBag) {}
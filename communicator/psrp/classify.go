@@ -0,0 +1,211 @@
+package psrp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/smnsjas/go-psrp/wsman"
+	"github.com/smnsjas/go-psrp/wsman/transport"
+)
+
+// Errors for the common failure classes. Connection and command errors
+// wrap them, so callers can branch with errors.Is.
+var (
+	ErrAuthFailed          = errors.New("PSRP authentication error")
+	ErrTLSFailed           = errors.New("PSRP TLS error")
+	ErrHostNotFound        = errors.New("PSRP DNS error")
+	ErrEndpointUnavailable = errors.New("PSRP endpoint error")
+	ErrConnectionTimeout   = errors.New("timeout waiting for PSRP")
+	ErrPipelineFailed      = errors.New("pipeline failed")
+	ErrOperationStalled    = errors.New("PSRP operation made no progress")
+	ErrQuotaExceeded       = errors.New("WinRM quota exceeded")
+	ErrSessionLost         = errors.New("PSRP connection lost during execution")
+)
+
+// errorClass groups connection failures by whether retrying can help.
+type errorClass int
+
+const (
+	// classTransient covers failures expected while the guest boots:
+	// refused connections, resets and timeouts. These are retried.
+	classTransient errorClass = iota
+	// classAuth means the server rejected the credentials.
+	classAuth
+	// classTLS means the TLS handshake or certificate verification failed.
+	classTLS
+	// classDNS means the host name does not resolve.
+	classDNS
+	// classEndpoint means WinRM answered but the PowerShell endpoint is
+	// missing or speaks an unsupported protocol version.
+	classEndpoint
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case classAuth:
+		return "authentication"
+	case classTLS:
+		return "TLS"
+	case classDNS:
+		return "DNS"
+	case classEndpoint:
+		return "endpoint"
+	default:
+		return "transient"
+	}
+}
+
+// sentinel returns the exported error for the class, or nil for
+// transient failures.
+func (c errorClass) sentinel() error {
+	switch c {
+	case classAuth:
+		return ErrAuthFailed
+	case classTLS:
+		return ErrTLSFailed
+	case classDNS:
+		return ErrHostNotFound
+	case classEndpoint:
+		return ErrEndpointUnavailable
+	default:
+		return nil
+	}
+}
+
+// retryable reports whether another connection attempt may succeed.
+func (c errorClass) retryable() bool {
+	return c == classTransient
+}
+
+// hint returns an actionable message for non-retryable classes.
+func (c errorClass) hint() string {
+	switch c {
+	case classAuth:
+		return "authentication failed; check psrp_username, psrp_password, psrp_domain and psrp_auth_type, and that the account may use PowerShell remoting (or, for the SSH tunnel, psrp_ssh_tunnel_username and its password or key)"
+	case classTLS:
+		return "TLS handshake failed; check psrp_use_tls matches the listener, that the certificate is trusted for the host name, or set psrp_insecure for self-signed listeners"
+	case classDNS:
+		return "host name could not be resolved; check psrp_host or the address reported by the builder"
+	case classEndpoint:
+		return "the PowerShell remoting endpoint is unavailable; run Enable-PSRemoting on the guest, or set psrp_winrm_fallback to use the WinRM communicator instead"
+	default:
+		return ""
+	}
+}
+
+// channelBindingHint adds to the authentication hint when the failure may
+// be the listener requiring channel binding tokens (CbtHardeningLevel
+// Strict). NTLM sends them unless psrp_skip_channel_binding is set;
+// Kerberos, including Negotiate when it picks Kerberos, does not.
+func (c *Config) channelBindingHint() string {
+	if !c.PSRPUseTLS || c.PSRPTransport != TransportWSMan {
+		return ""
+	}
+	switch auth := c.effectiveAuthType(); {
+	case auth == AuthBasic:
+		return ""
+	case c.PSRPSkipChannelBinding && auth != AuthKerberos:
+		return "; if the credentials are right, the listener may require the channel binding tokens psrp_skip_channel_binding turns off"
+	case auth == AuthNTLM:
+		return ""
+	}
+	return "; if the credentials are right, the listener may require channel binding tokens, which Kerberos does not send here: " +
+		"use ntlm (psrp_negotiate_mechanisms = [\"ntlm\"] with negotiate), or set CbtHardeningLevel to Relaxed (winrm set winrm/config/service/auth '@{CbtHardeningLevel=\"Relaxed\"}')"
+}
+
+// classifyConnectError determines the class of a Connect failure. go-psrp
+// does not wrap every failure with a typed error, so well-known message
+// fragments are matched as a fallback.
+func classifyConnectError(err error) errorClass {
+	if err == nil {
+		return classTransient
+	}
+
+	// Errors that already carry a sentinel keep their class
+	for _, class := range []errorClass{classAuth, classTLS, classDNS, classEndpoint} {
+		if errors.Is(err, class.sentinel()) {
+			return class
+		}
+	}
+
+	if errors.Is(err, transport.ErrUnauthorized) {
+		return classAuth
+	}
+	var fault *wsman.Fault
+	if errors.As(err, &fault) && fault.IsAccessDenied() {
+		return classAuth
+	}
+
+	if errors.Is(err, errFingerprintMismatch) {
+		return classTLS
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &certErr) || errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidCert) ||
+		errors.As(err, &recordErr) {
+		return classTLS
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return classDNS
+		}
+		return classTransient
+	}
+
+	if endpointUnavailable(err) != "" {
+		return classEndpoint
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "401 unauthorized"),
+		strings.Contains(msg, "403 forbidden"),
+		strings.Contains(msg, "access denied"),
+		strings.Contains(msg, "logon failure"),
+		strings.Contains(msg, "kdc_err_preauth_failed"),
+		strings.Contains(msg, "kdc_err_c_principal_unknown"),
+		strings.Contains(msg, "ssh: unable to authenticate"):
+		return classAuth
+	case strings.Contains(msg, "x509:"),
+		strings.Contains(msg, "tls: "),
+		strings.Contains(msg, "server gave http response to https client"):
+		return classTLS
+	}
+
+	return classTransient
+}
+
+// endpointUnavailable describes why the PowerShell endpoint cannot be used
+// when WinRM itself answered, or returns "" for any other failure.
+func endpointUnavailable(err error) string {
+	var text string
+	var fault *wsman.Fault
+	if errors.As(err, &fault) {
+		text = strings.ToLower(fault.Subcode + " " + fault.Reason + " " + fault.Message)
+	} else {
+		text = strings.ToLower(err.Error())
+	}
+	switch {
+	case strings.Contains(text, "tls:"):
+		return ""
+	case strings.Contains(text, "protocolversion"),
+		strings.Contains(text, "protocol version"):
+		return "the PowerShell remoting protocol version is not supported"
+	case strings.Contains(text, "invalidresourceuri"),
+		strings.Contains(text, "resource uri"),
+		strings.Contains(text, "session configuration"),
+		strings.Contains(text, "microsoft.powershell"):
+		return "the PowerShell endpoint is not available"
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package psrp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smnsjas/go-psrp/wsman"
+	"github.com/smnsjas/go-psrp/wsman/transport"
+)
+
+func TestClassifyConnectError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"nil", nil, classTransient},
+		{"unauthorized", fmt.Errorf("connect: %w", transport.ErrUnauthorized), classAuth},
+		{"access denied fault", fmt.Errorf("open shell: %w", &wsman.Fault{Subcode: "w:AccessDenied"}), classAuth},
+		{"access denied code", &wsman.Fault{WSManCode: 5}, classAuth},
+		{"other fault", &wsman.Fault{Subcode: "w:InvalidSelectors"}, classTransient},
+		{"kerberos preauth", errors.New("krb5: KDC_ERR_PREAUTH_FAILED"), classAuth},
+		{"unknown authority", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, classTLS},
+		{"hostname mismatch", x509.HostnameError{Host: "win.example.com", Certificate: &x509.Certificate{}}, classTLS},
+		{"plain http listener", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, classTLS},
+		{"host not found", &net.DNSError{Err: "no such host", Name: "win.example.com", IsNotFound: true}, classDNS},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "win.example.com", IsTimeout: true}, classTransient},
+		{"deadline", context.DeadlineExceeded, classTransient},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, classTransient},
+	}
+	for _, tc := range cases {
+		if got := classifyConnectError(tc.err); got != tc.want {
+			t.Errorf("%s: classifyConnectError(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+// TestClassifyConnectErrorNetwork classifies errors produced by real dials
+// and handshakes rather than constructed ones.
+func TestClassifyConnectErrorNetwork(t *testing.T) {
+	// A listener that was closed refuses connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, err = http.Get("http://" + addr + "/wsman")
+	if err == nil {
+		t.Fatal("request to a closed port succeeded")
+	}
+	if got := classifyConnectError(err); got != classTransient {
+		t.Errorf("refused connection %v classified as %v", err, got)
+	}
+
+	// A self-signed certificate the client doesn't trust
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	_, err = http.Get(srv.URL + "/wsman")
+	if err == nil {
+		t.Fatal("request with an untrusted certificate succeeded")
+	}
+	if got := classifyConnectError(err); got != classTLS {
+		t.Errorf("untrusted certificate %v classified as %v", err, got)
+	}
+
+	// HTTPS spoken to a plain HTTP listener
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	_, err = client.Get("https://" + plain.Listener.Addr().String() + "/wsman")
+	if err == nil {
+		t.Fatal("TLS request to a plain HTTP listener succeeded")
+	}
+	if got := classifyConnectError(err); got != classTLS {
+		t.Errorf("TLS to plain HTTP %v classified as %v", err, got)
+	}
+}
@@ -0,0 +1,131 @@
+package psrp
+
+import (
+	"context"
+
+	"github.com/smnsjas/go-psrp/client"
+	"github.com/smnsjas/go-psrpcore/messages"
+)
+
+// PSRPClient is the part of a PSRP client the Communicator needs. The
+// default implementation wraps go-psrp's *client.Client; tests can supply
+// their own (see the testutil package) through NewWithClientFactory.
+//
+// Optional capabilities are detected with type assertions: IsConnected()
+// bool for liveness checks, CloseWithStrategy for closing without network
+// traffic, Endpoint() string for ConnectionInfo, and resumableClient for
+// psrp_resume_on_disconnect.
+type PSRPClient interface {
+	Connect(ctx context.Context) error
+	Close(ctx context.Context) error
+	Execute(ctx context.Context, script string) (*client.Result, error)
+	ExecuteStream(ctx context.Context, script string) (*Stream, error)
+}
+
+// ClientFactory creates an unconnected client for target (a host, or a full
+// endpoint URL for custom WSMan paths).
+type ClientFactory func(target string, config *Config) (PSRPClient, error)
+
+// Stream is the streaming result of a command. The consumer must drain
+// every channel; they are closed once the command completes.
+type Stream struct {
+	Output      <-chan *messages.Message
+	Errors      <-chan *messages.Message
+	Warnings    <-chan *messages.Message
+	Verbose     <-chan *messages.Message
+	Debug       <-chan *messages.Message
+	Progress    <-chan *messages.Message
+	Information <-chan *messages.Message
+
+	// WaitFunc blocks until the command completes and returns its error.
+	// CancelFunc stops the command. Either may be nil.
+	WaitFunc   func() error
+	CancelFunc func()
+}
+
+// Wait blocks until the command completes.
+func (s *Stream) Wait() error {
+	if s.WaitFunc == nil {
+		return nil
+	}
+	return s.WaitFunc()
+}
+
+// Cancel stops the command.
+func (s *Stream) Cancel() {
+	if s.CancelFunc != nil {
+		s.CancelFunc()
+	}
+}
+
+// resumableClient is implemented by clients that can run a pipeline
+// detached and recover its output after reconnecting.
+type resumableClient interface {
+	PSRPClient
+	ExecuteAsync(ctx context.Context, script string) (string, error)
+	ShellID() string
+	PoolID() string
+	RecoverPipelineOutput(ctx context.Context, shellID, commandID string) (*client.Result, error)
+}
+
+// reattachableClient is a resumableClient that can be pointed at an
+// existing disconnected shell instead of creating one.
+type reattachableClient interface {
+	resumableClient
+	SetPoolID(poolID string) error
+	Reconnect(ctx context.Context, shellID string) error
+}
+
+// goPSRPClient adapts go-psrp's client to PSRPClient.
+type goPSRPClient struct {
+	*client.Client
+}
+
+// newGoPSRPClient is the default ClientFactory.
+func newGoPSRPClient(target string, config *Config) (PSRPClient, error) {
+	cl, err := client.New(config.Endpoint(target), config.ToGoPSRPConfig())
+	if err != nil {
+		return nil, err
+	}
+	return goPSRPClient{cl}, nil
+}
+
+// ExecuteStream runs script and returns its streams.
+func (g goPSRPClient) ExecuteStream(ctx context.Context, script string) (*Stream, error) {
+	sr, err := g.Client.ExecuteStream(ctx, script)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{
+		Output:      sr.Output,
+		Errors:      sr.Errors,
+		Warnings:    sr.Warnings,
+		Verbose:     sr.Verbose,
+		Debug:       sr.Debug,
+		Progress:    sr.Progress,
+		Information: sr.Information,
+		WaitFunc:    sr.Wait,
+		CancelFunc:  sr.Cancel,
+	}, nil
+}
+
+// clientConnected reports whether cl considers itself connected. Clients
+// that can't tell are assumed to be.
+func clientConnected(cl PSRPClient) bool {
+	if c, ok := cl.(interface{ IsConnected() bool }); ok {
+		return c.IsConnected()
+	}
+	return true
+}
+
+// forceClose releases cl without waiting on the network, for sessions that
+// are already known to be gone.
+func forceClose(ctx context.Context, cl PSRPClient) {
+	if c, ok := cl.(interface {
+		CloseWithStrategy(context.Context, client.CloseStrategy) error
+	}); ok {
+		_ = c.CloseWithStrategy(ctx, client.CloseStrategyForce)
+		return
+	}
+	_ = cl.Close(ctx)
+}
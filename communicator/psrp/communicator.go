@@ -8,56 +8,377 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/smnsjas/go-psrp/client"
 	"github.com/smnsjas/go-psrpcore/messages"
 	"github.com/smnsjas/go-psrpcore/serialization"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultUploadChunkSize is used when the communicator has no Config.
+const defaultUploadChunkSize = 256 * 1024
+
+// pipelineStopGrace is how long Close gives cancelled commands to finish
+// on their own before closing the session stops them, and
+// pipelineStopTimeout how long it then waits for them to wind down.
+const (
+	pipelineStopGrace   = 5 * time.Second
+	pipelineStopTimeout = 30 * time.Second
 )
 
 // Communicator implements the packer.Communicator interface using PSRP.
 type Communicator struct {
-	client *client.Client
-	config *Config
+	client     PSRPClient
+	newClient  ClientFactory
+	config     *Config
+	target     string
+	log        hclog.Logger // tagged with this connection's ID; see logging.go
+	trace      *wireTrace   // psrp_trace_file; nil when disabled
+	events     *eventLog    // psrp_event_log_file; nil when disabled
+	transcript *transcript  // psrp_transcript_dir; nil when disabled
+	tunnel     *sshTunnel   // psrp_ssh_tunnel_host; nil when connecting directly
+	front      *authFront   // authenticates in go-psrp's place; nil when go-psrp does
+
+	// Session liveness; see session.go
+	mu           sync.Mutex // guards client, connected, stale and watchdogStop
+	connected    bool
+	stale        bool
+	busy         atomic.Int32
+	watchdogStop chan struct{}
+	watchdogWG   sync.WaitGroup
+
+	// lazy defers connecting until the first operation (psrp_lazy_connect);
+	// connecting is that connection while it is being made, and
+	// fingerprint the certificate trusted on it. lazyCheck, if set, runs
+	// once it is made (StepConnect's identity check).
+	lazy        bool
+	connecting  *lazyConnect
+	fingerprint string
+	lazyCheck   func(context.Context) error
+
+	// remoteInfo caches the server-reported part of ConnectionInfo
+	remoteInfo *ConnectionInfo
+
+	// root is cancelled by Close, stopping operations in flight. Close
+	// replaces it, so a communicator that reconnects can be used again.
+	rootMu     sync.Mutex
+	root       context.Context
+	cancelRoot context.CancelFunc
+
+	// pipelines maps a channel per command started with Start, closed
+	// once its goroutines have finished, to the func that abandons it;
+	// Close waits for them.
+	pipelinesMu sync.Mutex
+	pipelines   map[chan struct{}]func()
+
+	// stats feeds the session summary; see Stats
+	stats sessionCounters
+
+	// ui receives heartbeats for quiet commands; see SetUi
+	ui packer.Ui
 }
 
+// opContext returns the context for one operation: abandoned after
+// PSRPOperationTimeout and cancelled by Close.
 func (c *Communicator) opContext() (context.Context, context.CancelFunc) {
-	if c.config != nil && c.config.PSRPTimeout > 0 {
-		return context.WithTimeout(context.Background(), c.config.PSRPTimeout)
+	return c.opContextFrom(context.Background())
+}
+
+// opContextFrom is opContext for an operation that also stops when parent
+// is done, such as a transfer the build may cancel.
+func (c *Communicator) opContextFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, _, cancel := c.progressContext(parent)
+	return ctx, cancel
+}
+
+// progressContext is opContextFrom for an operation made of several
+// requests. Calling progress restarts the PSRPOperationTimeout clock, so
+// the operation only fails once it stalls, however long it runs overall.
+func (c *Communicator) progressContext(parent context.Context) (ctx context.Context, progress func(), cancel context.CancelFunc) {
+	ctx, cancelCause := context.WithCancelCause(parent)
+	progress = func() {}
+	var timer *time.Timer
+	if c.config != nil && c.config.PSRPOperationTimeout > 0 {
+		timeout := c.config.PSRPOperationTimeout
+		timer = time.AfterFunc(timeout, func() {
+			cancelCause(fmt.Errorf("%w for %s (psrp_operation_timeout)", ErrOperationStalled, timeout))
+		})
+		progress = func() { timer.Reset(timeout) }
+	}
+	stop := context.AfterFunc(c.rootContext(), func() { cancelCause(nil) })
+	return ctx, progress, func() {
+		stop()
+		if timer != nil {
+			timer.Stop()
+		}
+		cancelCause(nil)
+	}
+}
+
+// stallError marks err as caused by the operation stalling when that is
+// why ctx ended.
+func stallError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrOperationStalled) {
+		return err
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, ErrOperationStalled) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	return err
+}
+
+// rootContext returns the context Close cancels.
+func (c *Communicator) rootContext() context.Context {
+	c.rootMu.Lock()
+	defer c.rootMu.Unlock()
+	if c.root == nil {
+		c.root, c.cancelRoot = context.WithCancel(context.Background())
+	}
+	return c.root
+}
+
+// trackPipeline registers a command started with Start. The returned
+// context is cancelled by Close, which then waits for finish to be called;
+// aborted is closed if Close gives up on the command.
+func (c *Communicator) trackPipeline(ctx context.Context) (_ context.Context, aborted <-chan struct{}, finish func()) {
+	started := time.Now()
+	c.stats.commands.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.rootContext(), cancel)
+	done := make(chan struct{})
+	abort := make(chan struct{})
+
+	c.pipelinesMu.Lock()
+	if c.pipelines == nil {
+		c.pipelines = make(map[chan struct{}]func())
 	}
-	return context.WithCancel(context.Background())
+	c.pipelines[done] = sync.OnceFunc(func() { close(abort) })
+	c.pipelinesMu.Unlock()
+
+	return ctx, abort, func() {
+		since(&c.stats.commandTime, started)
+		stop()
+		cancel()
+		c.pipelinesMu.Lock()
+		delete(c.pipelines, done)
+		c.pipelinesMu.Unlock()
+		close(done)
+	}
+}
+
+// waitPipelines waits up to timeout for the commands registered with
+// trackPipeline to finish, and returns how many are still running.
+func (c *Communicator) waitPipelines(timeout time.Duration) int {
+	c.pipelinesMu.Lock()
+	pending := make([]chan struct{}, 0, len(c.pipelines))
+	for done := range c.pipelines {
+		pending = append(pending, done)
+	}
+	c.pipelinesMu.Unlock()
+
+	deadline := time.After(timeout)
+	for i, done := range pending {
+		select {
+		case <-done:
+		case <-deadline:
+			return len(pending) - i
+		}
+	}
+	return 0
+}
+
+// abortPipelines abandons the commands registered with trackPipeline that
+// are still running.
+func (c *Communicator) abortPipelines() {
+	c.pipelinesMu.Lock()
+	defer c.pipelinesMu.Unlock()
+	for _, abort := range c.pipelines {
+		abort()
+	}
+}
+
+// cancelOperations stops every operation started from rootContext.
+func (c *Communicator) cancelOperations() {
+	c.rootMu.Lock()
+	defer c.rootMu.Unlock()
+	if c.cancelRoot != nil {
+		c.cancelRoot()
+	}
+	c.root, c.cancelRoot = nil, nil
 }
 
-// New creates a new PSRP communicator with the given configuration.
+// New creates a new PSRP communicator with the given configuration. With
+// psrp_ssh_tunnel_host set, its clients connect through an SSH tunnel that
+// the communicator closes with the session, and when go-psrp can't
+// authenticate the connection as configured, through an authFront.
 func New(target string, config *Config) (*Communicator, error) {
-	psrpConfig := config.ToGoPSRPConfig()
+	switch config.PSRPTransport {
+	case TransportNamedPipe:
+		return NewWithClientFactory(target, config, newPipeClient)
+	case TransportSSH:
+		return NewWithClientFactory(target, config, newSSHClient)
+	case TransportHvSocket:
+		if config.PSRPContainerID != "" {
+			return NewWithClientFactory(target, config, newContainerClient)
+		}
+	}
+	if config.PSRPSSHTunnelHost == "" && !config.useAuthFront() {
+		return NewWithClientFactory(target, config, newGoPSRPClient)
+	}
 
-	psrpClient, err := client.New(target, psrpConfig)
+	addr, err := config.probeAddr(target)
+	if err != nil {
+		return nil, err
+	}
+	factory := ClientFactory(newGoPSRPClient)
+	var tunnel *sshTunnel
+	if config.PSRPSSHTunnelHost != "" {
+		if tunnel, err = openSSHTunnel(config, addr); err != nil {
+			return nil, err
+		}
+		factory = tunnel.clientFactory(factory)
+		addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.port()))
+	}
+	var front *authFront
+	if config.useAuthFront() {
+		if front, err = openAuthFront(config, target, addr); err != nil {
+			if tunnel != nil {
+				tunnel.Close()
+			}
+			return nil, err
+		}
+		// The front dials the endpoint (through the tunnel, if any) itself
+		factory = front.clientFactory(newGoPSRPClient)
+	}
+
+	comm, err := NewWithClientFactory(target, config, factory)
+	if err != nil {
+		if front != nil {
+			front.Close()
+		}
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		return nil, err
+	}
+	comm.tunnel, comm.front = tunnel, front
+	return comm, nil
+}
+
+// NewWithClientFactory creates a communicator whose clients (the first one
+// and any created to reconnect) come from factory instead of go-psrp.
+func NewWithClientFactory(target string, config *Config, factory ClientFactory) (*Communicator, error) {
+	psrpClient, err := factory(target, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create PSRP client: %w", err)
 	}
 
+	connID := newConnID()
+	trace := newWireTrace(config, connID, target)
+	trace.attach(psrpClient)
+
 	return &Communicator{
-		client: psrpClient,
-		config: config,
+		client:     psrpClient,
+		newClient:  factory,
+		config:     config,
+		target:     target,
+		log:        logger.With("conn", connID, "target", target),
+		trace:      trace,
+		events:     newEventLog(config, connID, target),
+		transcript: newTranscript(config, connID, target),
+		lazy:       config.PSRPLazyConnect,
 	}, nil
 }
 
-// Connect establishes the PSRP connection.
-func (c *Communicator) Connect(ctx context.Context) error {
-	if err := c.client.Connect(ctx); err != nil {
-		return fmt.Errorf("failed to connect to PSRP endpoint: %w", err)
+// dial creates a new, unconnected client for the target.
+func (c *Communicator) dial() (PSRPClient, error) {
+	factory := c.newClient
+	if factory == nil {
+		factory = newGoPSRPClient
+	}
+	psrpClient, err := factory(c.target, c.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PSRP client: %w", err)
+	}
+	c.trace.attach(psrpClient)
+	return psrpClient, nil
+}
+
+// Connect establishes the PSRP connection. It returns as soon as ctx is
+// done, even if the underlying handshake is still blocked on the network.
+func (c *Communicator) Connect(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "psrp.Connect")
+	defer func() {
+		err = RedactError(err)
+		endSpan(span, err)
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logger().Trace("connecting", append([]any{"op", "connect"}, c.config.connectionFields()...)...)
+	start := time.Now()
+	if err := c.connectClient(ctx); err != nil {
+		c.trace.event("session.connect_failed", "error", err)
+		c.events.emit("session.connect_failed", err, "duration_ms", time.Since(start).Milliseconds())
+		c.logger().Trace("connect failed", "op", "connect", "elapsed", time.Since(start), "error", err)
+		return fmt.Errorf("failed to connect to PSRP endpoint: %w", c.config.explainFault(err))
 	}
+	c.trace.event("session.connected")
+	c.events.emit("session.connected", nil, "transport", c.config.PSRPTransport, "port", c.config.PSRPPort,
+		"tls", c.config.PSRPUseTLS, "auth", c.config.effectiveAuthType(), "duration_ms", time.Since(start).Milliseconds())
+	c.logger().Trace("connected", "op", "connect", "elapsed", time.Since(start))
+	c.connected = true
+	c.stale = false
+	c.startWatchdog()
 	return nil
 }
 
+// connectClient runs client.Connect, abandoning it if ctx is done first. An
+// abandoned client is replaced with a fresh one so the next attempt doesn't
+// queue behind the stuck handshake, and is closed once the handshake ends.
+// The caller must hold c.mu.
+func (c *Communicator) connectClient(ctx context.Context) error {
+	defer since(&c.stats.connectTime, time.Now())
+	cl := c.client
+	done := make(chan error, 1)
+	go func() { done <- cl.Connect(ctx) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			c.stats.markConnected()
+			c.startTranscriptLocked(ctx)
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	go func() {
+		if err := <-done; err == nil {
+			forceClose(context.Background(), cl)
+		}
+	}()
+	if fresh, err := c.dial(); err == nil {
+		c.client = fresh
+	}
+	return ctx.Err()
+}
+
 // deserializeMessage extracts deserialized objects from a PSRP message.
 // Returns the deserialized objects as a formatted string.
 func deserializeMessage(msg *messages.Message) string {
@@ -76,134 +397,443 @@ func deserializeMessage(msg *messages.Message) string {
 	return strings.Join(parts, "\n")
 }
 
+// exitMarker prefixes the line Start's wrapper script writes with the exit code.
+const exitMarker = "__PACKER_EXIT_CODE__:"
+
+// writeOutput writes the lines of text to w (if non-nil), filtering out the
+// exit marker line. It returns the exit code if the marker was present. Only
+// the output stream carries the marker; see writeLines for the others.
+func writeOutput(text string, w io.Writer) (exitCode int, found bool) {
+	if text == "" {
+		return 0, false
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, exitMarker) {
+			if parsed, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, exitMarker))); err == nil {
+				exitCode, found = parsed, true
+			}
+			continue
+		}
+		if i == len(lines)-1 && line == "" {
+			continue
+		}
+		if w != nil {
+			fmt.Fprintln(w, line)
+		}
+	}
+	return exitCode, found
+}
+
+// writeLines writes the lines of text to w (if non-nil) as they are. It is
+// used for the warning, verbose, debug and information streams: those are
+// drained concurrently with the output stream, so a marker-like line on
+// one of them must not be able to replace the exit code.
+func writeLines(text string, w io.Writer) {
+	if text == "" || w == nil {
+		return
+	}
+	fmt.Fprintln(w, strings.TrimSuffix(text, "\n"))
+}
+
+// culturePreamble returns script lines that switch the pipeline thread to the
+// configured locale/UI culture, or "" when neither is set. go-psrp always
+// negotiates en-US at the WSMan layer and takes no runspace pool culture, so
+// the culture is applied in-session. The process defaults are set too, so
+// threads PowerShell starts for the command inherit it.
+func (c *Communicator) culturePreamble() string {
+	if c.config == nil {
+		return ""
+	}
+	var b strings.Builder
+	if c.config.PSRPLocale != "" {
+		culture := psQuote(c.config.PSRPLocale)
+		fmt.Fprintf(&b, "[System.Globalization.CultureInfo]::DefaultThreadCurrentCulture = %s\n", culture)
+		fmt.Fprintf(&b, "[System.Threading.Thread]::CurrentThread.CurrentCulture = %s\n", culture)
+	}
+	if c.config.PSRPUICulture != "" {
+		culture := psQuote(c.config.PSRPUICulture)
+		fmt.Fprintf(&b, "[System.Globalization.CultureInfo]::DefaultThreadCurrentUICulture = %s\n", culture)
+		fmt.Fprintf(&b, "[System.Threading.Thread]::CurrentThread.CurrentUICulture = %s\n", culture)
+	}
+	return b.String()
+}
+
+// psQuote returns s as a single-quoted PowerShell string literal.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// exitCodeMask returns a script line that reduces the exit code the way a
+// POSIX shell sees pwsh's exit status (0-255, so "exit -1" is 255), or ""
+// on Windows, where exit codes are reported in full.
+func (c *Communicator) exitCodeMask() string {
+	if !c.config.POSIXTarget() {
+		return ""
+	}
+	return "$ec = $ec -band 0xFF\n"
+}
+
 // Start takes a RemoteCmd and starts executing it remotely.
 // This is non-blocking - it returns immediately and the command runs asynchronously.
 func (c *Communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
-	const exitMarker = "__PACKER_EXIT_CODE__:"
+	return RedactError(c.start(ctx, cmd))
+}
 
+// start implements Start; errors are redacted by the caller.
+func (c *Communicator) start(ctx context.Context, cmd *packer.RemoteCmd) error {
 	wrappedCmd := fmt.Sprintf(`& {
-%s
+%s%s
 $ec = if ($?) {
 	if ($LASTEXITCODE -ne $null) { $LASTEXITCODE } else { 0 }
 } else {
 	if ($LASTEXITCODE -ne $null) { $LASTEXITCODE } else { 1 }
 }
-Write-Output "%s$ec"
-}`, cmd.Command, exitMarker)
+%sWrite-Output "%s$ec"
+}`, c.culturePreamble(), cmd.Command, c.exitCodeMask(), exitMarker)
+
+	if c.config != nil && c.config.PSRPResumeOnDisconnect && c.config.PSRPTransport == TransportWSMan {
+		return c.startResumable(ctx, cmd, wrappedCmd)
+	}
 
-	streamResult, err := c.client.ExecuteStream(ctx, wrappedCmd)
+	// Close cancels the command and waits for its goroutines
+	ctx, aborted, finish := c.trackPipeline(ctx)
+
+	// The pipeline span lasts until the command exits, not just until Start
+	// returns
+	ctx, span := startSpan(ctx, "psrp.pipeline", attribute.Int("psrp.command_length", len(cmd.Command)))
+
+	c.busy.Add(1)
+	cl, err := c.session(ctx)
+	if err != nil {
+		c.busy.Add(-1)
+		finish()
+		err = fmt.Errorf("failed to start PSRP command: %w", err)
+		endSpan(span, err)
+		return err
+	}
+	// Once started, the stream outlives cancellation: go-psrp stops reading
+	// a stream whose context ends without failing its pipeline, so the
+	// stream would neither see Close stop the pipeline on the guest nor
+	// send the terminate signal when it ends.
+	streamCtx, stopStream := context.WithCancel(context.WithoutCancel(ctx))
+	stopStarting := context.AfterFunc(ctx, stopStream)
+	streamResult, err := cl.ExecuteStream(streamCtx, wrappedCmd)
+	stopStarting()
 	if err != nil {
-		return fmt.Errorf("failed to start PSRP command: %w", err)
+		c.busy.Add(-1)
+		stopStream()
+		finish()
+		err = fmt.Errorf("failed to start PSRP command: %w: %w", ErrPipelineFailed, c.config.explainFault(err))
+		c.recordFailure("command failed to start", err)
+		endSpan(span, err)
+		return err
 	}
 
+	run := c.beginCommand(cmd, wrappedCmd, span)
+	seq, stdout, stderr := run.seq, run.stdout, run.stderr
+	warnings := stderr
+	if c.ui != nil {
+		warnings = c.transcript.tee(warningWriter{c.ui})
+	}
+
+	// Stop the remote pipeline promptly if the build is cancelled
+	stopCancel := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.logger().Info("cancelling command", "op", "command", "reason", ctx.Err())
+			c.trace.event("pipeline.cancel", "seq", seq, "reason", ctx.Err())
+			streamResult.Cancel()
+		case <-stopCancel:
+		}
+	}()
+
+	hb := c.startHeartbeat()
+
 	go func() {
+		defer finish()
+		defer c.busy.Add(-1)
+		defer stopStream()
+		defer close(stopCancel)
+		defer hb.Stop()
+
 		var wg sync.WaitGroup
-		var hadErrors bool
+		var errorRecords int
 		var exitCode int
 		var exitCodeSet bool
 		var mu sync.Mutex
+		guard, tail := run.guard, run.tail
 
-		// Helper: drain a *messages.Message channel, deserialize, write to writer
-		drainTo := func(ch <-chan *messages.Message, w io.Writer) {
+		// Helper: drain a *messages.Message channel, deserialize, write to
+		// writer. Only the output stream is scanned for the exit marker.
+		drainTo := func(ch <-chan *messages.Message, w io.Writer, output bool) {
 			defer wg.Done()
 			for msg := range ch {
-				if w == nil || msg == nil {
+				if msg == nil {
 					continue
 				}
-				text := deserializeMessage(msg)
-				if text != "" {
-					lines := strings.Split(text, "\n")
-					for i, line := range lines {
-						if strings.HasPrefix(line, exitMarker) {
-							if parsed, parseErr := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, exitMarker))); parseErr == nil {
-								mu.Lock()
-								exitCode = parsed
-								exitCodeSet = true
-								mu.Unlock()
-							}
-							continue
-						}
-						if i == len(lines)-1 && line == "" {
-							continue
-						}
-						fmt.Fprintln(w, line)
+				c.trace.message(seq, msg)
+				hb.output()
+				guard.handle(func() {
+					text := deserializeMessage(msg)
+					tail.add(text)
+					if !output {
+						writeLines(text, w)
+						return
 					}
-				}
+					if code, ok := writeOutput(text, w); ok {
+						mu.Lock()
+						exitCode = code
+						exitCodeSet = true
+						mu.Unlock()
+					}
+				})
 			}
 		}
 
-		// Error channel: same as drainTo but tracks that errors occurred
+		// Error channel: same as drainTo but counts the error records
 		drainErrors := func(ch <-chan *messages.Message, w io.Writer) {
 			defer wg.Done()
 			for msg := range ch {
 				if msg == nil {
 					continue
 				}
+				c.trace.message(seq, msg)
+				hb.output()
 				mu.Lock()
-				hadErrors = true
+				errorRecords++
 				mu.Unlock()
-				if w != nil {
+				guard.handle(func() {
 					text := deserializeMessage(msg)
-					if text != "" {
+					tail.add(text)
+					if w != nil && text != "" {
 						fmt.Fprintln(w, text)
 					}
-				}
+				})
 			}
 		}
 
 		// Drain and discard (e.g., progress records)
 		drainDiscard := func(ch <-chan *messages.Message) {
 			defer wg.Done()
-			for range ch {
+			for msg := range ch {
+				c.trace.message(seq, msg)
 			}
 		}
 
 		wg.Add(7)
-		go drainTo(streamResult.Output, cmd.Stdout)
-		go drainErrors(streamResult.Errors, cmd.Stderr)
-		go drainTo(streamResult.Warnings, cmd.Stderr)
-		go drainTo(streamResult.Verbose, cmd.Stdout)
-		go drainTo(streamResult.Debug, cmd.Stdout)
+		go drainTo(streamResult.Output, stdout, true)
+		go drainErrors(streamResult.Errors, stderr)
+		go drainTo(streamResult.Warnings, warnings, false)
+		go drainTo(streamResult.Verbose, stdout, false)
+		go drainTo(streamResult.Debug, stdout, false)
 		go drainDiscard(streamResult.Progress)
-		go drainTo(streamResult.Information, cmd.Stdout)
+		go drainTo(streamResult.Information, stdout, false)
 
-		// Wait for pipeline completion and all streams to drain
-		runErr := streamResult.Wait()
-		wg.Wait()
+		// Wait for pipeline completion and all streams to drain, unless the
+		// guest stops answering or Close gives up on the command first
+		completed := make(chan error, 1)
+		go func() {
+			err := streamResult.Wait()
+			wg.Wait()
+			completed <- err
+		}()
+		lost, stopLiveness := c.watchLiveness()
+		var runErr error
+		state := "completed"
+		select {
+		case err := <-completed:
+			if runErr = c.config.explainFault(err); runErr != nil {
+				state = "failed"
+			}
+		case runErr = <-lost:
+			state = "lost"
+			c.trace.event("pipeline.lost", "seq", seq, "error", runErr)
+			c.abandonDeadSession(cl)
+			select {
+			case <-completed:
+			case <-aborted:
+			case <-time.After(pipelineStopTimeout):
+				c.logger().Warn("abandoning command on a dead session", "op", "command")
+			}
+		case <-aborted:
+			state = "abandoned"
+			runErr = fmt.Errorf("%w: the command did not stop before the session closed", ErrPipelineFailed)
+			c.trace.event("pipeline.abandoned", "seq", seq)
+		}
+		stopLiveness()
 
 		mu.Lock()
-		finalExitCode := exitCode
-		haveExitCode := exitCodeSet
-		hadErrs := hadErrors
+		finalExitCode, haveExitCode, errs := exitCode, exitCodeSet, errorRecords
 		mu.Unlock()
-
-		if !haveExitCode {
-			if runErr != nil || hadErrs {
-				finalExitCode = 1
-			} else {
-				finalExitCode = 0
-			}
-		}
-		cmd.SetExited(finalExitCode)
+		c.finishCommand(ctx, run, state, runErr, finalExitCode, haveExitCode, errs)
 	}()
 
 	return nil
 }
 
+// commandRun is the state start and startResumable share for one command.
+type commandRun struct {
+	cmd     *packer.RemoteCmd
+	seq     int64 // wire trace pipeline
+	eventID int64
+	started time.Time
+	span    trace.Span
+	guard   *streamGuard
+	tail    *lineTail
+
+	// stdout and stderr are cmd's, teed into the transcript
+	stdout, stderr io.Writer
+}
+
+// beginCommand records the start of cmd, running script, in the wire
+// trace, event log and transcript.
+func (c *Communicator) beginCommand(cmd *packer.RemoteCmd, script string, span trace.Span) *commandRun {
+	run := &commandRun{
+		cmd:     cmd,
+		seq:     c.trace.pipelineStart(script),
+		eventID: c.events.commandStart(len(script)),
+		started: time.Now(),
+		span:    span,
+		guard:   &streamGuard{log: c.logger()},
+		tail:    &lineTail{},
+	}
+	c.transcript.command(cmd.Command)
+	run.stdout, run.stderr = c.transcript.tee(cmd.Stdout), c.transcript.tee(cmd.Stderr)
+	return run
+}
+
+// finishCommand settles the exit code of a command whose pipeline ended
+// as state says, then reports it and exits run.cmd. A panic while
+// handling output fails the command; a missing exit code is handled by
+// missingExitCode.
+func (c *Communicator) finishCommand(ctx context.Context, run *commandRun, state string, runErr error,
+	exitCode int, haveExitCode bool, errorRecords int,
+) {
+	panicErr := run.guard.Err()
+	if panicErr != nil {
+		runErr = panicErr
+	}
+
+	switch {
+	case panicErr != nil:
+		// Output was dropped, so the command's own exit code doesn't
+		// tell whether the build got what it needed
+		exitCode = 1
+	case haveExitCode:
+	case ctx.Err() != nil:
+		// Cancelled commands never get to write their exit code
+		exitCode = 1
+	default:
+		var strictErr error
+		if exitCode, strictErr = c.missingExitCode(state, runErr, errorRecords, run.tail); strictErr != nil && runErr == nil {
+			runErr = strictErr
+		}
+	}
+	run.guard.try(func() { exitCode = c.failOnErrorRecords(exitCode, errorRecords, run.stderr) })
+
+	if runErr != nil && ctx.Err() == nil {
+		c.logger().Error("pipeline failed", "op", "command", "error", runErr)
+		c.recordFailure("pipeline failed", runErr)
+		if run.stderr != nil {
+			run.guard.try(func() { fmt.Fprintln(run.stderr, runErr) })
+		}
+	}
+	c.trace.pipelineEnd(run.seq, exitCode, haveExitCode, runErr)
+	c.events.commandEnd(run.eventID, run.started, exitCode, haveExitCode, errorRecords, runErr)
+	c.transcript.exited(exitCode, runErr)
+	run.span.SetAttributes(attribute.Int("psrp.exit_code", exitCode))
+	endSpan(run.span, runErr)
+	run.cmd.SetExited(exitCode)
+}
+
 // Upload uploads a file to the remote machine at the given path.
+// The input is streamed in chunks sized to fit the server's envelope limit,
+// so large files neither need to be buffered whole nor trip
+// "request size exceeded" faults.
 func (c *Communicator) Upload(path string, input io.Reader, fi *os.FileInfo) error {
-	ctx, cancel := c.opContext()
+	return c.UploadContext(context.Background(), path, input, fi)
+}
+
+// UploadContext is Upload, stopping between chunks and aborting the chunk
+// in flight when ctx is done.
+func (c *Communicator) UploadContext(ctx context.Context, path string, input io.Reader, fi *os.FileInfo) error {
+	return RedactError(c.upload(ctx, path, input))
+}
+
+// upload implements Upload under a per-file span that is a child of any
+// span in ctx.
+func (c *Communicator) upload(ctx context.Context, path string, input io.Reader) (err error) {
+	ctx, span := startSpan(ctx, "psrp.upload", attribute.String("psrp.path", path))
+	var offset int64
+	chunks := 0
+	started := time.Now()
+	defer func() {
+		elapsed := time.Since(started)
+		c.stats.uploadTime.Add(int64(elapsed))
+		c.stats.bytesUploaded.Add(offset)
+		if err == nil {
+			c.logger().Debug("uploaded file", "op", "transfer", "path", path, "bytes", offset,
+				"chunks", chunks, "elapsed", elapsed, "bytes_per_sec", bytesPerSecond(offset, elapsed))
+		}
+		c.events.transfer("upload", path, offset, elapsed, err)
+		span.SetAttributes(attribute.Int64("psrp.bytes", offset), attribute.Int("psrp.chunks", chunks))
+		endSpan(span, err)
+	}()
+
+	chunkSize := defaultUploadChunkSize
+	if c.config != nil {
+		chunkSize = c.config.UploadChunkSize()
+	}
+
+	ctx, progress, cancel := c.progressContext(ctx)
 	defer cancel()
 
-	data, err := io.ReadAll(input)
-	if err != nil {
-		return fmt.Errorf("failed to read input data: %w", err)
+	escapedPath := strings.ReplaceAll(path, "'", "''")
+	buf := make([]byte, chunkSize)
+	first := true
+
+	for {
+		if ctx.Err() != nil {
+			return fmt.Errorf("upload of %s cancelled after %d bytes: %w", path, offset, context.Cause(ctx))
+		}
+		n, readErr := io.ReadFull(input, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read input data: %w", readErr)
+		}
+
+		// Always send the first chunk so empty files are still created.
+		if n > 0 || first {
+			c.trace.event("upload.chunk", "path", path, "offset", offset, "bytes", n)
+			chunkStart := time.Now()
+			if err := c.uploadChunk(ctx, path, escapedPath, buf[:n], offset); err != nil {
+				return err
+			}
+			c.logger().Trace("uploaded chunk", "op", "transfer", "path", path,
+				"offset", offset, "bytes", n, "elapsed", time.Since(chunkStart))
+			first = false
+			offset += int64(n)
+			chunks++
+			progress()
+		}
+
+		if readErr != nil {
+			return nil
+		}
 	}
+}
 
+// uploadChunk writes the chunk of a file that starts at offset. The first
+// chunk creates (or truncates) the file and its parent directory; later
+// chunks append. Appends check the current length first, so a chunk that
+// is retried after the server already wrote it is not written twice.
+func (c *Communicator) uploadChunk(ctx context.Context, path, escapedPath string, data []byte, offset int64) error {
 	encoded := base64.StdEncoding.EncodeToString(data)
-	escapedPath := strings.ReplaceAll(path, "'", "''")
 
-	script := fmt.Sprintf(`
+	var script string
+	if offset == 0 {
+		script = fmt.Sprintf(`
 		$bytes = [System.Convert]::FromBase64String('%s')
 		$parentDir = Split-Path -Parent '%s'
 		if ($parentDir -and !(Test-Path $parentDir)) {
@@ -211,8 +841,23 @@ func (c *Communicator) Upload(path string, input io.Reader, fi *os.FileInfo) err
 		}
 		[System.IO.File]::WriteAllBytes('%s', $bytes)
 	`, encoded, escapedPath, escapedPath)
+	} else {
+		script = fmt.Sprintf(`
+		$bytes = [System.Convert]::FromBase64String('%s')
+		$stream = [System.IO.File]::Open('%s', [System.IO.FileMode]::Append)
+		try {
+			if ($stream.Length -eq %d) {
+				$stream.Write($bytes, 0, $bytes.Length)
+			} elseif ($stream.Length -ne %d) {
+				throw "unexpected length $($stream.Length) before writing at offset %d"
+			}
+		} finally {
+			$stream.Dispose()
+		}
+	`, encoded, escapedPath, offset, offset+int64(len(data)), offset)
+	}
 
-	result, err := c.client.Execute(ctx, script)
+	result, err := c.executeWithRetry(ctx, script)
 	if err != nil {
 		return fmt.Errorf("failed to upload file to %s: %w", path, err)
 	}
@@ -226,10 +871,28 @@ func (c *Communicator) Upload(path string, input io.Reader, fi *os.FileInfo) err
 
 // UploadDir uploads the contents of a directory to the remote machine.
 func (c *Communicator) UploadDir(dst string, src string, exclude []string) error {
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	return c.UploadDirContext(context.Background(), dst, src, exclude)
+}
+
+// UploadDirContext is UploadDir, stopping when ctx is done.
+func (c *Communicator) UploadDirContext(ctx context.Context, dst string, src string, exclude []string) (err error) {
+	ctx, span := startSpan(ctx, "psrp.upload_dir",
+		attribute.String("psrp.src", src), attribute.String("psrp.dst", dst))
+	totals := newTransferTotals()
+	defer func() {
+		err = RedactError(err)
+		totals.log(c, "uploaded directory", src, dst, err)
+		endSpan(span, err)
+	}()
+
+	var files []localFile
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		for _, pattern := range exclude {
 			if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
@@ -249,22 +912,41 @@ func (c *Communicator) UploadDir(dst string, src string, exclude []string) error
 			return err
 		}
 
-		// Use backslashes for Windows remote paths
-		dstPath := dst + "\\" + strings.ReplaceAll(relPath, "/", "\\")
-
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("failed to open %s: %w", path, err)
-		}
-		defer file.Close()
-
-		return c.Upload(dstPath, file, &info)
+		dstPath := c.config.RemoteJoin(dst, filepath.ToSlash(relPath))
+		files = append(files, localFile{local: path, remote: dstPath, size: info.Size()})
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	return c.uploadFiles(ctx, files, func(f localFile) { totals.add(f.size) })
 }
 
 // Download downloads a file from the remote machine.
 func (c *Communicator) Download(path string, output io.Writer) error {
-	ctx, cancel := c.opContext()
+	return c.DownloadContext(context.Background(), path, output)
+}
+
+// DownloadContext is Download, aborting when ctx is done.
+func (c *Communicator) DownloadContext(ctx context.Context, path string, output io.Writer) error {
+	return RedactError(c.download(ctx, path, output))
+}
+
+// download implements Download under a per-file span that is a child of any
+// span in parent.
+func (c *Communicator) download(parent context.Context, path string, output io.Writer) (err error) {
+	parent, span := startSpan(parent, "psrp.download", attribute.String("psrp.path", path))
+	start := time.Now()
+	var size int64
+	defer func() {
+		elapsed := time.Since(start)
+		c.stats.downloadTime.Add(int64(elapsed))
+		c.events.transfer("download", path, size, elapsed, err)
+		endSpan(span, err)
+	}()
+
+	ctx, cancel := c.opContextFrom(parent)
 	defer cancel()
 
 	escapedPath := strings.ReplaceAll(path, "'", "''")
@@ -277,7 +959,7 @@ func (c *Communicator) Download(path string, output io.Writer) error {
 		[System.Convert]::ToBase64String($bytes)
 	`, escapedPath, path, escapedPath)
 
-	result, err := c.client.Execute(ctx, script)
+	result, err := c.executeQuery(ctx, script)
 	if err != nil {
 		return fmt.Errorf("failed to download file from %s: %w", path, err)
 	}
@@ -302,16 +984,36 @@ func (c *Communicator) Download(path string, output io.Writer) error {
 		return fmt.Errorf("failed to decode downloaded data: %w", err)
 	}
 
+	span.SetAttributes(attribute.Int("psrp.bytes", len(decoded)))
+	c.stats.bytesDownloaded.Add(int64(len(decoded)))
 	if _, err := output.Write(decoded); err != nil {
 		return fmt.Errorf("failed to write downloaded data: %w", err)
 	}
+	size = int64(len(decoded))
+	elapsed := time.Since(start)
+	c.logger().Debug("downloaded file", "op", "transfer", "path", path, "bytes", len(decoded),
+		"elapsed", elapsed, "bytes_per_sec", bytesPerSecond(int64(len(decoded)), elapsed))
 
 	return nil
 }
 
 // DownloadDir downloads the contents of a directory from the remote machine.
 func (c *Communicator) DownloadDir(src string, dst string, exclude []string) error {
-	ctx, cancel := c.opContext()
+	return c.DownloadDirContext(context.Background(), src, dst, exclude)
+}
+
+// DownloadDirContext is DownloadDir, stopping when ctx is done.
+func (c *Communicator) DownloadDirContext(parent context.Context, src string, dst string, exclude []string) (err error) {
+	spanCtx, span := startSpan(parent, "psrp.download_dir",
+		attribute.String("psrp.src", src), attribute.String("psrp.dst", dst))
+	totals := newTransferTotals()
+	defer func() {
+		err = RedactError(err)
+		totals.log(c, "downloaded directory", src, dst, err)
+		endSpan(span, err)
+	}()
+
+	ctx, cancel := c.opContextFrom(spanCtx)
 	defer cancel()
 
 	escapedSrc := strings.ReplaceAll(src, "'", "''")
@@ -323,7 +1025,7 @@ func (c *Communicator) DownloadDir(src string, dst string, exclude []string) err
 		}
 	`, escapedSrc, escapedSrc)
 
-	result, err := c.client.Execute(ctx, script)
+	result, err := c.executeQuery(ctx, script)
 	if err != nil {
 		return fmt.Errorf("failed to list directory contents: %w", err)
 	}
@@ -337,6 +1039,9 @@ func (c *Communicator) DownloadDir(src string, dst string, exclude []string) err
 		if relPath == "" {
 			continue
 		}
+		if err := spanCtx.Err(); err != nil {
+			return err
+		}
 
 		// Check exclusions
 		excluded := false
@@ -350,7 +1055,7 @@ func (c *Communicator) DownloadDir(src string, dst string, exclude []string) err
 			continue
 		}
 
-		remotePath := src + "\\" + strings.ReplaceAll(relPath, "/", "\\")
+		remotePath := c.config.RemoteJoin(src, relPath)
 		localPath := filepath.Join(dst, filepath.FromSlash(strings.ReplaceAll(relPath, "\\", "/")))
 
 		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
@@ -358,13 +1063,14 @@ func (c *Communicator) DownloadDir(src string, dst string, exclude []string) err
 		}
 
 		var buf bytes.Buffer
-		if err := c.Download(remotePath, &buf); err != nil {
+		if err := c.download(spanCtx, remotePath, &buf); err != nil {
 			return fmt.Errorf("failed to download %s: %w", remotePath, err)
 		}
 
 		if err := os.WriteFile(localPath, buf.Bytes(), 0644); err != nil {
 			return fmt.Errorf("failed to write %s: %w", localPath, err)
 		}
+		totals.add(int64(buf.Len()))
 	}
 
 	return nil
@@ -372,9 +1078,56 @@ func (c *Communicator) DownloadDir(src string, dst string, exclude []string) err
 
 // Close closes the PSRP connection.
 func (c *Communicator) Close() error {
+	// Clear lazy first, so a lazy connection that completes from here on
+	// is discarded instead of starting a watchdog nothing would stop
+	c.mu.Lock()
+	c.lazy = false
+	c.mu.Unlock()
+	c.stopWatchdog()
+	// Stop transfers and commands still running before closing the session,
+	// so no command outlives it on the guest. go-psrp can't signal a single
+	// pipeline to stop, so cancelled commands get pipelineStopGrace to end
+	// on their own; closing the runspace pool and deleting the shell then
+	// stops the rest, along with any processes they started.
+	c.cancelOperations()
+	stuck := c.waitPipelines(pipelineStopGrace)
+	if stuck > 0 {
+		c.logger().Info("stopping running commands", "op", "close", "count", stuck)
+	}
+
 	ctx, cancel := c.opContext()
 	defer cancel()
-	if err := c.client.Close(ctx); err != nil {
+
+	c.mu.Lock()
+	c.finishTranscriptLocked(ctx)
+	c.connected = false
+	c.trace.event("session.close")
+	err := c.client.Close(ctx)
+	c.events.emit("session.close", err, "running_commands", stuck)
+	c.mu.Unlock()
+
+	// Commands that are ending need c.mu to finish, so wait without it
+	if stuck > 0 {
+		if err != nil {
+			c.logger().Warn("closing the session failed; commands may still be running on the guest",
+				"op", "close", "count", stuck, "error", err)
+		}
+		if stuck = c.waitPipelines(pipelineStopTimeout); stuck > 0 {
+			c.abortPipelines()
+			c.logger().Warn("abandoning commands still running after close", "op", "close", "count", stuck)
+		}
+	}
+	if c.front != nil {
+		c.front.Close()
+	}
+	if c.tunnel != nil {
+		c.tunnel.Close()
+	}
+	c.logStats()
+	if flushErr := FlushTracing(ctx); flushErr != nil {
+		c.logger().Debug("exporting traces failed", "error", flushErr)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to close PSRP connection: %w", err)
 	}
 	return nil
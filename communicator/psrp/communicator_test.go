@@ -0,0 +1,28 @@
+package psrp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCulturePreambleQuotes(t *testing.T) {
+	config := NewConfig()
+	config.PSRPLocale = "de-DE"
+	config.PSRPUICulture = "x'; Remove-Item C:\\ -Recurse; '"
+	c := &Communicator{config: config}
+
+	preamble := c.culturePreamble()
+	for _, want := range []string{
+		"[System.Threading.Thread]::CurrentThread.CurrentCulture = 'de-DE'",
+		"[System.Globalization.CultureInfo]::DefaultThreadCurrentCulture = 'de-DE'",
+		"[System.Threading.Thread]::CurrentThread.CurrentUICulture = 'x''; Remove-Item C:\\ -Recurse; '''",
+	} {
+		if !strings.Contains(preamble, want) {
+			t.Errorf("preamble is missing %q:\n%s", want, preamble)
+		}
+	}
+
+	if got := (&Communicator{config: NewConfig()}).culturePreamble(); got != "" {
+		t.Errorf("preamble without a culture = %q, want empty", got)
+	}
+}
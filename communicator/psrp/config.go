@@ -2,10 +2,16 @@ package psrp
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 	"github.com/smnsjas/go-psrp/client"
+	"github.com/smnsjas/go-psrp/wsman/auth"
 )
 
 // TransportType represents the PSRP transport mechanism
@@ -16,6 +22,39 @@ const (
 	TransportWSMan TransportType = "wsman"
 	// TransportHvSocket uses Hyper-V sockets (PowerShell Direct)
 	TransportHvSocket TransportType = "hvsock"
+	// TransportNamedPipe uses a local PowerShell host process's named pipe
+	TransportNamedPipe TransportType = "namedpipe"
+	// TransportSSH uses the SSH "powershell" subsystem
+	TransportSSH TransportType = "ssh"
+)
+
+// DefaultWSManPath is the URL path WinRM listeners serve WSMan on.
+const DefaultWSManPath = "/wsman"
+
+// DefaultSSHSubsystem is the sshd subsystem PowerShell registers for
+// remoting.
+const DefaultSSHSubsystem = "powershell"
+
+// DefaultMaxEnvelopeSize is the WinRM MaxEnvelopeSizekb default (in KB) on
+// Windows Server 2012 and later.
+const DefaultMaxEnvelopeSize = 500
+
+// envelopeOverhead is the space reserved in each request for the SOAP
+// envelope, PSRP message headers and the upload script itself.
+const envelopeOverhead = 16 * 1024
+
+// cultureNameRe matches .NET culture names such as "en-US" or "zh-Hans-CN".
+var cultureNameRe = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// PendingRebootAction is what StepConnect does when the guest reports a
+// pending reboot after connecting.
+type PendingRebootAction string
+
+const (
+	PendingRebootIgnore  PendingRebootAction = "ignore"
+	PendingRebootWarn    PendingRebootAction = "warn"
+	PendingRebootWait    PendingRebootAction = "wait"
+	PendingRebootRestart PendingRebootAction = "restart"
 )
 
 // AuthType represents the authentication method
@@ -37,63 +76,378 @@ type Config struct {
 	PSRPHost     string        `mapstructure:"psrp_host"`
 	PSRPPort     int           `mapstructure:"psrp_port"`
 	PSRPUsername string        `mapstructure:"psrp_username"`
-	PSRPPassword string        `mapstructure:"psrp_password"`
+	PSRPUser     string        `mapstructure:"psrp_user"`     // Alias of psrp_username
+	PSRPPassword string        `mapstructure:"psrp_password"` // Literal, or "env://NAME" / "file://PATH" reference
 	PSRPTimeout  time.Duration `mapstructure:"psrp_timeout"`
 
+	// PSRPCredentialHelper is a command (argv) run just before connecting
+	// whose stdout supplies the credentials; see ExecCredentialHelper.
+	PSRPCredentialHelper []string `mapstructure:"psrp_credential_helper"`
+
+	// CredentialProvider lets builders supply credentials programmatically at
+	// connect time. It takes precedence over psrp_credential_helper.
+	CredentialProvider CredentialProvider `mapstructure:"-" mapstructure-to-hcl2:",skip"`
+
+	// PSRPPasswordFile reads the password from a file at Prepare time.
+	// Mutually exclusive with psrp_password.
+	PSRPPasswordFile string `mapstructure:"psrp_password_file"`
+
+	// PSRPConnectAttemptTimeout bounds a single connection attempt, so a hung
+	// TCP/auth handshake fails over to the next retry instead of consuming the
+	// whole PSRPTimeout wait budget.
+	PSRPConnectAttemptTimeout time.Duration `mapstructure:"psrp_connect_attempt_timeout"`
+
+	// PSRPOperationTimeout aborts a file transfer or other request once it
+	// has gone this long without progress. It is reset after every chunk or
+	// file, so a large transfer that keeps moving is never cut short;
+	// PSRPTimeout only bounds the wait to connect.
+	PSRPOperationTimeout time.Duration `mapstructure:"psrp_operation_timeout"`
+
+	// PSRPHeartbeatInterval reports a command that has written nothing for
+	// this long as still running, and again at each interval while it stays
+	// quiet, so a long silent installer doesn't look like a hung build.
+	PSRPHeartbeatInterval time.Duration `mapstructure:"psrp_heartbeat_interval"`
+
+	// PSRPLivenessInterval is how often the WSMan listener is probed
+	// while a command runs. If three probes in a row go unanswered, the
+	// command fails with ErrSessionLost instead of waiting forever on a
+	// guest that died. PSRPSkipLivenessCheck turns the probes off.
+	PSRPLivenessInterval  time.Duration `mapstructure:"psrp_command_liveness_interval"`
+	PSRPSkipLivenessCheck bool          `mapstructure:"psrp_skip_liveness_check"`
+
+	// PSRPStrictExitCode fails a command whose exit code never arrived,
+	// for example because the script ended the pipeline or its output was
+	// cut short, instead of guessing 0 or 1 from whether it wrote errors.
+	PSRPStrictExitCode bool `mapstructure:"psrp_strict_exit_code"`
+
+	// PSRPFailOnErrorRecords makes a command that wrote any record to its
+	// error stream exit 1, even if its own exit code was 0, to catch
+	// scripts that report a failure and carry on.
+	PSRPFailOnErrorRecords bool `mapstructure:"psrp_fail_on_error_records"`
+
+	// Retry policy for connecting (StepConnect) and file transfers. Delays
+	// start at RetryInterval and grow per RetryBackoff (constant, exponential
+	// or fibonacci) up to RetryMaxInterval. RetryJitter (0-1) randomizes each
+	// delay by up to that fraction. MaxRetries of 0 retries connecting until
+	// PSRPTimeout expires; TransferRetries bounds retries of each transfer
+	// request and defaults to 0 (no retries).
+	PSRPMaxRetries       int             `mapstructure:"psrp_max_retries"`
+	PSRPRetryInterval    time.Duration   `mapstructure:"psrp_retry_interval"`
+	PSRPRetryMaxInterval time.Duration   `mapstructure:"psrp_retry_max_interval"`
+	PSRPRetryJitter      float64         `mapstructure:"psrp_retry_jitter"`
+	PSRPRetryBackoff     BackoffStrategy `mapstructure:"psrp_retry_backoff"`
+	PSRPTransferRetries  int             `mapstructure:"psrp_transfer_retries"`
+
+	// Pre-connection probing (wsman only). Before full PSRP negotiation,
+	// StepConnect waits until the port accepts TCP connections and, with
+	// PSRPHTTPProbe, until the listener answers HTTP at all.
+	PSRPSkipTCPProbe bool `mapstructure:"psrp_skip_tcp_probe"`
+	PSRPHTTPProbe    bool `mapstructure:"psrp_http_probe"`
+
+	// PSRPCheckClockSkew compares the guest clock (from the listener's HTTP
+	// Date header) with local time once the port is open, and warns if the
+	// skew would make Kerberos fail.
+	PSRPCheckClockSkew bool `mapstructure:"psrp_check_clock_skew"`
+
+	// PSRPLazyConnect makes StepConnect hand over the communicator without
+	// connecting; the connection is made (with the usual retry policy) on
+	// the first command or file transfer. The identity check runs once that
+	// connection is made; StepConnect's other post-connect checks and
+	// queries don't run. The ones a user opts into are rejected with it (see
+	// validateCombinations), and guest info is not queried.
+	PSRPLazyConnect bool `mapstructure:"psrp_lazy_connect"`
+
+	// PSRPPostConnectScript is run repeatedly after connecting until it exits
+	// 0 (e.g. "wait until OOBE finished"), at PSRPRetryInterval, for up to
+	// PSRPPostConnectTimeout. Provisioning starts only once it succeeds.
+	PSRPPostConnectScript  string        `mapstructure:"psrp_post_connect_script"`
+	PSRPPostConnectTimeout time.Duration `mapstructure:"psrp_post_connect_timeout"`
+
+	// PSRPPendingReboot checks the standard pending-reboot indicators after
+	// connecting and either ignores them (default), warns, waits for them to
+	// clear, or restarts the guest and reconnects before provisioning.
+	PSRPPendingReboot PendingRebootAction `mapstructure:"psrp_pending_reboot"`
+
+	// PSRPSkipIdentityCheck disables the check that a reconnect (StepConnect
+	// re-run, reboot, new address) reached the same machine, by MachineGuid.
+	PSRPSkipIdentityCheck bool `mapstructure:"psrp_skip_identity_check"`
+
+	// PSRPSkipGuestInfo disables the OS/PowerShell version query StepConnect
+	// runs after connecting (stored in state as "psrp_guest_info").
+	PSRPSkipGuestInfo bool `mapstructure:"psrp_skip_guest_info"`
+
+	// PSRPCollectFacts collects structured guest facts (OS build, features,
+	// .NET versions, disks, activation) after connecting, and publishes them
+	// in state as "psrp_guest_facts" and as build variables.
+	PSRPCollectFacts bool `mapstructure:"psrp_collect_facts"`
+
+	// PSRPCheckQuotas reads the guest's WinRM quotas after connecting and
+	// warns about any too low for this configuration, such as a
+	// MaxEnvelopeSizekb smaller than psrp_max_envelope_size.
+	PSRPCheckQuotas bool `mapstructure:"psrp_check_quotas"`
+
+	// PSRPWinRMFallback makes StepConnect fall back to the SDK's WinRM
+	// communicator, with a warning, when WinRM answers but PSRP cannot be
+	// used: the PowerShell endpoint is missing, restricted to other accounts
+	// or incompatible. PSRP-only features are unavailable after a fallback.
+	PSRPWinRMFallback bool `mapstructure:"psrp_winrm_fallback"`
+
+	// PSRPTargetOS is the target's operating system: "windows" (default),
+	// or "linux" or "macos" for PowerShell 7 reached over OMI/PSWSMan or
+	// SSH. It selects the path separator, the staging directory and how
+	// restarts and exit codes are handled.
+	PSRPTargetOS string `mapstructure:"psrp_target_os"`
+
 	// Transport configuration
 	PSRPTransport         TransportType `mapstructure:"psrp_transport"`
 	PSRPVMID              string        `mapstructure:"psrp_vmid"`               // For HvSocket transport
+	PSRPVMName            string        `mapstructure:"psrp_vm_name"`            // HvSocket: resolved to psrp_vmid at connect time
 	PSRPConfigurationName string        `mapstructure:"psrp_configuration_name"` // PowerShell config name (HvSocket)
+	PSRPWSManPath         string        `mapstructure:"psrp_wsman_path"`         // URL path of the WSMan endpoint (default "/wsman")
+
+	// PSRPContainerID selects a Hyper-V-isolated Windows container (hvsock)
+	// instead of a VM: PowerShell is started in the container and reached
+	// through its utility VM. psrp_vmid, if also set, is taken as that
+	// utility VM's ID rather than looked up.
+	PSRPContainerID string `mapstructure:"psrp_container_id"`
+
+	// PSRPContainerExecCommand is the command (argv) that starts a program
+	// in the container, followed by the container ID and the program's
+	// argv. It defaults to "docker exec --detach".
+	PSRPContainerExecCommand []string `mapstructure:"psrp_container_exec_command"`
+
+	// Named pipe transport. PSRPPipeName is the pipe to connect to, either
+	// a full \\.\pipe\ path or a bare name; PSRPPipeProcessID instead
+	// finds the pipe PowerShell opens in that process for
+	// Enter-PSHostProcess.
+	PSRPPipeName      string `mapstructure:"psrp_pipe_name"`
+	PSRPPipeProcessID int    `mapstructure:"psrp_pipe_process_id"`
+
+	// SSH transport. psrp_host, psrp_port (default 22), psrp_username and
+	// psrp_password carry over; these add key and agent authentication,
+	// host key verification and the subsystem name.
+	PSRPSSHPrivateKeyFile string `mapstructure:"psrp_ssh_private_key_file"`
+	PSRPSSHAgentAuth      bool   `mapstructure:"psrp_ssh_agent_auth"`
+	PSRPSSHKnownHosts     string `mapstructure:"psrp_ssh_known_hosts"`
+	PSRPSSHSubsystem      string `mapstructure:"psrp_ssh_subsystem"` // default "powershell"
+
+	// SSH tunnel (wsman only). When PSRPSSHTunnelHost is set, the WSMan
+	// port is reached through an SSH connection to this host instead of
+	// directly, for guests on networks where 5985/5986 isn't exposed.
+	// Authentication is by private key, password or SSH agent.
+	// PSRPSSHTunnelKnownHosts verifies the SSH host key; without it any key
+	// is accepted.
+	PSRPSSHTunnelHost       string `mapstructure:"psrp_ssh_tunnel_host"`
+	PSRPSSHTunnelPort       int    `mapstructure:"psrp_ssh_tunnel_port"`
+	PSRPSSHTunnelUsername   string `mapstructure:"psrp_ssh_tunnel_username"`
+	PSRPSSHTunnelPassword   string `mapstructure:"psrp_ssh_tunnel_password"` // Literal, or "env://NAME" / "file://PATH" reference
+	PSRPSSHTunnelKeyFile    string `mapstructure:"psrp_ssh_tunnel_private_key_file"`
+	PSRPSSHTunnelKnownHosts string `mapstructure:"psrp_ssh_tunnel_known_hosts"`
+	PSRPSSHTunnelAgentAuth  bool   `mapstructure:"psrp_ssh_tunnel_agent_auth"`
+
+	// Packer-style bastion names for the SSH tunnel options, as offered by
+	// the SSH communicator
+	PSRPBastionHost           string `mapstructure:"psrp_bastion_host"`
+	PSRPBastionPort           int    `mapstructure:"psrp_bastion_port"`
+	PSRPBastionUsername       string `mapstructure:"psrp_bastion_username"`
+	PSRPBastionPassword       string `mapstructure:"psrp_bastion_password"`
+	PSRPBastionPrivateKeyFile string `mapstructure:"psrp_bastion_private_key_file"`
+	PSRPBastionAgentAuth      bool   `mapstructure:"psrp_bastion_agent_auth"`
 
 	// TLS/SSL settings
 	PSRPUseTLS             bool `mapstructure:"psrp_use_tls"`
+	PSRPUseSSL             bool `mapstructure:"psrp_use_ssl"` // Alias of psrp_use_tls (WinRM naming)
 	PSRPInsecureSkipVerify bool `mapstructure:"psrp_insecure"`
 
+	// Certificate pinning for self-signed listeners. PSRPTLSFingerprint pins
+	// the SHA-256 of the listener certificate; PSRPTLSTrustOnFirstUse records
+	// it on first connect and rejects a different certificate on reconnect.
+	PSRPTLSFingerprint     string `mapstructure:"psrp_tls_fingerprint"`
+	PSRPTLSTrustOnFirstUse bool   `mapstructure:"psrp_tls_tofu"`
+
+	// PSRPTLSServerName is the name the listener certificate is verified
+	// against instead of the host connected to, for connecting by IP
+	// address to a listener with a certificate for its host name.
+	PSRPTLSServerName string `mapstructure:"psrp_tls_server_name"`
+
+	// PSRPSkipChannelBinding stops NTLM over TLS from carrying a channel
+	// binding token, for TLS-terminating proxies whose certificate the
+	// listener doesn't know. Listeners with CbtHardeningLevel Strict then
+	// reject it. Kerberos sends no token either way.
+	PSRPSkipChannelBinding bool `mapstructure:"psrp_skip_channel_binding"`
+
 	// Authentication
 	PSRPAuthType AuthType `mapstructure:"psrp_auth_type"`
 	PSRPDomain   string   `mapstructure:"psrp_domain"` // For NTLM and Negotiate
 	PSRPRealm    string   `mapstructure:"psrp_realm"`  // For Kerberos (optional on Windows/SSPI)
 
-	// Kerberos-specific (Unix/gokrb5 path; ignored on Windows when SSPI is used)
+	// PSRPNegotiateMechanisms narrows negotiate auth: ["kerberos", "ntlm"]
+	// (the default) tries Kerberos and falls back to NTLM, ["kerberos"] or
+	// ["ntlm"] uses only that one. With ["kerberos"], StepConnect fails if
+	// the server reports the session used NTLM anyway.
+	PSRPNegotiateMechanisms []string `mapstructure:"psrp_negotiate_mechanisms"`
+
+	// PSRPAllowInsecureBasic permits basic auth over plain HTTP, which sends
+	// the password base64-encoded in every request.
+	PSRPAllowInsecureBasic bool `mapstructure:"psrp_allow_insecure_basic"`
+
+	// PSRPUseMachineCredentials authenticates as the account the build agent
+	// runs under (machine account or gMSA) via SSPI, with no stored password.
+	// Requires Windows and kerberos/negotiate auth with no username/password.
+	PSRPUseMachineCredentials bool `mapstructure:"psrp_use_machine_credentials"`
+
+	// Kerberos-specific (gokrb5 path: always on Unix, on Windows with
+	// PSRPForceGokrb5)
 	PSRPKrb5ConfPath string `mapstructure:"psrp_krb5_conf_path"` // Defaults to /etc/krb5.conf on Unix
 	PSRPKeytabPath   string `mapstructure:"psrp_keytab_path"`
 	PSRPCCachePath   string `mapstructure:"psrp_ccache_path"`
 
+	// PSRPForceGokrb5 authenticates with the pure-Go gokrb5 stack instead of
+	// SSPI on a Windows Packer host, so psrp_keytab_path, psrp_ccache_path
+	// and psrp_krb5_conf_path are honoured there. It has no effect on Unix,
+	// where gokrb5 is the only stack.
+	PSRPForceGokrb5 bool `mapstructure:"psrp_force_gokrb5"`
+
 	// Advanced settings
-	PSRPIdleTimeout         string        `mapstructure:"psrp_idle_timeout"` // ISO8601 duration (e.g., "PT30M")
+	PSRPIdleTimeout         string        `mapstructure:"psrp_idle_timeout"` // Go ("30m") or ISO8601 ("PT30M") duration
 	PSRPMaxRunspaces        int           `mapstructure:"psrp_max_runspaces"`
 	PSRPKeepAliveInterval   time.Duration `mapstructure:"psrp_keepalive_interval"`
 	PSRPRunspaceOpenTimeout time.Duration `mapstructure:"psrp_runspace_open_timeout"`
 
-	ctx interpolate.Context
+	// PSRPWatchdogInterval enables a background watchdog that probes the idle
+	// session at this interval and transparently reconnects before the next
+	// operation if it has died (e.g. idle timeout during a long local step).
+	PSRPWatchdogInterval time.Duration `mapstructure:"psrp_watchdog_interval"`
+
+	// PSRPResumeOnDisconnect runs commands so that a transient network outage
+	// doesn't kill them: the communicator reattaches to the disconnected shell
+	// for up to PSRPResumeTimeout and recovers the output (wsman only).
+	PSRPResumeOnDisconnect bool          `mapstructure:"psrp_resume_on_disconnect"`
+	PSRPResumeTimeout      time.Duration `mapstructure:"psrp_resume_timeout"`
+
+	// PSRPKeepSession leaves the session open when StepConnect cleans up and
+	// registers it by host (see RegisterSession), so the builder's later
+	// steps can reuse it instead of reconnecting. The registry is per
+	// process, so it only helps the builder that set it.
+	PSRPKeepSession bool `mapstructure:"psrp_keep_session"`
+
+	// Session culture (e.g. "en-US"), applied to every command so guest error
+	// messages and date/number formats don't depend on the image's region.
+	// go-psrp fixes the WSMan locale at en-US and has no runspace pool
+	// culture option, so these are set on the command's thread instead.
+	// Windows PowerShell 5.1 can still run parts of a pipeline under the
+	// pool's own culture, so treat them as best-effort there.
+	PSRPLocale    string `mapstructure:"psrp_locale"`
+	PSRPUICulture string `mapstructure:"psrp_ui_culture"`
+
+	// Transfer sizing. PSRPMaxEnvelopeSize mirrors the server's
+	// MaxEnvelopeSizekb (in KB) and is used to derive the upload chunk size
+	// unless PSRPUploadChunkSize (raw bytes per chunk) is set explicitly.
+	// BootstrapScript applies it to the guest; go-psrp's own requests keep
+	// their fixed MaxEnvelopeSize header and 32 KB PSRP fragments, which
+	// the pinned go-psrp offers no way to change, so fragment sizing is
+	// not configurable.
+	PSRPMaxEnvelopeSize int `mapstructure:"psrp_max_envelope_size"`
+	PSRPUploadChunkSize int `mapstructure:"psrp_upload_chunk_size"`
+
+	// UploadDir packs files small enough to share an upload chunk into
+	// batches written by one request each, rather than a request per file.
+	// PSRPSkipUploadBatching uploads every file on its own.
+	PSRPSkipUploadBatching bool `mapstructure:"psrp_skip_upload_batching"`
+
+	// PSRPTraceFile appends a protocol-level trace (message types and sizes,
+	// runspace pool and pipeline state changes, upload chunks) to this file
+	// for debugging hangs and deserialization bugs; PSRPTracePayloads adds
+	// the scripts sent and records received. Secrets are redacted.
+	PSRPTraceFile     string `mapstructure:"psrp_trace_file"`
+	PSRPTracePayloads bool   `mapstructure:"psrp_trace_payloads"`
+
+	// PSRPEventLogFile appends machine-readable JSON events to this file, one
+	// per line, for build farms to ingest: connects, reconnects and close,
+	// each command with its exit code and duration, each transferred file,
+	// and the session summary. Secrets are redacted.
+	PSRPEventLogFile string `mapstructure:"psrp_event_log_file"`
+
+	// The flight recorder keeps the last protocol events of every session in
+	// memory, without payloads, and writes them to a file in
+	// PSRPFlightRecorderDir (default: the system temp directory) when a
+	// connection or command fails. PSRPSkipFlightRecorder turns it off.
+	PSRPFlightRecorderDir  string `mapstructure:"psrp_flight_recorder_dir"`
+	PSRPSkipFlightRecorder bool   `mapstructure:"psrp_skip_flight_recorder"`
+
+	// PSRPTranscriptDir records the session for compliance evidence: a local
+	// mirror of each command and its output, plus a Start-Transcript log on
+	// the guest that is downloaded here when the session closes.
+	PSRPTranscriptDir string `mapstructure:"psrp_transcript_dir"`
+
+	ctx      interpolate.Context
+	warnings []string
 }
 
 // NewConfig returns a Config with default values.
 // Defaults match go-psrp's DefaultConfig() where applicable.
 func NewConfig() *Config {
 	return &Config{
-		Type:                    "psrp",
-		PSRPPort:                5985,
-		PSRPTimeout:             5 * time.Minute,
-		PSRPTransport:           TransportWSMan,
-		PSRPUseTLS:              false,
-		PSRPInsecureSkipVerify:  false,
-		PSRPAuthType:            AuthNegotiate, // go-psrp default
-		PSRPIdleTimeout:         "PT30M",
-		PSRPMaxRunspaces:        1,
-		PSRPKeepAliveInterval:   0, // Disabled by default
-		PSRPRunspaceOpenTimeout: 60 * time.Second,
+		Type:                      "psrp",
+		PSRPPort:                  5985,
+		PSRPTimeout:               5 * time.Minute,
+		PSRPConnectAttemptTimeout: 2 * time.Minute,
+		PSRPOperationTimeout:      5 * time.Minute,
+		PSRPLivenessInterval:      time.Minute,
+		PSRPRetryInterval:         5 * time.Second,
+		PSRPRetryMaxInterval:      30 * time.Second,
+		PSRPRetryBackoff:          BackoffExponential,
+		PSRPTransport:             TransportWSMan,
+		PSRPWSManPath:             DefaultWSManPath,
+		PSRPUseTLS:                false,
+		PSRPInsecureSkipVerify:    false,
+		PSRPAuthType:              AuthNegotiate, // go-psrp default
+		PSRPIdleTimeout:           "PT30M",
+		PSRPMaxRunspaces:          1,
+		PSRPKeepAliveInterval:     0, // Disabled by default
+		PSRPRunspaceOpenTimeout:   60 * time.Second,
+		PSRPMaxEnvelopeSize:       DefaultMaxEnvelopeSize,
 	}
 }
 
+// PrepareOption changes what Prepare does besides validating.
+type PrepareOption func(*prepareOptions)
+
+type prepareOptions struct {
+	interpolate bool
+}
+
+// WithInterpolation makes Prepare render template expressions in the string
+// fields. Only use it for a Config that wasn't decoded with
+// config.DecodeOpts.Interpolate: rendering twice breaks values that contain
+// "{{" after the first pass.
+func WithInterpolation() PrepareOption {
+	return func(o *prepareOptions) { o.interpolate = true }
+}
+
 // Prepare validates the configuration
-func (c *Config) Prepare(ctx *interpolate.Context) []error {
+func (c *Config) Prepare(ctx *interpolate.Context, opts ...PrepareOption) []error {
 	if ctx != nil {
 		c.ctx = *ctx
 	}
+	var o prepareOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	var errs []error
 
+	// Fold alias/deprecated option names into their canonical fields
+	warnings, aliasErrs := c.applyAliases()
+	c.warnings = warnings
+	errs = append(errs, aliasErrs...)
+
+	// Render template expressions in string fields, unless config.Decode
+	// already did
+	if o.interpolate {
+		errs = append(errs, c.interpolate()...)
+	}
+
 	// Apply defaults for unset values
 	if c.PSRPPort == 0 {
 		c.PSRPPort = 5985
@@ -101,18 +455,71 @@ func (c *Config) Prepare(ctx *interpolate.Context) []error {
 	if c.PSRPTimeout == 0 {
 		c.PSRPTimeout = 5 * time.Minute
 	}
+	if c.PSRPConnectAttemptTimeout == 0 {
+		c.PSRPConnectAttemptTimeout = 2 * time.Minute
+	}
+	if c.PSRPOperationTimeout == 0 {
+		c.PSRPOperationTimeout = 5 * time.Minute
+	}
+	if c.PSRPLivenessInterval == 0 {
+		c.PSRPLivenessInterval = time.Minute
+	}
+	if c.PSRPRetryInterval == 0 {
+		c.PSRPRetryInterval = 5 * time.Second
+	}
+	if c.PSRPRetryMaxInterval == 0 {
+		c.PSRPRetryMaxInterval = 30 * time.Second
+	}
 	if c.PSRPTransport == "" {
 		c.PSRPTransport = TransportWSMan
 	}
 	if c.PSRPAuthType == "" {
 		c.PSRPAuthType = AuthNegotiate
 	}
+	if c.PSRPWSManPath == "" {
+		c.PSRPWSManPath = DefaultWSManPath
+	}
+	if !strings.HasPrefix(c.PSRPWSManPath, "/") {
+		c.PSRPWSManPath = "/" + c.PSRPWSManPath
+	}
+	if c.PSRPMaxEnvelopeSize == 0 {
+		c.PSRPMaxEnvelopeSize = DefaultMaxEnvelopeSize
+	}
+	if c.PSRPSSHTunnelHost != "" && c.PSRPSSHTunnelPort == 0 {
+		c.PSRPSSHTunnelPort = 22
+	}
+
+	// Resolve password references before anything inspects the password
+	if c.PSRPPasswordFile != "" {
+		if c.PSRPPassword != "" {
+			errs = append(errs, errors.New("only one of psrp_password or psrp_password_file may be set"))
+		} else if password, err := readSecretFile(c.PSRPPasswordFile); err != nil {
+			errs = append(errs, fmt.Errorf("psrp_password_file: %w", err))
+		} else {
+			c.PSRPPassword = password
+		}
+	} else if password, err := resolveSecret(c.PSRPPassword); err != nil {
+		errs = append(errs, fmt.Errorf("psrp_password: %w", err))
+	} else {
+		c.PSRPPassword = password
+	}
+	RegisterSecret(c.PSRPPassword)
+	if password, err := resolveSecret(c.PSRPSSHTunnelPassword); err != nil {
+		errs = append(errs, fmt.Errorf("psrp_ssh_tunnel_password: %w", err))
+	} else {
+		c.PSRPSSHTunnelPassword = password
+	}
+	RegisterSecret(c.PSRPSSHTunnelPassword)
+	if c.PSRPKeytabPath != "" {
+		registerKeytab(c.PSRPKeytabPath)
+	}
 
 	// Validate authentication type
 	switch c.PSRPAuthType {
 	case AuthBasic, AuthNTLM:
-		// Basic and NTLM always require explicit credentials (no SSO path)
-		if c.PSRPUsername == "" {
+		// Basic and NTLM always require explicit credentials (no SSO path),
+		// unless they are fetched at connect time.
+		if c.PSRPUsername == "" && c.credentialProvider() == nil {
 			errs = append(errs, errors.New("psrp_username is required for basic/ntlm authentication"))
 		}
 	case AuthKerberos, AuthNegotiate:
@@ -126,6 +533,28 @@ func (c *Config) Prepare(ctx *interpolate.Context) []error {
 		errs = append(errs, errors.New("psrp_auth_type must be 'basic', 'ntlm', 'kerberos', or 'negotiate'"))
 	}
 
+	errs = append(errs, c.validateNegotiateMechanisms()...)
+
+	// Machine/gMSA credentials are only available through SSPI SSO, which
+	// go-psrp triggers when no username is configured.
+	if c.PSRPUseMachineCredentials {
+		if c.PSRPAuthType != AuthKerberos && c.PSRPAuthType != AuthNegotiate {
+			errs = append(errs, errors.New("psrp_use_machine_credentials requires psrp_auth_type 'kerberos' or 'negotiate'"))
+		}
+		if c.PSRPUsername != "" || c.PSRPPassword != "" {
+			errs = append(errs, errors.New("psrp_use_machine_credentials cannot be combined with psrp_username or psrp_password"))
+		}
+		if c.PSRPKeytabPath != "" || c.PSRPCCachePath != "" {
+			errs = append(errs, errors.New("psrp_use_machine_credentials cannot be combined with psrp_keytab_path or psrp_ccache_path"))
+		}
+		if c.credentialProvider() != nil {
+			errs = append(errs, errors.New("psrp_use_machine_credentials cannot be combined with a credential helper"))
+		}
+		if !auth.SupportsSSO() {
+			errs = append(errs, errors.New("psrp_use_machine_credentials requires Windows (SSPI) on the Packer host"))
+		}
+	}
+
 	// Transport-specific validation
 	switch c.PSRPTransport {
 	case TransportWSMan:
@@ -137,16 +566,244 @@ func (c *Config) Prepare(ctx *interpolate.Context) []error {
 			c.PSRPPort = 5986
 		}
 	case TransportHvSocket:
-		if c.PSRPVMID == "" {
-			errs = append(errs, errors.New("psrp_vmid is required for hvsock transport"))
+		if c.PSRPVMID == "" && c.PSRPVMName == "" && c.PSRPContainerID == "" {
+			errs = append(errs, errors.New("one of psrp_vmid, psrp_vm_name or psrp_container_id is required for hvsock transport"))
+		}
+	case TransportNamedPipe:
+		if (c.PSRPPipeName == "") == (c.PSRPPipeProcessID == 0) {
+			errs = append(errs, errors.New("one of psrp_pipe_name or psrp_pipe_process_id is required for namedpipe transport"))
+		}
+		if c.PSRPPipeProcessID < 0 {
+			errs = append(errs, errors.New("psrp_pipe_process_id must not be negative"))
+		}
+	case TransportSSH:
+		if c.PSRPHost == "" {
+			errs = append(errs, errors.New("psrp_host is required for ssh transport"))
+		}
+		if c.PSRPPort == 5985 {
+			c.PSRPPort = 22
+		}
+		if c.PSRPSSHSubsystem == "" {
+			c.PSRPSSHSubsystem = DefaultSSHSubsystem
+		}
+		if c.PSRPUsername == "" && c.credentialProvider() == nil {
+			errs = append(errs, errors.New("psrp_username is required for ssh transport"))
+		}
+		if c.PSRPPassword == "" && c.PSRPSSHPrivateKeyFile == "" && !c.PSRPSSHAgentAuth && c.credentialProvider() == nil {
+			errs = append(errs, errors.New("one of psrp_password, psrp_ssh_private_key_file or psrp_ssh_agent_auth is required for ssh transport"))
 		}
 	default:
-		errs = append(errs, errors.New("psrp_transport must be 'wsman' or 'hvsock'"))
+		errs = append(errs, errors.New("psrp_transport must be 'wsman', 'hvsock', 'namedpipe' or 'ssh'"))
+	}
+
+	if c.PSRPTargetOS == "" {
+		c.PSRPTargetOS = TargetWindows
+	}
+	switch c.PSRPTargetOS {
+	case TargetWindows, TargetLinux, TargetMacOS:
+	default:
+		errs = append(errs, errors.New("psrp_target_os must be 'windows', 'linux' or 'macos'"))
+	}
+
+	switch c.PSRPPendingReboot {
+	case "", PendingRebootIgnore, PendingRebootWarn, PendingRebootWait, PendingRebootRestart:
+	default:
+		errs = append(errs, errors.New("psrp_pending_reboot must be 'ignore', 'warn', 'wait', or 'restart'"))
+	}
+
+	if c.PSRPResumeOnDisconnect && c.PSRPResumeTimeout == 0 {
+		c.PSRPResumeTimeout = 5 * time.Minute
+	}
+	if c.PSRPResumeTimeout < 0 {
+		errs = append(errs, errors.New("psrp_resume_timeout must not be negative"))
+	}
+	if c.PSRPPostConnectScript != "" && c.PSRPPostConnectTimeout == 0 {
+		c.PSRPPostConnectTimeout = c.PSRPTimeout
+	}
+	if c.PSRPPostConnectTimeout < 0 {
+		errs = append(errs, errors.New("psrp_post_connect_timeout must not be negative"))
+	}
+	if c.PSRPWatchdogInterval < 0 {
+		errs = append(errs, errors.New("psrp_watchdog_interval must not be negative"))
+	}
+
+	// Retry policy
+	if c.PSRPConnectAttemptTimeout < 0 {
+		errs = append(errs, errors.New("psrp_connect_attempt_timeout must not be negative"))
+	}
+	if c.PSRPOperationTimeout < 0 {
+		errs = append(errs, errors.New("psrp_operation_timeout must not be negative"))
+	}
+	if c.PSRPHeartbeatInterval < 0 {
+		errs = append(errs, errors.New("psrp_heartbeat_interval must not be negative"))
+	}
+	if c.PSRPLivenessInterval < 0 {
+		errs = append(errs, errors.New("psrp_command_liveness_interval must not be negative"))
+	}
+	if c.PSRPMaxRetries < 0 {
+		errs = append(errs, errors.New("psrp_max_retries must not be negative"))
+	}
+	if c.PSRPRetryInterval < 0 || c.PSRPRetryMaxInterval < 0 {
+		errs = append(errs, errors.New("psrp_retry_interval and psrp_retry_max_interval must not be negative"))
+	} else if c.PSRPRetryMaxInterval < c.PSRPRetryInterval {
+		errs = append(errs, errors.New("psrp_retry_max_interval must not be less than psrp_retry_interval"))
+	}
+	if c.PSRPRetryJitter < 0 || c.PSRPRetryJitter > 1 {
+		errs = append(errs, errors.New("psrp_retry_jitter must be between 0 and 1"))
+	}
+	switch c.PSRPRetryBackoff {
+	case "":
+		c.PSRPRetryBackoff = BackoffExponential
+	case BackoffConstant, BackoffExponential, BackoffFibonacci:
+	default:
+		errs = append(errs, errors.New("psrp_retry_backoff must be 'constant', 'exponential', or 'fibonacci'"))
+	}
+	if c.PSRPTransferRetries < 0 {
+		errs = append(errs, errors.New("psrp_transfer_retries must not be negative"))
+	}
+
+	// go-psrp expects an ISO 8601 idle timeout; accept Go durations too
+	if c.PSRPIdleTimeout != "" {
+		if idle, err := toISO8601Duration(c.PSRPIdleTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("psrp_idle_timeout: %w", err))
+		} else {
+			c.PSRPIdleTimeout = idle
+		}
+	}
+
+	// Culture names are embedded in scripts, so restrict them to BCP 47 shapes
+	if c.PSRPLocale != "" && !cultureNameRe.MatchString(c.PSRPLocale) {
+		errs = append(errs, fmt.Errorf("psrp_locale %q is not a valid culture name (e.g. 'en-US')", c.PSRPLocale))
+	}
+	if c.PSRPUICulture != "" && !cultureNameRe.MatchString(c.PSRPUICulture) {
+		errs = append(errs, fmt.Errorf("psrp_ui_culture %q is not a valid culture name (e.g. 'en-US')", c.PSRPUICulture))
 	}
 
+	// Transfer sizing
+	if c.PSRPMaxEnvelopeSize*1024 <= envelopeOverhead {
+		errs = append(errs, fmt.Errorf("psrp_max_envelope_size must be greater than %d (KB)", envelopeOverhead/1024))
+	}
+	if c.PSRPUploadChunkSize < 0 {
+		errs = append(errs, errors.New("psrp_upload_chunk_size must not be negative"))
+	} else if c.PSRPUploadChunkSize > 0 && c.PSRPMaxEnvelopeSize*1024 > envelopeOverhead &&
+		c.PSRPUploadChunkSize > c.maxUploadChunkSize() {
+		errs = append(errs, fmt.Errorf("psrp_upload_chunk_size %d exceeds the %d bytes that fit in a %d KB envelope",
+			c.PSRPUploadChunkSize, c.maxUploadChunkSize(), c.PSRPMaxEnvelopeSize))
+	}
+
+	// Certificate pinning replaces chain verification, so it needs TLS
+	if c.PSRPTLSFingerprint != "" {
+		c.PSRPTLSFingerprint = normalizeFingerprint(c.PSRPTLSFingerprint)
+		if !validFingerprint(c.PSRPTLSFingerprint) {
+			errs = append(errs, errors.New("psrp_tls_fingerprint must be a SHA-256 hex digest"))
+		}
+	}
+	if (c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse) && !c.PSRPUseTLS {
+		errs = append(errs, errors.New("psrp_tls_fingerprint and psrp_tls_tofu require psrp_use_tls"))
+	}
+	if c.PSRPTLSServerName != "" && !c.PSRPUseTLS {
+		errs = append(errs, errors.New("psrp_tls_server_name requires psrp_use_tls"))
+	}
+
+	// Cross-field checks
+	comboWarnings, comboErrs := c.validateCombinations()
+	c.warnings = append(c.warnings, comboWarnings...)
+	errs = append(errs, comboErrs...)
+
+	return errs
+}
+
+// Warnings returns non-fatal issues found by the last Prepare call, such as
+// deprecated option names. Builders should return them from their Prepare so
+// Packer shows them in the UI.
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// interpolate renders template expressions (e.g. {{ .HTTPIP }} or user
+// variables) in the string fields, in place.
+func (c *Config) interpolate() []error {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"psrp_host", &c.PSRPHost},
+		{"psrp_username", &c.PSRPUsername},
+		{"psrp_password", &c.PSRPPassword},
+		{"psrp_password_file", &c.PSRPPasswordFile},
+		{"psrp_vmid", &c.PSRPVMID},
+		{"psrp_vm_name", &c.PSRPVMName},
+		{"psrp_configuration_name", &c.PSRPConfigurationName},
+		{"psrp_container_id", &c.PSRPContainerID},
+		{"psrp_wsman_path", &c.PSRPWSManPath},
+		{"psrp_tls_server_name", &c.PSRPTLSServerName},
+		{"psrp_pipe_name", &c.PSRPPipeName},
+		{"psrp_ssh_private_key_file", &c.PSRPSSHPrivateKeyFile},
+		{"psrp_ssh_known_hosts", &c.PSRPSSHKnownHosts},
+		{"psrp_ssh_subsystem", &c.PSRPSSHSubsystem},
+		{"psrp_domain", &c.PSRPDomain},
+		{"psrp_realm", &c.PSRPRealm},
+		{"psrp_krb5_conf_path", &c.PSRPKrb5ConfPath},
+		{"psrp_keytab_path", &c.PSRPKeytabPath},
+		{"psrp_ccache_path", &c.PSRPCCachePath},
+		{"psrp_idle_timeout", &c.PSRPIdleTimeout},
+		{"psrp_locale", &c.PSRPLocale},
+		{"psrp_ui_culture", &c.PSRPUICulture},
+		{"psrp_ssh_tunnel_host", &c.PSRPSSHTunnelHost},
+		{"psrp_ssh_tunnel_username", &c.PSRPSSHTunnelUsername},
+		{"psrp_ssh_tunnel_password", &c.PSRPSSHTunnelPassword},
+		{"psrp_ssh_tunnel_private_key_file", &c.PSRPSSHTunnelKeyFile},
+		{"psrp_ssh_tunnel_known_hosts", &c.PSRPSSHTunnelKnownHosts},
+		{"psrp_trace_file", &c.PSRPTraceFile},
+		{"psrp_event_log_file", &c.PSRPEventLogFile},
+		{"psrp_flight_recorder_dir", &c.PSRPFlightRecorderDir},
+		{"psrp_transcript_dir", &c.PSRPTranscriptDir},
+	}
+
+	var errs []error
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+		rendered, err := interpolate.Render(*f.value, &c.ctx)
+		if err != nil {
+			// Don't echo the value: it may be a password
+			errs = append(errs, fmt.Errorf("error interpolating %s: %w", f.name, err))
+			continue
+		}
+		*f.value = rendered
+	}
+	for i, arg := range c.PSRPCredentialHelper {
+		rendered, err := interpolate.Render(arg, &c.ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error interpolating psrp_credential_helper[%d]: %w", i, err))
+			continue
+		}
+		c.PSRPCredentialHelper[i] = rendered
+	}
 	return errs
 }
 
+// maxUploadChunkSize returns the largest raw chunk that fits in one request
+// envelope. Chunk data is base64-encoded into the upload script, and the
+// serialized pipeline is base64-encoded again inside the SOAP body, so each
+// raw byte costs roughly 16/9 bytes on the wire.
+func (c *Config) maxUploadChunkSize() int {
+	envelope := c.PSRPMaxEnvelopeSize
+	if envelope <= 0 {
+		envelope = DefaultMaxEnvelopeSize
+	}
+	return (envelope*1024 - envelopeOverhead) * 9 / 16
+}
+
+// UploadChunkSize returns the number of raw bytes sent per upload request.
+func (c *Config) UploadChunkSize() int {
+	if c.PSRPUploadChunkSize > 0 {
+		return c.PSRPUploadChunkSize
+	}
+	return c.maxUploadChunkSize()
+}
+
 // ToGoPSRPConfig converts the Packer config to a go-psrp client.Config.
 // Returns by value to match client.New(hostname, Config) signature.
 func (c *Config) ToGoPSRPConfig() client.Config {
@@ -158,6 +815,10 @@ func (c *Config) ToGoPSRPConfig() client.Config {
 	cfg.Port = c.PSRPPort
 	cfg.UseTLS = c.PSRPUseTLS
 	cfg.InsecureSkipVerify = c.PSRPInsecureSkipVerify
+	if c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse {
+		// The authFront checks the fingerprint instead of the chain
+		cfg.InsecureSkipVerify = true
+	}
 	cfg.Timeout = c.PSRPTimeout
 
 	// Transport
@@ -172,9 +833,9 @@ func (c *Config) ToGoPSRPConfig() client.Config {
 
 	// Authentication
 	// On Windows, Kerberos/Negotiate use SSPI natively when Username is empty
-	// (SSO with logged-in user). The Krb5/Keytab/CCachePath fields are for
-	// the Unix gokrb5 (pure Go) path, or Windows fallback when SSPI isn't used.
-	switch c.PSRPAuthType {
+	// (SSO with logged-in user), and with the given credentials otherwise. The
+	// Krb5/Keytab/CCachePath fields are for the Unix gokrb5 (pure Go) path.
+	switch c.effectiveAuthType() {
 	case AuthBasic:
 		cfg.AuthType = client.AuthBasic
 	case AuthNTLM:
@@ -196,6 +857,13 @@ func (c *Config) ToGoPSRPConfig() client.Config {
 		cfg.CCachePath = c.PSRPCCachePath
 	}
 
+	// Machine credentials: an empty username makes go-psrp use SSPI SSO with
+	// the process identity (machine account or gMSA).
+	if c.PSRPUseMachineCredentials {
+		cfg.Username = ""
+		cfg.Password = ""
+	}
+
 	// Advanced settings
 	cfg.IdleTimeout = c.PSRPIdleTimeout
 	cfg.MaxRunspaces = c.PSRPMaxRunspaces
@@ -204,3 +872,30 @@ func (c *Config) ToGoPSRPConfig() client.Config {
 
 	return cfg
 }
+
+// Endpoint returns the connection target passed to go-psrp for the given host.
+// go-psrp builds "<scheme>://host:port/wsman" itself, so for the default path
+// the bare host is returned. A custom psrp_wsman_path (e.g. WinRM behind a
+// reverse proxy) is expressed as a full URL, which go-psrp uses verbatim.
+func (c *Config) Endpoint(host string) string {
+	if c.PSRPTransport != TransportWSMan || c.PSRPWSManPath == "" || c.PSRPWSManPath == DefaultWSManPath {
+		return host
+	}
+	return c.EndpointURL(host)
+}
+
+// EndpointURL returns the full WSMan URL for host.
+func (c *Config) EndpointURL(host string) string {
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		return host
+	}
+	scheme := "http"
+	if c.PSRPUseTLS {
+		scheme = "https"
+	}
+	path := c.PSRPWSManPath
+	if path == "" {
+		path = DefaultWSManPath
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(c.PSRPPort)), path)
+}
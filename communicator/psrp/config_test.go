@@ -0,0 +1,109 @@
+package psrp
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestUploadChunkFitsEnvelope checks that a chunk of the derived size, once
+// base64-encoded into the upload script and encoded again into the SOAP
+// body, leaves envelopeOverhead free in the envelope.
+func TestUploadChunkFitsEnvelope(t *testing.T) {
+	for _, kb := range []int{32, 64, 150, DefaultMaxEnvelopeSize, 8192} {
+		c := NewConfig()
+		c.PSRPMaxEnvelopeSize = kb
+
+		n := c.UploadChunkSize()
+		if n <= 0 {
+			t.Errorf("%d KB: chunk size %d", kb, n)
+			continue
+		}
+		wire := base64.StdEncoding.EncodedLen(base64.StdEncoding.EncodedLen(n))
+		if wire+envelopeOverhead > kb*1024 {
+			t.Errorf("%d KB: a %d byte chunk takes %d bytes on the wire, leaving less than %d for the envelope",
+				kb, n, wire, envelopeOverhead)
+		}
+	}
+}
+
+func TestUploadChunkSizeExplicit(t *testing.T) {
+	c := NewConfig()
+	c.PSRPUploadChunkSize = 4096
+	if got := c.UploadChunkSize(); got != 4096 {
+		t.Errorf("UploadChunkSize() = %d, want 4096", got)
+	}
+
+	c.PSRPUploadChunkSize = c.maxUploadChunkSize() + 1
+	if !hasError(c.Prepare(nil), "exceeds the") {
+		t.Errorf("Prepare accepted psrp_upload_chunk_size %d over the envelope", c.PSRPUploadChunkSize)
+	}
+
+	c = NewConfig()
+	c.PSRPMaxEnvelopeSize = envelopeOverhead / 1024
+	if !hasError(c.Prepare(nil), "psrp_max_envelope_size must be greater") {
+		t.Errorf("Prepare accepted a %d KB envelope", c.PSRPMaxEnvelopeSize)
+	}
+}
+
+func hasError(errs []error, substr string) bool {
+	for _, err := range errs {
+		if strings.Contains(err.Error(), substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepare must not render templates a second time: config.Decode already
+// did, and a rendered password may contain "{{".
+func TestPrepareInterpolation(t *testing.T) {
+	c := NewConfig()
+	c.PSRPHost = "win.example.com"
+	c.PSRPPassword = "p{{ass"
+	if errs := c.Prepare(nil); len(errs) > 0 {
+		t.Fatalf("Prepare: %v", errs)
+	}
+	if c.PSRPPassword != "p{{ass" {
+		t.Errorf("password rendered to %q", c.PSRPPassword)
+	}
+
+	c = NewConfig()
+	c.PSRPHost = "{{ `win.example.com` }}"
+	if errs := c.Prepare(nil, WithInterpolation()); len(errs) > 0 {
+		t.Fatalf("Prepare: %v", errs)
+	}
+	if c.PSRPHost != "win.example.com" {
+		t.Errorf("WithInterpolation left host %q", c.PSRPHost)
+	}
+}
+
+// psrp_tls_server_name must be verified in the handshakes that carry the
+// session, not only in a check before them: go-psrp can't verify against
+// it, so the connections go through the auth front, which does.
+func TestTLSServerNameVerified(t *testing.T) {
+	c := NewConfig()
+	c.PSRPHost = "192.0.2.10"
+	c.PSRPUsername = "user"
+	c.PSRPPassword = "pass"
+	c.PSRPUseTLS = true
+	c.PSRPAuthType = AuthBasic
+	c.PSRPTLSServerName = "win.example.com"
+	if errs := c.Prepare(nil); len(errs) > 0 {
+		t.Fatalf("Prepare: %v", errs)
+	}
+
+	if !c.useAuthFront() {
+		t.Fatal("psrp_tls_server_name with basic auth doesn't use the auth front")
+	}
+	if c.ToGoPSRPConfig().InsecureSkipVerify {
+		t.Error("psrp_tls_server_name turns off go-psrp's certificate verification")
+	}
+	f := &authFront{url: &url.URL{Scheme: "https", Host: "192.0.2.10:5986"}, config: c}
+	tlsConfig := f.tlsConfig()
+	if tlsConfig.ServerName != "win.example.com" || tlsConfig.InsecureSkipVerify {
+		t.Errorf("auth front verifies against %q (skip %v), want \"win.example.com\"",
+			tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+	}
+}
@@ -0,0 +1,95 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+)
+
+// ConnectionInfo describes how the session was actually established. The
+// transport and TLS fields come from the local configuration; the rest is
+// reported by the server for this session, since go-psrp doesn't expose
+// what was negotiated.
+type ConnectionInfo struct {
+	Endpoint  string        `json:"endpoint"`
+	Transport TransportType `json:"transport"`
+
+	// TLS state of the WSMan connection
+	TLS            bool `json:"tls"`
+	TLSVerified    bool `json:"tls_verified"`    // chain verified by the TLS stack, or against psrp_tls_server_name
+	TLSFingerprint bool `json:"tls_fingerprint"` // certificate checked against a pinned/TOFU fingerprint
+
+	// Server-reported ($PSSenderInfo / $PSVersionTable)
+	AuthMechanism     string `json:"auth_mechanism"` // e.g. "Kerberos", "NTLM", "Basic"
+	User              string `json:"user"`
+	ConfigurationName string `json:"configuration_name"`
+	ProtocolVersion   string `json:"protocol_version"`
+	PSVersion         string `json:"ps_version"`
+}
+
+// String returns a one-line summary for logs.
+func (i ConnectionInfo) String() string {
+	tls := "no TLS"
+	switch {
+	case i.TLS && i.TLSFingerprint:
+		tls = "TLS (fingerprint)"
+	case i.TLS && i.TLSVerified:
+		tls = "TLS (verified)"
+	case i.TLS:
+		tls = "TLS (unverified)"
+	}
+	return fmt.Sprintf("%s via %s, %s, auth %s as %s, configuration %s, protocol %s, PowerShell %s",
+		i.Endpoint, i.Transport, tls, i.AuthMechanism, i.User, i.ConfigurationName, i.ProtocolVersion, i.PSVersion)
+}
+
+const connectionInfoScript = `
+$id = if ($PSSenderInfo) { $PSSenderInfo.UserInfo.Identity } else { $null }
+[pscustomobject]@{
+	auth_mechanism     = if ($id) { "$($id.AuthenticationType)" } else { '' }
+	user               = if ($id) { "$($id.Name)" } else { [System.Security.Principal.WindowsIdentity]::GetCurrent().Name }
+	configuration_name = if ($PSSenderInfo) { "$($PSSenderInfo.ConfigurationName)" } else { '' }
+	protocol_version   = "$($PSVersionTable.PSRemotingProtocolVersion)"
+	ps_version         = $PSVersionTable.PSVersion.ToString()
+} | ConvertTo-Json -Compress
+`
+
+// QueryConnectionInfo asks the server how this session was established
+// and caches the result for ConnectionInfo.
+func (c *Communicator) QueryConnectionInfo(ctx context.Context) (ConnectionInfo, error) {
+	var remote ConnectionInfo
+	if err := c.queryJSON(ctx, connectionInfoScript, &remote); err != nil {
+		return c.ConnectionInfo(), fmt.Errorf("failed to query connection info: %w", err)
+	}
+
+	c.mu.Lock()
+	c.remoteInfo = &remote
+	c.mu.Unlock()
+	return c.ConnectionInfo(), nil
+}
+
+// ConnectionInfo returns the connection details. Server-reported fields are
+// empty until QueryConnectionInfo has run (StepConnect runs it after
+// connecting).
+func (c *Communicator) ConnectionInfo() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var info ConnectionInfo
+	if c.remoteInfo != nil {
+		info = *c.remoteInfo
+	}
+	if c.front != nil {
+		// go-psrp only knows the front's loopback address
+		info.Endpoint = c.front.url.String()
+	} else if e, ok := c.client.(interface{ Endpoint() string }); ok {
+		info.Endpoint = e.Endpoint()
+	} else if c.config != nil {
+		info.Endpoint = c.config.Endpoint(c.target)
+	}
+	if c.config != nil {
+		info.Transport = c.config.PSRPTransport
+		info.TLS = c.config.PSRPUseTLS && c.config.PSRPTransport == TransportWSMan
+		info.TLSFingerprint = info.TLS && (c.config.PSRPTLSFingerprint != "" || c.config.PSRPTLSTrustOnFirstUse)
+		info.TLSVerified = info.TLS && !c.config.ToGoPSRPConfig().InsecureSkipVerify
+	}
+	return info
+}
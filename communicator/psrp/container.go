@@ -0,0 +1,79 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DefaultContainerExecCommand starts a program in a container with the
+// docker CLI, returning once it is running.
+var DefaultContainerExecCommand = []string{"docker", "exec", "--detach"}
+
+// containerExec starts argv in the psrp_container_id container with
+// psrp_container_exec_command.
+func (c *Config) containerExec(ctx context.Context, argv []string) error {
+	command := c.PSRPContainerExecCommand
+	if len(command) == 0 {
+		command = DefaultContainerExecCommand
+	}
+	args := append(append(append([]string{}, command[1:]...), c.PSRPContainerID), argv...)
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", strings.Join(command, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// containerVMID returns the ID of the utility VM of psrp_container_id:
+// psrp_vmid if set, otherwise the container's RuntimeId from the Host
+// Compute Service.
+func (c *Config) containerVMID(ctx context.Context) (uuid.UUID, error) {
+	if c.PSRPVMID != "" {
+		return uuid.Parse(c.PSRPVMID)
+	}
+
+	// Docker prints short IDs; the Host Compute Service knows the full one
+	script := fmt.Sprintf("@(Get-ComputeProcess -ErrorAction Stop | Where-Object Id -like '%s*')[0].RuntimeId",
+		strings.ReplaceAll(c.PSRPContainerID, "'", "''"))
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("Get-ComputeProcess %q failed: %w: %s", c.PSRPContainerID, err, strings.TrimSpace(stderr.String()))
+	}
+
+	id, err := uuid.Parse(strings.TrimSpace(string(out)))
+	if err != nil || id == uuid.Nil {
+		return uuid.Nil, fmt.Errorf("found no Hyper-V-isolated container %q; check psrp_container_id, and use psrp_transport 'namedpipe' for process-isolated containers", c.PSRPContainerID)
+	}
+	logger.Info("resolved container utility VM", "container_id", c.PSRPContainerID, "vm_id", id)
+	return id, nil
+}
+
+// validateContainer checks psrp_container_id against the other hvsock
+// options.
+func (c *Config) validateContainer() (warnings []string, errs []error) {
+	if c.PSRPVMName != "" {
+		errs = append(errs, errors.New("psrp_vm_name cannot be combined with psrp_container_id"))
+	}
+	if c.PSRPVMID != "" {
+		if _, err := uuid.Parse(c.PSRPVMID); err != nil {
+			errs = append(errs, fmt.Errorf("psrp_vmid must be the container's utility VM ID: %w", err))
+		}
+	}
+	if c.PSRPConfigurationName != "" {
+		errs = append(errs, errors.New("psrp_configuration_name cannot be used with psrp_container_id; containers have no session configurations"))
+	}
+	if c.PSRPUsername != "" || c.PSRPPassword != "" {
+		warnings = append(warnings, "psrp_username and psrp_password are ignored with psrp_container_id; the container runtime authorizes the connection")
+	}
+	return warnings, errs
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package psrp
+
+import "errors"
+
+// newContainerClient fails off Windows: Hyper-V sockets need a Windows
+// container host.
+func newContainerClient(string, *Config) (PSRPClient, error) {
+	return nil, errors.New("psrp_container_id requires Packer to run on the Windows container host")
+}
@@ -0,0 +1,64 @@
+//go:build windows
+
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smnsjas/go-psrp/hvsock"
+)
+
+// containerServerStart bounds the wait for PowerShell in the container to
+// start listening on its Hyper-V socket.
+const containerServerStart = 30 * time.Second
+
+// containerPowerShell is the command PowerShell itself runs in a
+// Hyper-V-isolated container for Enter-PSSession -ContainerId: it serves
+// one session on the utility VM's PowerShell Direct service.
+var containerPowerShell = []string{"powershell.exe", "-NoLogo", "-so"}
+
+// newContainerClient is the ClientFactory for hvsock with psrp_container_id:
+// PowerShell Direct to a Hyper-V-isolated Windows container. The container
+// runs in a utility VM; PowerShell is started in the container and reached
+// on the utility VM's PowerShell service directly. There is no broker and
+// no credential exchange, as the container runtime already authorized the
+// caller. The target is unused.
+func newContainerClient(_ string, config *Config) (PSRPClient, error) {
+	return newOutOfProcClient("container Hyper-V socket", func(ctx context.Context) (io.ReadWriteCloser, error) {
+		// The utility VM changes when the container restarts, so it is looked
+		// up on every connection
+		vmID, err := config.containerVMID(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := config.containerExec(ctx, containerPowerShell); err != nil {
+			return nil, fmt.Errorf("failed to start PowerShell in container %s: %w", config.PSRPContainerID, err)
+		}
+		return dialContainer(ctx, vmID)
+	}), nil
+}
+
+// dialContainer connects to the PowerShell service of the utility VM,
+// retrying while the PowerShell just started in the container comes up.
+func dialContainer(ctx context.Context, vmID uuid.UUID) (io.ReadWriteCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, containerServerStart)
+	defer cancel()
+	for {
+		conn, err := hvsock.DialService(ctx, vmID, hvsock.PsrpServerServiceID)
+		if err == nil {
+			return conn, nil
+		}
+		logger.Debug("container PowerShell not listening yet", "utility_vm", vmID, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to connect to PowerShell in utility VM %s: %w", vmID, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package psrp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Credentials are the values a CredentialProvider may supply. Empty fields
+// leave the corresponding Config value unchanged.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Domain   string `json:"domain"`
+}
+
+// CredentialProvider fetches credentials just before a connection attempt,
+// e.g. a short-lived local admin password stored in Vault or SSM.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (*Credentials, error)
+}
+
+// CredentialProviderFunc adapts a function to the CredentialProvider interface.
+type CredentialProviderFunc func(ctx context.Context) (*Credentials, error)
+
+// Credentials calls f(ctx).
+func (f CredentialProviderFunc) Credentials(ctx context.Context) (*Credentials, error) {
+	return f(ctx)
+}
+
+// ExecCredentialHelper runs an external command and parses its stdout as
+// credentials. Output may be a JSON object with "username", "password" and
+// "domain" keys, or a bare password.
+type ExecCredentialHelper struct {
+	Command []string
+}
+
+// Credentials runs the helper command.
+func (h *ExecCredentialHelper) Credentials(ctx context.Context) (*Credentials, error) {
+	if len(h.Command) == 0 {
+		return nil, errors.New("credential helper command is empty")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// stderr is included for diagnostics; stdout may hold the secret.
+		return nil, fmt.Errorf("credential helper %s failed: %w: %s",
+			h.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 {
+		return nil, fmt.Errorf("credential helper %s produced no output", h.Command[0])
+	}
+
+	if out[0] == '{' {
+		var creds Credentials
+		if err := json.Unmarshal(out, &creds); err != nil {
+			return nil, fmt.Errorf("credential helper %s returned invalid JSON", h.Command[0])
+		}
+		return &creds, nil
+	}
+	return &Credentials{Password: string(out)}, nil
+}
+
+// credentialProvider returns the provider configured for c, if any. An
+// explicitly set CredentialProvider takes precedence over psrp_credential_helper.
+func (c *Config) credentialProvider() CredentialProvider {
+	if c.CredentialProvider != nil {
+		return c.CredentialProvider
+	}
+	if len(c.PSRPCredentialHelper) > 0 {
+		return &ExecCredentialHelper{Command: c.PSRPCredentialHelper}
+	}
+	return nil
+}
+
+// WithResolvedCredentials returns a copy of c with credentials from the
+// configured provider applied. When no provider is configured c is returned
+// unchanged. The receiver is never modified, so fetched secrets don't
+// outlive the connection that needed them.
+func (c *Config) WithResolvedCredentials(ctx context.Context) (*Config, error) {
+	provider := c.credentialProvider()
+	if provider == nil {
+		return c, nil
+	}
+
+	creds, err := provider.Credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch PSRP credentials: %w", err)
+	}
+	if creds == nil {
+		return nil, errors.New("credential provider returned no credentials")
+	}
+
+	resolved := *c
+	if creds.Username != "" {
+		resolved.PSRPUsername = creds.Username
+	}
+	if creds.Password != "" {
+		RegisterSecret(creds.Password)
+		resolved.PSRPPassword = creds.Password
+	}
+	if creds.Domain != "" {
+		resolved.PSRPDomain = creds.Domain
+	}
+	return &resolved, nil
+}
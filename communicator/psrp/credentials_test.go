@@ -0,0 +1,39 @@
+package psrp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// CredentialProvider is set from Go, not HCL; packer-sdc must not put it in
+// the generated FlatConfig specs, which can't decode an interface.
+func TestCredentialProviderSkippedInHCL2Spec(t *testing.T) {
+	field, ok := reflect.TypeOf(Config{}).FieldByName("CredentialProvider")
+	if !ok {
+		t.Fatal("Config has no CredentialProvider field")
+	}
+	if got := field.Tag.Get("mapstructure-to-hcl2"); got != ",skip" {
+		t.Errorf("mapstructure-to-hcl2 tag = %q, want \",skip\"", got)
+	}
+}
+
+func TestWithResolvedCredentials(t *testing.T) {
+	config := NewConfig()
+	config.PSRPUsername = "Administrator"
+	config.PSRPPassword = "static"
+	config.CredentialProvider = CredentialProviderFunc(func(context.Context) (*Credentials, error) {
+		return &Credentials{Password: "rotated"}, nil
+	})
+
+	resolved, err := config.WithResolvedCredentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.PSRPUsername != "Administrator" || resolved.PSRPPassword != "rotated" {
+		t.Errorf("resolved %q/%q, want Administrator/rotated", resolved.PSRPUsername, resolved.PSRPPassword)
+	}
+	if config.PSRPPassword != "static" {
+		t.Errorf("receiver password changed to %q", config.PSRPPassword)
+	}
+}
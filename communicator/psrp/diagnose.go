@@ -0,0 +1,405 @@
+package psrp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CheckStatus is the outcome of a diagnostic check.
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckFail CheckStatus = "fail"
+	CheckWarn CheckStatus = "warn" // failed, but the configuration doesn't depend on it
+	CheckSkip CheckStatus = "skip"
+)
+
+// Check is the result of one diagnostic check. Hint says how to fix a
+// failure or warning.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+	Hint   string
+}
+
+// diagnoseConnectTimeout bounds each authentication attempt.
+const diagnoseConnectTimeout = 30 * time.Second
+
+// diagnosis collects check results against one target.
+type diagnosis struct {
+	config *Config
+	host   string
+	checks []Check
+}
+
+func (d *diagnosis) pass(name, detail string) {
+	d.checks = append(d.checks, Check{Name: name, Status: CheckPass, Detail: detail})
+}
+
+func (d *diagnosis) fail(name, detail, hint string) {
+	d.checks = append(d.checks, Check{Name: name, Status: CheckFail, Detail: detail, Hint: hint})
+}
+
+func (d *diagnosis) warn(name, detail, hint string) {
+	d.checks = append(d.checks, Check{Name: name, Status: CheckWarn, Detail: detail, Hint: hint})
+}
+
+func (d *diagnosis) skip(name, detail string) {
+	d.checks = append(d.checks, Check{Name: name, Status: CheckSkip, Detail: detail})
+}
+
+// Diagnose runs a battery of checks against the target described by config
+// (DNS, TCP, TLS, each authentication mechanism, envelope size, the session
+// configuration and a transfer round-trip) and reports each outcome. Checks
+// stop at the first failure the rest depend on. config must be prepared.
+func Diagnose(ctx context.Context, config *Config) []Check {
+	d := &diagnosis{host: config.PSRPHost}
+
+	cfg, err := config.WithResolvedCredentials(ctx)
+	if err != nil {
+		d.fail("credentials", err.Error(), "check psrp_credential_helper")
+		return d.checks
+	}
+	if cfg.PSRPTransport == TransportHvSocket && cfg.PSRPVMID == "" && cfg.PSRPVMName != "" {
+		id, err := cfg.resolveVMID(ctx)
+		if err != nil {
+			d.fail("VM lookup", err.Error(), "check psrp_vm_name and that the VM exists on this Hyper-V host")
+			return d.checks
+		}
+		resolved := *cfg
+		resolved.PSRPVMID = id
+		cfg = &resolved
+	}
+	d.config = cfg
+
+	if cfg.PSRPTransport == TransportWSMan && !d.checkNetwork(ctx) {
+		return d.checks
+	}
+
+	comm := d.checkAuth(ctx)
+	if comm == nil {
+		return d.checks
+	}
+	defer comm.Close()
+
+	d.checkSessionConfiguration(ctx, comm)
+	d.checkEnvelopeSize(ctx, comm)
+	d.checkTransfer(ctx, comm)
+	return d.checks
+}
+
+// checkNetwork runs the WSMan reachability checks, and reports whether
+// authentication is worth attempting.
+func (d *diagnosis) checkNetwork(ctx context.Context) bool {
+	addr, err := d.config.probeAddr(d.host)
+	if err != nil {
+		d.fail("DNS", err.Error(), "set psrp_host")
+		return false
+	}
+	hostname, _, _ := net.SplitHostPort(addr)
+
+	if net.ParseIP(hostname) != nil {
+		d.skip("DNS", hostname+" is an IP address")
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		addrs, err := net.DefaultResolver.LookupHost(lookupCtx, hostname)
+		cancel()
+		if err != nil {
+			d.fail("DNS", err.Error(), classDNS.hint())
+			return false
+		}
+		d.pass("DNS", fmt.Sprintf("%s resolves to %s", hostname, strings.Join(addrs, ", ")))
+	}
+
+	if err := probeTCP(ctx, addr); err != nil {
+		d.fail("TCP", err.Error(), fmt.Sprintf("nothing accepted a connection on %s; check the WinRM listener "+
+			"(winrm enumerate winrm/config/listener), firewall rules for the port, and psrp_port", addr))
+		return false
+	}
+	d.pass("TCP", addr+" accepts connections")
+
+	if d.config.PSRPUseTLS {
+		name := hostname
+		if d.config.PSRPTLSServerName != "" {
+			name = d.config.PSRPTLSServerName
+		}
+		if !d.checkTLS(ctx, addr, name) {
+			return false
+		}
+	} else {
+		d.skip("TLS", "psrp_use_tls is not set")
+	}
+
+	endpoint := d.config.EndpointURL(d.host)
+	header, err := probeHTTPResponse(ctx, endpoint)
+	if err != nil {
+		d.fail("WSMan listener", err.Error(), "the port is open but doesn't answer WSMan requests; check psrp_use_tls "+
+			"matches the listener, and psrp_wsman_path")
+		return false
+	}
+	offered := header.Values("WWW-Authenticate")
+	for i, v := range offered {
+		offered[i], _, _ = strings.Cut(v, " ")
+	}
+	if len(offered) > 0 {
+		d.pass("WSMan listener", fmt.Sprintf("%s answers, offering %s", endpoint, strings.Join(offered, ", ")))
+	} else {
+		d.pass("WSMan listener", endpoint+" answers")
+	}
+
+	if d.config.PSRPAuthType == AuthKerberos || d.config.PSRPAuthType == AuthNegotiate {
+		msg, err := d.config.checkClockSkew(ctx, d.host)
+		switch {
+		case err != nil:
+			d.skip("clock skew", err.Error())
+		case msg != "":
+			d.fail("clock skew", msg, "sync the guest clock (w32tm /resync) or this machine's")
+		default:
+			d.pass("clock skew", "guest clock is within Kerberos tolerance")
+		}
+	}
+	return true
+}
+
+// checkTLS inspects the listener certificate and verifies it the way the
+// connection will: by pinned fingerprint, by chain and host name, or not at
+// all with psrp_insecure.
+func (d *diagnosis) checkTLS(ctx context.Context, addr, hostname string) bool {
+	dialCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	dialer := &tls.Dialer{Config: &tls.Config{
+		ServerName:         hostname,
+		InsecureSkipVerify: true, //nolint:gosec // verified below, as configured
+	}}
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		d.fail("TLS", err.Error(), classTLS.hint())
+		return false
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	conn.Close()
+	if len(state.PeerCertificates) == 0 {
+		d.fail("TLS", addr+" presented no certificate", classTLS.hint())
+		return false
+	}
+
+	cert := state.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	detail := fmt.Sprintf("%s, subject %q, issuer %q, expires %s, names %s, sha256 %s",
+		tls.VersionName(state.Version), cert.Subject.String(), cert.Issuer.String(),
+		cert.NotAfter.Format("2006-01-02"), strings.Join(certNames(cert), ", "), fingerprint)
+
+	switch {
+	case d.config.PSRPTLSFingerprint != "":
+		if want := normalizeFingerprint(d.config.PSRPTLSFingerprint); fingerprint != want {
+			d.fail("TLS", fmt.Sprintf("%s; does not match psrp_tls_fingerprint %s", detail, want),
+				"update psrp_tls_fingerprint if the listener certificate was replaced")
+			return false
+		}
+		d.pass("TLS", detail+"; matches psrp_tls_fingerprint")
+	case d.config.PSRPInsecureSkipVerify || d.config.PSRPTLSTrustOnFirstUse:
+		d.pass("TLS", detail+"; not verified (psrp_insecure or psrp_tls_tofu)")
+	default:
+		intermediates := x509.NewCertPool()
+		for _, c := range state.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: hostname, Intermediates: intermediates}); err != nil {
+			d.fail("TLS", fmt.Sprintf("%s; %s", detail, err), classTLS.hint()+
+				", or pin it with psrp_tls_fingerprint = \""+fingerprint+"\"")
+			return false
+		}
+		d.pass("TLS", detail+"; verified")
+	}
+
+	if time.Until(cert.NotAfter) < 30*24*time.Hour {
+		d.warn("TLS expiry", "certificate expires "+cert.NotAfter.Format(time.RFC3339), "renew the listener certificate")
+	}
+	return true
+}
+
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		names = append(names, "(none)")
+	}
+	return names
+}
+
+// checkAuth connects with the configured mechanism, then tries the others
+// to show which ones the target accepts; those only warn on failure. It returns the session opened with
+// the configured mechanism, or nil if that failed.
+func (d *diagnosis) checkAuth(ctx context.Context) *Communicator {
+	configured := d.config.PSRPAuthType
+	comm, err := d.connect(ctx, configured)
+	if err != nil {
+		d.fail("auth "+string(configured), err.Error(), d.authHint(err, configured))
+	} else {
+		d.pass("auth "+string(configured), "connected (configured mechanism)")
+	}
+
+	if d.config.PSRPTransport != TransportWSMan {
+		return comm
+	}
+	for _, auth := range []AuthType{AuthNegotiate, AuthKerberos, AuthNTLM, AuthBasic} {
+		if auth == configured {
+			continue
+		}
+		name := "auth " + string(auth)
+		if (auth == AuthNTLM || auth == AuthBasic) && d.config.PSRPUsername == "" {
+			d.skip(name, "needs psrp_username")
+			continue
+		}
+		if auth == AuthBasic && !d.config.PSRPUseTLS {
+			d.skip(name, "would send the password unencrypted over HTTP")
+			continue
+		}
+		other, err := d.connect(ctx, auth)
+		if err != nil {
+			d.warn(name, err.Error(), d.authHint(err, auth))
+			continue
+		}
+		other.Close()
+		d.pass(name, "connected")
+	}
+	return comm
+}
+
+func (d *diagnosis) authHint(err error, auth AuthType) string {
+	class := classifyConnectError(err)
+	if class == classAuth {
+		cfg := *d.config
+		cfg.PSRPAuthType = auth
+		return class.hint() + cfg.channelBindingHint()
+	}
+	if hint := class.hint(); hint != "" {
+		return hint
+	}
+	return "check that PowerShell remoting is enabled (Enable-PSRemoting) and the listener allows this mechanism " +
+		"(winrm get winrm/config/service/auth)"
+}
+
+// connect opens a session with the given auth mechanism.
+func (d *diagnosis) connect(ctx context.Context, auth AuthType) (*Communicator, error) {
+	cfg := *d.config
+	cfg.PSRPAuthType = auth
+
+	ctx, cancel := context.WithTimeout(ctx, diagnoseConnectTimeout)
+	defer cancel()
+
+	if err := cfg.verifyCertificate(ctx, d.host, new(string)); err != nil {
+		return nil, err
+	}
+	comm, err := New(d.host, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := comm.Connect(ctx); err != nil {
+		comm.Close()
+		return nil, err
+	}
+	return comm, nil
+}
+
+// checkSessionConfiguration reports the session configuration the server
+// gave the connection.
+func (d *diagnosis) checkSessionConfiguration(ctx context.Context, comm *Communicator) {
+	info, err := comm.QueryConnectionInfo(ctx)
+	if err != nil {
+		d.fail("session configuration", err.Error(), "the session opened but can't run commands; check the endpoint's "+
+			"session configuration (Get-PSSessionConfiguration) and psrp_configuration_name")
+		return
+	}
+	d.pass("session configuration", fmt.Sprintf("%q as %s via %s, protocol %s, PowerShell %s",
+		info.ConfigurationName, info.User, info.AuthMechanism, info.ProtocolVersion, info.PSVersion))
+}
+
+// checkEnvelopeSize compares psrp_max_envelope_size with the server's
+// MaxEnvelopeSizekb, which only administrators can read.
+func (d *diagnosis) checkEnvelopeSize(ctx context.Context, comm *Communicator) {
+	result, err := comm.execute(ctx, `(Get-Item WSMan:\localhost\MaxEnvelopeSizekb).Value`)
+	if err != nil || result.HadErrors || len(result.Output) == 0 {
+		d.skip("envelope size", "could not read MaxEnvelopeSizekb (needs administrator rights)")
+		return
+	}
+	server, err := strconv.Atoi(strings.TrimSpace(fmt.Sprintf("%v", result.Output[0])))
+	if err != nil {
+		d.skip("envelope size", fmt.Sprintf("unexpected MaxEnvelopeSizekb %v", result.Output[0]))
+		return
+	}
+
+	configured := d.config.PSRPMaxEnvelopeSize
+	if configured == 0 {
+		configured = DefaultMaxEnvelopeSize
+	}
+	if configured > server {
+		d.fail("envelope size", fmt.Sprintf("psrp_max_envelope_size is %d KB but the server allows %d KB", configured, server),
+			fmt.Sprintf("set psrp_max_envelope_size = %d, or raise it on the server with "+
+				"Set-Item WSMan:\\localhost\\MaxEnvelopeSizekb %d", server, configured))
+		return
+	}
+	d.pass("envelope size", fmt.Sprintf("server allows %d KB, psrp_max_envelope_size is %d KB", server, configured))
+}
+
+// checkTransfer uploads a file spanning several chunks, verifies it by
+// checksum, downloads it again and removes it.
+func (d *diagnosis) checkTransfer(ctx context.Context, comm *Communicator) {
+	data := make([]byte, 2*d.config.UploadChunkSize()+1)
+	if _, err := rand.Read(data); err != nil {
+		d.fail("transfer", err.Error(), "")
+		return
+	}
+	sum := sha256.Sum256(data)
+	path := fmt.Sprintf("C:/Windows/Temp/packer-psrp-doctor-%s.bin", uuid.New())
+	defer comm.execute(ctx, fmt.Sprintf("Remove-Item -LiteralPath '%s' -Force -ErrorAction SilentlyContinue", path)) //nolint:errcheck // best effort
+
+	hint := "uploads are chunked to psrp_upload_chunk_size; if chunks are rejected as too large, lower " +
+		"psrp_max_envelope_size or psrp_upload_chunk_size"
+	start := time.Now()
+	if err := comm.Upload(path, bytes.NewReader(data), nil); err != nil {
+		d.fail("transfer", err.Error(), hint)
+		return
+	}
+	uploaded := time.Since(start)
+
+	stat, err := comm.StatFile(ctx, path)
+	if err != nil {
+		d.fail("transfer", err.Error(), hint)
+		return
+	}
+	if stat.SHA256 != hex.EncodeToString(sum[:]) {
+		d.fail("transfer", fmt.Sprintf("uploaded file has sha256 %s, expected %x", stat.SHA256, sum), hint)
+		return
+	}
+
+	var buf bytes.Buffer
+	start = time.Now()
+	if err := comm.Download(path, &buf); err != nil {
+		d.fail("transfer", err.Error(), "downloads are buffered in memory on the server; check MaxMemoryPerShellMB")
+		return
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		d.fail("transfer", "downloaded file differs from the uploaded one", "")
+		return
+	}
+	d.pass("transfer", fmt.Sprintf("%d bytes uploaded in %s and downloaded in %s, checksums match",
+		len(data), uploaded.Round(time.Millisecond), time.Since(start).Round(time.Millisecond)))
+}
@@ -0,0 +1,342 @@
+package psrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultDSCTimeout bounds waiting for the Local Configuration Manager to
+// finish applying a configuration.
+const defaultDSCTimeout = 30 * time.Minute
+
+// psIdentifier matches names safe to splice into a script as a command or
+// parameter name.
+var psIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// DSCConfiguration is a DSC configuration to apply with
+// ApplyDSCConfiguration: either a configuration script compiled on the
+// guest, or MOF documents compiled beforehand.
+type DSCConfiguration struct {
+	// Script is a local .ps1 file defining the configuration called Name.
+	// Data optionally names a local .psd1 ConfigurationData file, and
+	// Parameters are passed to the configuration as strings.
+	Script     string
+	Name       string
+	Data       string
+	Parameters map[string]string
+
+	// MOF is a local .mof file, or a directory of them, to apply as is.
+	MOF string
+
+	// Timeout bounds the wait for the configuration to converge. Zero means
+	// 30 minutes.
+	Timeout time.Duration
+}
+
+// DSCResource is a single DSC resource to apply with InvokeDSCResource.
+type DSCResource struct {
+	Name          string // e.g. "WindowsFeature"
+	ModuleName    string // e.g. "PSDesiredStateConfiguration"
+	ModuleVersion string // optional
+	Properties    map[string]interface{}
+}
+
+// DSCResult is the state the guest converged to.
+type DSCResult struct {
+	// InDesiredState lists the resources that reached their desired state,
+	// by resource ID (e.g. "[WindowsFeature]IIS").
+	InDesiredState []string
+
+	// RebootRequired reports that a resource asked for a reboot to finish.
+	RebootRequired bool
+}
+
+// DSCResourceFailure is a resource that didn't reach its desired state.
+type DSCResourceFailure struct {
+	ResourceID string `json:"resource_id"`
+	Error      string `json:"error"`
+}
+
+// DSCError is returned when resources are left out of their desired state.
+// Result holds what did converge.
+type DSCError struct {
+	Failures []DSCResourceFailure
+	Result   *DSCResult
+}
+
+func (e *DSCError) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		parts[i] = f.ResourceID
+		if f.Error != "" {
+			parts[i] += ": " + f.Error
+		}
+	}
+	return fmt.Sprintf("DSC left %d resource(s) out of the desired state: %s", len(e.Failures), strings.Join(parts, "; "))
+}
+
+// ApplyDSCConfiguration uploads a DSC configuration, compiling it on the
+// guest if it is a script, applies it with Start-DscConfiguration while
+// streaming its verbose output to progress, waits for the Local
+// Configuration Manager to finish, and checks every resource with
+// Test-DscConfiguration. Resources left out of their desired state are
+// reported as a *DSCError.
+func (c *Communicator) ApplyDSCConfiguration(ctx context.Context, cfg *DSCConfiguration, progress io.Writer) (*DSCResult, error) {
+	if (cfg.Script == "") == (cfg.MOF == "") {
+		return nil, fmt.Errorf("exactly one of a configuration script or MOF must be given")
+	}
+	if cfg.Script != "" && !psIdentifier.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("invalid DSC configuration name %q", cfg.Name)
+	}
+
+	work := fmt.Sprintf("C:/Windows/Temp/packer-dsc-%s", uuid.New())
+	mofDir := work + "/mof"
+	defer c.execute(ctx, fmt.Sprintf("Remove-Item -LiteralPath %s -Recurse -Force -ErrorAction SilentlyContinue", psQuote(work))) //nolint:errcheck // best effort
+
+	if cfg.Script != "" {
+		if err := c.compileDSC(ctx, cfg, work, mofDir, progress); err != nil {
+			return nil, err
+		}
+	} else if err := c.uploadMOFs(ctx, cfg.MOF, mofDir); err != nil {
+		return nil, err
+	}
+
+	code, err := c.runStreaming(ctx, fmt.Sprintf(
+		"Start-DscConfiguration -Path %s -Wait -Force -Verbose", psQuote(mofDir)), progress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply DSC configuration: %w", err)
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultDSCTimeout
+	}
+	result, failures, err := c.dscStatus(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(failures) > 0 {
+		return nil, &DSCError{Failures: failures, Result: result}
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("Start-DscConfiguration exited with status %d", code)
+	}
+	return result, nil
+}
+
+// compileDSC uploads the configuration script and its data, and compiles
+// them into MOF documents in mofDir.
+func (c *Communicator) compileDSC(ctx context.Context, cfg *DSCConfiguration, work, mofDir string, progress io.Writer) error {
+	script := work + "/" + filepath.Base(cfg.Script)
+	if err := c.uploadFile(ctx, cfg.Script, script); err != nil {
+		return err
+	}
+
+	var args strings.Builder
+	fmt.Fprintf(&args, " -OutputPath %s", psQuote(mofDir))
+	if cfg.Data != "" {
+		data := work + "/" + filepath.Base(cfg.Data)
+		if err := c.uploadFile(ctx, cfg.Data, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(&args, " -ConfigurationData %s", psQuote(data))
+	}
+	names := make([]string, 0, len(cfg.Parameters))
+	for name := range cfg.Parameters {
+		if !psIdentifier.MatchString(name) {
+			return fmt.Errorf("invalid DSC configuration parameter name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&args, " -%s %s", name, psQuote(cfg.Parameters[name]))
+	}
+
+	code, err := c.runStreaming(ctx, fmt.Sprintf("$ErrorActionPreference = 'Stop'\n. %s\n%s%s | Out-Null",
+		psQuote(script), cfg.Name, args.String()), progress)
+	if err != nil {
+		return fmt.Errorf("failed to compile DSC configuration: %w", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("compiling DSC configuration %s failed with status %d", cfg.Name, code)
+	}
+	return nil
+}
+
+// uploadMOFs uploads a MOF file, or the MOF files in a directory, to dir.
+func (c *Communicator) uploadMOFs(ctx context.Context, src, dir string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	files := []string{src}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(src, "*.mof")); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no .mof files in %s", src)
+		}
+	}
+	for _, f := range files {
+		if err := c.uploadFile(ctx, f, dir+"/"+filepath.Base(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads the local file src to dst.
+func (c *Communicator) uploadFile(ctx context.Context, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := c.upload(ctx, dst, f); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", src, err)
+	}
+	return nil
+}
+
+// dscStatusScript waits for the LCM to go idle, then tests the current
+// configuration. Errors for failed resources come from the last run's
+// status, which Test-DscConfiguration doesn't report.
+const dscStatusScript = `
+$deadline = (Get-Date).AddSeconds(%d)
+while ((Get-DscLocalConfigurationManager).LCMState -eq 'Busy') {
+	if ((Get-Date) -gt $deadline) { throw 'timed out waiting for the DSC Local Configuration Manager to finish' }
+	Start-Sleep -Seconds 5
+}
+$lcm = Get-DscLocalConfigurationManager
+$test = Test-DscConfiguration -Detailed -ErrorAction Stop
+$errors = @{}
+$status = Get-DscConfigurationStatus -ErrorAction SilentlyContinue
+if ($status) {
+	foreach ($r in @($status.ResourcesNotInDesiredState)) { $errors[$r.ResourceId] = "$($r.Error)" }
+}
+[pscustomobject]@{
+	reboot_required      = [bool]($lcm.LCMState -eq 'PendingReboot')
+	in_desired_state     = @($test.ResourcesInDesiredState | ForEach-Object { $_.ResourceId })
+	not_in_desired_state = @($test.ResourcesNotInDesiredState | ForEach-Object {
+		[pscustomobject]@{ resource_id = $_.ResourceId; error = $errors[$_.ResourceId] }
+	})
+} | ConvertTo-Json -Compress -Depth 4
+`
+
+// dscStatus waits up to timeout for the configuration to converge and
+// reports the resources in and out of their desired state.
+func (c *Communicator) dscStatus(ctx context.Context, timeout time.Duration) (*DSCResult, []DSCResourceFailure, error) {
+	var status struct {
+		RebootRequired    bool                 `json:"reboot_required"`
+		InDesiredState    []string             `json:"in_desired_state"`
+		NotInDesiredState []DSCResourceFailure `json:"not_in_desired_state"`
+	}
+	if err := c.queryJSON(ctx, fmt.Sprintf(dscStatusScript, int(timeout.Seconds())), &status); err != nil {
+		return nil, nil, fmt.Errorf("failed to query DSC status: %w", err)
+	}
+	return &DSCResult{InDesiredState: status.InDesiredState, RebootRequired: status.RebootRequired},
+		status.NotInDesiredState, nil
+}
+
+// InvokeDSCResource applies a single resource with Invoke-DscResource: it
+// tests the resource, sets it if it isn't in the desired state (streaming
+// verbose output to progress), and tests it again. Properties are passed
+// through JSON, so they must be JSON-representable. On Windows PowerShell
+// 5.1 this requires the LCM's RefreshMode to be Disabled.
+func (c *Communicator) InvokeDSCResource(ctx context.Context, res *DSCResource, progress io.Writer) (*DSCResult, error) {
+	props, err := json.Marshal(res.Properties)
+	if err != nil {
+		return nil, fmt.Errorf("invalid properties for DSC resource %s: %w", res.Name, err)
+	}
+	module := psQuote(res.ModuleName)
+	if res.ModuleVersion != "" {
+		module = fmt.Sprintf("@{ ModuleName = %s; ModuleVersion = %s }", psQuote(res.ModuleName), psQuote(res.ModuleVersion))
+	}
+	params := fmt.Sprintf(`$props = @{}
+(ConvertFrom-Json %s).psobject.Properties | ForEach-Object { $props[$_.Name] = $_.Value }
+$params = @{ Name = %s; ModuleName = %s; Property = $props }
+`, psQuote(string(props)), psQuote(res.Name), module)
+	id := res.ModuleName + `\` + res.Name
+
+	var test struct {
+		InDesiredState bool `json:"InDesiredState"`
+	}
+	testScript := params + "Invoke-DscResource @params -Method Test -ErrorAction Stop | ConvertTo-Json -Compress"
+	if err := c.queryJSON(ctx, testScript, &test); err != nil {
+		return nil, fmt.Errorf("failed to test DSC resource %s: %w", id, err)
+	}
+	if test.InDesiredState {
+		return &DSCResult{InDesiredState: []string{id}}, nil
+	}
+
+	var set struct {
+		RebootRequired bool `json:"reboot_required"`
+	}
+	setScript := params + `$r = Invoke-DscResource @params -Method Set -Verbose -ErrorAction Stop
+Write-Output ("` + dscResultMarker + `" + (@{ reboot_required = [bool]$r.RebootRequired } | ConvertTo-Json -Compress))`
+	out := &markerWriter{marker: dscResultMarker, w: progress}
+	code, err := c.runStreaming(ctx, setScript, out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set DSC resource %s: %w", id, err)
+	}
+	if code != 0 || out.value == "" {
+		return nil, &DSCError{Failures: []DSCResourceFailure{{ResourceID: id, Error: fmt.Sprintf("Set exited with status %d", code)}}}
+	}
+	if err := json.Unmarshal([]byte(out.value), &set); err != nil {
+		return nil, fmt.Errorf("failed to parse DSC result: %w", err)
+	}
+
+	result := &DSCResult{RebootRequired: set.RebootRequired}
+	if err := c.queryJSON(ctx, testScript, &test); err != nil {
+		return nil, fmt.Errorf("failed to test DSC resource %s: %w", id, err)
+	}
+	if !test.InDesiredState && !set.RebootRequired {
+		return nil, &DSCError{Failures: []DSCResourceFailure{{ResourceID: id, Error: "not in the desired state after Set"}}, Result: result}
+	}
+	if test.InDesiredState {
+		result.InDesiredState = []string{id}
+	}
+	return result, nil
+}
+
+// dscResultMarker prefixes the line carrying a streamed script's result.
+const dscResultMarker = "__PACKER_DSC_RESULT__:"
+
+// markerWriter passes output through to w, except for the line starting
+// with marker, whose remainder it keeps in value.
+type markerWriter struct {
+	mu     sync.Mutex
+	marker string
+	w      io.Writer
+	value  string
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if v, ok := strings.CutPrefix(line, m.marker); ok {
+			m.value = strings.TrimSpace(v)
+			continue
+		}
+		if line != "" && m.w != nil {
+			if _, err := io.WriteString(m.w, line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+package psrp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// iso8601DurationRe matches the ISO 8601 durations WSMan accepts for shell
+// timeouts, e.g. "PT30M", "PT1H30M" or "P1DT2H".
+var iso8601DurationRe = regexp.MustCompile(`^P(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`)
+
+// toISO8601Duration normalizes a Go-style duration ("30m", "2h") or an ISO
+// 8601 duration ("PT30M") to the ISO 8601 form used on the wire.
+func toISO8601Duration(s string) (string, error) {
+	if upper := strings.ToUpper(s); strings.HasPrefix(upper, "P") {
+		if upper == "P" || strings.HasSuffix(upper, "T") || !iso8601DurationRe.MatchString(upper) {
+			return "", fmt.Errorf("invalid ISO 8601 duration %q", s)
+		}
+		return upper, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid duration %q (use e.g. \"30m\" or \"PT30M\")", s)
+	}
+	if d < time.Second {
+		return "", fmt.Errorf("duration %q must be at least 1s", s)
+	}
+
+	d = d.Round(time.Second)
+	h := int64(d / time.Hour)
+	m := int64(d % time.Hour / time.Minute)
+	sec := int64(d % time.Minute / time.Second)
+
+	var b strings.Builder
+	b.WriteString("PT")
+	if h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+	}
+	if m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+	}
+	if sec > 0 {
+		fmt.Fprintf(&b, "%dS", sec)
+	}
+	return b.String(), nil
+}
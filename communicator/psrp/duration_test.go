@@ -0,0 +1,41 @@
+package psrp
+
+import "testing"
+
+func TestToISO8601Duration(t *testing.T) {
+	cases := []struct {
+		in, want string
+		err      bool
+	}{
+		{in: "30m", want: "PT30M"},
+		{in: "2h", want: "PT2H"},
+		{in: "1h30m15s", want: "PT1H30M15S"},
+		{in: "90m", want: "PT1H30M"},
+		{in: "36h", want: "PT36H"},
+		{in: "1500ms", want: "PT2S"},
+		{in: "PT30M", want: "PT30M"},
+		{in: "pt1h30m", want: "PT1H30M"},
+		{in: "P1DT2H", want: "P1DT2H"},
+		{in: "PT0.5S", want: "PT0.5S"},
+		{in: "P", err: true},
+		{in: "PT", err: true},
+		{in: "P1DT", err: true},
+		{in: "P1H", err: true},
+		{in: "500ms", err: true},
+		{in: "-5m", err: true},
+		{in: "soon", err: true},
+		{in: "", err: true},
+	}
+	for _, tc := range cases {
+		got, err := toISO8601Duration(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("toISO8601Duration(%q) = %q, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("toISO8601Duration(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package psrp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EC2PasswordDataFunc returns an instance's PasswordData, as EC2's
+// GetPasswordData reports it: base64 of the Administrator password
+// encrypted with the instance's key pair, or "" while EC2Launch hasn't
+// generated it yet. Builders implement it with their own EC2 client, so
+// this plugin takes no dependency on the AWS SDK.
+type EC2PasswordDataFunc func(ctx context.Context, instanceID string) (string, error)
+
+// EC2PasswordProvider is a CredentialProvider supplying the Administrator
+// password of a Windows EC2 instance. It waits for EC2 to publish the
+// password data, decrypts it with the key pair's private key and caches
+// the result, so reconnects don't fetch it again. Set it as
+// Config.CredentialProvider; psrp_username stays as configured.
+type EC2PasswordProvider struct {
+	InstanceID string
+	PrivateKey []byte // PEM, PKCS #1 or PKCS #8
+	Fetch      EC2PasswordDataFunc
+
+	// Timeout bounds the wait for the password data (default 20m); the
+	// first boot of a Windows AMI often takes several minutes.
+	Timeout time.Duration
+	// PollInterval is how often GetPasswordData is called (default 15s).
+	PollInterval time.Duration
+
+	mu       sync.Mutex
+	password string
+}
+
+// Credentials returns the decrypted password.
+func (p *EC2PasswordProvider) Credentials(ctx context.Context) (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.password != "" {
+		return &Credentials{Password: p.password}, nil
+	}
+	if p.Fetch == nil || p.InstanceID == "" {
+		return nil, errors.New("EC2 password retrieval needs an instance ID and a fetch function")
+	}
+
+	key, err := parseRSAPrivateKey(p.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, interval := p.Timeout, p.PollInterval
+	if timeout <= 0 {
+		timeout = 20 * time.Minute
+	}
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		data, err := p.Fetch(ctx, p.InstanceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get password data for %s: %w", p.InstanceID, err)
+		}
+		if data = strings.Join(strings.Fields(data), ""); data != "" {
+			password, err := decryptEC2Password(key, data)
+			if err != nil {
+				return nil, err
+			}
+			p.password = password
+			return &Credentials{Password: password}, nil
+		}
+
+		logger.Debug("waiting for EC2 password data", "instance", p.InstanceID)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout waiting for the password of %s; check the instance launched with a key pair and runs EC2Launch: %w", p.InstanceID, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// decryptEC2Password decrypts base64 password data with key.
+func decryptEC2Password(key *rsa.PrivateKey, data string) (string, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode EC2 password data: %w", err)
+	}
+	password, err := rsa.DecryptPKCS1v15(rand.Reader, key, encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt EC2 password data; is this the instance's key pair? %w", err)
+	}
+	return string(password), nil
+}
+
+// parseRSAPrivateKey parses an unencrypted PEM RSA key.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("EC2 key pair private key is not PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse EC2 key pair private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("EC2 password data can only be decrypted with an RSA key pair")
+	}
+	return key, nil
+}
@@ -0,0 +1,90 @@
+package psrp
+
+import (
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// envEventLogFile enables the event log without template changes. It
+// applies when psrp_event_log_file is unset.
+const envEventLogFile = "PACKER_PSRP_EVENT_LOG_FILE"
+
+// eventLog records what a communicator did as machine-readable events for
+// build farms to ingest: one JSON object per line, for the connection's
+// lifecycle, each command and each transferred file. Lines are redacted.
+// A nil *eventLog records nothing.
+type eventLog struct {
+	log      *slog.Logger
+	commands atomic.Int64
+}
+
+// newEventLog opens the event log for a connection, or returns nil if it
+// is off or the file can't be opened (telemetry must never fail a build).
+func newEventLog(config *Config, connID, target string) *eventLog {
+	path := os.Getenv(envEventLogFile)
+	if config != nil && config.PSRPEventLogFile != "" {
+		path = config.PSRPEventLogFile
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := openTraceFile(path)
+	if err != nil {
+		logger.Warn("event log disabled", "error", err)
+		return nil
+	}
+	handler := slog.NewJSONHandler(f, &slog.HandlerOptions{
+		// Every line is an event; name it "event" and drop the level
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				return slog.Attr{}
+			case slog.MessageKey:
+				a.Key = "event"
+			}
+			return a
+		},
+	})
+	return &eventLog{log: slog.New(handler).With("conn", connID, "target", target)}
+}
+
+// emit records one event. A non-nil err is added as "error".
+func (e *eventLog) emit(event string, err error, args ...any) {
+	if e == nil {
+		return
+	}
+	if err != nil {
+		args = append(args, "error", err.Error())
+	}
+	e.log.Info(event, args...)
+}
+
+// commandStart records a command starting and returns its ID, which
+// commandEnd's event repeats.
+func (e *eventLog) commandStart(scriptBytes int) int64 {
+	if e == nil {
+		return 0
+	}
+	id := e.commands.Add(1)
+	e.emit("command.start", nil, "command_id", id, "script_bytes", scriptBytes)
+	return id
+}
+
+// commandEnd records a command's exit. reported is false when the exit
+// code was inferred because the command never wrote it.
+func (e *eventLog) commandEnd(id int64, started time.Time, exitCode int, reported bool, errorRecords int, err error) {
+	e.emit("command.end", err, "command_id", id, "exit_code", exitCode, "exit_code_reported", reported,
+		"error_records", errorRecords, "duration_ms", time.Since(started).Milliseconds())
+}
+
+// transfer records one uploaded or downloaded file. A file uploaded in a
+// batch is given the batch's duration.
+func (e *eventLog) transfer(event, path string, bytes int64, elapsed time.Duration, err error, args ...any) {
+	e.emit(event, err, append([]any{"path", path, "bytes", bytes, "duration_ms", elapsed.Milliseconds(),
+		"bytes_per_sec", bytesPerSecond(bytes, elapsed)}, args...)...)
+}
@@ -0,0 +1,87 @@
+package psrp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// outputTailLines is how many of a command's last lines are kept for the
+// warning logged when its exit code goes missing.
+const outputTailLines = 5
+
+// lineTail keeps the last lines a command wrote to its output and error
+// streams.
+type lineTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// add records the lines of text, skipping the exit marker.
+func (t *lineTail) add(text string) {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, exitMarker) {
+			t.lines = append(t.lines, line)
+		}
+	}
+	if n := len(t.lines); n > outputTailLines {
+		t.lines = append([]string(nil), t.lines[n-outputTailLines:]...)
+	}
+}
+
+// String returns the kept lines.
+func (t *lineTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// missingExitCode reports a command that ended without writing its exit
+// code, and returns the exit code to use. With psrp_strict_exit_code that
+// is 1 and an error failing the command; otherwise it is guessed from
+// whether the pipeline failed or the command wrote error records. state
+// says how the pipeline ended.
+func (c *Communicator) missingExitCode(state string, runErr error, errorRecords int, tail *lineTail) (int, error) {
+	strict := c.config != nil && c.config.PSRPStrictExitCode
+	args := []any{"op", "command", "pipeline", state, "error_records", errorRecords,
+		"last_output", tail.String(), "strict", strict}
+	if runErr != nil {
+		args = append(args, "error", runErr)
+	}
+	c.logger().Warn("command ended without reporting its exit code", args...)
+
+	if strict {
+		return 1, fmt.Errorf("%w: the command ended without reporting its exit code (pipeline %s, %d error records)",
+			ErrPipelineFailed, state, errorRecords)
+	}
+	code := 0
+	if runErr != nil || errorRecords > 0 {
+		code = 1
+	}
+	if c.ui != nil {
+		uiWarn(c.ui, fmt.Sprintf("command ended without reporting its exit code (pipeline %s, %d error records); assuming %d",
+			state, errorRecords, code))
+	}
+	return code, nil
+}
+
+// failOnErrorRecords applies psrp_fail_on_error_records: a command that
+// exited 0 after writing error records exits 1 instead, with a note on
+// stderr saying why.
+func (c *Communicator) failOnErrorRecords(exitCode, errorRecords int, stderr io.Writer) int {
+	if c.config == nil || !c.config.PSRPFailOnErrorRecords || exitCode != 0 || errorRecords == 0 {
+		return exitCode
+	}
+	c.logger().Info("failing command that wrote error records", "op", "command", "error_records", errorRecords)
+	if stderr != nil {
+		fmt.Fprintf(stderr, "command wrote %d error records; failing it (psrp_fail_on_error_records)\n", errorRecords)
+	}
+	return 1
+}
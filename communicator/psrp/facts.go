@@ -0,0 +1,149 @@
+package psrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packerbuilderdata"
+)
+
+// GuestFacts is a structured description of the guest for templates and
+// provisioners to branch on. With psrp_collect_facts, StepConnect stores
+// it in the state bag under "psrp_guest_facts" and publishes it as build
+// variables.
+type GuestFacts struct {
+	// OSBuild is the full build number, e.g. "10.0.20348.2340".
+	OSBuild   string `json:"os_build"`
+	OSCaption string `json:"os_caption"`
+
+	// InstallationType is "Server", "Server Core" or "Client".
+	InstallationType string `json:"installation_type"`
+
+	// Features are the installed roles and features (Get-WindowsFeature)
+	// on servers, or the enabled optional features on clients.
+	Features []string `json:"features"`
+
+	// DotNetVersions are the installed .NET Framework versions, e.g.
+	// "3.5", "4.8".
+	DotNetVersions []string `json:"dotnet_versions"`
+
+	Disks []GuestDisk `json:"disks"`
+
+	// ActivationStatus is the Windows license status, e.g. "Licensed" or
+	// "Notification", or "Unknown" if it can't be read.
+	ActivationStatus string `json:"activation_status"`
+}
+
+// GuestDisk is a fixed volume on the guest.
+type GuestDisk struct {
+	Drive      string `json:"drive"` // e.g. "C:"
+	Label      string `json:"label"`
+	FileSystem string `json:"file_system"`
+	Size       int64  `json:"size"` // bytes
+	Free       int64  `json:"free"` // bytes
+}
+
+// guestFactsScript collects GuestFacts. Each fact is gathered on its own,
+// so a missing cmdlet or class leaves just that fact empty.
+const guestFactsScript = `
+$ErrorActionPreference = 'SilentlyContinue'
+$os = Get-CimInstance -ClassName Win32_OperatingSystem
+$cv = Get-ItemProperty 'HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion'
+$build = if ($cv.UBR -ne $null) { "$($os.Version).$($cv.UBR)" } else { "$($os.Version)" }
+
+$features = @()
+if (Get-Command Get-WindowsFeature) {
+	$features = @(Get-WindowsFeature | Where-Object Installed | ForEach-Object { $_.Name })
+} elseif (Get-Command Get-WindowsOptionalFeature) {
+	$features = @(Get-WindowsOptionalFeature -Online | Where-Object State -eq 'Enabled' | ForEach-Object { $_.FeatureName })
+}
+
+$dotnet = @(Get-ChildItem 'HKLM:\SOFTWARE\Microsoft\NET Framework Setup\NDP' |
+	Where-Object { $_.PSChildName -match '^v[23]' } |
+	Where-Object { (Get-ItemProperty $_.PSPath).Install -eq 1 } |
+	ForEach-Object { $_.PSChildName.TrimStart('v') })
+$release = (Get-ItemProperty 'HKLM:\SOFTWARE\Microsoft\NET Framework Setup\NDP\v4\Full').Release
+if ($release) {
+	$v4 = switch ($release) {
+		{ $_ -ge 533320 } { '4.8.1'; break }
+		{ $_ -ge 528040 } { '4.8'; break }
+		{ $_ -ge 461808 } { '4.7.2'; break }
+		{ $_ -ge 461308 } { '4.7.1'; break }
+		{ $_ -ge 460798 } { '4.7'; break }
+		{ $_ -ge 394802 } { '4.6.2'; break }
+		{ $_ -ge 394254 } { '4.6.1'; break }
+		{ $_ -ge 393295 } { '4.6'; break }
+		{ $_ -ge 379893 } { '4.5.2'; break }
+		{ $_ -ge 378675 } { '4.5.1'; break }
+		default { '4.5' }
+	}
+	$dotnet += $v4
+}
+
+$disks = @(Get-CimInstance -ClassName Win32_LogicalDisk -Filter 'DriveType=3' | ForEach-Object {
+	[pscustomobject]@{
+		drive       = $_.DeviceID
+		label       = "$($_.VolumeName)"
+		file_system = "$($_.FileSystem)"
+		size        = [int64]$_.Size
+		free        = [int64]$_.FreeSpace
+	}
+})
+
+$statuses = @('Unlicensed', 'Licensed', 'OOBGrace', 'OOTGrace', 'NonGenuineGrace', 'Notification', 'ExtendedGrace')
+$license = Get-CimInstance -ClassName SoftwareLicensingProduct -Filter "ApplicationID='55c92734-d682-4d71-983e-d6ec3f16059f' AND PartialProductKey IS NOT NULL" |
+	Select-Object -First 1
+$activation = if ($license) { $statuses[[int]$license.LicenseStatus] } else { 'Unknown' }
+
+[pscustomobject]@{
+	os_build          = $build
+	os_caption        = "$($os.Caption)".Trim()
+	installation_type = "$($cv.InstallationType)"
+	features          = @($features | Sort-Object)
+	dotnet_versions   = @($dotnet)
+	disks             = $disks
+	activation_status = "$activation"
+} | ConvertTo-Json -Compress -Depth 4
+`
+
+// GuestFacts collects structured facts about the guest. Facts that can't
+// be read (e.g. features on a minimal image) are left empty rather than
+// failing the query.
+func (c *Communicator) GuestFacts(ctx context.Context) (*GuestFacts, error) {
+	var facts GuestFacts
+	if err := c.queryJSON(ctx, guestFactsScript, &facts); err != nil {
+		return nil, fmt.Errorf("failed to collect guest facts: %w", err)
+	}
+	return &facts, nil
+}
+
+// HasFeature reports whether the named role or feature is installed.
+func (f *GuestFacts) HasFeature(name string) bool {
+	for _, feature := range f.Features {
+		if strings.EqualFold(feature, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish stores the facts in the state bag and as build variables.
+// Lists are published comma-separated, and the whole set as JSON in
+// PSRPGuestFacts for templates that need the detail (e.g. disks).
+func (f *GuestFacts) publish(state multistep.StateBag) {
+	state.Put("psrp_guest_facts", f)
+
+	data := &packerbuilderdata.GeneratedData{State: state}
+	data.Put("PSRPOSBuild", f.OSBuild)
+	data.Put("PSRPOSCaption", f.OSCaption)
+	data.Put("PSRPInstallationType", f.InstallationType)
+	data.Put("PSRPFeatures", strings.Join(f.Features, ","))
+	data.Put("PSRPDotNetVersions", strings.Join(f.DotNetVersions, ","))
+	data.Put("PSRPActivationStatus", f.ActivationStatus)
+	if raw, err := json.Marshal(f); err == nil {
+		data.Put("PSRPGuestFacts", string(raw))
+	}
+}
@@ -0,0 +1,259 @@
+package psrp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/smnsjas/go-psrp/wsman"
+)
+
+// WSMan error codes (wsmerror.h) with a known remedy.
+const (
+	wsmanCannotConnect       uint32 = 0x80338012
+	wsmanKerberosUnavailable uint32 = 0x8033809D
+	wsmanQuotaMaxShells      uint32 = 0x803381A5
+	wsmanQuotaMaxOperations  uint32 = 0x803381A6
+	wsmanQuotaUser           uint32 = 0x803381A7
+	wsmanQuotaSystem         uint32 = 0x803381A8
+	wsmanQuotaMaxShellUsers  uint32 = 0x803381AB
+	wsmanQuotaPluginFirst    uint32 = 0x803381E4 // per-plugin quotas
+	wsmanQuotaPluginLast     uint32 = 0x803381EA
+	wsmanErrorAccessDenied   uint32 = 5
+)
+
+// unnamedQuota marks a quota fault that doesn't say which quota.
+const unnamedQuota = "*"
+
+// httpStatusPattern matches go-psrp's errors for unexpected HTTP statuses,
+// which carry the response body (a SOAP fault, for 500s).
+var httpStatusPattern = regexp.MustCompile(`(?s)transport: HTTP (\d{3}): (.*)`)
+
+// faultError adds a remedy to a WSMan fault or HTTP error. errors.Is and
+// errors.As still see the original error.
+type faultError struct {
+	err   error
+	msg   string // replaces err's text, e.g. to summarize a SOAP body
+	hint  string
+	quota string // the WinRM quota that was exceeded, if any
+}
+
+func (e *faultError) Error() string {
+	msg := e.msg
+	if msg == "" {
+		msg = e.err.Error()
+	}
+	if e.quota != "" {
+		label := e.quota + " quota"
+		if e.quota == unnamedQuota {
+			label = "quota"
+		}
+		msg = "WinRM " + label + " exceeded: " + msg
+	}
+	if e.hint == "" {
+		return msg
+	}
+	return msg + " (" + e.hint + ")"
+}
+
+func (e *faultError) Unwrap() error { return e.err }
+
+// Is matches ErrQuotaExceeded when a quota was identified.
+func (e *faultError) Is(target error) bool {
+	return target == ErrQuotaExceeded && e.quota != ""
+}
+
+// explainFault wraps err with what to do about the WSMan fault, HTTP status
+// or missing listener behind it, or returns err unchanged if there is
+// nothing to add.
+func (c *Config) explainFault(err error) error {
+	if err == nil {
+		return nil
+	}
+	var explained *faultError
+	if errors.As(err, &explained) {
+		return err
+	}
+
+	var fault *wsman.Fault
+	if errors.As(err, &fault) {
+		return wrapQuota(wrapFault(err, "", wsmanFaultHint(fault)), faultQuota(fault))
+	}
+
+	// go-psrp reports a SOAP fault sent with an HTTP error status as the
+	// raw response body
+	if m := httpStatusPattern.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		if fault, _ := wsman.ParseFault([]byte(m[2])); fault != nil {
+			summary := fmt.Sprintf("HTTP %d: %s", status, fault.Error())
+			if fault.Message != "" {
+				summary += ": " + strings.TrimSpace(fault.Message)
+			}
+			msg := strings.Replace(err.Error(), m[0], summary, 1)
+			hint := wsmanFaultHint(fault)
+			if hint == "" {
+				hint = c.httpStatusHint(status)
+			}
+			return wrapFault(err, msg, hint)
+		}
+		return wrapFault(err, "", c.httpStatusHint(status))
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "401 Unauthorized"):
+		return wrapFault(err, "", c.httpStatusHint(401))
+	case strings.Contains(msg, "403 Forbidden"):
+		return wrapFault(err, "", c.httpStatusHint(403))
+	}
+
+	// A shell the server kills mid-stream often surfaces as plain text
+	// rather than a fault
+	if quota, hint := textQuota(msg); quota != "" {
+		return wrapQuota(wrapFault(err, "", hint), quota)
+	}
+
+	refused := errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(msg, "actively refused")
+	if refused && c != nil && c.PSRPTransport == TransportWSMan {
+		if c.PSRPUseTLS {
+			return wrapFault(err, "", "nothing is listening on the port; enable the HTTPS listener "+
+				"(New-Item WSMan:\\localhost\\Listener -Transport HTTPS -Address * -CertificateThumbprint <thumbprint>)")
+		}
+		return wrapFault(err, "", "nothing is listening on the port; run Enable-PSRemoting (or winrm quickconfig) on the guest")
+	}
+	return err
+}
+
+// wrapFault returns err with msg and hint, or err itself if there is
+// nothing to add.
+func wrapFault(err error, msg, hint string) error {
+	if msg == "" && hint == "" {
+		return err
+	}
+	return &faultError{err: err, msg: msg, hint: hint}
+}
+
+// wrapQuota records the quota behind err, if any, so it matches
+// ErrQuotaExceeded and names the quota.
+func wrapQuota(err error, quota string) error {
+	if quota == "" {
+		return err
+	}
+	if fe, ok := err.(*faultError); ok {
+		fe.quota = quota
+		return fe
+	}
+	return &faultError{err: err, quota: quota}
+}
+
+// faultQuota returns the name of the WinRM quota a fault reports was
+// exceeded, or "".
+func faultQuota(fault *wsman.Fault) string {
+	switch code := uint32(fault.WSManCode); {
+	case code == wsmanQuotaMaxShells:
+		return "MaxShellsPerUser"
+	case code == wsmanQuotaMaxShellUsers:
+		return "MaxShellUsers"
+	case code == wsmanQuotaMaxOperations:
+		return "MaxConcurrentOperationsPerUser"
+	}
+	if quota, _ := textQuota(fault.Reason + " " + fault.Message); quota != "" {
+		return quota
+	}
+	switch code := uint32(fault.WSManCode); {
+	case code == wsmanQuotaUser:
+		return "per-user"
+	case code == wsmanQuotaSystem:
+		return "system-wide"
+	case code >= wsmanQuotaPluginFirst && code <= wsmanQuotaPluginLast:
+		return "plugin"
+	case strings.Contains(fault.Subcode, "QuotaLimit"):
+		return unnamedQuota
+	}
+	return ""
+}
+
+// textQuota recognizes a quota violation from error text, returning the
+// quota and its remedy, or "" if the text names none.
+func textQuota(text string) (quota, hint string) {
+	lower := strings.ToLower(text)
+	switch {
+	case strings.Contains(lower, "maxmemorypershellmb"),
+		strings.Contains(lower, "memory quota"),
+		strings.Contains(lower, "out of memory") && strings.Contains(lower, "shell"):
+		return "MaxMemoryPerShellMB", "raise MaxMemoryPerShellMB " +
+			"(Set-Item WSMan:\\localhost\\Shell\\MaxMemoryPerShellMB 2048, and the same on the Microsoft.PowerShell plugin's quotas)"
+	case strings.Contains(lower, "maxconcurrentoperationsperuser"):
+		return "MaxConcurrentOperationsPerUser", "lower psrp_max_runspaces, or raise MaxConcurrentOperationsPerUser " +
+			"(Set-Item WSMan:\\localhost\\Service\\MaxConcurrentOperationsPerUser 1500)"
+	case strings.Contains(lower, "maxshellsperuser"):
+		return "MaxShellsPerUser", "close leftover sessions, or raise MaxShellsPerUser " +
+			"(Set-Item WSMan:\\localhost\\Shell\\MaxShellsPerUser 50)"
+	case strings.Contains(lower, "maxprocessespershell"):
+		return "MaxProcessesPerShell", "raise MaxProcessesPerShell " +
+			"(Set-Item WSMan:\\localhost\\Shell\\MaxProcessesPerShell 0)"
+	}
+	return "", ""
+}
+
+// wsmanFaultHint returns the remedy for a WSMan fault, or "".
+func wsmanFaultHint(fault *wsman.Fault) string {
+	code := uint32(fault.WSManCode)
+	text := strings.ToLower(fault.Reason + " " + fault.Message)
+	switch {
+	case fault.IsAccessDenied() || code == wsmanErrorAccessDenied:
+		return "the account lacks remote management rights; add it to Remote Management Users (or Administrators), " +
+			"or grant it access to the session configuration with Set-PSSessionConfiguration -ShowSecurityDescriptorUI"
+	case code == wsmanQuotaMaxShells, code == wsmanQuotaMaxShellUsers:
+		return "the account has too many open shells; close leftover sessions, or raise MaxShellsPerUser " +
+			"(Set-Item WSMan:\\localhost\\Shell\\MaxShellsPerUser 50)"
+	case code == wsmanQuotaMaxOperations:
+		return "the account has too many concurrent operations; lower psrp_max_runspaces, or raise MaxConcurrentOperationsPerUser " +
+			"(Set-Item WSMan:\\localhost\\Service\\MaxConcurrentOperationsPerUser 1500)"
+	case strings.Contains(text, "memory"),
+		strings.Contains(text, "did not return a proper response"):
+		return "the remote shell may have run out of memory; increase MaxMemoryPerShellMB " +
+			"(Set-Item WSMan:\\localhost\\Shell\\MaxMemoryPerShellMB 2048, and the same on the Microsoft.PowerShell plugin's quotas)"
+	case code == wsmanQuotaUser, code == wsmanQuotaSystem,
+		code >= wsmanQuotaPluginFirst && code <= wsmanQuotaPluginLast,
+		strings.Contains(fault.Subcode, "QuotaLimit"):
+		return "a WinRM quota was exceeded; check the limits under WSMan:\\localhost\\Shell, WSMan:\\localhost\\Service " +
+			"and the Microsoft.PowerShell plugin's quotas"
+	case strings.Contains(fault.Subcode, "EncodingLimit"):
+		return "a message exceeded the server's MaxEnvelopeSizekb; raise it (Set-Item WSMan:\\localhost\\MaxEnvelopeSizekb 8192), " +
+			"or for uploads set psrp_max_envelope_size to match it"
+	case code == wsmanKerberosUnavailable:
+		return "Kerberos cannot be used for this address; connect by the host's DNS name, or use ntlm or basic " +
+			"and add the address to TrustedHosts"
+	case code == wsmanCannotConnect:
+		return "WinRM could not reach the destination; check the WinRM service is running and has a listener for this address"
+	}
+	return ""
+}
+
+// httpStatusHint returns the remedy for an HTTP status from the WSMan
+// listener, or "".
+func (c *Config) httpStatusHint(status int) string {
+	switch {
+	case status == 401:
+		return "the listener rejected the credentials; check the account, and that the service allows psrp_auth_type " +
+			"(winrm get winrm/config/service/auth)"
+	case status == 403 && c != nil && !c.PSRPUseTLS:
+		return "access denied; the listener may only accept encrypted traffic, so enable the HTTPS listener and set psrp_use_tls, " +
+			"or the account lacks remote management rights"
+	case status == 403:
+		return "access denied; the account lacks remote management rights (Remote Management Users or Administrators)"
+	case status == 404:
+		return "no WSMan endpoint at this URL; check psrp_wsman_path, and list the listeners with winrm enumerate winrm/config/listener"
+	case status == 413:
+		return "the request exceeded the server's MaxEnvelopeSizekb; for uploads, set psrp_max_envelope_size to match it"
+	case status == 503:
+		return "the WinRM service is unavailable; it may be restarting or over a quota"
+	case status >= 500:
+		return "the WinRM service failed to process the request; check the Microsoft-Windows-WinRM/Operational event log on the guest"
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package psrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// defaultFeatureRestart bounds waiting for the guest after a restart that
+// enabling features required.
+const defaultFeatureRestart = 15 * time.Minute
+
+// FeatureOptions controls InstallFeatures.
+type FeatureOptions struct {
+	// IncludeAllSubFeatures also enables sub-features (and, for optional
+	// features, the parent features they depend on).
+	IncludeAllSubFeatures bool
+
+	// IncludeManagementTools installs a role's management tools. It only
+	// applies to Install-WindowsFeature.
+	IncludeManagementTools bool
+
+	// Source is an alternate source for feature payloads removed from the
+	// image, such as a mounted \sources\sxs directory or a WIM.
+	Source string
+
+	// SkipRestart leaves a required restart to the caller instead of
+	// restarting the guest once all features are enabled.
+	SkipRestart    bool
+	RestartTimeout time.Duration
+}
+
+// FeatureResult is the outcome for one feature.
+type FeatureResult struct {
+	Name string `json:"name"`
+
+	// Method is how the feature was enabled: "Install-WindowsFeature",
+	// "Enable-WindowsOptionalFeature" or "dism".
+	Method string `json:"method"`
+
+	// Changed is false if the feature was already enabled.
+	Changed       bool   `json:"changed"`
+	RestartNeeded bool   `json:"restart_needed"`
+	Error         string `json:"error,omitempty"`
+}
+
+// FeatureSummary is what InstallFeatures did.
+type FeatureSummary struct {
+	Features []FeatureResult
+
+	// RestartNeeded reports that a feature needs a restart to finish.
+	// Unless SkipRestart is set, Restarted is then true as well.
+	RestartNeeded bool
+	Restarted     bool
+}
+
+// FeatureError is returned when features fail to enable. Summary holds
+// the results for every feature.
+type FeatureError struct {
+	Failed  []FeatureResult
+	Summary *FeatureSummary
+}
+
+func (e *FeatureError) Error() string {
+	parts := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		parts[i] = f.Name + ": " + f.Error
+	}
+	return fmt.Sprintf("%d feature(s) failed to install: %s", len(e.Failed), strings.Join(parts, "; "))
+}
+
+// featureResultMarker prefixes the line carrying a feature's result.
+const featureResultMarker = "__PACKER_FEATURE_RESULT__:"
+
+// installFeatureScript enables one feature with the best tool available:
+// Install-WindowsFeature on servers, Enable-WindowsOptionalFeature on
+// clients, and dism.exe if neither cmdlet exists or the cmdlet fails (the
+// DISM module is unreliable in some remote sessions).
+const installFeatureScript = `$ErrorActionPreference = 'Stop'
+$name = %s
+$all = $%t
+$tools = $%t
+$source = %s
+$r = @{ name = $name; changed = $false; restart_needed = $false }
+$done = $false
+try {
+	if (Get-Command Install-WindowsFeature -ErrorAction SilentlyContinue) {
+		$r.method = 'Install-WindowsFeature'
+		$p = @{ Name = $name; IncludeAllSubFeature = $all; IncludeManagementTools = $tools; Verbose = $true }
+		if ($source) { $p.Source = $source }
+		$out = Install-WindowsFeature @p
+		if (-not $out.Success) { throw "Install-WindowsFeature failed with $($out.ExitCode)" }
+		$r.changed = "$($out.ExitCode)" -ne 'NoChangeNeeded'
+		$r.restart_needed = "$($out.RestartNeeded)" -eq 'Yes'
+		$done = $true
+	} elseif (Get-Command Enable-WindowsOptionalFeature -ErrorAction SilentlyContinue) {
+		$r.method = 'Enable-WindowsOptionalFeature'
+		$state = (Get-WindowsOptionalFeature -Online -FeatureName $name).State
+		if (-not $state) { throw "unknown feature $name" }
+		if ("$state" -ne 'Enabled') {
+			$p = @{ Online = $true; FeatureName = $name; All = $all; NoRestart = $true }
+			if ($source) { $p.Source = $source; $p.LimitAccess = $true }
+			$out = Enable-WindowsOptionalFeature @p
+			$r.changed = $true
+			$r.restart_needed = [bool]$out.RestartNeeded
+		}
+		$done = $true
+	}
+} catch {
+	Write-Warning "$($r.method) failed for ${name}: $_; falling back to dism.exe"
+}
+if (-not $done) {
+	$r.method = 'dism'
+	$dismArgs = @('/Online', '/Enable-Feature', "/FeatureName:$name", '/NoRestart', '/Quiet')
+	if ($all) { $dismArgs += '/All' }
+	if ($source) { $dismArgs += "/Source:$source"; $dismArgs += '/LimitAccess' }
+	& dism.exe @dismArgs
+	switch ($LASTEXITCODE) {
+		0       { $r.changed = $true }
+		3010    { $r.changed = $true; $r.restart_needed = $true }
+		default { $r.error = "dism.exe failed with exit code $LASTEXITCODE" }
+	}
+}
+Write-Output ('` + featureResultMarker + `' + (ConvertTo-Json -Compress -InputObject $r))
+`
+
+// InstallFeatures enables Windows roles, features or optional features,
+// streaming progress to progress. Each feature is reported with how it was
+// enabled and whether it changed anything. If any feature needs a restart,
+// the guest is restarted once after the last one and the session
+// reconnected in place. Features that fail are reported as a
+// *FeatureError, after the others have been tried.
+func (c *Communicator) InstallFeatures(ctx context.Context, names []string, opts *FeatureOptions, progress io.Writer) (*FeatureSummary, error) {
+	if opts == nil {
+		opts = &FeatureOptions{}
+	}
+	summary := &FeatureSummary{}
+	var failed []FeatureResult
+	for _, name := range names {
+		out := &markerWriter{marker: featureResultMarker, w: progress}
+		script := fmt.Sprintf(installFeatureScript, psQuote(name), opts.IncludeAllSubFeatures, opts.IncludeManagementTools, psQuote(opts.Source))
+		code, err := c.runStreaming(ctx, script, out)
+		if err != nil {
+			return summary, fmt.Errorf("failed to install feature %s: %w", name, err)
+		}
+
+		result := FeatureResult{Name: name}
+		if out.value == "" {
+			result.Error = fmt.Sprintf("exited with status %d without reporting a result", code)
+		} else if err := json.Unmarshal([]byte(out.value), &result); err != nil {
+			return summary, fmt.Errorf("failed to parse feature result: %w", err)
+		}
+		c.logger().Info("feature installed", "op", "features", "feature", name, "method", result.Method,
+			"changed", result.Changed, "restart_needed", result.RestartNeeded, "error", result.Error)
+
+		summary.Features = append(summary.Features, result)
+		summary.RestartNeeded = summary.RestartNeeded || result.RestartNeeded
+		if result.Error != "" {
+			failed = append(failed, result)
+		}
+	}
+
+	if summary.RestartNeeded && !opts.SkipRestart {
+		timeout := opts.RestartTimeout
+		if timeout <= 0 {
+			timeout = defaultFeatureRestart
+		}
+		if progress != nil {
+			fmt.Fprintln(progress, "Restarting to finish installing features...")
+		}
+		if err := c.Restart(ctx, timeout); err != nil {
+			return summary, err
+		}
+		summary.Restarted = true
+	}
+
+	if len(failed) > 0 {
+		return summary, &FeatureError{Failed: failed, Summary: summary}
+	}
+	return summary, nil
+}
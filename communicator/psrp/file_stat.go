@@ -0,0 +1,44 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// FileStat describes a path on the remote machine.
+type FileStat struct {
+	Exists bool  `json:"exists"`
+	Dir    bool  `json:"dir"`
+	Size   int64 `json:"size"`
+	// SHA256 is the lowercase hex SHA-256 of a file's contents; empty for
+	// directories.
+	SHA256 string `json:"sha256"`
+}
+
+const fileStatScript = `
+$p = '%s'
+$item = Get-Item -LiteralPath $p -Force -ErrorAction SilentlyContinue
+if (!$item) {
+	[pscustomobject]@{ exists = $false } | ConvertTo-Json -Compress
+} elseif ($item.PSIsContainer) {
+	[pscustomobject]@{ exists = $true; dir = $true } | ConvertTo-Json -Compress
+} else {
+	[pscustomobject]@{
+		exists = $true
+		size   = $item.Length
+		sha256 = (Get-FileHash -LiteralPath $p -Algorithm SHA256).Hash.ToLowerInvariant()
+	} | ConvertTo-Json -Compress
+}
+`
+
+// StatFile reports whether path exists on the remote machine and, for a
+// file, its size and SHA-256, so transfers can be verified end to end.
+func (c *Communicator) StatFile(ctx context.Context, path string) (*FileStat, error) {
+	var stat FileStat
+	script := fmt.Sprintf(fileStatScript, strings.ReplaceAll(path, "'", "''"))
+	if err := c.queryJSON(ctx, script, &stat); err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return &stat, nil
+}
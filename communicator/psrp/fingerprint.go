@@ -0,0 +1,113 @@
+package psrp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// errFingerprintMismatch is returned when the listener presents a
+// certificate other than the pinned or first-seen one.
+var errFingerprintMismatch = errors.New("TLS certificate fingerprint mismatch")
+
+// normalizeFingerprint lower-cases a hex SHA-256 fingerprint and strips
+// colon/space separators, so "AB:CD:..." and "abcd..." compare equal.
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(fp)
+	fp = strings.ReplaceAll(fp, ":", "")
+	return strings.ReplaceAll(fp, " ", "")
+}
+
+// validFingerprint reports whether fp (normalized) is a SHA-256 hex digest.
+func validFingerprint(fp string) bool {
+	if len(fp) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(fp)
+	return err == nil
+}
+
+// certFingerprint performs a TLS handshake with addr ("host:port") and
+// returns the SHA-256 fingerprint of the leaf certificate. Chain
+// verification is skipped: the fingerprint is the trust decision.
+func certFingerprint(ctx context.Context, addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, //nolint:gosec // verified by fingerprint below
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("%s presented no certificate", addr)
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifyServerName performs a TLS handshake with addr ("host:port"),
+// verifying the certificate chain and that it is valid for name.
+func verifyServerName(ctx context.Context, addr, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: name}}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("TLS handshake with %s as %s failed: %w", addr, name, err)
+	}
+	return conn.Close()
+}
+
+// verifyCertificate checks the listener certificate for host in the ways
+// go-psrp cannot: against psrp_tls_server_name, against the pinned
+// fingerprint, or against *seen when trust-on-first-use is enabled. On
+// first use *seen is set to the presented fingerprint. The authFront
+// checks psrp_tls_server_name on every connection; this makes a mismatch
+// fail before go-psrp is involved, with a clearer error.
+func (c *Config) verifyCertificate(ctx context.Context, host string, seen *string) error {
+	if c.PSRPTLSFingerprint == "" && !c.PSRPTLSTrustOnFirstUse && c.PSRPTLSServerName == "" {
+		return nil
+	}
+
+	addr, err := c.probeAddr(host)
+	if err != nil {
+		return err
+	}
+	if c.PSRPTLSServerName != "" {
+		return verifyServerName(ctx, addr, c.PSRPTLSServerName)
+	}
+	got, err := certFingerprint(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	want := normalizeFingerprint(c.PSRPTLSFingerprint)
+	if want == "" {
+		want = *seen
+	}
+	if want == "" {
+		*seen = got
+		return nil
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s presented %s, expected %s", errFingerprintMismatch, addr, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flightRecorderEvents is how many recent protocol events the flight
+// recorder keeps, and maxFlightDumps how many dumps one communicator
+// writes, so a build retrying a failing connection can't fill the disk.
+const (
+	flightRecorderEvents = 1000
+	maxFlightDumps       = 5
+)
+
+// flightRecorder keeps the most recent wire trace events in memory and
+// writes them to a file when a connection or command fails, so failures
+// nobody can reproduce still leave a protocol trace behind. Payloads are
+// never recorded and lines are redacted. A nil *flightRecorder records
+// nothing.
+type flightRecorder struct {
+	base string // dump path without the timestamp and extension
+
+	mu    sync.Mutex
+	lines []string // ring buffer; next is the oldest once full
+	next  int
+	dumps int
+}
+
+// newFlightRecorder returns the recorder for a connection, or nil if
+// psrp_skip_flight_recorder is set.
+func newFlightRecorder(config *Config, connID, target string) *flightRecorder {
+	dir := os.TempDir()
+	if config != nil {
+		if config.PSRPSkipFlightRecorder {
+			return nil
+		}
+		if config.PSRPFlightRecorderDir != "" {
+			dir = config.PSRPFlightRecorderDir
+		}
+	}
+	return &flightRecorder{
+		base: filepath.Join(dir, fmt.Sprintf("psrp-flight-%s-%s", unsafeFileChars.ReplaceAllString(target, "_"), connID)),
+	}
+}
+
+// handler returns a handler that records into the ring buffer. It drops
+// the payload attributes a trace with psrp_trace_payloads adds.
+func (r *flightRecorder) handler() slog.Handler {
+	return slog.NewTextHandler(r, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == "script" || a.Key == "payload") {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+// Write records one line, as slog handlers write one record per call.
+func (r *flightRecorder) Write(p []byte) (int, error) {
+	line := nameMessageTypes(Redact(string(p)))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) < flightRecorderEvents {
+		r.lines = append(r.lines, line)
+	} else {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % flightRecorderEvents
+	}
+	return len(p), nil
+}
+
+// dump writes the recorded events, oldest first, to a new file and
+// returns its path.
+func (r *flightRecorder) dump(reason string, cause error) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dumps >= maxFlightDumps {
+		return "", errors.New("dump limit reached")
+	}
+	r.dumps++
+
+	path := fmt.Sprintf("%s-%s.log", r.base, time.Now().Format("20060102T150405.000"))
+	var b strings.Builder
+	fmt.Fprintf(&b, "# PSRP flight recorder: %s at %s\n", reason, time.Now().Format(time.RFC3339))
+	if cause != nil {
+		fmt.Fprintf(&b, "# error: %s\n", Redact(cause.Error()))
+	}
+	fmt.Fprintf(&b, "# last %d protocol events, oldest first\n", len(r.lines))
+	for _, line := range r.lines[r.next:] {
+		b.WriteString(line)
+	}
+	for _, line := range r.lines[:r.next] {
+		b.WriteString(line)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write PSRP flight recorder: %w", err)
+	}
+	return path, nil
+}
+
+// recordFailure dumps the flight recorder after a connection or command
+// failed, and logs where it went.
+func (c *Communicator) recordFailure(reason string, cause error) {
+	if c.trace == nil || c.trace.recorder == nil {
+		return
+	}
+	c.trace.event("failure", "reason", reason, "error", cause)
+	path, err := c.trace.recorder.dump(reason, cause)
+	if err != nil {
+		c.logger().Debug("flight recorder not written", "op", "trace", "reason", reason, "error", err)
+		return
+	}
+	c.logger().Warn("wrote protocol flight recorder", "op", "trace", "reason", reason, "path", path)
+}
+
+// teeHandler sends each record to every handler that accepts its level.
+type teeHandler []slog.Handler
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(h))
+	for i, handler := range h {
+		out[i] = handler.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(h))
+	for i, handler := range h {
+		out[i] = handler.WithGroup(name)
+	}
+	return out
+}
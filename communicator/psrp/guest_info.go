@@ -0,0 +1,83 @@
+package psrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/smnsjas/go-psrp/client"
+)
+
+// GuestInfo describes the remote machine. StepConnect stores it in the state
+// bag under "psrp_guest_info" after connecting.
+type GuestInfo struct {
+	Hostname     string `json:"hostname"`
+	OSVersion    string `json:"os_version"`
+	PSVersion    string `json:"ps_version"`
+	PSEdition    string `json:"ps_edition"`
+	Architecture string `json:"architecture"`
+}
+
+// String returns a one-line summary suitable for the UI.
+func (g *GuestInfo) String() string {
+	return fmt.Sprintf("%s: %s, PowerShell %s %s, %s",
+		g.Hostname, g.OSVersion, g.PSVersion, g.PSEdition, g.Architecture)
+}
+
+const guestInfoScript = `
+$os = if (Get-Command Get-CimInstance -ErrorAction SilentlyContinue) { Get-CimInstance -ClassName Win32_OperatingSystem -ErrorAction SilentlyContinue }
+[pscustomobject]@{
+	hostname     = [System.Environment]::MachineName
+	os_version   = if ($os) { "$($os.Caption) $($os.Version)".Trim() } else { [System.Environment]::OSVersion.VersionString }
+	ps_version   = $PSVersionTable.PSVersion.ToString()
+	ps_edition   = "$($PSVersionTable.PSEdition)"
+	architecture = if ($env:PROCESSOR_ARCHITECTURE) { $env:PROCESSOR_ARCHITECTURE } else { "$([System.Runtime.InteropServices.RuntimeInformation]::OSArchitecture)" }
+} | ConvertTo-Json -Compress
+`
+
+// GuestInfo queries basic facts about the remote machine.
+func (c *Communicator) GuestInfo(ctx context.Context) (*GuestInfo, error) {
+	var info GuestInfo
+	if err := c.queryJSON(ctx, guestInfoScript, &info); err != nil {
+		return nil, fmt.Errorf("failed to query guest info: %w", err)
+	}
+	return &info, nil
+}
+
+// executeJSON runs a script whose output is a single JSON document (e.g.
+// from ConvertTo-Json) and decodes it into v.
+func (c *Communicator) executeJSON(ctx context.Context, script string, v interface{}) error {
+	result, err := c.execute(ctx, script)
+	return decodeJSONResult(result, err, v)
+}
+
+// queryJSON is executeJSON for a read-only script, which is retried on
+// transient faults; see executeQuery.
+func (c *Communicator) queryJSON(ctx context.Context, script string, v interface{}) error {
+	result, err := c.executeQuery(ctx, script)
+	return decodeJSONResult(result, err, v)
+}
+
+// decodeJSONResult decodes the single JSON document a script wrote into v.
+func decodeJSONResult(result *client.Result, err error, v interface{}) error {
+	if err != nil {
+		return err
+	}
+	if result.HadErrors {
+		return fmt.Errorf("%s", formatResultErrors(result))
+	}
+
+	var parts []string
+	for _, obj := range result.Output {
+		parts = append(parts, fmt.Sprintf("%v", obj))
+	}
+	out := strings.TrimSpace(strings.Join(parts, "\n"))
+	if out == "" {
+		return fmt.Errorf("no output received")
+	}
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		return fmt.Errorf("failed to parse output: %w", err)
+	}
+	return nil
+}
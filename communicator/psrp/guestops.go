@@ -0,0 +1,69 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// guestPowerShell is Windows PowerShell's full path; guest operations don't
+// search PATH.
+const guestPowerShell = `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`
+
+// guestOpsPollInterval is how often a guest process is checked for exit.
+const guestOpsPollInterval = 2 * time.Second
+
+// GuestOperations is the part of VMware's guest operations API (vSphere's
+// GuestProcessManager, carried by VMware Tools) the bootstrap needs. A
+// vSphere builder implements it with its own client and guest credentials,
+// so this plugin takes no dependency on govmomi.
+type GuestOperations interface {
+	// StartProgram starts the program at path in the guest and returns its
+	// process ID.
+	StartProgram(ctx context.Context, path, args string) (pid int64, err error)
+
+	// ProcessExitCode returns the exit code of process pid, with exited
+	// false while it is still running.
+	ProcessExitCode(ctx context.Context, pid int64) (code int32, exited bool, err error)
+}
+
+// GuestOpsChannel returns a BootstrapChannel that runs scripts with Windows
+// PowerShell through guest operations, waiting for each to exit. VMware
+// Tools must be running in the guest; builders typically place the step
+// after waiting for the guest's IP address, which Tools reports.
+func GuestOpsChannel(ops GuestOperations) BootstrapChannel {
+	return BootstrapFunc(func(ctx context.Context, script string) error {
+		pid, err := ops.StartProgram(ctx, guestPowerShell, encodedCommandArgs(script))
+		if err != nil {
+			return fmt.Errorf("failed to start PowerShell through guest operations: %w", err)
+		}
+		logger.Debug("bootstrap started through guest operations", "pid", pid)
+
+		ticker := time.NewTicker(guestOpsPollInterval)
+		defer ticker.Stop()
+		for {
+			code, exited, err := ops.ProcessExitCode(ctx, pid)
+			if err != nil {
+				return fmt.Errorf("failed to check guest process %d: %w", pid, err)
+			}
+			if exited {
+				if code != 0 {
+					return fmt.Errorf("bootstrap script exited with %d in the guest", code)
+				}
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("waiting for guest process %d: %w", pid, ctx.Err())
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// NewGuestOpsBootstrap returns a StepBootstrap that enables remoting for
+// cfg through VMware guest operations. vSphere builders place it before the
+// connect step, so images no longer need WinRM enabled ahead of time.
+func NewGuestOpsBootstrap(cfg *Config, ops GuestOperations) *StepBootstrap {
+	return &StepBootstrap{Config: cfg, Channel: GuestOpsChannel(ops)}
+}
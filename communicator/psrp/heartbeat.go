@@ -0,0 +1,78 @@
+package psrp
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat reports a command that has gone quiet as still running, so a
+// build doesn't look hung. A nil *heartbeat does nothing.
+type heartbeat struct {
+	started    time.Time
+	lastOutput atomic.Int64 // UnixNano
+	stop       chan struct{}
+}
+
+// startHeartbeat starts the heartbeat for a command, or returns nil if
+// psrp_heartbeat_interval is unset.
+func (c *Communicator) startHeartbeat() *heartbeat {
+	if c.config == nil || c.config.PSRPHeartbeatInterval <= 0 {
+		return nil
+	}
+	interval := c.config.PSRPHeartbeatInterval
+	h := &heartbeat{started: time.Now(), stop: make(chan struct{})}
+	h.lastOutput.Store(h.started.UnixNano())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case now := <-ticker.C:
+				quiet := now.Sub(time.Unix(0, h.lastOutput.Load()))
+				if quiet < interval {
+					continue
+				}
+				msg := fmt.Sprintf("still running (elapsed %s, last output %s ago)",
+					shortDuration(now.Sub(h.started)), shortDuration(quiet))
+				if c.ui != nil {
+					c.ui.Message(msg)
+				} else {
+					c.logger().Info(msg, "op", "command")
+				}
+			}
+		}
+	}()
+	return h
+}
+
+// output records that the command wrote something.
+func (h *heartbeat) output() {
+	if h != nil {
+		h.lastOutput.Store(time.Now().UnixNano())
+	}
+}
+
+// Stop ends the heartbeat once the command exits.
+func (h *heartbeat) Stop() {
+	if h != nil {
+		close(h.stop)
+	}
+}
+
+// shortDuration formats d to the second, dropping zero trailing units:
+// "12m", "1h5m", "45s".
+func shortDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// guestIdentity identifies a machine across reboots and address changes.
+type guestIdentity struct {
+	MachineGUID string `json:"machine_guid"`
+	Hostname    string `json:"hostname"`
+}
+
+func (g *guestIdentity) String() string {
+	return fmt.Sprintf("%s (MachineGuid %s)", g.Hostname, g.MachineGUID)
+}
+
+const guestIdentityScript = `
+[pscustomobject]@{
+	machine_guid = if ($IsLinux) {
+		"$(Get-Content /etc/machine-id -TotalCount 1 -ErrorAction SilentlyContinue)"
+	} else {
+		"$((Get-ItemProperty -Path 'HKLM:\SOFTWARE\Microsoft\Cryptography' -Name MachineGuid -ErrorAction SilentlyContinue).MachineGuid)"
+	}
+	hostname     = [System.Environment]::MachineName
+} | ConvertTo-Json -Compress
+`
+
+// identity queries the guest's identity.
+func (c *Communicator) identity(ctx context.Context) (*guestIdentity, error) {
+	var id guestIdentity
+	if err := c.queryJSON(ctx, guestIdentityScript, &id); err != nil {
+		return nil, fmt.Errorf("failed to query guest identity: %w", err)
+	}
+	return &id, nil
+}
+
+// verifyIdentity records the guest's identity on first connect and, on
+// every later connect (step re-run, reboot, new address), checks that the
+// same machine answered. The MachineGuid is authoritative when both sides
+// have one, since provisioning may legitimately rename the computer; the
+// hostname is compared only as a fallback.
+func (s *StepConnect) verifyIdentity(ctx context.Context) error {
+	if s.Config.PSRPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Config.PSRPTimeout)
+		defer cancel()
+	}
+
+	got, err := s.comm.identity(ctx)
+	if err != nil {
+		// Not being able to tell shouldn't block the build
+		s.logger().Warn("skipping identity check", "error", err)
+		return nil
+	}
+	if s.identity == nil {
+		s.identity = got
+		return nil
+	}
+
+	want := s.identity
+	same := strings.EqualFold(got.Hostname, want.Hostname)
+	if got.MachineGUID != "" && want.MachineGUID != "" {
+		same = strings.EqualFold(got.MachineGUID, want.MachineGUID)
+	}
+	if !same {
+		return fmt.Errorf("reconnected to a different machine at %s: expected %s, got %s; "+
+			"the address may have been reassigned (e.g. a reused DHCP lease)", s.host, want, got)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ImageManifest summarizes what a build put on the guest, for recording
+// alongside the artifact once provisioning is done.
+type ImageManifest struct {
+	CollectedAt time.Time   `json:"collected_at"`
+	Facts       *GuestFacts `json:"facts"`
+
+	// Updates are the installed updates (Get-HotFix), oldest first.
+	Updates []InstalledUpdate `json:"updates"`
+
+	// Software is what appears under Programs and Features, from both
+	// registry views.
+	Software []InstalledSoftware `json:"software"`
+}
+
+// InstalledUpdate is an installed Windows update.
+type InstalledUpdate struct {
+	ID          string `json:"id"` // e.g. "KB5034439"
+	Description string `json:"description"`
+
+	// InstalledOn is empty when Windows doesn't record the date.
+	InstalledOn string `json:"installed_on,omitempty"`
+}
+
+// InstalledSoftware is an entry from Programs and Features.
+type InstalledSoftware struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Publisher string `json:"publisher,omitempty"`
+}
+
+// imageManifestScript collects the updates and software for ImageManifest.
+// Software names are matched against the -like patterns in $patterns.
+const imageManifestScript = `$ErrorActionPreference = 'SilentlyContinue'
+$patterns = @(%s)
+$updates = @(Get-HotFix | Sort-Object { $_.InstalledOn } | ForEach-Object {
+	[pscustomobject]@{
+		id           = "$($_.HotFixID)"
+		description  = "$($_.Description)"
+		installed_on = if ($_.InstalledOn) { $_.InstalledOn.ToString('yyyy-MM-dd') } else { '' }
+	}
+})
+$keys = @(
+	'HKLM:\SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall\*',
+	'HKLM:\SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall\*'
+)
+$software = @(Get-ItemProperty -Path $keys |
+	Where-Object { $_.DisplayName -and -not $_.SystemComponent -and -not $_.ParentKeyName } |
+	Where-Object { $n = $_.DisplayName; -not $patterns.Count -or ($patterns | Where-Object { $n -like $_ }) } |
+	Sort-Object DisplayName, DisplayVersion -Unique |
+	ForEach-Object {
+		[pscustomobject]@{ name = "$($_.DisplayName)"; version = "$($_.DisplayVersion)"; publisher = "$($_.Publisher)" }
+	})
+[pscustomobject]@{ updates = $updates; software = $software } | ConvertTo-Json -Compress -Depth 4
+`
+
+// ImageManifest collects an ImageManifest. If software is non-empty, only
+// software whose name matches one of its wildcard patterns (e.g.
+// "Microsoft Visual C++*") is listed.
+func (c *Communicator) ImageManifest(ctx context.Context, software []string) (*ImageManifest, error) {
+	facts, err := c.GuestFacts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ImageManifest{CollectedAt: time.Now().UTC(), Facts: facts}
+	if err := c.queryJSON(ctx, fmt.Sprintf(imageManifestScript, psList(software)), manifest); err != nil {
+		return nil, fmt.Errorf("failed to collect image manifest: %w", err)
+	}
+	return manifest, nil
+}
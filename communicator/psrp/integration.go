@@ -0,0 +1,73 @@
+package psrp
+
+import (
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// CommunicatorType is the value of the template's "communicator" option
+// that selects PSRP.
+const CommunicatorType = "psrp"
+
+// HostFunc returns the address of the machine to connect to.
+type HostFunc func(multistep.StateBag) (string, error)
+
+// WrapStepConnect registers a PSRP StepConnect for cfg under
+// CustomConnect["psrp"] on the SDK's communicator step and returns it. If
+// host is nil, commStep.Host is used; if commStep.Host is nil, it is set to
+// host so the SDK can report the address it connects to.
+func WrapStepConnect(commStep *communicator.StepConnect, cfg *Config, host HostFunc) *communicator.StepConnect {
+	if host == nil {
+		host = commStep.Host
+	}
+	if commStep.Host == nil {
+		commStep.Host = host
+	}
+	if commStep.CustomConnect == nil {
+		commStep.CustomConnect = make(map[string]multistep.Step)
+	}
+	commStep.CustomConnect[CommunicatorType] = &StepConnect{
+		Config: cfg,
+		Host:   host,
+	}
+	return commStep
+}
+
+// PrepareCommunicator prepares the SDK communicator config and, when it
+// selects PSRP, cfg as well. The SDK rejects communicator types it doesn't
+// know, so for "psrp" it is validated as "none" (which still checks the
+// shared options such as pause_before_connecting) and the type restored.
+// Builders call this in place of comm.Prepare. The SDK's ssh_bastion_*
+// options, when set, configure the SSH tunnel unless psrp_ssh_tunnel_host
+// (or psrp_bastion_host) does. opts are passed to cfg.Prepare; pass
+// WithInterpolation if the builder decodes its configuration without
+// interpolating it.
+func PrepareCommunicator(comm *communicator.Config, cfg *Config, ctx *interpolate.Context, opts ...PrepareOption) (warnings []string, errs []error) {
+	if comm.Type != CommunicatorType {
+		return nil, comm.Prepare(ctx)
+	}
+
+	comm.Type = "none"
+	errs = comm.Prepare(ctx)
+	comm.Type = CommunicatorType
+
+	applyBastion(comm, cfg)
+	errs = append(errs, cfg.Prepare(ctx, opts...)...)
+	return cfg.Warnings(), errs
+}
+
+// applyBastion copies the SDK's ssh_bastion_* options onto the SSH tunnel
+// options, so templates can keep the bastion settings they use with the SSH
+// communicator.
+func applyBastion(comm *communicator.Config, cfg *Config) {
+	if comm.SSHBastionHost == "" || cfg.PSRPSSHTunnelHost != "" || cfg.PSRPBastionHost != "" {
+		return
+	}
+	cfg.PSRPSSHTunnelHost = comm.SSHBastionHost
+	cfg.PSRPSSHTunnelPort = comm.SSHBastionPort
+	cfg.PSRPSSHTunnelUsername = comm.SSHBastionUsername
+	cfg.PSRPSSHTunnelPassword = comm.SSHBastionPassword
+	cfg.PSRPSSHTunnelKeyFile = comm.SSHBastionPrivateKeyFile
+	cfg.PSRPSSHTunnelAgentAuth = comm.SSHBastionAgentAuth
+}
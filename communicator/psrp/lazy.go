@@ -0,0 +1,160 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errClosedWhileConnecting is returned to operations waiting on a deferred
+// connection that Close abandoned.
+var errClosedWhileConnecting = errors.New("communicator closed while connecting")
+
+// lazyConnect is a deferred connection in progress. Operations that need
+// the session while it runs wait for it instead of starting their own.
+type lazyConnect struct {
+	done chan struct{}
+	err  error
+}
+
+// connectLazily establishes a connection deferred by psrp_lazy_connect,
+// retrying at PSRPRetryInterval until PSRPTimeout as StepConnect would
+// have. The retries run without c.mu, so Close isn't held up by them; c.mu
+// is only taken to install the session.
+func (c *Communicator) connectLazily(ctx context.Context) error {
+	c.mu.Lock()
+	if c.connected || !c.lazy {
+		c.mu.Unlock()
+		return nil
+	}
+	if pending := c.connecting; pending != nil {
+		c.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	attempt := &lazyConnect{done: make(chan struct{})}
+	c.connecting = attempt
+	fingerprint := c.fingerprint
+	c.mu.Unlock()
+
+	attempt.err = c.retryLazyConnect(ctx, fingerprint)
+
+	c.mu.Lock()
+	c.connecting = nil
+	c.mu.Unlock()
+	close(attempt.done)
+	return attempt.err
+}
+
+// retryLazyConnect runs the attempts for connectLazily and installs the
+// first client that connects.
+func (c *Communicator) retryLazyConnect(ctx context.Context, fingerprint string) error {
+	timeout := c.config.PSRPTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	interval := c.config.PSRPRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c.logger().Info("establishing deferred connection")
+	for attempt := 1; ; attempt++ {
+		cl, err := c.lazyAttempt(ctx, &fingerprint)
+		if err == nil {
+			if err := c.installLazyClient(ctx, cl, fingerprint); err != nil {
+				return err
+			}
+			return c.checkLazyClient(ctx)
+		}
+
+		c.logger().Debug("deferred connection attempt failed", "attempt", attempt, "error", err)
+		if perr := c.config.permanentConnectError(err); perr != nil {
+			return perr
+		}
+		c.mu.Lock()
+		closed := !c.lazy
+		c.mu.Unlock()
+		if closed {
+			return errClosedWhileConnecting
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: deferred connection (last error: %w)", ErrConnectionTimeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lazyAttempt connects a new client, abandoning it if ctx is done first.
+func (c *Communicator) lazyAttempt(ctx context.Context, fingerprint *string) (PSRPClient, error) {
+	if err := c.config.verifyCertificate(ctx, c.target, fingerprint); err != nil {
+		return nil, err
+	}
+	c.trustCertificate(*fingerprint)
+	cl, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cl.Connect(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return cl, nil
+	case <-ctx.Done():
+	}
+	go func() {
+		if err := <-done; err == nil {
+			forceClose(context.Background(), cl)
+		}
+	}()
+	return nil, ctx.Err()
+}
+
+// installLazyClient makes cl the session, unless Close ran meanwhile.
+func (c *Communicator) installLazyClient(ctx context.Context, cl PSRPClient, fingerprint string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.lazy {
+		forceClose(ctx, cl)
+		return errClosedWhileConnecting
+	}
+	c.client = cl
+	c.fingerprint = fingerprint
+	c.connected = true
+	c.stale = false
+	c.startWatchdog()
+	return nil
+}
+
+// checkLazyClient runs lazyCheck on the session just installed, and drops
+// the session if it fails so no operation runs on it.
+func (c *Communicator) checkLazyClient(ctx context.Context) error {
+	if c.lazyCheck == nil {
+		return nil
+	}
+	err := c.lazyCheck(ctx)
+	if err == nil {
+		return nil
+	}
+
+	c.stopWatchdog()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	forceClose(ctx, c.client)
+	return err
+}
@@ -0,0 +1,94 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestCloseDuringLazyConnect checks that Close doesn't wait for a deferred
+// connection's retries, and that the operation waiting on it then fails.
+func TestCloseDuringLazyConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	config := NewConfig()
+	config.PSRPHost = "127.0.0.1"
+	config.PSRPPort = port
+	config.PSRPAuthType = AuthBasic
+	config.PSRPUsername = "packer"
+	config.PSRPPassword = "packer"
+	config.PSRPLazyConnect = true
+	config.PSRPTimeout = time.Minute
+	config.PSRPRetryInterval = 10 * time.Millisecond
+	comm, err := New("127.0.0.1", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := comm.session(context.Background())
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		comm.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the deferred connection's retries")
+	}
+
+	// The attempt in flight ends on its own, and no more are made
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errClosedWhileConnecting) {
+			t.Fatalf("deferred connection ended with %v, want %v", err, errClosedWhileConnecting)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deferred connection kept retrying after Close")
+	}
+}
+
+// TestCheckLazyClient checks that a deferred connection failing the
+// identity check is dropped rather than used.
+func TestCheckLazyClient(t *testing.T) {
+	config := NewConfig()
+	config.PSRPUsername = "packer"
+	config.PSRPPassword = "packer"
+	config.PSRPLazyConnect = true
+	comm, err := New("127.0.0.1", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatch := errors.New("reconnected to a different machine")
+	comm.lazyCheck = func(context.Context) error { return mismatch }
+	comm.connected = true
+	if err := comm.checkLazyClient(context.Background()); !errors.Is(err, mismatch) {
+		t.Fatalf("checkLazyClient() = %v, want %v", err, mismatch)
+	}
+	if comm.connected {
+		t.Error("session still marked connected after a failed check")
+	}
+
+	comm.lazyCheck = func(context.Context) error { return nil }
+	comm.connected = true
+	if err := comm.checkLazyClient(context.Background()); err != nil {
+		t.Fatalf("checkLazyClient() = %v", err)
+	}
+	if !comm.connected {
+		t.Error("session dropped after a passing check")
+	}
+}
@@ -0,0 +1,77 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// livenessFailures is how many probes in a row must fail before a running
+// command's session is declared dead.
+const livenessFailures = 3
+
+// watchLiveness probes the WSMan listener every psrp_command_liveness_interval
+// while a command runs and sends on the returned channel if it stops
+// answering, since a guest that dies mid-command can leave the pipeline's
+// streams open forever. stop ends the watch. Only wsman sessions are
+// watched; the other transports see their connection close. With an SSH
+// tunnel the probes go through it.
+func (c *Communicator) watchLiveness() (lost <-chan error, stop func()) {
+	ch := make(chan error, 1)
+	if c.config == nil || c.config.PSRPSkipLivenessCheck || c.config.PSRPTransport != TransportWSMan ||
+		c.config.PSRPLivenessInterval <= 0 {
+		return ch, func() {}
+	}
+	interval := c.config.PSRPLivenessInterval
+	endpoint := c.config.EndpointURL(c.target)
+	if c.tunnel != nil {
+		// The guest may only be reachable through the tunnel
+		endpoint = c.tunnel.endpointURL(c.config)
+	}
+	ctx, cancel := context.WithCancel(c.rootContext())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := probeHTTP(ctx, endpoint)
+			if err == nil {
+				failures = 0
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			c.logger().Warn("guest not answering while a command runs", "op", "command",
+				"failures", failures, "of", livenessFailures, "error", err)
+			if failures >= livenessFailures {
+				ch <- fmt.Errorf("%w: the listener at %s did not answer %d probes %s apart: %w",
+					ErrSessionLost, endpoint, failures, interval, err)
+				return
+			}
+		}
+	}()
+	return ch, cancel
+}
+
+// abandonDeadSession marks the session dead so the next operation
+// reconnects, and force-closes its client so goroutines blocked on it
+// return.
+func (c *Communicator) abandonDeadSession(cl PSRPClient) {
+	c.mu.Lock()
+	if c.client == cl {
+		c.stale = true
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	forceClose(ctx, cl)
+}
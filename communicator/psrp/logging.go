@@ -0,0 +1,143 @@
+package psrp
+
+import (
+	"encoding/base64"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+)
+
+// redacted replaces secrets in log output.
+const redacted = "<redacted>"
+
+// minSecretLength is the shortest value RegisterSecret scrubs; shorter ones
+// would blank out unrelated text.
+const minSecretLength = 4
+
+// logger is the package's root logger. It writes through log.Writer(), where
+// Packer collects plugin logs, after redacting secrets. Communicators and
+// steps derive their own loggers from it with their connection ID.
+var logger = hclog.New(&hclog.LoggerOptions{
+	Name:   "psrp",
+	Level:  rootLogLevel(),
+	Output: redactingWriter{},
+})
+
+// rootLogLevel is debug, or trace with PACKER_PSRP_TRACE set.
+func rootLogLevel() hclog.Level {
+	if traceEnabled() {
+		return hclog.Trace
+	}
+	return hclog.Debug
+}
+
+// secretKeyPattern matches key=value pairs whose key names a secret, so
+// values logged under such keys are hidden even if never registered.
+var secretKeyPattern = regexp.MustCompile(`(?i)\b([\w.-]*(?:password|passwd|secret|token|keytab)[\w.-]*)=("(?:[^"\\]|\\.)*"|\S+)`)
+
+var secrets struct {
+	sync.RWMutex
+	values []string // longest first, so overlapping secrets are fully hidden
+}
+
+// RegisterSecret adds value to the set of strings scrubbed from log output.
+// Config.Prepare registers the password and keytab; plugins should register
+// any other credential they hold, such as an elevated password.
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+	sort.Slice(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+}
+
+// registerKeytab registers the contents of a keytab file, raw and base64
+// encoded, so neither form can leak into logs.
+func registerKeytab(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return // reported when the keytab is used
+	}
+	RegisterSecret(string(data))
+	RegisterSecret(base64.StdEncoding.EncodeToString(data))
+}
+
+// Redact returns s with registered secrets and values of secret-named keys
+// replaced.
+func Redact(s string) string {
+	secrets.RLock()
+	for _, v := range secrets.values {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	secrets.RUnlock()
+	return secretKeyPattern.ReplaceAllString(s, "$1="+redacted)
+}
+
+// redactingWriter redacts each log line before handing it to the standard
+// logger's writer, looked up per write since Packer sets it after init.
+type redactingWriter struct{}
+
+func (redactingWriter) Write(p []byte) (int, error) {
+	if _, err := log.Writer().Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newConnID returns a short identifier tying together one connection's log
+// lines.
+func newConnID() string {
+	return uuid.NewString()[:8]
+}
+
+// logger returns the communicator's logger, tagged with its connection ID.
+func (c *Communicator) logger() hclog.Logger {
+	if c.log == nil {
+		return logger
+	}
+	return c.log
+}
+
+// logger returns the step's logger: the communicator's once there is one,
+// so connect-time lines carry the connection ID.
+func (s *StepConnect) logger() hclog.Logger {
+	if s.comm != nil {
+		return s.comm.logger().With("op", "connect")
+	}
+	return logger.With("op", "connect", "host", s.host)
+}
+
+// connectionFields describes the negotiated connection settings for the
+// trace-level log lines PACKER_PSRP_TRACE turns on.
+func (c *Config) connectionFields() []any {
+	if c == nil {
+		return nil
+	}
+	return []any{
+		"transport", c.PSRPTransport,
+		"port", c.PSRPPort,
+		"tls", c.PSRPUseTLS,
+		"auth", c.PSRPAuthType,
+		"effective_auth", c.effectiveAuthType(),
+		"wsman_path", c.PSRPWSManPath,
+		"max_envelope_kb", c.PSRPMaxEnvelopeSize,
+		"upload_chunk_bytes", c.UploadChunkSize(),
+		"max_runspaces", c.PSRPMaxRunspaces,
+		"idle_timeout", c.PSRPIdleTimeout,
+		"keepalive", c.PSRPKeepAliveInterval,
+		"operation_timeout", c.PSRPOperationTimeout,
+	}
+}
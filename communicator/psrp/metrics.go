@@ -0,0 +1,68 @@
+package psrp
+
+import (
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packerbuilderdata"
+)
+
+// GeneratedDataKeys are the build variables StepConnect publishes. Builders
+// should return them from Prepare (as generated variable names) so templates
+// can reference e.g. build.PSRPTimeToConnect. The guest facts are only set
+// with psrp_collect_facts; see GuestFacts.
+var GeneratedDataKeys = []string{
+	"PSRPTimeToPortOpen",
+	"PSRPTimeToConnect",
+	"PSRPConnectRetries",
+	"PSRPOSBuild",
+	"PSRPOSCaption",
+	"PSRPInstallationType",
+	"PSRPFeatures",
+	"PSRPDotNetVersions",
+	"PSRPActivationStatus",
+	"PSRPGuestFacts",
+}
+
+// ConnectMetrics records how long StepConnect took to reach the guest.
+// StepConnect stores it in the state bag under "psrp_connect_metrics" and
+// publishes it as build variables (see GeneratedDataKeys).
+type ConnectMetrics struct {
+	// TimeToPortOpen is the time from the start of the step until the
+	// endpoint accepted TCP connections (zero if the probe was skipped).
+	TimeToPortOpen time.Duration
+
+	// TimeToConnect is the time from the start of the step until the first
+	// successful authentication and runspace open.
+	TimeToConnect time.Duration
+
+	// Retries is the number of connection attempts after the first.
+	Retries int
+
+	started time.Time
+}
+
+// portOpen records the first time the port was seen open.
+func (m *ConnectMetrics) portOpen() {
+	if m.TimeToPortOpen == 0 {
+		m.TimeToPortOpen = time.Since(m.started)
+	}
+}
+
+// connected records the first successful connection.
+func (m *ConnectMetrics) connected() {
+	if m.TimeToConnect == 0 {
+		m.TimeToConnect = time.Since(m.started)
+	}
+}
+
+// publish stores the metrics in the state bag and as build variables.
+// Durations are published in (fractional) seconds.
+func (m *ConnectMetrics) publish(state multistep.StateBag) {
+	state.Put("psrp_connect_metrics", m)
+
+	data := &packerbuilderdata.GeneratedData{State: state}
+	data.Put("PSRPTimeToPortOpen", m.TimeToPortOpen.Seconds())
+	data.Put("PSRPTimeToConnect", m.TimeToConnect.Seconds())
+	data.Put("PSRPConnectRetries", m.Retries)
+}
@@ -0,0 +1,266 @@
+package psrp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/smnsjas/go-psrp/client"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// mockConfig returns a prepared config for a communicator on a MockClient.
+func mockConfig(t *testing.T) *psrp.Config {
+	t.Helper()
+	config := psrp.NewConfig()
+	config.PSRPHost = "mock"
+	config.PSRPUsername = "packer"
+	config.PSRPPassword = "packer"
+	config.PSRPAllowInsecureBasic = true
+	config.PSRPFlightRecorderDir = t.TempDir()
+	if errs := config.Prepare(nil); len(errs) > 0 {
+		t.Fatalf("Prepare: %v", errs)
+	}
+	return config
+}
+
+// mockComm returns a connected communicator whose sessions are m.
+func mockComm(t *testing.T, m *testutil.MockClient, config *psrp.Config) *psrp.Communicator {
+	t.Helper()
+	comm, err := psrp.NewWithClientFactory("mock", config, m.Factory())
+	if err != nil {
+		t.Fatalf("NewWithClientFactory: %v", err)
+	}
+	t.Cleanup(func() { comm.Close() })
+	if err := comm.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return comm
+}
+
+// run starts command and returns its exit code and output.
+func run(t *testing.T, comm *psrp.Communicator, command string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errs bytes.Buffer
+	cmd := &packersdk.RemoteCmd{Command: command, Stdout: &out, Stderr: &errs}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return cmd.Wait(), out.String(), errs.String()
+}
+
+func TestMockStartExitCode(t *testing.T) {
+	m := testutil.NewMockClient()
+	m.StreamFunc = testutil.StreamLines("hello", "__PACKER_EXIT_CODE__:4")
+	comm := mockComm(t, m, mockConfig(t))
+
+	code, stdout, _ := run(t, comm, "Do-Something")
+	if code != 4 {
+		t.Errorf("exit code = %d, want 4", code)
+	}
+	if !strings.Contains(stdout, "hello") {
+		t.Errorf("stdout = %q, want hello", stdout)
+	}
+	if scripts := m.Scripts(); len(scripts) != 1 || !strings.Contains(scripts[0], "Do-Something") {
+		t.Errorf("scripts = %q", scripts)
+	}
+}
+
+func TestMockStreamError(t *testing.T) {
+	m := testutil.NewMockClient()
+	m.StreamFunc = testutil.StreamError(errors.New("pipeline broke"), "error record")
+	comm := mockComm(t, m, mockConfig(t))
+
+	code, _, stderr := run(t, comm, "Do-Something")
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	for _, want := range []string{"error record", "pipeline broke"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr %q is missing %q", stderr, want)
+		}
+	}
+}
+
+func TestMockFailOnErrorRecords(t *testing.T) {
+	m := testutil.NewMockClient()
+	m.StreamFunc = func(context.Context, string) (*psrp.Stream, error) {
+		return testutil.NewStream([]string{"__PACKER_EXIT_CODE__:0"}, []string{"error record"}, nil), nil
+	}
+	config := mockConfig(t)
+	config.PSRPFailOnErrorRecords = true
+	comm := mockComm(t, m, config)
+
+	if code, _, _ := run(t, comm, "Do-Something"); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+}
+
+func TestMockCancel(t *testing.T) {
+	m := testutil.NewMockClient()
+	m.StreamFunc = testutil.StreamBlocking()
+	comm := mockComm(t, m, mockConfig(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := &packersdk.RemoteCmd{Command: "Start-Sleep 3600"}
+	if err := comm.Start(ctx, cmd); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	cancel()
+
+	exited := make(chan int, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("exit code = %d, want 1", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("cancelled command did not exit")
+	}
+}
+
+func TestMockConnectError(t *testing.T) {
+	m := testutil.NewMockClient()
+	m.ConnectErr = errors.New("access denied")
+	comm, err := psrp.NewWithClientFactory("mock", mockConfig(t), m.Factory())
+	if err != nil {
+		t.Fatalf("NewWithClientFactory: %v", err)
+	}
+	defer comm.Close()
+
+	if err := comm.Connect(context.Background()); err == nil {
+		t.Fatal("Connect succeeded despite ConnectErr")
+	}
+	if m.IsConnected() {
+		t.Error("mock reports connected after a failed Connect")
+	}
+}
+
+func TestMockCloseStopsWatchdog(t *testing.T) {
+	m := testutil.NewMockClient()
+	m.StreamFunc = testutil.StreamBlocking()
+	config := mockConfig(t)
+	config.PSRPLazyConnect = true
+	config.PSRPWatchdogInterval = time.Millisecond
+	comm := mockComm(t, m, config)
+
+	// The first command makes the deferred connection, which starts the
+	// watchdog on its own goroutine
+	go comm.Start(context.Background(), &packersdk.RemoteCmd{Command: "Do-Something"})
+	deadline := time.Now().Add(10 * time.Second)
+	for !m.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("deferred connection not made")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	comm.Close()
+
+	probes := func() (n int) {
+		for _, s := range m.Scripts() {
+			if s == "$null" {
+				n++
+			}
+		}
+		return n
+	}
+	before := probes()
+	time.Sleep(50 * time.Millisecond)
+	if after := probes(); after != before {
+		t.Errorf("watchdog probed %d times after Close", after-before)
+	}
+}
+
+// TestMockCloseWaitsWithoutLock checks that Close doesn't hold the
+// session lock while it waits for commands: one that ignores cancellation
+// ends once the session is closed, and needs the lock to finish, as the
+// resume and liveness paths do.
+func TestMockCloseWaitsWithoutLock(t *testing.T) {
+	m := testutil.NewMockClient()
+	var comm *psrp.Communicator
+	m.StreamFunc = func(context.Context, string) (*psrp.Stream, error) {
+		s := testutil.NewStream(nil, nil, nil)
+		s.CancelFunc = func() {}
+		s.WaitFunc = func() error {
+			for m.IsConnected() {
+				time.Sleep(time.Millisecond)
+			}
+			comm.ConnectionInfo()
+			return errors.New("session closed")
+		}
+		return s, nil
+	}
+	comm = mockComm(t, m, mockConfig(t))
+
+	cmd := &packersdk.RemoteCmd{Command: "Start-Sleep 3600"}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	start := time.Now()
+	comm.Close()
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("Close took %v, waiting out its timeout for a command that had ended", elapsed)
+	}
+	if code := cmd.Wait(); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+}
+
+// resumableMock adds go-psrp's recovery API to a MockClient, for
+// psrp_resume_on_disconnect. Every command's output is result.
+type resumableMock struct {
+	*testutil.MockClient
+	result *client.Result
+}
+
+func (r *resumableMock) ExecuteAsync(context.Context, string) (string, error) { return "command", nil }
+func (r *resumableMock) ShellID() string                                      { return "shell" }
+func (r *resumableMock) PoolID() string                                       { return "pool" }
+
+func (r *resumableMock) RecoverPipelineOutput(context.Context, string, string) (*client.Result, error) {
+	return r.result, nil
+}
+
+// panicWriter panics on every write, as a broken caller's Writer might.
+type panicWriter struct{}
+
+func (panicWriter) Write([]byte) (int, error) { panic("broken writer") }
+
+func TestMockResumablePanic(t *testing.T) {
+	m := &resumableMock{
+		MockClient: testutil.NewMockClient(),
+		result:     testutil.Result("hello", "__PACKER_EXIT_CODE__:0"),
+	}
+	config := mockConfig(t)
+	config.PSRPResumeOnDisconnect = true
+	comm, err := psrp.NewWithClientFactory("mock", config, func(string, *psrp.Config) (psrp.PSRPClient, error) {
+		return m, nil
+	})
+	if err != nil {
+		t.Fatalf("NewWithClientFactory: %v", err)
+	}
+	t.Cleanup(func() { comm.Close() })
+	if err := comm.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := &packersdk.RemoteCmd{Command: "Write-Output hello", Stdout: panicWriter{}, Stderr: &stderr}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if code := cmd.Wait(); code != 1 {
+		t.Errorf("exit code = %d, want 1 after the output writer panicked", code)
+	}
+	if !strings.Contains(stderr.String(), "panic while handling command output") {
+		t.Errorf("stderr %q doesn't report the panic", stderr.String())
+	}
+}
@@ -0,0 +1,105 @@
+package psrp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// StateAuthMechanism is set in the state bag to the authentication
+// mechanism the server reports for the session (e.g. "Kerberos", "NTLM").
+const StateAuthMechanism = "psrp_auth_mechanism"
+
+// validNegotiateMechanisms are the psrp_negotiate_mechanisms go-psrp can
+// honour: it tries Kerberos and falls back to NTLM, or uses one alone.
+var validNegotiateMechanisms = []string{"kerberos,ntlm", "kerberos", "ntlm"}
+
+// negotiateMechanisms returns psrp_negotiate_mechanisms as a normalized,
+// comma-joined list, defaulting to "kerberos,ntlm".
+func (c *Config) negotiateMechanisms() string {
+	if len(c.PSRPNegotiateMechanisms) == 0 {
+		return "kerberos,ntlm"
+	}
+	mechs := make([]string, len(c.PSRPNegotiateMechanisms))
+	for i, m := range c.PSRPNegotiateMechanisms {
+		mechs[i] = strings.ToLower(strings.TrimSpace(m))
+	}
+	return strings.Join(mechs, ",")
+}
+
+// effectiveAuthType returns the mechanism go-psrp is asked for: negotiate
+// narrowed to kerberos or ntlm by psrp_negotiate_mechanisms.
+func (c *Config) effectiveAuthType() AuthType {
+	if c.PSRPAuthType != AuthNegotiate {
+		return c.PSRPAuthType
+	}
+	switch c.negotiateMechanisms() {
+	case "kerberos":
+		return AuthKerberos
+	case "ntlm":
+		return AuthNTLM
+	}
+	return AuthNegotiate
+}
+
+// forbidsNTLM reports whether psrp_negotiate_mechanisms rules out NTLM.
+// SSPI's Kerberos can still fall back to NTLM on Windows, so StepConnect
+// checks what the server saw.
+func (c *Config) forbidsNTLM() bool {
+	return c.PSRPAuthType == AuthNegotiate && c.negotiateMechanisms() == "kerberos"
+}
+
+// validateNegotiateMechanisms checks psrp_negotiate_mechanisms.
+func (c *Config) validateNegotiateMechanisms() (errs []error) {
+	if len(c.PSRPNegotiateMechanisms) == 0 {
+		return nil
+	}
+	valid := false
+	for _, v := range validNegotiateMechanisms {
+		valid = valid || c.negotiateMechanisms() == v
+	}
+	if !valid {
+		errs = append(errs, errors.New(`psrp_negotiate_mechanisms must be ["kerberos", "ntlm"], ["kerberos"] or ["ntlm"]`))
+	}
+	if c.PSRPAuthType != AuthNegotiate || c.PSRPTransport != TransportWSMan {
+		errs = append(errs, errors.New("psrp_negotiate_mechanisms requires psrp_auth_type 'negotiate' and psrp_transport 'wsman'"))
+	}
+	if c.negotiateMechanisms() == "ntlm" && (c.PSRPUsername == "" && c.credentialProvider() == nil || c.PSRPUseMachineCredentials) {
+		errs = append(errs, errors.New(`psrp_negotiate_mechanisms ["ntlm"] needs psrp_username; single sign-on is Kerberos only`))
+	}
+	if c.forbidsNTLM() && c.PSRPLazyConnect {
+		errs = append(errs, errors.New(`psrp_negotiate_mechanisms ["kerberos"] cannot be used with psrp_lazy_connect, which skips the mechanism check`))
+	}
+	return errs
+}
+
+// checkAuthMechanism asks the server how the session authenticated,
+// reports it, and fails if NTLM was used where psrp_negotiate_mechanisms
+// forbids it.
+func (s *StepConnect) checkAuthMechanism(state multistep.StateBag, ui packersdk.Ui) error {
+	infoCtx, infoCancel := s.comm.opContext()
+	info, err := s.comm.QueryConnectionInfo(infoCtx)
+	infoCancel()
+	if err != nil {
+		if s.config.forbidsNTLM() {
+			return fmt.Errorf("could not confirm the session did not use NTLM, as psrp_negotiate_mechanisms requires: %w", err)
+		}
+		s.logger().Debug("querying connection info failed", "error", err)
+		return nil
+	}
+	s.logger().Debug("connection info", "info", info)
+
+	if info.AuthMechanism == "" {
+		return nil
+	}
+	state.Put(StateAuthMechanism, info.AuthMechanism)
+	if s.config.forbidsNTLM() && strings.EqualFold(info.AuthMechanism, "NTLM") {
+		return errors.New(`the session authenticated with NTLM, which psrp_negotiate_mechanisms ["kerberos"] forbids; ` +
+			"check that the host name has an SPN (HTTP/" + s.host + ") and the Packer host can reach a domain controller")
+	}
+	ui.Message(fmt.Sprintf("Authenticated with %s", info.AuthMechanism))
+	return nil
+}
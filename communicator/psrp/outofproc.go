@@ -0,0 +1,184 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/smnsjas/go-psrp/client"
+	"github.com/smnsjas/go-psrpcore/messages"
+	"github.com/smnsjas/go-psrpcore/outofproc"
+	"github.com/smnsjas/go-psrpcore/runspace"
+	"github.com/smnsjas/go-psrpcore/serialization"
+)
+
+// outOfProcClient speaks PSRP with the out-of-process framing PowerShell
+// uses over any byte stream that isn't WSMan: named pipes, the SSH
+// "powershell" subsystem and PowerShell Direct. dial opens the stream.
+type outOfProcClient struct {
+	name string // what the stream is, for errors
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+
+	mu        sync.Mutex // guards conn, pool and closed
+	conn      io.ReadWriteCloser
+	pool      *runspace.Pool
+	closed    bool
+	pipelines chan struct{} // one pipeline at a time, as the pool has one runspace
+}
+
+func newOutOfProcClient(name string, dial func(ctx context.Context) (io.ReadWriteCloser, error)) *outOfProcClient {
+	return &outOfProcClient{name: name, dial: dial, pipelines: make(chan struct{}, 1)}
+}
+
+// Connect opens the connection and the runspace pool on it.
+func (p *outOfProcClient) Connect(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("client is closed")
+	}
+	if p.pool != nil {
+		return nil
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	poolID := uuid.New()
+	adapter := outofproc.NewAdapter(outofproc.NewTransportFromReadWriter(conn), poolID)
+	pool := runspace.New(adapter, poolID)
+	if err := pool.Open(ctx); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to open runspace pool over %s: %w", p.name, err)
+	}
+	pool.StartDispatchLoop()
+
+	p.conn, p.pool = conn, pool
+	return nil
+}
+
+// IsConnected reports whether the runspace pool is open.
+func (p *outOfProcClient) IsConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pool != nil && p.pool.State() == runspace.StateOpened
+}
+
+// Close closes the runspace pool and the pipe.
+func (p *outOfProcClient) Close(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.pool == nil {
+		return nil
+	}
+	err := p.pool.Close(ctx)
+	if cerr := p.conn.Close(); err == nil {
+		err = cerr
+	}
+	p.pool, p.conn = nil, nil
+	return err
+}
+
+// ExecuteStream runs script and returns its streams. Commands queue for
+// the pool's single runspace.
+func (p *outOfProcClient) ExecuteStream(ctx context.Context, script string) (*Stream, error) {
+	select {
+	case p.pipelines <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("pool busy: %w", ctx.Err())
+	}
+	release := func() { <-p.pipelines }
+
+	p.mu.Lock()
+	pool := p.pool
+	p.mu.Unlock()
+	if pool == nil {
+		release()
+		return nil, errors.New("client not connected")
+	}
+
+	pl, err := pool.CreatePipeline(script)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("create pipeline: %w", err)
+	}
+	if err := pl.Invoke(ctx); err != nil {
+		release()
+		return nil, fmt.Errorf("invoke pipeline: %w", err)
+	}
+	_ = pl.CloseInput(ctx)
+
+	var once sync.Once
+	return &Stream{
+		Output:      pl.Output(),
+		Errors:      pl.Error(),
+		Warnings:    pl.Warning(),
+		Verbose:     pl.Verbose(),
+		Debug:       pl.Debug(),
+		Progress:    pl.Progress(),
+		Information: pl.Information(),
+		WaitFunc: func() error {
+			err := pl.Wait()
+			once.Do(release)
+			return err
+		},
+		CancelFunc: pl.Cancel,
+	}, nil
+}
+
+// Execute runs script and collects its deserialized streams, the way
+// go-psrp's client does.
+func (p *outOfProcClient) Execute(ctx context.Context, script string) (*client.Result, error) {
+	stream, err := p.ExecuteStream(ctx, script)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &client.Result{}
+	var wg sync.WaitGroup
+	guard := &streamGuard{log: logger}
+	collect := func(ch <-chan *messages.Message, target *[]interface{}) {
+		defer wg.Done()
+		for msg := range ch {
+			if msg == nil {
+				continue
+			}
+			guard.handle(func() {
+				objects, err := serialization.NewDeserializer().Deserialize(msg.Data)
+				if err != nil {
+					return
+				}
+				*target = append(*target, objects...)
+			})
+		}
+	}
+	wg.Add(7)
+	go collect(stream.Output, &result.Output)
+	go collect(stream.Errors, &result.Errors)
+	go collect(stream.Warnings, &result.Warnings)
+	go collect(stream.Verbose, &result.Verbose)
+	go collect(stream.Debug, &result.Debug)
+	go collect(stream.Progress, &result.Progress)
+	go collect(stream.Information, &result.Information)
+
+	runErr := stream.WaitFunc()
+	wg.Wait()
+	if err := guard.Err(); err != nil {
+		return nil, err
+	}
+
+	result.HadErrors = runErr != nil || len(result.Errors) > 0
+	if runErr != nil && len(result.Errors) == 0 {
+		result.Errors = append(result.Errors, runErr.Error())
+	}
+	return result, nil
+}
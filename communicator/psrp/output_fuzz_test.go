@@ -0,0 +1,98 @@
+package psrp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/smnsjas/go-psrpcore/messages"
+)
+
+// outputSeeds are remote outputs that have tripped up marker scanning: the
+// marker split across two writes, CRLF line endings, and a marker that
+// isn't followed by a number.
+var outputSeeds = []struct {
+	text  string
+	split int
+}{
+	{"hello\n" + exitMarker + "0\n", 0},
+	{"hello\n" + exitMarker + "3", 10},
+	{exitMarker + "42", len(exitMarker) / 2},
+	{"line one\r\nline two\r\n" + exitMarker + "1\r\n", 0},
+	{"a\r\n" + exitMarker + "7\r\n", 3},
+	{exitMarker + "\r\n", 0},
+	{exitMarker + "not a number\n", 0},
+	{exitMarker + "99999999999999999999", 0},
+	{"\n\n\n", 1},
+}
+
+// FuzzWriteOutput checks that the exit marker never reaches the writer,
+// that an exit code is only reported for a marker line, and that other
+// lines come through intact, however the output is split into messages.
+func FuzzWriteOutput(f *testing.F) {
+	for _, seed := range outputSeeds {
+		f.Add(seed.text, seed.split)
+	}
+	f.Fuzz(func(t *testing.T, text string, split int) {
+		if split < 0 || split > len(text) {
+			split = 0
+		}
+		var out bytes.Buffer
+		found := false
+		for _, part := range []string{text[:split], text[split:]} {
+			if _, ok := writeOutput(part, &out); ok {
+				found = true
+			}
+		}
+
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, exitMarker) {
+				t.Fatalf("exit marker line %q reached the writer", line)
+			}
+		}
+		if found && !strings.Contains(text, exitMarker) {
+			t.Fatalf("exit code reported for output without a marker: %q", text)
+		}
+
+		if split != 0 {
+			return
+		}
+		var want strings.Builder
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(line, exitMarker) || (i == len(lines)-1 && line == "") {
+				continue
+			}
+			want.WriteString(line + "\n")
+		}
+		if text != "" && out.String() != want.String() {
+			t.Fatalf("writeOutput(%q) wrote %q, want %q", text, out.String(), want.String())
+		}
+	})
+}
+
+// FuzzDeserializeMessage checks that malformed message data never panics
+// the deserializer fallback, that undecodable data is passed through as
+// text, and that the result is safe to scan for the exit marker.
+func FuzzDeserializeMessage(f *testing.F) {
+	for _, seed := range []string{
+		"<S>hello</S>",
+		"<S>" + exitMarker + "0</S>",
+		"<S>" + exitMarker[:10],
+		exitMarker[10:] + "3</S>",
+		"<S>line one_x000D__x000A_line two</S>",
+		"<S>a</S>\r\n<S>" + exitMarker + "1</S>\r\n",
+		`<Obj RefId="0"><MS><S N="x">y</S></MS></Obj>`,
+		"<Obj RefId=\"0\"><TN RefId=\"0\"><T>System.String</T></TN>",
+		"plain text, not CLIXML",
+		"",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		text := deserializeMessage(&messages.Message{Data: data})
+		writeOutput(text, &bytes.Buffer{})
+		writeLines(text, &bytes.Buffer{})
+		(&lineTail{}).add(text)
+	})
+}
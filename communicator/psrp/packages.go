@@ -0,0 +1,326 @@
+package psrp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PackageManager is a package manager InstallPackages can drive.
+type PackageManager string
+
+const (
+	PackageManagerChocolatey PackageManager = "choco"
+	PackageManagerWinget     PackageManager = "winget"
+)
+
+// Package install defaults.
+const (
+	defaultPackageRetries    = 3
+	defaultPackageRetryDelay = 10 * time.Second
+	defaultPackageRestart    = 15 * time.Minute
+)
+
+// Package is a package to install.
+type Package struct {
+	// Name is the Chocolatey package name or winget package ID.
+	Name string
+
+	// Version pins the version to install. Empty installs the latest.
+	Version string
+}
+
+// PackageOptions controls InstallPackages.
+type PackageOptions struct {
+	// Manager defaults to Chocolatey.
+	Manager PackageManager
+
+	// Source is a package source (a Chocolatey feed URL or a winget source
+	// name) to install from instead of the defaults.
+	Source string
+
+	// Retries is how many times to retry a package after a transient
+	// failure such as a CDN timeout. Defaults to 3; negative disables
+	// retries.
+	Retries    int
+	RetryDelay time.Duration
+
+	// SkipRestart leaves a required restart to the caller instead of
+	// restarting the guest once all packages are installed.
+	SkipRestart    bool
+	RestartTimeout time.Duration
+}
+
+// PackageResult is what InstallPackages did.
+type PackageResult struct {
+	Installed []string
+
+	// RebootRequired reports that an install asked for a restart. Unless
+	// SkipRestart is set, Restarted is then true as well.
+	RebootRequired bool
+	Restarted      bool
+}
+
+// PackageError is returned when a package fails to install. Result holds
+// what installed before it.
+type PackageError struct {
+	Package  string
+	ExitCode int
+	Result   *PackageResult
+}
+
+func (e *PackageError) Error() string {
+	return fmt.Sprintf("failed to install package %s (exit code %d)", e.Package, e.ExitCode)
+}
+
+// packageOutcome is how an installer exit code is interpreted.
+type packageOutcome int
+
+const (
+	packageFailed packageOutcome = iota
+	packageInstalled
+	packageRebootRequired
+	packageTransient
+)
+
+// packageExitCodes normalizes exit codes that aren't plain success or
+// failure. Codes not listed other than zero are failures, unless the
+// output shows a transient network error.
+var packageExitCodes = map[PackageManager]map[int32]packageOutcome{
+	PackageManagerChocolatey: {
+		1641: packageRebootRequired, // MSI: restart initiated
+		3010: packageRebootRequired, // MSI: restart required
+	},
+	PackageManagerWinget: {
+		1641:        packageRebootRequired,
+		3010:        packageRebootRequired,
+		-1978335189: packageInstalled,      // 0x8A15002B: no applicable upgrade
+		-1978334963: packageInstalled,      // 0x8A15010D: already installed
+		-1978334967: packageRebootRequired, // 0x8A150109: reboot required to finish
+		-1978334966: packageRebootRequired, // 0x8A15010A: reboot initiated
+		-1978335224: packageTransient,      // 0x8A150008: download failed
+		-2147012894: packageTransient,      // 0x80072EE2: timed out
+		-2147012889: packageTransient,      // 0x80072EE7: name not resolved
+		-2147012867: packageTransient,      // 0x80072EFD: cannot connect
+		-2147012865: packageTransient,      // 0x80072EFF: connection reset
+	},
+}
+
+// transientPackageOutput matches installer output that points at a
+// network failure worth retrying.
+var transientPackageOutput = regexp.MustCompile(`(?i)` +
+	`the operation has timed out|unable to connect to the remote server|` +
+	`the remote name could not be resolved|the underlying connection was closed|` +
+	`the remote server returned an error: \((408|429|5\d\d)\)|download failed|` +
+	`connection (was )?(reset|refused)`)
+
+// interpretPackageExit classifies an installer exit code.
+func interpretPackageExit(manager PackageManager, code int, output string) packageOutcome {
+	if outcome, ok := packageExitCodes[manager][int32(code)]; ok {
+		return outcome
+	}
+	if code == 0 {
+		return packageInstalled
+	}
+	if transientPackageOutput.MatchString(output) {
+		return packageTransient
+	}
+	return packageFailed
+}
+
+// bootstrapChocolateyScript installs Chocolatey if it is missing.
+const bootstrapChocolateyScript = `$ErrorActionPreference = 'Stop'
+if (-not (Get-Command choco.exe -ErrorAction SilentlyContinue) -and -not (Test-Path "$env:ProgramData\chocolatey\bin\choco.exe")) {
+	Write-Output 'Installing Chocolatey...'
+	[Net.ServicePointManager]::SecurityProtocol = [Net.ServicePointManager]::SecurityProtocol -bor [Net.SecurityProtocolType]::Tls12
+	Set-ExecutionPolicy Bypass -Scope Process -Force
+	Invoke-Expression ((New-Object System.Net.WebClient).DownloadString('https://community.chocolatey.org/install.ps1'))
+}
+`
+
+// bootstrapWingetScript installs winget if it is missing, with the
+// Microsoft.WinGet.Client module.
+const bootstrapWingetScript = `$ErrorActionPreference = 'Stop'
+$winget = Get-ChildItem "$env:ProgramFiles\WindowsApps\Microsoft.DesktopAppInstaller_*_x64__8wekyb3d8bbwe\winget.exe" -ErrorAction SilentlyContinue
+if (-not $winget -and -not (Get-Command winget.exe -ErrorAction SilentlyContinue)) {
+	Write-Output 'Installing winget...'
+	[Net.ServicePointManager]::SecurityProtocol = [Net.ServicePointManager]::SecurityProtocol -bor [Net.SecurityProtocolType]::Tls12
+	if (-not (Get-PackageProvider -ListAvailable -Name NuGet -ErrorAction SilentlyContinue | Where-Object { $_.Version -ge [version]'2.8.5.201' })) {
+		Install-PackageProvider -Name NuGet -MinimumVersion 2.8.5.201 -Force -Scope AllUsers | Out-Null
+	}
+	Install-Module -Name Microsoft.WinGet.Client -Force -Scope AllUsers -Repository PSGallery
+	Repair-WinGetPackageManager -AllUsers -Latest
+}
+`
+
+// packageCommand returns the script that installs pkg.
+func packageCommand(opts *PackageOptions, pkg Package) string {
+	var args []string
+	switch opts.Manager {
+	case PackageManagerWinget:
+		args = append(args, "install", "--id", pkg.Name, "--exact", "--silent", "--disable-interactivity",
+			"--accept-package-agreements", "--accept-source-agreements")
+		if pkg.Version != "" {
+			args = append(args, "--version", pkg.Version)
+		}
+		if opts.Source != "" {
+			args = append(args, "--source", opts.Source)
+		}
+		// winget isn't on the PATH of remote sessions; find it in the App
+		// Installer package
+		return fmt.Sprintf(`$winget = Get-ChildItem "$env:ProgramFiles\WindowsApps\Microsoft.DesktopAppInstaller_*_x64__8wekyb3d8bbwe\winget.exe" -ErrorAction SilentlyContinue | Select-Object -Last 1 -ExpandProperty FullName
+if (-not $winget) { $winget = 'winget.exe' }
+& $winget %s
+exit $LASTEXITCODE`, psArgs(args))
+	default:
+		args = append(args, "install", pkg.Name, "--yes", "--no-progress")
+		if pkg.Version != "" {
+			args = append(args, "--version", pkg.Version)
+		}
+		if opts.Source != "" {
+			args = append(args, "--source", opts.Source)
+		}
+		return fmt.Sprintf(`$choco = Join-Path $env:ProgramData 'chocolatey\bin\choco.exe'
+if (-not (Test-Path $choco)) { $choco = 'choco.exe' }
+& $choco %s
+exit $LASTEXITCODE`, psArgs(args))
+	}
+}
+
+// InstallPackages installs packages with Chocolatey or winget, installing
+// the package manager first if the guest doesn't have it. Each package is
+// retried after transient download failures, and installer exit codes
+// that ask for a restart (3010, 1641 and winget's equivalents) are
+// collected so the guest is restarted once, after the last package, and
+// the session reconnected in place. Output streams to progress. A package
+// that fails is reported as a *PackageError.
+func (c *Communicator) InstallPackages(ctx context.Context, packages []Package, opts *PackageOptions, progress io.Writer) (*PackageResult, error) {
+	o := *opts
+	if o.Manager == "" {
+		o.Manager = PackageManagerChocolatey
+	}
+	if o.Manager != PackageManagerChocolatey && o.Manager != PackageManagerWinget {
+		return nil, fmt.Errorf("unknown package manager %q", o.Manager)
+	}
+	if o.Retries == 0 {
+		o.Retries = defaultPackageRetries
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultPackageRetryDelay
+	}
+	if o.RestartTimeout <= 0 {
+		o.RestartTimeout = defaultPackageRestart
+	}
+	if progress == nil {
+		progress = io.Discard
+	}
+
+	bootstrap := bootstrapChocolateyScript
+	if o.Manager == PackageManagerWinget {
+		bootstrap = bootstrapWingetScript
+	}
+	code, err := c.runStreaming(ctx, bootstrap, progress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to install %s: %w", o.Manager, err)
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("installing %s failed with status %d", o.Manager, code)
+	}
+
+	result := &PackageResult{}
+	for _, pkg := range packages {
+		reboot, err := c.installPackage(ctx, &o, pkg, progress)
+		if err != nil {
+			var pkgErr *PackageError
+			if errors.As(err, &pkgErr) {
+				pkgErr.Result = result
+			}
+			return result, err
+		}
+		result.Installed = append(result.Installed, pkg.Name)
+		result.RebootRequired = result.RebootRequired || reboot
+	}
+
+	if result.RebootRequired && !o.SkipRestart {
+		fmt.Fprintln(progress, "Restarting to finish installing packages...")
+		if err := c.Restart(ctx, o.RestartTimeout); err != nil {
+			return result, err
+		}
+		result.Restarted = true
+	}
+	return result, nil
+}
+
+// installPackage installs one package, retrying transient failures, and
+// reports whether it needs a restart.
+func (c *Communicator) installPackage(ctx context.Context, opts *PackageOptions, pkg Package, progress io.Writer) (bool, error) {
+	script := packageCommand(opts, pkg)
+	for attempt := 0; ; attempt++ {
+		var out lockedBuffer
+		code, err := c.runStreaming(ctx, script, io.MultiWriter(progress, &out))
+		if err != nil {
+			return false, fmt.Errorf("failed to install package %s: %w", pkg.Name, err)
+		}
+
+		switch interpretPackageExit(opts.Manager, code, out.String()) {
+		case packageInstalled:
+			return false, nil
+		case packageRebootRequired:
+			c.logger().Info("package requires a restart", "op", "packages", "package", pkg.Name, "exit_code", code)
+			return true, nil
+		case packageTransient:
+			if attempt < opts.Retries {
+				c.logger().Warn("transient package install failure; retrying", "op", "packages",
+					"package", pkg.Name, "exit_code", code, "attempt", attempt+1)
+				select {
+				case <-ctx.Done():
+					return false, ctx.Err()
+				case <-time.After(opts.RetryDelay):
+				}
+				continue
+			}
+		}
+		return false, &PackageError{Package: pkg.Name, ExitCode: code}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for the concurrent stdout and stderr
+// writes of a running command.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// psArgs returns args as space-separated PowerShell string literals, for
+// passing to a native command.
+func psArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = psQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ParsePackage parses "name" or "name@version".
+func ParsePackage(s string) Package {
+	name, version, _ := strings.Cut(s, "@")
+	return Package{Name: strings.TrimSpace(name), Version: strings.TrimSpace(version)}
+}
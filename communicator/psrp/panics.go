@@ -0,0 +1,53 @@
+package psrp
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// streamGuard turns a panic raised while handling a command's output, by
+// the deserializer or a caller's Writer, into a command failure. Without
+// it the panic ends a drain goroutine, and a stream nobody drains blocks
+// the pipeline and everything waiting on it.
+type streamGuard struct {
+	log hclog.Logger
+
+	mu  sync.Mutex
+	err error
+}
+
+// handle runs fn for one message. Once a handler has panicked, later
+// messages are dropped, so the streams still drain.
+func (g *streamGuard) handle(fn func()) {
+	if g.Err() == nil {
+		g.try(fn)
+	}
+}
+
+// try runs fn, recording the first panic it raises.
+func (g *streamGuard) try(fn func()) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		g.log.Error("recovered panic while handling command output", "op", "command",
+			"panic", r, "stack", string(debug.Stack()))
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.err == nil {
+			g.err = fmt.Errorf("%w: panic while handling command output: %v", ErrPipelineFailed, r)
+		}
+	}()
+	fn()
+}
+
+// Err returns the first panic recovered as an error, or nil.
+func (g *streamGuard) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
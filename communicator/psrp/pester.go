@@ -0,0 +1,237 @@
+package psrp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultPesterVersion is the oldest Pester RunPester accepts by default.
+// Windows ships Pester 3.4, whose Invoke-Pester lacks the configuration
+// object used here.
+const defaultPesterVersion = "5.3.0"
+
+// PesterRun is a set of Pester tests to run with RunPester.
+type PesterRun struct {
+	// Paths are local test files, or directories of them, uploaded with any
+	// helpers or data files next to them.
+	Paths []string
+
+	// MinimumVersion is the oldest Pester to use. If no such version is
+	// installed, it is installed from the PowerShell Gallery. Defaults to
+	// 5.3.0.
+	MinimumVersion string
+
+	// Tags and ExcludeTags filter the tests run.
+	Tags        []string
+	ExcludeTags []string
+
+	// ResultsFile, if set, is a local path where the NUnit XML results are
+	// saved.
+	ResultsFile string
+
+	// Timeout bounds the test run. Zero means no limit beyond ctx.
+	Timeout time.Duration
+}
+
+// PesterResult summarizes a test run.
+type PesterResult struct {
+	Total    int             `json:"total"`
+	Passed   int             `json:"passed"`
+	Failed   int             `json:"failed"`
+	Skipped  int             `json:"skipped"`
+	Duration float64         `json:"duration"` // seconds
+	Failures []PesterFailure `json:"failures"`
+}
+
+// PesterFailure is a failed test, or a container that failed to run.
+type PesterFailure struct {
+	Name    string `json:"name"` // e.g. "IIS.is installed"
+	Message string `json:"message"`
+}
+
+// PesterError is returned when tests fail. Result holds the whole run.
+type PesterError struct {
+	Result *PesterResult
+}
+
+func (e *PesterError) Error() string {
+	names := make([]string, len(e.Result.Failures))
+	for i, f := range e.Result.Failures {
+		names[i] = f.Name
+	}
+	return fmt.Sprintf("%d of %d Pester test(s) failed: %s", e.Result.Failed, e.Result.Total, strings.Join(names, "; "))
+}
+
+// pesterResultMarker prefixes the line carrying RunPester's summary.
+const pesterResultMarker = "__PACKER_PESTER_RESULT__:"
+
+// ensurePesterScript installs Pester from the gallery unless a new enough
+// version is already there.
+const ensurePesterScript = `$ErrorActionPreference = 'Stop'
+$min = [version]%s
+if (-not (Get-Module -ListAvailable -Name Pester | Where-Object { $_.Version -ge $min })) {
+	Write-Output "Installing Pester $min or later..."
+	[Net.ServicePointManager]::SecurityProtocol = [Net.ServicePointManager]::SecurityProtocol -bor [Net.SecurityProtocolType]::Tls12
+	if (-not (Get-PackageProvider -ListAvailable -Name NuGet -ErrorAction SilentlyContinue | Where-Object { $_.Version -ge [version]'2.8.5.201' })) {
+		Install-PackageProvider -Name NuGet -MinimumVersion 2.8.5.201 -Force -Scope AllUsers | Out-Null
+	}
+	Install-Module -Name Pester -MinimumVersion $min -Force -SkipPublisherCheck -Scope AllUsers -Repository PSGallery
+}
+`
+
+// runPesterScript runs the tests under the work directory and writes the
+// summary after pesterResultMarker.
+const runPesterScript = `Import-Module Pester -MinimumVersion %s -ErrorAction Stop
+$config = New-PesterConfiguration
+$config.Run.Path = %s
+$config.Run.PassThru = $true
+$config.Output.Verbosity = 'Detailed'
+$config.Filter.Tag = @(%s)
+$config.Filter.ExcludeTag = @(%s)
+$config.TestResult.Enabled = $true
+$config.TestResult.OutputFormat = 'NUnitXml'
+$config.TestResult.OutputPath = %s
+$r = Invoke-Pester -Configuration $config
+$failures = @($r.Failed | ForEach-Object {
+	@{ name = $_.ExpandedPath; message = "$($_.ErrorRecord | Select-Object -First 1)" }
+}) + @($r.Containers | Where-Object { $_.Result -eq 'Failed' -and $_.ErrorRecord } | ForEach-Object {
+	@{ name = "$($_.Item)"; message = "$($_.ErrorRecord | Select-Object -First 1)" }
+})
+Write-Output ("` + pesterResultMarker + `" + (@{
+	total    = $r.TotalCount
+	passed   = $r.PassedCount
+	failed   = $r.FailedCount + $r.FailedContainersCount
+	skipped  = $r.SkippedCount
+	duration = $r.Duration.TotalSeconds
+	failures = $failures
+} | ConvertTo-Json -Compress -Depth 4))
+`
+
+// RunPester uploads Pester tests, installs Pester if needed, runs the tests
+// while streaming their output to progress, and returns a summary. Failed
+// tests are reported as a *PesterError along with the summary.
+func (c *Communicator) RunPester(ctx context.Context, run *PesterRun, progress io.Writer) (*PesterResult, error) {
+	if len(run.Paths) == 0 {
+		return nil, fmt.Errorf("no Pester tests given")
+	}
+	version := run.MinimumVersion
+	if version == "" {
+		version = defaultPesterVersion
+	}
+	if run.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, run.Timeout)
+		defer cancel()
+	}
+
+	work := fmt.Sprintf("C:/Windows/Temp/packer-pester-%s", uuid.New())
+	tests := work + "/tests"
+	results := work + "/results.xml"
+	defer c.execute(context.Background(), fmt.Sprintf("Remove-Item -LiteralPath %s -Recurse -Force -ErrorAction SilentlyContinue", psQuote(work))) //nolint:errcheck // best effort
+
+	for _, path := range run.Paths {
+		if err := c.uploadTree(ctx, path, tests+"/"+filepath.Base(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	code, err := c.runStreaming(ctx, fmt.Sprintf(ensurePesterScript, psQuote(version)), progress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to install Pester: %w", err)
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("installing Pester %s failed with status %d", version, code)
+	}
+
+	out := &markerWriter{marker: pesterResultMarker, w: progress}
+	code, err = c.runStreaming(ctx, fmt.Sprintf(runPesterScript,
+		psQuote(version), psQuote(tests), psList(run.Tags), psList(run.ExcludeTags), psQuote(results)), out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run Pester: %w", err)
+	}
+	if out.value == "" {
+		return nil, fmt.Errorf("Pester exited with status %d without reporting results", code)
+	}
+	var result PesterResult
+	if err := json.Unmarshal([]byte(out.value), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse Pester results: %w", err)
+	}
+
+	if run.ResultsFile != "" {
+		if err := c.downloadFile(ctx, results, run.ResultsFile); err != nil {
+			c.logger().Warn("Pester results not saved", "op", "pester", "path", run.ResultsFile, "error", err)
+		}
+	}
+
+	if result.Failed > 0 {
+		return &result, &PesterError{Result: &result}
+	}
+	return &result, nil
+}
+
+// uploadTree uploads the local file src to dst, or if src is a directory,
+// every file under it to the same relative path under dst.
+func (c *Communicator) uploadTree(ctx context.Context, src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return c.uploadFile(ctx, src, dst)
+	}
+	var files []localFile
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, localFile{local: path, remote: dst + "/" + filepath.ToSlash(rel), size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.uploadFiles(ctx, files, func(localFile) {})
+}
+
+// downloadFile downloads the remote file src to the local path dst.
+func (c *Communicator) downloadFile(ctx context.Context, src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := c.download(ctx, src, f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to download %s: %w", src, err)
+	}
+	return f.Close()
+}
+
+// psList returns values as a comma-separated list of PowerShell string
+// literals, for use inside @().
+func psList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = psQuote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,50 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pipePrefix is the namespace of local named pipes.
+const pipePrefix = `\\.\pipe\`
+
+// newPipeClient is the ClientFactory for the namedpipe transport: PSRP over
+// a local named pipe, either the one every PowerShell process opens for
+// Enter-PSHostProcess or one a container runtime exposes on the host. There
+// is no WSMan layer, no authentication beyond the pipe's ACL, and no network
+// configuration. The target is unused: the pipe is named by psrp_pipe_name
+// or psrp_pipe_process_id.
+func newPipeClient(_ string, config *Config) (PSRPClient, error) {
+	return newOutOfProcClient("named pipe", func(ctx context.Context) (io.ReadWriteCloser, error) {
+		path, err := config.pipePath()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialPipe(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open named pipe %s: %w", path, err)
+		}
+		return conn, nil
+	}), nil
+}
+
+// pipePath returns the full path of the configured pipe, looking up the
+// PowerShell host pipe of psrp_pipe_process_id if that is what is set.
+func (c *Config) pipePath() (string, error) {
+	if c.PSRPPipeProcessID != 0 {
+		return findHostPipe(c.PSRPPipeProcessID)
+	}
+	if strings.HasPrefix(c.PSRPPipeName, pipePrefix) {
+		return c.PSRPPipeName, nil
+	}
+	return pipePrefix + c.PSRPPipeName, nil
+}
+
+// hostPipeMatches reports whether name is the pipe PowerShell opens in
+// process pid. Those are named PSHost.<start time>.<pid>.<app domain>.<process name>.
+func hostPipeMatches(name string, pid int) bool {
+	parts := strings.Split(name, ".")
+	return len(parts) >= 5 && strings.EqualFold(parts[0], "PSHost") && parts[2] == fmt.Sprint(pid)
+}
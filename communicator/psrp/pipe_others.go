@@ -0,0 +1,20 @@
+//go:build !windows
+
+package psrp
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errPipeUnsupported is returned by the namedpipe transport off Windows.
+var errPipeUnsupported = errors.New("psrp_transport 'namedpipe' requires Packer to run on Windows")
+
+func dialPipe(context.Context, string) (net.Conn, error) {
+	return nil, errPipeUnsupported
+}
+
+func findHostPipe(int) (string, error) {
+	return "", errPipeUnsupported
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+)
+
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, path)
+}
+
+// findHostPipe returns the PowerShell host pipe of process pid.
+func findHostPipe(pid int) (string, error) {
+	entries, err := os.ReadDir(pipePrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list named pipes: %w", err)
+	}
+	for _, e := range entries {
+		if hostPipeMatches(e.Name(), pid) {
+			return pipePrefix + e.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no PowerShell host pipe found for process %d; is it a PowerShell process running as the same user?", pid)
+}
@@ -0,0 +1,119 @@
+package psrp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// probeTimeout bounds a single TCP or HTTP probe.
+const probeTimeout = 5 * time.Second
+
+// probeTCP checks that addr ("host:port") accepts TCP connections.
+func probeTCP(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP checks that endpoint answers HTTP. Any response, including 401
+// or 405, means the listener is up; only transport failures count as errors.
+// Certificates are not verified here: the probe sends no credentials and the
+// real connection performs verification.
+func probeHTTP(ctx context.Context, endpoint string) error {
+	_, err := probeHTTPResponse(ctx, endpoint)
+	return err
+}
+
+// probeClock returns the guest's clock as reported in the Date header of an
+// unauthenticated response from endpoint (HTTP.sys sets it on the 401).
+func probeClock(ctx context.Context, endpoint string) (time.Time, error) {
+	header, err := probeHTTPResponse(ctx, endpoint)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date := header.Get("Date")
+	if date == "" {
+		return time.Time{}, fmt.Errorf("no Date header in response from %s", endpoint)
+	}
+	return http.ParseTime(date)
+}
+
+// probeHTTPResponse sends an unauthenticated request to endpoint and returns
+// the response headers.
+func probeHTTPResponse(ctx context.Context, endpoint string) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // unauthenticated reachability probe
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Header, resp.Body.Close()
+}
+
+// probeAddr returns the "host:port" to probe for host.
+func (c *Config) probeAddr(host string) (string, error) {
+	if u, err := url.Parse(host); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if u.Port() != "" {
+			return u.Host, nil
+		}
+		if u.Scheme == "https" {
+			return net.JoinHostPort(u.Hostname(), "443"), nil
+		}
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+	if host == "" {
+		return "", fmt.Errorf("no host to probe")
+	}
+	return net.JoinHostPort(host, fmt.Sprint(c.PSRPPort)), nil
+}
+
+// maxKerberosSkew is the default maximum clock skew Kerberos tolerates.
+const maxKerberosSkew = 5 * time.Minute
+
+// checkClockSkew compares the guest clock with the local one and returns a
+// diagnostic if the difference would make Kerberos fail, or "" if not.
+func (c *Config) checkClockSkew(ctx context.Context, host string) (string, error) {
+	sent := time.Now()
+	guest, err := probeClock(ctx, c.EndpointURL(host))
+	if err != nil {
+		return "", err
+	}
+	// The Date header has one-second resolution; compare against the midpoint
+	local := sent.Add(time.Since(sent) / 2)
+
+	skew := guest.Sub(local)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= maxKerberosSkew {
+		return "", nil
+	}
+	return fmt.Sprintf("guest clock differs from this machine's by %v; clock skew exceeds %v, so Kerberos authentication will fail "+
+		"(guest time %s, local time %s)", skew.Round(time.Second), maxKerberosSkew,
+		guest.UTC().Format(time.RFC3339), local.UTC().Format(time.RFC3339)), nil
+}
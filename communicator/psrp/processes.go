@@ -0,0 +1,284 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Errors returned by the process helpers.
+var (
+	ErrProcessLost    = errors.New("process exited without recording an exit code")
+	ErrProcessTimeout = errors.New("timed out waiting for process to exit")
+)
+
+// processPollInterval is how often Wait and WaitForExit poll the guest.
+const processPollInterval = 2 * time.Second
+
+// ProcessSpec describes a process to start with Processes.Start.
+type ProcessSpec struct {
+	// Path is the executable, e.g. "msiexec.exe" or a full path.
+	Path string
+
+	// Args are passed as one command line, quoted as needed.
+	Args []string
+
+	// WorkingDir defaults to the wrapper's (C:\Windows\System32).
+	WorkingDir string
+}
+
+// Process is a detached process started by Processes.Start. Its output
+// and exit code are recorded in Dir on the guest.
+type Process struct {
+	ID  string // identifies the process across sessions
+	Dir string // the guest directory holding its logs
+	PID int    // the process ID on the guest
+}
+
+// ProcessStatus is a started process's state.
+type ProcessStatus struct {
+	Running  bool
+	ExitCode int // valid once Running is false
+}
+
+// ProcessInfo describes a process found by Processes.List.
+type ProcessInfo struct {
+	PID         int       `json:"pid"`
+	Name        string    `json:"name"`
+	CommandLine string    `json:"command_line"`
+	Started     time.Time `json:"started"`
+}
+
+// Processes starts, inspects and waits for processes on the guest. Unlike
+// commands run through Start, processes started here are detached from
+// the session: they outlive it, including a reconnect, and are waited on
+// by polling, so they suit installers that spawn background work and
+// return immediately.
+type Processes struct {
+	c *Communicator
+}
+
+// Processes returns the process helpers for this session.
+func (c *Communicator) Processes() *Processes {
+	return &Processes{c: c}
+}
+
+// processWrapperScript runs the process with its output redirected, and
+// records its PID and then its exit code.
+const processWrapperScript = `$dir = %s
+$p = @{ FilePath = %s; PassThru = $true; NoNewWindow = $true
+	RedirectStandardOutput = Join-Path $dir 'stdout.txt'; RedirectStandardError = Join-Path $dir 'stderr.txt' }
+$argv = @(%s)
+if ($argv.Count) { $p.ArgumentList = ($argv | ForEach-Object { if ($_ -match '[\s"]' -or $_ -eq '') { '"' + ($_ -replace '(\\*)"', '$1$1\"' -replace '(\\+)$', '$1$1') + '"' } else { $_ } }) -join ' ' }
+if (%s) { $p.WorkingDirectory = %s }
+try {
+	$proc = Start-Process @p
+	Set-Content -LiteralPath (Join-Path $dir 'pid.txt') -Value $proc.Id
+	$proc.WaitForExit()
+	$code = $proc.ExitCode
+} catch {
+	Add-Content -LiteralPath (Join-Path $dir 'stderr.txt') -Value "$_"
+	$code = -1
+}
+Set-Content -LiteralPath (Join-Path $dir 'exit.txt') -Value $code
+`
+
+// startProcessScript starts the wrapper outside the session's job object,
+// so it survives the session, and waits for it to report the PID.
+const startProcessScript = `$ErrorActionPreference = 'Stop'
+$dir = %s
+New-Item -ItemType Directory -Path $dir -Force | Out-Null
+$r = Invoke-CimMethod -ClassName Win32_Process -MethodName Create -Arguments @{ CommandLine = %s }
+if ($r.ReturnValue -ne 0) { throw "Win32_Process.Create failed with $($r.ReturnValue)" }
+$deadline = (Get-Date).AddSeconds(30)
+while (-not (Test-Path -LiteralPath (Join-Path $dir 'pid.txt')) -and -not (Test-Path -LiteralPath (Join-Path $dir 'exit.txt'))) {
+	if ((Get-Date) -gt $deadline) { throw 'process did not start within 30s' }
+	Start-Sleep -Milliseconds 200
+}
+$id = Get-Content -LiteralPath (Join-Path $dir 'pid.txt') -ErrorAction SilentlyContinue
+ConvertTo-Json -Compress -InputObject ([int]"$id")
+`
+
+// Start starts a detached process. Its stdout and stderr go to files
+// collected with Logs.
+func (p *Processes) Start(ctx context.Context, spec ProcessSpec) (*Process, error) {
+	if spec.Path == "" {
+		return nil, errors.New("no process path given")
+	}
+	id := uuid.New().String()
+	dir := `C:\Windows\Temp\packer-process-` + id
+	wrapper := fmt.Sprintf(processWrapperScript, psQuote(dir), psQuote(spec.Path), psList(spec.Args),
+		fmt.Sprintf("$%t", spec.WorkingDir != ""), psQuote(spec.WorkingDir))
+	command := "powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand " + encodeCommand(wrapper)
+
+	var pid int
+	if err := p.c.executeJSON(ctx, fmt.Sprintf(startProcessScript, psQuote(dir), psQuote(command)), &pid); err != nil {
+		return nil, fmt.Errorf("failed to start process %s: %w", spec.Path, err)
+	}
+	p.c.logger().Debug("started detached process", "op", "process", "path", spec.Path, "pid", pid, "dir", dir)
+	return &Process{ID: id, Dir: dir, PID: pid}, nil
+}
+
+// processStatusScript reports a started process's state.
+const processStatusScript = `$dir = %s
+$exit = Join-Path $dir 'exit.txt'
+if (Test-Path -LiteralPath $exit) {
+	@{ state = 'exited'; exit_code = [int](Get-Content -LiteralPath $exit -Raw).Trim() } | ConvertTo-Json -Compress
+} elseif (Get-Process -Id %d -ErrorAction SilentlyContinue) {
+	'{"state":"running"}'
+} else {
+	# The process may have finished between the two checks
+	if (Test-Path -LiteralPath $exit) {
+		@{ state = 'exited'; exit_code = [int](Get-Content -LiteralPath $exit -Raw).Trim() } | ConvertTo-Json -Compress
+	} else { '{"state":"lost"}' }
+}
+`
+
+// Status reports whether a started process is still running and, once it
+// has exited, its exit code. A process that is gone without an exit code,
+// e.g. after a restart, is reported as ErrProcessLost.
+func (p *Processes) Status(ctx context.Context, proc *Process) (*ProcessStatus, error) {
+	var out struct {
+		State    string `json:"state"`
+		ExitCode int    `json:"exit_code"`
+	}
+	if err := p.c.queryJSON(ctx, fmt.Sprintf(processStatusScript, psQuote(proc.Dir), proc.PID), &out); err != nil {
+		return nil, fmt.Errorf("failed to query process %d: %w", proc.PID, err)
+	}
+	switch out.State {
+	case "running":
+		return &ProcessStatus{Running: true}, nil
+	case "exited":
+		return &ProcessStatus{ExitCode: out.ExitCode}, nil
+	}
+	return nil, fmt.Errorf("process %d: %w", proc.PID, ErrProcessLost)
+}
+
+// Wait waits up to timeout (no limit beyond ctx if zero) for a started
+// process to exit and returns its exit code. Failed polls, e.g. while the
+// process restarts the network, are retried until the timeout.
+func (p *Processes) Wait(ctx context.Context, proc *Process, timeout time.Duration) (int, error) {
+	var code int
+	err := p.poll(ctx, timeout, func(ctx context.Context) (bool, error) {
+		status, err := p.Status(ctx, proc)
+		if err != nil {
+			return false, err
+		}
+		code = status.ExitCode
+		return !status.Running, nil
+	})
+	if errors.Is(err, ErrProcessLost) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("process %d: %w", proc.PID, err)
+	}
+	return code, nil
+}
+
+// Logs returns what a started process has written to stdout and stderr
+// so far.
+func (p *Processes) Logs(ctx context.Context, proc *Process) (stdout, stderr string, err error) {
+	var out struct {
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+	}
+	script := fmt.Sprintf(`$dir = %s
+function Read-Log($name) {
+	$path = Join-Path $dir $name
+	if (-not (Test-Path -LiteralPath $path)) { return '' }
+	$fs = [System.IO.File]::Open($path, 'Open', 'Read', 'ReadWrite')
+	try { (New-Object System.IO.StreamReader($fs)).ReadToEnd() } finally { $fs.Close() }
+}
+@{ stdout = Read-Log 'stdout.txt'; stderr = Read-Log 'stderr.txt' } | ConvertTo-Json -Compress
+`, psQuote(proc.Dir))
+	if err := p.c.queryJSON(ctx, script, &out); err != nil {
+		return "", "", fmt.Errorf("failed to read logs of process %d: %w", proc.PID, err)
+	}
+	return out.Stdout, out.Stderr, nil
+}
+
+// Kill stops a started process and its child processes.
+func (p *Processes) Kill(ctx context.Context, proc *Process) error {
+	if err := p.c.executeChecked(ctx, fmt.Sprintf("taskkill.exe /PID %d /T /F 2>&1 | Out-Null", proc.PID)); err != nil {
+		return fmt.Errorf("failed to kill process %d: %w", proc.PID, err)
+	}
+	return nil
+}
+
+// Remove deletes a started process's logs from the guest.
+func (p *Processes) Remove(ctx context.Context, proc *Process) error {
+	script := fmt.Sprintf("Remove-Item -LiteralPath %s -Recurse -Force -ErrorAction SilentlyContinue", psQuote(proc.Dir))
+	return p.c.executeChecked(ctx, script)
+}
+
+// List returns the processes whose image name matches name (e.g.
+// "msiexec.exe"), including those not started by Start.
+func (p *Processes) List(ctx context.Context, name string) ([]ProcessInfo, error) {
+	var out []ProcessInfo
+	script := fmt.Sprintf(`ConvertTo-Json -Compress -InputObject @(Get-CimInstance -ClassName Win32_Process -Filter ("Name='{0}'" -f %s.Replace("'", "\'")) | ForEach-Object {
+	@{ pid = [int]$_.ProcessId; name = $_.Name; command_line = "$($_.CommandLine)"; started = $_.CreationDate.ToUniversalTime().ToString('o') }
+})`, psQuote(name))
+	if err := p.c.queryJSON(ctx, script, &out); err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+	return out, nil
+}
+
+// WaitForExit waits up to timeout (no limit beyond ctx if zero) for the
+// process with the given PID, started any way, to exit. Its exit code
+// isn't available.
+func (p *Processes) WaitForExit(ctx context.Context, pid int, timeout time.Duration) error {
+	err := p.poll(ctx, timeout, func(ctx context.Context) (bool, error) {
+		var running bool
+		script := fmt.Sprintf("ConvertTo-Json -InputObject ([bool](Get-Process -Id %d -ErrorAction SilentlyContinue))", pid)
+		if err := p.c.queryJSON(ctx, script, &running); err != nil {
+			return false, err
+		}
+		return !running, nil
+	})
+	if err != nil {
+		return fmt.Errorf("process %d: %w", pid, err)
+	}
+	return nil
+}
+
+// poll calls check every processPollInterval until it reports done. Errors
+// from check are retried, except ErrProcessLost, and the last one is
+// reported if the timeout passes.
+func (p *Processes) poll(ctx context.Context, timeout time.Duration, check func(context.Context) (bool, error)) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var lastErr error
+	for {
+		done, err := check(ctx)
+		switch {
+		case errors.Is(err, ErrProcessLost):
+			return err
+		case err != nil:
+			lastErr = err
+			p.c.logger().Debug("process poll failed", "op", "process", "error", err)
+		case done:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil && ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("%w (last error: %v)", ErrProcessTimeout, lastErr)
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrProcessTimeout
+			}
+			return ctx.Err()
+		case <-time.After(processPollInterval):
+		}
+	}
+}
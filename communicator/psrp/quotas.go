@@ -0,0 +1,89 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+)
+
+// minShellMemoryMB is the MaxMemoryPerShellMB below which installers and
+// Windows Update commonly get their shell killed. Older Windows versions
+// default to 150.
+const minShellMemoryMB = 512
+
+// WSManQuotas are the guest's WinRM limits that most often cut a build
+// short. A value of 0 means it could not be read; the WSMan: drive needs
+// administrator rights.
+type WSManQuotas struct {
+	MaxEnvelopeSizeKB              int `json:"max_envelope_size_kb"`
+	MaxMemoryPerShellMB            int `json:"max_memory_per_shell_mb"`
+	PluginMaxMemoryPerShellMB      int `json:"plugin_max_memory_per_shell_mb"` // Microsoft.PowerShell plugin
+	MaxShellsPerUser               int `json:"max_shells_per_user"`
+	MaxConcurrentOperationsPerUser int `json:"max_concurrent_operations_per_user"`
+}
+
+const wsmanQuotasScript = `
+$ErrorActionPreference = 'SilentlyContinue'
+function Get-Quota($path) {
+	$item = Get-Item "WSMan:\localhost\$path"
+	if ($item) { [int64]$item.Value } else { 0 }
+}
+[pscustomobject]@{
+	max_envelope_size_kb               = Get-Quota 'MaxEnvelopeSizekb'
+	max_memory_per_shell_mb            = Get-Quota 'Shell\MaxMemoryPerShellMB'
+	plugin_max_memory_per_shell_mb     = Get-Quota 'Plugin\microsoft.powershell\Quotas\MaxMemoryPerShellMB'
+	max_shells_per_user                = Get-Quota 'Shell\MaxShellsPerUser'
+	max_concurrent_operations_per_user = Get-Quota 'Service\MaxConcurrentOperationsPerUser'
+} | ConvertTo-Json -Compress
+`
+
+// WSManQuotas reads the guest's WinRM quotas.
+func (c *Communicator) WSManQuotas(ctx context.Context) (*WSManQuotas, error) {
+	var q WSManQuotas
+	if err := c.queryJSON(ctx, wsmanQuotasScript, &q); err != nil {
+		return nil, fmt.Errorf("failed to query WinRM quotas: %w", err)
+	}
+	return &q, nil
+}
+
+// quotaWarnings returns a warning for each quota in q that is too low for
+// this configuration.
+func (c *Config) quotaWarnings(q *WSManQuotas) []string {
+	var warnings []string
+
+	if q.MaxEnvelopeSizeKB > 0 && q.MaxEnvelopeSizeKB < c.PSRPMaxEnvelopeSize {
+		warnings = append(warnings, fmt.Sprintf(
+			"the guest's MaxEnvelopeSizekb is %d KB but psrp_max_envelope_size is %d, so uploads will fail; "+
+				"set psrp_max_envelope_size to %d or raise MaxEnvelopeSizekb",
+			q.MaxEnvelopeSizeKB, c.PSRPMaxEnvelopeSize, q.MaxEnvelopeSizeKB))
+	}
+
+	// An upload chunk is held several times over while it is decoded and
+	// written: in the script text, as base64 and as bytes.
+	memoryMB := q.MaxMemoryPerShellMB
+	if q.PluginMaxMemoryPerShellMB > 0 && (memoryMB == 0 || q.PluginMaxMemoryPerShellMB < memoryMB) {
+		memoryMB = q.PluginMaxMemoryPerShellMB
+	}
+	chunkMB := (c.UploadChunkSize()*8 + 1<<20 - 1) >> 20
+	if memoryMB > 0 && (memoryMB < minShellMemoryMB || memoryMB < chunkMB) {
+		warnings = append(warnings, fmt.Sprintf(
+			"the guest's MaxMemoryPerShellMB is %d MB; the shell may be killed during uploads or installers "+
+				"(Set-Item WSMan:\\localhost\\Shell\\MaxMemoryPerShellMB 2048, and the same on the Microsoft.PowerShell plugin's quotas)",
+			memoryMB))
+	}
+
+	// Each runspace runs its own operation, plus one for the shell itself
+	if q.MaxConcurrentOperationsPerUser > 0 && q.MaxConcurrentOperationsPerUser <= c.PSRPMaxRunspaces {
+		warnings = append(warnings, fmt.Sprintf(
+			"the guest's MaxConcurrentOperationsPerUser is %d, too low for psrp_max_runspaces %d; "+
+				"lower psrp_max_runspaces or raise the quota",
+			q.MaxConcurrentOperationsPerUser, c.PSRPMaxRunspaces))
+	}
+
+	if q.MaxShellsPerUser > 0 && q.MaxShellsPerUser < 2 {
+		warnings = append(warnings, fmt.Sprintf(
+			"the guest's MaxShellsPerUser is %d; a reconnect may be refused until the old shell times out",
+			q.MaxShellsPerUser))
+	}
+
+	return warnings
+}
@@ -0,0 +1,262 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// maxPendingRebootRestarts bounds how many times psrp_pending_reboot
+// "restart" reboots the guest before giving up.
+const maxPendingRebootRestarts = 3
+
+// rebootShutdownTimeout bounds how long to wait for the guest to go down
+// after a restart has been requested.
+const rebootShutdownTimeout = 5 * time.Minute
+
+// pendingRebootScript reports which of the standard pending-reboot
+// indicators are set, as a JSON array of names.
+const pendingRebootScript = `
+$reasons = @()
+if (Test-Path 'HKLM:\SOFTWARE\Microsoft\Windows\CurrentVersion\Component Based Servicing\RebootPending') {
+	$reasons += 'Component Based Servicing'
+}
+if (Test-Path 'HKLM:\SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired') {
+	$reasons += 'Windows Update'
+}
+$sm = Get-ItemProperty -Path 'HKLM:\SYSTEM\CurrentControlSet\Control\Session Manager' -Name PendingFileRenameOperations -ErrorAction SilentlyContinue
+if ($sm -and $sm.PendingFileRenameOperations) {
+	$reasons += 'PendingFileRenameOperations'
+}
+$active = (Get-ItemProperty -Path 'HKLM:\SYSTEM\CurrentControlSet\Control\ComputerName\ActiveComputerName' -ErrorAction SilentlyContinue).ComputerName
+$pending = (Get-ItemProperty -Path 'HKLM:\SYSTEM\CurrentControlSet\Control\ComputerName\ComputerName' -ErrorAction SilentlyContinue).ComputerName
+if ($active -and $pending -and $active -ne $pending) {
+	$reasons += 'Computer rename'
+}
+if (Test-Path 'HKLM:\SOFTWARE\Microsoft\Updates\UpdateExeVolatile') {
+	$reasons += 'UpdateExeVolatile'
+}
+ConvertTo-Json -Compress -InputObject @($reasons)
+`
+
+// PendingReboot returns the pending-reboot indicators set on the guest, or
+// an empty slice if no reboot is pending.
+func (c *Communicator) PendingReboot(ctx context.Context) ([]string, error) {
+	var reasons []string
+	if err := c.queryJSON(ctx, pendingRebootScript, &reasons); err != nil {
+		return nil, fmt.Errorf("failed to query pending reboot state: %w", err)
+	}
+	return reasons, nil
+}
+
+// handlePendingReboot applies psrp_pending_reboot to the connected guest.
+func (s *StepConnect) handlePendingReboot(ctx context.Context, state multistep.StateBag, ui packersdk.Ui) error {
+	for restarts := 0; ; restarts++ {
+		reasons, err := s.pendingReboot(ctx)
+		if err != nil {
+			// Not being able to tell shouldn't block the build
+			s.logger().Warn("skipping pending reboot check", "error", err)
+			return nil
+		}
+		if len(reasons) == 0 {
+			return nil
+		}
+
+		summary := strings.Join(reasons, ", ")
+		switch s.Config.PSRPPendingReboot {
+		case PendingRebootWarn:
+			ui.Message(fmt.Sprintf("Warning: guest has a pending reboot (%s)", summary))
+			return nil
+		case PendingRebootWait:
+			return s.waitForRebootCleared(ctx, ui, summary)
+		case PendingRebootRestart:
+			if restarts >= maxPendingRebootRestarts {
+				return fmt.Errorf("guest still reports a pending reboot after %d restarts (%s)", restarts, summary)
+			}
+			ui.Say(fmt.Sprintf("Guest has a pending reboot (%s); restarting...", summary))
+			if err := s.restartAndReconnect(ctx, state, ui); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// pendingReboot queries the pending-reboot indicators, bounded by
+// PSRPTimeout as well as ctx.
+func (s *StepConnect) pendingReboot(ctx context.Context) ([]string, error) {
+	if s.Config.PSRPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Config.PSRPTimeout)
+		defer cancel()
+	}
+	return s.comm.PendingReboot(ctx)
+}
+
+// waitForRebootCleared polls until no pending-reboot indicator is set, e.g.
+// while a servicing task finishes and reboots the guest on its own.
+func (s *StepConnect) waitForRebootCleared(ctx context.Context, ui packersdk.Ui, summary string) error {
+	timeout := s.Config.PSRPTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	interval := s.Config.PSRPRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ui.Say(fmt.Sprintf("Guest has a pending reboot (%s); waiting for it to clear (timeout: %v)...", summary, timeout))
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timeout waiting for pending reboot to clear (%s)", summary)
+		case <-time.After(interval):
+		}
+
+		reasons, err := s.pendingReboot(ctx)
+		if err != nil {
+			// The guest may be rebooting itself; the session recovers on its own
+			s.logger().Debug("pending reboot check failed", "error", err)
+			continue
+		}
+		if len(reasons) == 0 {
+			return nil
+		}
+		summary = strings.Join(reasons, ", ")
+	}
+}
+
+// restartAndReconnect reboots the guest, waits for it to go down, and
+// connects again.
+func (s *StepConnect) restartAndReconnect(ctx context.Context, state multistep.StateBag, ui packersdk.Ui) error {
+	// shutdown.exe returns immediately, so the command completes before the
+	// listener goes away.
+	restartCtx, cancel := s.comm.opContext()
+	code, output, err := s.comm.runScript(restartCtx, s.config.restartScript("Packer restart for pending reboot"))
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to restart guest: %w", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("failed to restart guest (exit code %d): %s", code, strings.TrimSpace(output))
+	}
+
+	s.comm.Close()
+	s.comm = nil
+
+	if s.Config.PSRPTransport == TransportWSMan || s.Config.PSRPTransport == TransportSSH {
+		s.waitForShutdown(ctx)
+	}
+
+	// Recreate the communicator for whatever address the guest comes back on
+	s.host = ""
+	if err := s.refreshHost(state); err != nil {
+		return err
+	}
+	if err := s.connect(ctx, state, ui); err != nil {
+		return fmt.Errorf("failed to reconnect after restart: %w", err)
+	}
+	if !s.Config.PSRPSkipIdentityCheck {
+		if err := s.verifyIdentity(ctx); err != nil {
+			return err
+		}
+	}
+	ui.Say("Reconnected to PSRP after restart")
+	return nil
+}
+
+// waitForShutdown waits until the listener stops accepting connections so
+// a reconnect doesn't land on the guest before it has gone down. It gives
+// up quietly after rebootShutdownTimeout.
+func (s *StepConnect) waitForShutdown(ctx context.Context) {
+	addr, err := s.config.probeAddr(s.host)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rebootShutdownTimeout)
+	defer cancel()
+
+	for {
+		if err := probeTCP(ctx, addr); err != nil {
+			s.logger().Debug("stopped accepting connections", "addr", addr, "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			s.logger().Warn("still accepting connections after restart request", "addr", addr)
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Restart reboots the guest and waits up to timeout (5m if zero) for it to
+// come back, reconnecting this communicator's session in place. It knows
+// the guest is back when its boot time changes, so it can't mistake the
+// session from before the reboot for the new one.
+func (c *Communicator) Restart(ctx context.Context, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	interval := 5 * time.Second
+	if c.config != nil && c.config.PSRPRetryInterval > 0 {
+		interval = c.config.PSRPRetryInterval
+	}
+
+	var booted int64
+	if err := c.queryJSON(ctx, c.config.bootTimeScript(), &booted); err != nil {
+		return fmt.Errorf("failed to query boot time: %w", err)
+	}
+	code, output, err := c.runScript(ctx, c.config.restartScript("Packer restart"))
+	if err != nil {
+		return fmt.Errorf("failed to restart guest: %w", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("failed to restart guest (exit code %d): %s", code, strings.TrimSpace(output))
+	}
+	c.logger().Info("restart requested", "op", "restart")
+	c.trace.event("session.restart")
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c.markStale()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timeout waiting for guest to restart")
+		case <-time.After(interval):
+		}
+
+		var now int64
+		if err := c.queryJSON(ctx, c.config.bootTimeScript(), &now); err != nil {
+			c.logger().Debug("guest not back yet", "op", "restart", "error", err)
+			c.markStale()
+			continue
+		}
+		if now != booted {
+			c.logger().Info("guest restarted", "op", "restart")
+			return nil
+		}
+		// Still the old boot: the guest hasn't gone down yet
+		c.markStale()
+	}
+}
+
+// markStale makes the next operation re-establish the session.
+func (c *Communicator) markStale() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected {
+		c.stale = true
+	}
+}
@@ -0,0 +1,67 @@
+package psrp
+
+import (
+	"fmt"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// redactedError hides registered secrets in an error's text, for errors
+// that quote a script or a server response. errors.Is and errors.As still
+// see the original error.
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string { return Redact(e.err.Error()) }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// RedactError returns err with secrets scrubbed from its text, as Redact
+// does for strings. nil and errors with nothing to scrub are returned as is.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*redactedError); ok {
+		return err
+	}
+	if msg := err.Error(); Redact(msg) == msg {
+		return err
+	}
+	return &redactedError{err: err}
+}
+
+// redactingUi scrubs secrets from everything shown on the wrapped Ui.
+type redactingUi struct {
+	packersdk.Ui
+}
+
+// RedactUi returns ui with secrets scrubbed from every message, so errors
+// and remote output shown to the user can't reveal a credential.
+func RedactUi(ui packersdk.Ui) packersdk.Ui {
+	if _, ok := ui.(redactingUi); ok || ui == nil {
+		return ui
+	}
+	return redactingUi{Ui: ui}
+}
+
+func (u redactingUi) Say(message string)     { u.Ui.Say(Redact(message)) }
+func (u redactingUi) Message(message string) { u.Ui.Message(Redact(message)) }
+func (u redactingUi) Error(message string)   { u.Ui.Error(Redact(message)) }
+func (u redactingUi) Warn(message string)    { uiWarn(u.Ui, Redact(message)) }
+
+func (u redactingUi) Sayf(format string, args ...any) {
+	u.Ui.Say(Redact(fmt.Sprintf(format, args...)))
+}
+
+func (u redactingUi) Errorf(format string, args ...any) {
+	u.Ui.Error(Redact(fmt.Sprintf(format, args...)))
+}
+
+func (u redactingUi) Machine(category string, args ...string) {
+	redactedArgs := make([]string, len(args))
+	for i, arg := range args {
+		redactedArgs[i] = Redact(arg)
+	}
+	u.Ui.Machine(category, redactedArgs...)
+}
@@ -0,0 +1,110 @@
+package psrp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// registry holds sessions that StepConnect left open (psrp_keep_session) so
+// later steps in the same process can reuse them. Packer runs provisioners,
+// post-processors and data sources in plugin processes of their own, so
+// only the builder's steps ever find a session here.
+var registry = struct {
+	sync.Mutex
+	sessions map[string]*Communicator
+}{sessions: make(map[string]*Communicator)}
+
+// RegisterSession records comm as the reusable session for host, closing any
+// session previously registered for it.
+func RegisterSession(host string, comm *Communicator) {
+	registry.Lock()
+	old := registry.sessions[host]
+	registry.sessions[host] = comm
+	registry.Unlock()
+
+	if old != nil && old != comm {
+		old.Close()
+	}
+}
+
+// LookupSession returns the registered session for host if it is still
+// connected, or nil. The session stays registered; callers must not Close it.
+func LookupSession(host string) *Communicator {
+	registry.Lock()
+	comm := registry.sessions[host]
+	registry.Unlock()
+
+	if comm == nil || !comm.isConnected() {
+		return nil
+	}
+	return comm
+}
+
+// takeSession removes and returns the registered session for host if it is
+// still connected and was opened the way config would open it. Dead
+// sessions are dropped and closed; a session opened with other settings
+// stays registered until the caller's own session replaces it.
+func takeSession(host string, config *Config) *Communicator {
+	registry.Lock()
+	comm := registry.sessions[host]
+	if comm == nil || !comm.config.sameSession(config) {
+		registry.Unlock()
+		return nil
+	}
+	delete(registry.sessions, host)
+	registry.Unlock()
+
+	if !comm.isConnected() {
+		comm.Close()
+		return nil
+	}
+	return comm
+}
+
+// sameSession reports whether a session opened with c is one o would open:
+// the same port, transport, account and session configuration.
+func (c *Config) sameSession(o *Config) bool {
+	return c.PSRPPort == o.PSRPPort &&
+		c.PSRPTransport == o.PSRPTransport &&
+		c.PSRPUsername == o.PSRPUsername &&
+		c.PSRPDomain == o.PSRPDomain &&
+		c.PSRPConfigurationName == o.PSRPConfigurationName
+}
+
+// ReleaseSession unregisters and closes the session for host, if any.
+func ReleaseSession(host string) error {
+	registry.Lock()
+	comm := registry.sessions[host]
+	delete(registry.sessions, host)
+	registry.Unlock()
+
+	if comm == nil {
+		return nil
+	}
+	return comm.Close()
+}
+
+// CloseSessions closes every registered session. Builders that enable
+// psrp_keep_session should call it once the build has finished.
+func CloseSessions() error {
+	registry.Lock()
+	sessions := registry.sessions
+	registry.sessions = make(map[string]*Communicator)
+	registry.Unlock()
+
+	var errs []error
+	for host, comm := range sessions {
+		if err := comm.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isConnected reports whether the session is connected and not known dead.
+func (c *Communicator) isConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected && !c.stale && clientConnected(c.client)
+}
@@ -0,0 +1,201 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/smnsjas/go-psrp/client"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// startResumable runs a command so that it survives a transient network
+// outage (psrp_resume_on_disconnect). The pipeline is started detached and
+// its output is collected with go-psrp's recovery API; if collection fails,
+// the communicator reattaches to the same shell and resumes collecting,
+// instead of failing the build while the command keeps running remotely.
+//
+// go-psrp only exposes recovery as a buffered result, so output is written
+// when the command completes rather than streamed, and only the output and
+// error streams are preserved.
+func (c *Communicator) startResumable(ctx context.Context, cmd *packer.RemoteCmd, script string) error {
+	ctx, _, finish := c.trackPipeline(ctx)
+	ctx, span := startSpan(ctx, "psrp.pipeline", attribute.Int("psrp.command_length", len(cmd.Command)),
+		attribute.Bool("psrp.resumable", true))
+	c.busy.Add(1)
+	fail := func(err error) error {
+		c.busy.Add(-1)
+		finish()
+		err = fmt.Errorf("failed to start PSRP command: %w", err)
+		endSpan(span, err)
+		return err
+	}
+	sess, err := c.session(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	cl, ok := sess.(resumableClient)
+	if !ok {
+		return fail(errors.New("client does not support psrp_resume_on_disconnect"))
+	}
+
+	commandID, err := cl.ExecuteAsync(ctx, script)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrPipelineFailed, c.config.explainFault(err))
+		c.recordFailure("command failed to start", err)
+		return fail(err)
+	}
+	shellID := cl.ShellID()
+	poolID := cl.PoolID()
+	run := c.beginCommand(cmd, script, span)
+
+	hb := c.startHeartbeat()
+
+	go func() {
+		defer finish()
+		defer c.busy.Add(-1)
+		defer hb.Stop()
+
+		window := c.config.PSRPResumeTimeout
+		if window <= 0 {
+			window = 5 * time.Minute
+		}
+		retryDelay := c.config.PSRPRetryInterval
+		if retryDelay <= 0 {
+			retryDelay = 5 * time.Second
+		}
+
+		var result *client.Result
+		var lastErr error
+		var resumeDeadline time.Time
+
+		for {
+			result, lastErr = cl.RecoverPipelineOutput(ctx, shellID, commandID)
+			if lastErr == nil || ctx.Err() != nil {
+				break
+			}
+
+			// Collection failed; keep trying to reattach until the window closes
+			if resumeDeadline.IsZero() {
+				resumeDeadline = time.Now().Add(window)
+			}
+			if time.Now().After(resumeDeadline) {
+				break
+			}
+			c.logger().Warn("connection lost while command was running; reattaching", "op", "command",
+				"command_id", commandID, "shell_id", shellID, "error", lastErr)
+			c.trace.event("pipeline.reattach", "seq", run.seq, "error", lastErr)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryDelay):
+			}
+			if resumed, err := c.reattach(ctx, shellID, poolID); err != nil {
+				c.logger().Debug("reattach failed", "op", "command", "error", err)
+			} else {
+				cl = resumed
+			}
+		}
+
+		if ctx.Err() != nil {
+			// Closing the shell is the only way to stop a detached pipeline
+			c.abandonShell(cl)
+			if run.stderr != nil {
+				run.guard.try(func() { fmt.Fprintf(run.stderr, "PSRP command cancelled: %v\n", ctx.Err()) })
+			}
+			c.finishCommand(ctx, run, "cancelled", ctx.Err(), 1, false, 0)
+			return
+		}
+
+		if lastErr != nil {
+			lost := fmt.Errorf("%w: %w", ErrSessionLost, c.config.explainFault(lastErr))
+			c.finishCommand(ctx, run, "lost", lost, 0, false, 0)
+			return
+		}
+
+		// The output was buffered, so it goes through the same guard and
+		// exit code handling as a streamed command's
+		exitCode, haveExitCode := 0, false
+		for _, obj := range result.Output {
+			run.guard.handle(func() {
+				text := fmt.Sprintf("%v", obj)
+				run.tail.add(text)
+				if code, ok := writeOutput(text, run.stdout); ok {
+					exitCode, haveExitCode = code, true
+				}
+			})
+		}
+		for _, obj := range result.Errors {
+			run.guard.handle(func() {
+				text := fmt.Sprintf("%v", obj)
+				run.tail.add(text)
+				if run.stderr != nil && text != "" {
+					fmt.Fprintln(run.stderr, text)
+				}
+			})
+		}
+
+		state, runErr := "completed", error(nil)
+		if result.HadErrors && len(result.Errors) == 0 {
+			// HadErrors without error records means the pipeline failed
+			state = "failed"
+			runErr = fmt.Errorf("%w: the pipeline failed", ErrPipelineFailed)
+		}
+		c.finishCommand(ctx, run, state, runErr, exitCode, haveExitCode, len(result.Errors))
+	}()
+
+	return nil
+}
+
+// reattach replaces the client with one reconnected to the existing
+// (disconnected) shell, so a running pipeline's output can be recovered.
+func (c *Communicator) reattach(ctx context.Context, shellID, poolID string) (resumableClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.config.verifyCertificate(ctx, c.target, &c.fingerprint); err != nil {
+		return nil, err
+	}
+	c.trustCertificate(c.fingerprint)
+
+	// Dial through the client factory so the reattached session uses the
+	// same SSH tunnel and transport options as the original
+	dialed, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	psrpClient, ok := dialed.(reattachableClient)
+	if !ok {
+		return nil, fmt.Errorf("client does not support psrp_resume_on_disconnect")
+	}
+	c.trace.event("session.reattach", "shell_id", shellID, "pool_id", poolID)
+	if err := psrpClient.SetPoolID(poolID); err != nil {
+		return nil, fmt.Errorf("invalid runspace pool ID %q: %w", poolID, err)
+	}
+	if err := psrpClient.Reconnect(ctx, shellID); err != nil {
+		return nil, fmt.Errorf("failed to reconnect to shell %s: %w", shellID, err)
+	}
+
+	forceClose(ctx, c.client)
+	c.client = psrpClient
+	c.stale = false
+	return psrpClient, nil
+}
+
+// abandonShell closes cl's shell (terminating anything still running in it)
+// and marks the session stale so the next operation reconnects.
+func (c *Communicator) abandonShell(cl PSRPClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), watchdogProbeTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := cl.Close(ctx); err != nil {
+		c.logger().Debug("failed to close shell after cancellation", "op", "command", "error", err)
+	}
+	if cl == c.client {
+		c.stale = true
+	}
+}
@@ -0,0 +1,40 @@
+package psrp
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// runScript runs a script synchronously through Start and returns its exit
+// code and combined output. ctx bounds both starting and waiting.
+func (c *Communicator) runScript(ctx context.Context, script string) (int, string, error) {
+	var out bytes.Buffer
+	code, err := c.runStreaming(ctx, script, &out)
+	return code, out.String(), err
+}
+
+// runStreaming runs a script synchronously through Start, writing its
+// output streams to out as they arrive, and returns its exit code.
+func (c *Communicator) runStreaming(ctx context.Context, script string, out io.Writer) (int, error) {
+	cmd := &packer.RemoteCmd{
+		Command: script,
+		Stdout:  out,
+		Stderr:  out,
+	}
+	if err := c.Start(ctx, cmd); err != nil {
+		return 0, err
+	}
+
+	done := make(chan int, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case code := <-done:
+		return code, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
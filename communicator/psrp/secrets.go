@@ -0,0 +1,47 @@
+package psrp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secret reference prefixes accepted by psrp_password. They let credentials
+// live outside the template and any committed variable files.
+const (
+	secretRefEnv  = "env://"
+	secretRefFile = "file://"
+)
+
+// resolveSecret expands a secret reference into its value. Values without a
+// recognized prefix are returned unchanged. Errors never include the value.
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, secretRefEnv):
+		name := strings.TrimPrefix(ref, secretRefEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, secretRefFile):
+		return readSecretFile(strings.TrimPrefix(ref, secretRefFile))
+	default:
+		return ref, nil
+	}
+}
+
+// readSecretFile reads a secret from path, dropping a single trailing newline
+// so files written with `echo` work as expected.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	value := strings.TrimSuffix(string(data), "\n")
+	value = strings.TrimSuffix(value, "\r")
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return value, nil
+}
@@ -0,0 +1,249 @@
+package psrp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// connect returns a communicator connected to srv, closed with the test.
+func connect(t *testing.T, srv *testutil.Server, config *psrp.Config) *psrp.Communicator {
+	t.Helper()
+	config.PSRPFlightRecorderDir = t.TempDir()
+	comm, err := psrp.New(srv.Host(), config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { comm.Close() })
+	if err := comm.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return comm
+}
+
+func TestServerConnect(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+
+	comm := connect(t, srv, srv.Config())
+	if err := comm.Healthy(context.Background()); err != nil {
+		t.Fatalf("Healthy: %v", err)
+	}
+	if got := srv.ShellsCreated(); got != 1 {
+		t.Errorf("ShellsCreated = %d, want 1", got)
+	}
+}
+
+func TestStepConnectRetries(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+	srv.FailRequests(3)
+
+	config := srv.Config()
+	config.PSRPSkipTCPProbe = true
+	config.PSRPFlightRecorderDir = t.TempDir()
+	step := &psrp.StepConnect{
+		Config: config,
+		Host:   func(multistep.StateBag) (string, error) { return srv.Host(), nil },
+	}
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", packersdk.TestUi(t))
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("Run = %v, error %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	metrics, ok := state.Get("psrp_connect_metrics").(*psrp.ConnectMetrics)
+	if !ok {
+		t.Fatal("no connect metrics in state")
+	}
+	if metrics.Retries == 0 {
+		t.Error("connected without retrying past the failed requests")
+	}
+}
+
+func TestStartExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		response testutil.Response
+		strict   bool
+		want     int
+	}{
+		{"zero", testutil.Exit(0, "ok"), false, 0},
+		{"nonzero", testutil.Exit(3, "ok"), false, 3},
+		{"missing", testutil.Response{Output: []string{"ok"}}, false, 0},
+		{"missing after errors", testutil.Response{Errors: []string{"bad"}}, false, 1},
+		{"missing strict", testutil.Response{Output: []string{"ok"}}, true, 1},
+		{"failed pipeline", testutil.Response{Failed: true}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := testutil.NewServer()
+			defer srv.Close()
+			srv.Handler = func(string) testutil.Response { return tt.response }
+
+			config := srv.Config()
+			config.PSRPStrictExitCode = tt.strict
+			comm := connect(t, srv, config)
+			if code, _, _ := run(t, comm, "Do-Something"); code != tt.want {
+				t.Errorf("exit code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartStreams(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+	srv.Handler = func(string) testutil.Response {
+		r := testutil.Exit(0, "output")
+		r.Errors = []string{"error record"}
+		r.Warnings = []string{"warning record"}
+		r.Verbose = []string{"verbose record"}
+		r.Information = []string{"information record"}
+		return r
+	}
+
+	comm := connect(t, srv, srv.Config())
+	code, stdout, stderr := run(t, comm, "Do-Something")
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	for _, want := range []string{"output", "verbose record", "information record"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout %q is missing %q", stdout, want)
+		}
+	}
+	for _, want := range []string{"error record", "warning record"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr %q is missing %q", stderr, want)
+		}
+	}
+	if strings.Contains(stdout, "__PACKER_EXIT_CODE__") {
+		t.Errorf("stdout %q includes the exit marker", stdout)
+	}
+	if scripts := srv.Scripts(); len(scripts) == 0 || !strings.Contains(scripts[len(scripts)-1], "Do-Something") {
+		t.Errorf("server did not receive the command: %q", scripts)
+	}
+}
+
+func TestUploadChunks(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+
+	config := srv.Config()
+	config.PSRPUploadChunkSize = 1024
+	comm := connect(t, srv, config)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 300) // several chunks
+	path := `C:\Windows\Temp\upload.bin`
+	before := len(srv.Scripts())
+	if err := comm.Upload(path, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	got, ok := srv.File(path)
+	if !ok {
+		t.Fatalf("server has no file %s", path)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("uploaded %d bytes, server assembled %d", len(data), len(got))
+	}
+	if chunks := len(srv.Scripts()) - before; chunks < len(data)/config.PSRPUploadChunkSize {
+		t.Errorf("upload took %d requests, want at least %d", chunks, len(data)/config.PSRPUploadChunkSize)
+	}
+
+	var out bytes.Buffer
+	if err := comm.Download(path, &out); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("downloaded %d bytes, want %d", out.Len(), len(data))
+	}
+}
+
+// TestUploadChunksFitEnvelope checks that requests carrying chunks of the
+// derived UploadChunkSize stay within psrp_max_envelope_size.
+func TestUploadChunksFitEnvelope(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+
+	config := srv.Config()
+	config.PSRPMaxEnvelopeSize = 64
+	comm := connect(t, srv, config)
+
+	// Random data, so nothing on the way can compress it
+	data := make([]byte, 3*config.UploadChunkSize()+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := `C:\Windows\Temp\envelope.bin`
+	if err := comm.Upload(path, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got, _ := srv.File(path); !bytes.Equal(got, data) {
+		t.Fatalf("uploaded %d bytes, server assembled %d", len(data), len(got))
+	}
+	if got, limit := srv.MaxRequestSize(), config.PSRPMaxEnvelopeSize*1024; got > limit {
+		t.Errorf("largest request was %d bytes, over the %d byte envelope", got, limit)
+	}
+}
+
+func TestKeepSessionReuse(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+	defer psrp.CloseSessions()
+
+	config := srv.Config()
+	config.PSRPSkipTCPProbe = true
+	config.PSRPKeepSession = true
+	config.PSRPFlightRecorderDir = t.TempDir()
+	connectStep := func(config *psrp.Config) (*psrp.StepConnect, multistep.StateBag) {
+		step := &psrp.StepConnect{
+			Config: config,
+			Host:   func(multistep.StateBag) (string, error) { return srv.Host(), nil },
+		}
+		state := new(multistep.BasicStateBag)
+		state.Put("ui", packersdk.TestUi(t))
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("Run = %v, error %v", action, state.Get("error"))
+		}
+		return step, state
+	}
+
+	first, state := connectStep(config)
+	first.Cleanup(state)
+	if psrp.LookupSession(srv.Host()) == nil {
+		t.Fatal("kept session was not registered")
+	}
+
+	second, state := connectStep(config)
+	if got := srv.ShellsCreated(); got != 1 {
+		t.Errorf("ShellsCreated = %d, want 1 after adopting the kept session", got)
+	}
+	second.Cleanup(state)
+
+	// A step for another session configuration opens its own session
+	other := *config
+	other.PSRPConfigurationName = "Other.Endpoint"
+	third, state := connectStep(&other)
+	if got := srv.ShellsCreated(); got != 2 {
+		t.Errorf("ShellsCreated = %d, want 2 after connecting with another configuration", got)
+	}
+	third.Cleanup(state)
+
+	if err := psrp.CloseSessions(); err != nil {
+		t.Fatalf("CloseSessions: %v", err)
+	}
+	if psrp.LookupSession(srv.Host()) != nil {
+		t.Error("session still registered after CloseSessions")
+	}
+}
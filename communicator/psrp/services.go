@@ -0,0 +1,195 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by the service helpers.
+var (
+	ErrServiceNotFound     = errors.New("service not found")
+	ErrServiceStateTimeout = errors.New("timed out waiting for service state")
+)
+
+// defaultServiceTimeout bounds waiting for a service to change state.
+const defaultServiceTimeout = 2 * time.Minute
+
+// ServiceState is a service's status, as in
+// System.ServiceProcess.ServiceControllerStatus.
+type ServiceState string
+
+const (
+	ServiceRunning         ServiceState = "Running"
+	ServiceStopped         ServiceState = "Stopped"
+	ServicePaused          ServiceState = "Paused"
+	ServiceStartPending    ServiceState = "StartPending"
+	ServiceStopPending     ServiceState = "StopPending"
+	ServiceContinuePending ServiceState = "ContinuePending"
+	ServicePausePending    ServiceState = "PausePending"
+)
+
+// ServiceStartType is how a service starts.
+type ServiceStartType string
+
+const (
+	ServiceAutomatic        ServiceStartType = "Automatic"
+	ServiceAutomaticDelayed ServiceStartType = "AutomaticDelayedStart"
+	ServiceManual           ServiceStartType = "Manual"
+	ServiceDisabled         ServiceStartType = "Disabled"
+)
+
+// scStartTypes maps start types to sc.exe config start= values, which
+// unlike Set-Service on Windows PowerShell can set a delayed start.
+var scStartTypes = map[ServiceStartType]string{
+	ServiceAutomatic:        "auto",
+	ServiceAutomaticDelayed: "delayed-auto",
+	ServiceManual:           "demand",
+	ServiceDisabled:         "disabled",
+}
+
+// Service describes a Windows service.
+type Service struct {
+	Name        string           `json:"name"`
+	DisplayName string           `json:"display_name"`
+	State       ServiceState     `json:"state"`
+	StartType   ServiceStartType `json:"start_type"`
+	ProcessID   int              `json:"process_id"`
+
+	// DependentServices are the services that depend on this one, and so
+	// are stopped along with it.
+	DependentServices []string `json:"dependent_services"`
+}
+
+// Services queries and controls the guest's Windows services. Start, Stop
+// and WaitForState wait for the service to settle and fail with
+// ErrServiceStateTimeout if it doesn't within the timeout (2m if zero).
+type Services struct {
+	c *Communicator
+}
+
+// Services returns the service helpers for this session.
+func (c *Communicator) Services() *Services {
+	return &Services{c: c}
+}
+
+// getServiceScript looks up a service, emitting {"found":false} if there
+// is none. It leaves the controller in $s for scripts appended to it.
+const getServiceScript = `$ErrorActionPreference = 'Stop'
+$s = Get-Service -Name %s -ErrorAction SilentlyContinue
+if (-not $s) { '{"found":false}'; return }
+`
+
+// describeServiceScript emits the Service for $s.
+const describeServiceScript = `$w = Get-CimInstance -ClassName Win32_Service -Filter ("Name='{0}'" -f $s.Name.Replace("'", "\'"))
+$start = switch ("$($w.StartMode)") {
+	'Auto'     { if ($w.DelayedAutoStart) { 'AutomaticDelayedStart' } else { 'Automatic' } }
+	'Manual'   { 'Manual' }
+	'Disabled' { 'Disabled' }
+	default    { "$($w.StartMode)" }
+}
+[pscustomobject]@{
+	found              = $true
+	name               = $s.Name
+	display_name       = $s.DisplayName
+	state              = "$($s.Status)"
+	start_type         = $start
+	process_id         = [int]$w.ProcessId
+	dependent_services = @($s.DependentServices | ForEach-Object { $_.Name })
+} | ConvertTo-Json -Compress
+`
+
+// waitServiceScript polls $s until it reaches the wanted state or the
+// deadline passes, then emits the Service.
+const waitServiceScript = `$deadline = (Get-Date).AddSeconds(%d)
+while ("$($s.Status)" -ne %s -and (Get-Date) -lt $deadline) {
+	Start-Sleep -Milliseconds 500
+	$s.Refresh()
+}
+`
+
+// runService runs script against the named service and decodes the
+// resulting Service.
+func (s *Services) runService(ctx context.Context, name, script string) (*Service, error) {
+	var out struct {
+		Found bool `json:"found"`
+		Service
+	}
+	if err := s.c.executeJSON(ctx, fmt.Sprintf(getServiceScript, psQuote(name))+script+describeServiceScript, &out); err != nil {
+		return nil, err
+	}
+	if !out.Found {
+		return nil, ErrServiceNotFound
+	}
+	return &out.Service, nil
+}
+
+// Get returns a service's state and configuration.
+func (s *Services) Get(ctx context.Context, name string) (*Service, error) {
+	svc, err := s.runService(ctx, name, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query service %s: %w", name, err)
+	}
+	return svc, nil
+}
+
+// SetStartType changes how a service starts.
+func (s *Services) SetStartType(ctx context.Context, name string, startType ServiceStartType) error {
+	sc, ok := scStartTypes[startType]
+	if !ok {
+		return fmt.Errorf("unknown service start type %q", startType)
+	}
+	script := fmt.Sprintf(`$out = sc.exe config $s.Name start= %s 2>&1
+if ($LASTEXITCODE -ne 0) { throw "sc.exe config failed: $out" }
+`, sc)
+	if _, err := s.runService(ctx, name, script); err != nil {
+		return fmt.Errorf("failed to set start type of service %s: %w", name, err)
+	}
+	return nil
+}
+
+// Start starts a service and waits for it to be running.
+func (s *Services) Start(ctx context.Context, name string, timeout time.Duration) (*Service, error) {
+	svc, err := s.control(ctx, name, "if (\"$($s.Status)\" -ne 'Running') { $s.Start() }\n", ServiceRunning, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start service %s: %w", name, err)
+	}
+	return svc, nil
+}
+
+// Stop stops a service, and the services that depend on it, and waits for
+// it to be stopped.
+func (s *Services) Stop(ctx context.Context, name string, timeout time.Duration) (*Service, error) {
+	svc, err := s.control(ctx, name, "Stop-Service -InputObject $s -Force -NoWait\n", ServiceStopped, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stop service %s: %w", name, err)
+	}
+	return svc, nil
+}
+
+// WaitForState waits for a service to reach state.
+func (s *Services) WaitForState(ctx context.Context, name string, state ServiceState, timeout time.Duration) (*Service, error) {
+	svc, err := s.control(ctx, name, "", state, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for service %s: %w", name, err)
+	}
+	return svc, nil
+}
+
+// control runs action against the service, then waits for it to reach
+// want.
+func (s *Services) control(ctx context.Context, name, action string, want ServiceState, timeout time.Duration) (*Service, error) {
+	if timeout <= 0 {
+		timeout = defaultServiceTimeout
+	}
+	script := action + fmt.Sprintf(waitServiceScript, int(timeout.Seconds()), psQuote(string(want)))
+	svc, err := s.runService(ctx, name, script)
+	if err != nil {
+		return nil, err
+	}
+	if svc.State != want {
+		return svc, fmt.Errorf("still %s, not %s, after %v: %w", svc.State, want, timeout, ErrServiceStateTimeout)
+	}
+	return svc, nil
+}
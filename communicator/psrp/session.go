@@ -0,0 +1,216 @@
+package psrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/smnsjas/go-psrp/client"
+)
+
+// watchdogProbeTimeout bounds a single watchdog liveness probe.
+const watchdogProbeTimeout = 30 * time.Second
+
+// session returns a live client, transparently establishing a deferred
+// connection or re-establishing the session first if the watchdog (or
+// go-psrp) has found it dead.
+func (c *Communicator) session(ctx context.Context) (PSRPClient, error) {
+	if err := c.connectLazily(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected && (c.stale || !clientConnected(c.client)) {
+		if err := c.reconnectLocked(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c.client, nil
+}
+
+// reconnectLocked replaces the client with a freshly connected one. The
+// caller must hold c.mu.
+func (c *Communicator) reconnectLocked(ctx context.Context) error {
+	c.logger().Info("session is no longer alive; reconnecting")
+	c.trace.event("session.reconnect")
+
+	// The old session is already gone; don't wait on the network to close it
+	forceClose(ctx, c.client)
+
+	// The guest may have come back with another certificate (or another
+	// machine may have its address)
+	if err := c.config.verifyCertificate(ctx, c.target, &c.fingerprint); err != nil {
+		c.stale = true
+		return fmt.Errorf("failed to re-establish PSRP session: %w", err)
+	}
+	c.trustCertificate(c.fingerprint)
+
+	psrpClient, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.client = psrpClient
+	if err := c.connectClient(ctx); err != nil {
+		c.stale = true
+		c.events.emit("session.reconnect_failed", err)
+		c.recordFailure("reconnect failed", err)
+		return fmt.Errorf("failed to re-establish PSRP session: %w", err)
+	}
+	c.events.emit("session.reconnected", nil)
+
+	c.stale = false
+	c.stats.reconnects.Add(1)
+	c.logger().Info("session re-established")
+	return nil
+}
+
+// Healthy reports whether the session is alive, returning nil if so. It
+// round-trips a trivial pipeline that produces no output, and never
+// reconnects, so it can tell a live session from a zombie one.
+func (c *Communicator) Healthy(ctx context.Context) error {
+	c.mu.Lock()
+	cl, connected, stale := c.client, c.connected, c.stale
+	c.mu.Unlock()
+
+	switch {
+	case !connected:
+		return errors.New("PSRP session is not connected")
+	case stale:
+		return errors.New("PSRP session was found dead and has not been re-established")
+	}
+	return c.probeSession(ctx, cl)
+}
+
+// probeSession checks that cl is connected and can run a pipeline. A probe
+// that fails transiently is retried, so one dropped response doesn't
+// condemn a live session.
+func (c *Communicator) probeSession(ctx context.Context, cl PSRPClient) error {
+	if !clientConnected(cl) {
+		return errors.New("client reports disconnected")
+	}
+	err := c.retryTransient(ctx, "health", queryRetries, func() error {
+		_, err := cl.Execute(ctx, "$null")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("session probe failed: %w", err)
+	}
+	return nil
+}
+
+// NewSession opens an additional, independent session (its own shell and
+// runspace pool) to the same target with the same configuration, so work
+// can run in parallel with this one, e.g. tailing a log while an installer
+// runs. The caller must Close it.
+func (c *Communicator) NewSession(ctx context.Context) (*Communicator, error) {
+	c.mu.Lock()
+	fingerprint := c.fingerprint
+	c.mu.Unlock()
+
+	comm, err := New(c.target, c.config)
+	if err != nil {
+		return nil, err
+	}
+	comm.lazy = false
+	comm.fingerprint = fingerprint
+
+	// New may have opened an SSH tunnel and auth front already, so close the
+	// communicator on failure rather than dropping it
+	if err := c.config.verifyCertificate(ctx, c.target, &comm.fingerprint); err != nil {
+		comm.Close()
+		return nil, err
+	}
+	comm.trustCertificate(comm.fingerprint)
+	if err := comm.Connect(ctx); err != nil {
+		comm.Close()
+		return nil, err
+	}
+	return comm, nil
+}
+
+// execute runs a script on a live session, tracking it as an active
+// operation so the watchdog doesn't probe concurrently.
+func (c *Communicator) execute(ctx context.Context, script string) (*client.Result, error) {
+	c.stats.requests.Add(1)
+	c.busy.Add(1)
+	defer c.busy.Add(-1)
+
+	cl, err := c.session(ctx)
+	if err != nil {
+		return nil, stallError(ctx, err)
+	}
+	result, err := cl.Execute(ctx, script)
+	if err != nil {
+		return nil, stallError(ctx, fmt.Errorf("%w: %w", ErrPipelineFailed, c.config.explainFault(err)))
+	}
+	return result, nil
+}
+
+// startWatchdog launches the keep-alive watchdog if psrp_watchdog_interval
+// is set. It is a no-op if the watchdog is already running. The caller
+// holds c.mu.
+func (c *Communicator) startWatchdog() {
+	if c.config == nil || c.config.PSRPWatchdogInterval <= 0 || c.watchdogStop != nil {
+		return
+	}
+	c.watchdogStop = make(chan struct{})
+	c.watchdogWG.Add(1)
+	go c.watchdogLoop(c.config.PSRPWatchdogInterval, c.watchdogStop)
+}
+
+// stopWatchdog stops the watchdog and waits for it to exit. The watchdog
+// takes c.mu, so the caller must not hold it.
+func (c *Communicator) stopWatchdog() {
+	c.mu.Lock()
+	stop := c.watchdogStop
+	c.watchdogStop = nil
+	c.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	c.watchdogWG.Wait()
+}
+
+// watchdogLoop probes the session while it is idle. A failed probe marks
+// the session stale so the next operation reconnects before running. The
+// probe itself keeps the runspace from reaching its idle timeout during
+// long local steps.
+func (c *Communicator) watchdogLoop(interval time.Duration, stop <-chan struct{}) {
+	defer c.watchdogWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if c.busy.Load() > 0 {
+				continue
+			}
+
+			c.mu.Lock()
+			cl, stale := c.client, c.stale
+			c.mu.Unlock()
+			if stale {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), watchdogProbeTimeout)
+			err := c.probeSession(ctx, cl)
+			cancel()
+			if err != nil {
+				c.logger().Warn("watchdog probe failed", "op", "watchdog", "error", err)
+				c.mu.Lock()
+				if c.client == cl {
+					c.stale = true
+				}
+				c.mu.Unlock()
+			}
+		}
+	}
+}
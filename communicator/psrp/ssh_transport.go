@@ -0,0 +1,112 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHClient is the ClientFactory for the ssh transport: PSRP over the
+// SSH "powershell" subsystem, which PowerShell 6+ registers with sshd on
+// Windows (OpenSSH) and on Linux and macOS. The subsystem runs pwsh in
+// server mode, which speaks the same out-of-process framing as a named
+// pipe.
+func newSSHClient(target string, config *Config) (PSRPClient, error) {
+	username := config.PSRPUsername
+	if config.PSRPDomain != "" && !strings.ContainsAny(username, `\@`) {
+		username = config.PSRPDomain + `\` + username
+	}
+	auth := sshAuth{
+		option:         "psrp_ssh",
+		username:       username,
+		password:       config.PSRPPassword,
+		privateKeyFile: config.PSRPSSHPrivateKeyFile,
+		knownHosts:     config.PSRPSSHKnownHosts,
+		agent:          config.PSRPSSHAgentAuth,
+	}
+	addr := net.JoinHostPort(target, strconv.Itoa(config.PSRPPort))
+	subsystem := config.PSRPSSHSubsystem
+	if subsystem == "" {
+		subsystem = DefaultSSHSubsystem
+	}
+
+	return newOutOfProcClient("SSH subsystem "+subsystem, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return dialSSHSubsystem(ctx, addr, auth, subsystem)
+	}), nil
+}
+
+// sshStream is the stdin and stdout of an SSH subsystem.
+type sshStream struct {
+	io.Reader
+	io.WriteCloser
+	session *ssh.Session
+	client  *ssh.Client
+	agent   io.Closer
+}
+
+// Close ends the subsystem and the SSH connection.
+func (s *sshStream) Close() error {
+	s.WriteCloser.Close()
+	s.session.Close()
+	err := s.client.Close()
+	if s.agent != nil {
+		s.agent.Close()
+	}
+	return err
+}
+
+// dialSSHSubsystem connects to addr and starts subsystem on a new session.
+func dialSSHSubsystem(ctx context.Context, addr string, auth sshAuth, subsystem string) (_ io.ReadWriteCloser, err error) {
+	sshConfig, agentConn, err := auth.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && agentConn != nil {
+			agentConn.Close()
+		}
+	}()
+
+	dialer := net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem(subsystem); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to start SSH subsystem %q (is PowerShell registered as an sshd subsystem?): %w", subsystem, err)
+	}
+	return &sshStream{Reader: stdout, WriteCloser: stdin, session: session, client: client, agent: agentConn}, nil
+}
@@ -0,0 +1,153 @@
+package psrp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats summarizes what a communicator did, so users can see where
+// build time goes. Close logs it, and StepConnect stores it in the state
+// bag under "psrp_session_stats" when it closes the session.
+type SessionStats struct {
+	// Commands is the number of commands started with Start, and Requests
+	// the number of requests the communicator ran itself: transfer chunks,
+	// listings and queries.
+	Commands int64
+	Requests int64
+
+	BytesUploaded   int64
+	BytesDownloaded int64
+
+	// Retries counts transfer, query and health probe requests retried
+	// after a transient fault; Reconnects counts sessions re-established
+	// after going dead.
+	Retries    int64
+	Reconnects int64
+
+	// Wall-clock time spent in each phase. Commands and transfers that
+	// run concurrently are each counted in full.
+	ConnectTime  time.Duration
+	CommandTime  time.Duration
+	UploadTime   time.Duration
+	DownloadTime time.Duration
+
+	// SessionTime is the time from the first connection to Close.
+	SessionTime time.Duration
+}
+
+// String returns a one-line summary suitable for the UI.
+func (s SessionStats) String() string {
+	return fmt.Sprintf("%d commands (%s), %d requests, uploaded %d bytes (%s), downloaded %d bytes (%s), "+
+		"%d retries, %d reconnects, connecting took %s, session lasted %s",
+		s.Commands, s.CommandTime.Round(time.Millisecond), s.Requests,
+		s.BytesUploaded, s.UploadTime.Round(time.Millisecond),
+		s.BytesDownloaded, s.DownloadTime.Round(time.Millisecond),
+		s.Retries, s.Reconnects, s.ConnectTime.Round(time.Millisecond), s.SessionTime.Round(time.Second))
+}
+
+// sessionCounters accumulates a communicator's SessionStats. Durations are
+// in nanoseconds.
+type sessionCounters struct {
+	commands, requests             atomic.Int64
+	bytesUploaded, bytesDownloaded atomic.Int64
+	retries, reconnects            atomic.Int64
+	connectTime, commandTime       atomic.Int64
+	uploadTime, downloadTime       atomic.Int64
+	connectedAt                    atomic.Int64 // UnixNano of the first connection
+	closedAt                       atomic.Int64
+}
+
+// since adds the time elapsed since start to the counter d.
+func since(d *atomic.Int64, start time.Time) {
+	d.Add(int64(time.Since(start)))
+}
+
+// markConnected records the first connection, which starts SessionTime.
+func (s *sessionCounters) markConnected() {
+	s.connectedAt.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// Stats returns what the communicator has done so far.
+func (c *Communicator) Stats() SessionStats {
+	s := &c.stats
+	stats := SessionStats{
+		Commands:        s.commands.Load(),
+		Requests:        s.requests.Load(),
+		BytesUploaded:   s.bytesUploaded.Load(),
+		BytesDownloaded: s.bytesDownloaded.Load(),
+		Retries:         s.retries.Load(),
+		Reconnects:      s.reconnects.Load(),
+		ConnectTime:     time.Duration(s.connectTime.Load()),
+		CommandTime:     time.Duration(s.commandTime.Load()),
+		UploadTime:      time.Duration(s.uploadTime.Load()),
+		DownloadTime:    time.Duration(s.downloadTime.Load()),
+	}
+	if connected := s.connectedAt.Load(); connected != 0 {
+		end := time.Now().UnixNano()
+		if closed := s.closedAt.Load(); closed != 0 {
+			end = closed
+		}
+		stats.SessionTime = time.Duration(end - connected)
+	}
+	return stats
+}
+
+// logStats logs the session summary at Close, and records it in the
+// event log.
+func (c *Communicator) logStats() {
+	c.stats.closedAt.Store(time.Now().UnixNano())
+	s := c.Stats()
+	c.logger().Info("session summary", "op", "close",
+		"commands", s.Commands, "requests", s.Requests,
+		"bytes_uploaded", s.BytesUploaded, "bytes_downloaded", s.BytesDownloaded,
+		"retries", s.Retries, "reconnects", s.Reconnects,
+		"connect_time", s.ConnectTime, "command_time", s.CommandTime,
+		"upload_time", s.UploadTime, "download_time", s.DownloadTime,
+		"session_time", s.SessionTime)
+	c.events.emit("session.summary", nil,
+		"commands", s.Commands, "requests", s.Requests,
+		"bytes_uploaded", s.BytesUploaded, "bytes_downloaded", s.BytesDownloaded,
+		"retries", s.Retries, "reconnects", s.Reconnects,
+		"connect_ms", s.ConnectTime.Milliseconds(), "command_ms", s.CommandTime.Milliseconds(),
+		"upload_ms", s.UploadTime.Milliseconds(), "download_ms", s.DownloadTime.Milliseconds(),
+		"session_ms", s.SessionTime.Milliseconds())
+}
+
+// bytesPerSecond is the throughput of moving n bytes in d, for transfer
+// logs.
+func bytesPerSecond(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+// transferTotals sums the files moved by one UploadDir or DownloadDir.
+type transferTotals struct {
+	started time.Time
+	files   int
+	bytes   int64
+}
+
+func newTransferTotals() *transferTotals {
+	return &transferTotals{started: time.Now()}
+}
+
+// add records one transferred file of n bytes.
+func (t *transferTotals) add(n int64) {
+	t.files++
+	t.bytes += n
+}
+
+// log logs the totals at debug level as msg, noting err if the transfer
+// stopped early.
+func (t *transferTotals) log(c *Communicator, msg, src, dst string, err error) {
+	elapsed := time.Since(t.started)
+	args := []any{"op", "transfer", "src", src, "dst", dst, "files", t.files, "bytes", t.bytes,
+		"elapsed", elapsed, "bytes_per_sec", bytesPerSecond(t.bytes, elapsed)}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	c.logger().Debug(msg, args...)
+}
@@ -2,12 +2,14 @@ package psrp
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // StepConnect is a multistep Step that establishes a PSRP connection
@@ -35,125 +37,723 @@ type StepConnect struct {
 	Config *Config
 	Host   func(multistep.StateBag) (string, error)
 
+	// Hosts optionally reports several candidate addresses (multiple NICs,
+	// IPv4 and IPv6). When set it takes precedence over Host, and each
+	// connection attempt races all candidates, keeping whichever answers first.
+	Hosts func(multistep.StateBag) ([]string, error)
+
+	// HostPort optionally reports the port along with the address, for
+	// builders whose forwarded port can change between boots (NAT). When set
+	// it takes precedence over Host and Hosts, and a port of 0 means
+	// psrp_port. Like Host, it is called again before every retry.
+	HostPort func(multistep.StateBag) (string, int, error)
+
 	// Internal state
-	comm *Communicator
+	comm       *Communicator
+	host       string   // address s.comm was created for
+	candidates []string // addresses raced when Hosts reports more than one
+	config     *Config  // Config with connect-time credentials applied
+	metrics    *ConnectMetrics
+
+	// fingerprint is the listener certificate seen on first connect when
+	// psrp_tls_tofu is enabled. It survives re-runs so reconnects are checked.
+	fingerprint string
+
+	// identity is the machine seen on first connect. It survives re-runs so
+	// a reconnect to a different machine is caught.
+	identity *guestIdentity
 }
 
 // Run establishes the PSRP connection with retry logic.
 func (s *StepConnect) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
-	ui := state.Get("ui").(packersdk.Ui)
+	ctx, span := startSpan(ctx, "psrp.StepConnect",
+		attribute.String("psrp.transport", string(s.Config.PSRPTransport)),
+		attribute.String("psrp.auth_type", string(s.Config.PSRPAuthType)))
+
+	action := s.run(ctx, state)
+
+	var err error
+	if action == multistep.ActionHalt {
+		err, _ = state.Get("error").(error)
+		if err != nil {
+			err = RedactError(err)
+			state.Put("error", err)
+		}
+	}
+	span.SetAttributes(attribute.String("psrp.host", s.host))
+	if s.metrics != nil {
+		span.SetAttributes(attribute.Int("psrp.retries", s.metrics.Retries))
+	}
+	endSpan(span, err)
+	return action
+}
+
+func (s *StepConnect) run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := RedactUi(state.Get("ui").(packersdk.Ui))
+	var err error
 
 	// If we're being re-run (e.g., after pause_before_connecting),
 	// close the previous connection first.
 	if s.comm != nil {
-		log.Printf("[DEBUG] Closing previous PSRP connection before reconnect")
+		s.logger().Debug("closing previous connection before reconnect")
 		s.comm.Close()
 		s.comm = nil
 	}
 
-	// Get the host to connect to
-	host, err := s.Host(state)
+	s.metrics = &ConnectMetrics{started: time.Now()}
+
+	// Fetch just-in-time credentials, if a provider is configured
+	s.config, err = s.Config.WithResolvedCredentials(ctx)
 	if err != nil {
-		err := fmt.Errorf("error getting PSRP host: %w", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	ui.Say(fmt.Sprintf("Connecting to PSRP endpoint at %s:%d...", host, s.Config.PSRPPort))
+	// Look up the VM GUID by name; psrp_vmid takes precedence
+	if s.config.PSRPTransport == TransportHvSocket && s.config.PSRPVMID == "" && s.config.PSRPVMName != "" {
+		if err := s.resolveVMID(ctx, ui); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	// Reuse a session an earlier StepConnect left open for this host
+	if s.Config.PSRPKeepSession && s.adoptSession(state) {
+		ui.Say(fmt.Sprintf("Reusing open PSRP session to %s", s.host))
+		s.metrics.publish(state)
+		s.comm.SetUi(ui)
+		state.Put("communicator", s.comm)
+		return multistep.ActionContinue
+	}
 
-	// Create the communicator
-	s.comm, err = New(host, s.Config)
-	if err != nil {
-		err := fmt.Errorf("error creating PSRP communicator: %w", err)
+	if s.config.insecureBasic() {
+		ui.Error(fmt.Sprintf("Warning: basic authentication over plain HTTP sends the password for %q unencrypted "+
+			"(psrp_allow_insecure_basic). Use psrp_use_tls outside isolated lab networks.", s.config.PSRPUsername))
+	}
+
+	// Get the host to connect to and create the communicator
+	s.host = ""
+	if err := s.refreshHost(state); err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	// Attempt connection with retry logic
-	timeout := s.Config.PSRPTimeout
-	if timeout == 0 {
-		timeout = 5 * time.Minute
+	// Hand over an unconnected communicator; it connects on first use
+	if s.Config.PSRPLazyConnect {
+		if s.comm == nil {
+			if s.comm, err = New(s.host, s.config); err != nil {
+				err = fmt.Errorf("error creating PSRP communicator: %w", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+		}
+		if !s.Config.PSRPSkipIdentityCheck {
+			s.comm.lazyCheck = s.verifyIdentity
+		}
+		ui.Say(fmt.Sprintf("Deferring PSRP connection to %s until first use", s.host))
+		if !s.Config.PSRPSkipGuestInfo {
+			ui.Message("Guest info is not queried for a deferred connection; psrp_guest_info will not be set")
+		}
+		state.Put("communicator", s.comm)
+		return multistep.ActionContinue
 	}
 
-	retryCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	ui.Say(fmt.Sprintf("Waiting for PSRP to become available (timeout: %v)...", timeout))
+	ui.Say(fmt.Sprintf("Connecting to PSRP endpoint at %s:%d...", s.host, s.config.PSRPPort))
 
-	err = s.waitForPSRP(retryCtx, ui)
-	if err != nil {
+	if err := s.connect(ctx, state, ui); err != nil {
+		if reason, ok := winrmFallbackReason(err); ok && s.Config.PSRPWinRMFallback {
+			return s.fallbackToWinRM(state, ui, reason, err)
+		}
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
 	ui.Say("Connected to PSRP!")
+	if !s.Config.PSRPSkipIdentityCheck {
+		if err := s.verifyIdentity(ctx); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	if err := s.checkAuthMechanism(state, ui); err != nil {
+		// Don't leave the session for psrp_keep_session to hand out
+		s.comm.Close()
+		s.comm = nil
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.logger().Info("connected", "time_to_connect", s.metrics.TimeToConnect,
+		"time_to_port_open", s.metrics.TimeToPortOpen, "retries", s.metrics.Retries)
+
+	// Deal with a reboot left pending by image servicing
+	if s.Config.PSRPPendingReboot != "" && s.Config.PSRPPendingReboot != PendingRebootIgnore {
+		if err := s.handlePendingReboot(ctx, state, ui); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	// Hold provisioning until the guest reports it is ready
+	if s.Config.PSRPPostConnectScript != "" {
+		if err := s.waitForCondition(ctx, ui); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	if s.fingerprint != "" {
+		ui.Message(fmt.Sprintf("Trusting PSRP listener certificate with SHA-256 fingerprint %s", s.fingerprint))
+		state.Put("psrp_tls_fingerprint", s.fingerprint)
+	}
+
+	// Report what we connected to; failure here is not fatal
+	if !s.Config.PSRPSkipGuestInfo {
+		infoCtx, infoCancel := s.comm.opContext()
+		info, err := s.comm.GuestInfo(infoCtx)
+		infoCancel()
+		if err != nil {
+			s.logger().Warn("querying guest info failed", "error", err)
+		} else {
+			ui.Say(fmt.Sprintf("Connected to %s", info))
+			state.Put("psrp_guest_info", info)
+		}
+	}
+
+	if s.Config.PSRPCollectFacts {
+		factsCtx, factsCancel := s.comm.opContext()
+		facts, err := s.comm.GuestFacts(factsCtx)
+		factsCancel()
+		if err != nil {
+			s.logger().Warn("collecting guest facts failed", "error", err)
+		} else {
+			s.logger().Debug("guest facts", "os_build", facts.OSBuild, "features", len(facts.Features), "activation", facts.ActivationStatus)
+			facts.publish(state)
+		}
+	}
+
+	if s.Config.PSRPCheckQuotas && s.Config.PSRPTransport == TransportWSMan && !s.Config.POSIXTarget() {
+		quotasCtx, quotasCancel := s.comm.opContext()
+		quotas, err := s.comm.WSManQuotas(quotasCtx)
+		quotasCancel()
+		if err != nil {
+			s.logger().Warn("checking WinRM quotas failed", "error", err)
+		} else {
+			s.logger().Debug("WinRM quotas", "quotas", quotas)
+			for _, warning := range s.config.quotaWarnings(quotas) {
+				ui.Error("Warning: " + warning)
+			}
+		}
+	}
+
+	s.metrics.publish(state)
 
 	// Store the communicator in state for provisioners to use
+	s.comm.SetUi(ui)
 	state.Put("communicator", s.comm)
 
 	return multistep.ActionContinue
 }
 
-// waitForPSRP attempts to connect with retry logic until successful or timeout.
-func (s *StepConnect) waitForPSRP(ctx context.Context, ui packersdk.Ui) error {
+// resolveVMID fills in psrp_vmid from psrp_vm_name on the connect-time copy
+// of the configuration, waiting up to PSRPTimeout for the VM to register.
+func (s *StepConnect) resolveVMID(ctx context.Context, ui packersdk.Ui) error {
+	timeout := s.Config.PSRPTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ui.Say(fmt.Sprintf("Looking up Hyper-V VM %q...", s.config.PSRPVMName))
+	id, err := s.config.resolveVMID(ctx)
+	if err != nil {
+		return err
+	}
+
+	resolved := *s.config
+	resolved.PSRPVMID = id
+	s.config = &resolved
+	return nil
+}
+
+// connect waits for the endpoint and establishes the session, retrying
+// until PSRPTimeout expires.
+func (s *StepConnect) connect(ctx context.Context, state multistep.StateBag, ui packersdk.Ui) error {
+	timeout := s.Config.PSRPTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+
+	retryCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ui.Say(fmt.Sprintf("Waiting for PSRP to become available (timeout: %v)...", timeout))
+
+	// Wait for the listener cheaply before starting full negotiation. Through
+	// an SSH tunnel the local end always accepts, so there is nothing to probe.
+	network := s.Config.PSRPTransport == TransportWSMan || s.Config.PSRPTransport == TransportSSH
+	if network && !s.Config.PSRPSkipTCPProbe && s.Config.PSRPSSHTunnelHost == "" {
+		if err := s.waitForPort(retryCtx, state); err != nil {
+			return err
+		}
+		s.metrics.portOpen()
+
+		if s.Config.PSRPCheckClockSkew && s.Config.PSRPTransport == TransportWSMan {
+			if msg, err := s.config.checkClockSkew(retryCtx, s.host); err != nil {
+				s.logger().Debug("clock skew check failed", "error", err)
+			} else if msg != "" {
+				ui.Error(fmt.Sprintf("Warning: %s", msg))
+			}
+		}
+	}
+
+	if err := s.waitForPSRP(retryCtx, state, ui); err != nil {
+		// Failed attempts are expected while the guest boots; only record
+		// the one that ends the wait
+		if s.comm != nil {
+			s.comm.recordFailure("connect failed", err)
+		}
+		return err
+	}
+	s.metrics.connected()
+
+	// Extra sessions (NewSession) must present the same certificate
+	s.comm.mu.Lock()
+	s.comm.fingerprint = s.fingerprint
+	s.comm.mu.Unlock()
+	return nil
+}
+
+// waitForPSRP attempts to connect with retry logic until successful, the
+// configured retry budget is spent, or the context times out.
+func (s *StepConnect) waitForPSRP(ctx context.Context, state multistep.StateBag, ui packersdk.Ui) error {
 	var lastErr error
-	retryDelay := 5 * time.Second
-	maxRetryDelay := 30 * time.Second
+	delays := s.Config.newBackoff()
 	attempt := 0
 
-	ticker := time.NewTicker(retryDelay)
+	ticker := time.NewTicker(delays.next())
 	defer ticker.Stop()
 
 	// Try immediately first
-	if err := s.comm.Connect(ctx); err == nil {
+	if err := s.connectAttempt(ctx); err == nil {
 		return nil
 	} else {
 		lastErr = err
-		log.Printf("[DEBUG] Initial PSRP connection failed: %v", err)
+		s.logger().Debug("initial connection failed", "error", err)
+		if err := s.config.permanentConnectError(err); err != nil {
+			return err
+		}
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			if lastErr != nil {
-				return fmt.Errorf("timeout waiting for PSRP (last error: %w)", lastErr)
+				return fmt.Errorf("%w (last error: %w)", ErrConnectionTimeout, lastErr)
 			}
-			return fmt.Errorf("timeout waiting for PSRP")
+			return ErrConnectionTimeout
 
 		case <-ticker.C:
 			attempt++
-			ui.Message(fmt.Sprintf("Attempting PSRP connection (attempt %d)...", attempt))
+			s.metrics.Retries++
+
+			// The builder may report a new address mid-boot (DHCP renew,
+			// NAT re-map); keep using the last one if lookup fails.
+			if err := s.refreshHost(state); err != nil {
+				s.logger().Debug("host lookup failed; retrying previous host", "error", err)
+			}
+
+			ui.Message(fmt.Sprintf("Attempting PSRP connection to %s (attempt %d)...", s.host, attempt))
 
-			err := s.comm.Connect(ctx)
+			err := s.connectAttempt(ctx)
 			if err == nil {
 				return nil // Success!
 			}
 
 			lastErr = err
-			log.Printf("[DEBUG] PSRP connection attempt %d failed: %v", attempt, err)
+			s.logger().Debug("connection attempt failed", "attempt", attempt, "error", err)
+			if err := s.config.permanentConnectError(err); err != nil {
+				return err
+			}
 
-			// Exponential backoff with max delay
-			retryDelay = retryDelay * 2
-			if retryDelay > maxRetryDelay {
-				retryDelay = maxRetryDelay
+			if s.Config.PSRPMaxRetries > 0 && attempt >= s.Config.PSRPMaxRetries {
+				return fmt.Errorf("giving up on PSRP after %d retries (last error: %w)", attempt, lastErr)
 			}
-			ticker.Reset(retryDelay)
+
+			ticker.Reset(delays.next())
 		}
 	}
 }
 
-// Cleanup closes the PSRP connection if it was established.
+// waitForPort polls the WSMan port (and optionally the HTTP listener) until
+// it answers or the context expires. Probes are cheap, so they run at the
+// initial retry interval without backoff. The host is re-resolved each time.
+func (s *StepConnect) waitForPort(ctx context.Context, state multistep.StateBag) error {
+	interval := s.Config.PSRPRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	for {
+		if err := s.refreshHost(state); err != nil {
+			s.logger().Debug("host lookup failed; probing previous host", "error", err)
+		}
+		hosts := s.candidates
+		if len(hosts) == 0 {
+			hosts = []string{s.host}
+		}
+
+		var addr string
+		var err error
+		for _, host := range hosts {
+			addr, err = s.config.probeAddr(host)
+			if err != nil {
+				return err
+			}
+
+			err = probeTCP(ctx, addr)
+			if err == nil && s.Config.PSRPHTTPProbe && s.Config.PSRPTransport == TransportWSMan {
+				err = probeHTTP(ctx, s.config.EndpointURL(host))
+			}
+			if err == nil {
+				s.logger().Debug("endpoint is accepting connections", "addr", addr)
+				return nil
+			}
+			s.logger().Debug("port probe failed", "addr", addr, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s is not accepting connections (last error: %w)", ErrConnectionTimeout, addr, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// State keys a builder can set to direct StepConnect to another endpoint,
+// such as 127.0.0.1 and the host port forwarded to the guest's WSMan port
+// under QEMU or VirtualBox NAT. They override the Host, Hosts and HostPort
+// callbacks and psrp_host/psrp_port, and are read again before every retry,
+// so a builder that forwards a different port after a VM restart can
+// update them.
+const (
+	StateConnectHost = "psrp_connect_host" // string
+	StateConnectPort = "psrp_connect_port" // int
+)
+
+// statePort returns the port published under StateConnectPort, or 0.
+func statePort(state multistep.StateBag) (int, error) {
+	raw, ok := state.GetOk(StateConnectPort)
+	if !ok {
+		return 0, nil
+	}
+	port, ok := raw.(int)
+	if !ok || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("%s must be a port number, not %v", StateConnectPort, raw)
+	}
+	return port, nil
+}
+
+// lookupHosts returns the builder's current candidate addresses, and the
+// port if the builder reports one (0 otherwise).
+func (s *StepConnect) lookupHosts(state multistep.StateBag) ([]string, int, error) {
+	port, err := statePort(state)
+	if err != nil {
+		return nil, 0, err
+	}
+	if host, _ := state.Get(StateConnectHost).(string); host != "" {
+		return []string{host}, port, nil
+	}
+	if port > 0 {
+		hosts, _, err := s.lookupCallbacks(state)
+		return hosts, port, err
+	}
+	return s.lookupCallbacks(state)
+}
+
+// lookupCallbacks returns the addresses and port the builder's callbacks
+// report.
+func (s *StepConnect) lookupCallbacks(state multistep.StateBag) ([]string, int, error) {
+	if s.HostPort != nil {
+		host, port, err := s.HostPort(state)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []string{host}, port, nil
+	}
+	hosts, err := s.lookupAddrs(state)
+	return hosts, 0, err
+}
+
+// lookupAddrs returns the addresses reported by Hosts or Host.
+func (s *StepConnect) lookupAddrs(state multistep.StateBag) ([]string, error) {
+	if s.Hosts == nil {
+		if s.Host == nil {
+			return nil, fmt.Errorf("no address to connect to: set StepConnect.Host or the %q state key", StateConnectHost)
+		}
+		host, err := s.Host(state)
+		if err != nil {
+			return nil, err
+		}
+		return []string{host}, nil
+	}
+
+	hosts, err := s.Hosts(state)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(hosts))
+	var unique []string
+	for _, h := range hosts {
+		if h != "" && !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("no candidate addresses reported")
+	}
+	return unique, nil
+}
+
+// waitForCondition runs psrp_post_connect_script until it exits 0 or
+// psrp_post_connect_timeout expires.
+func (s *StepConnect) waitForCondition(ctx context.Context, ui packersdk.Ui) error {
+	timeout := s.Config.PSRPPostConnectTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	interval := s.Config.PSRPRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ui.Say(fmt.Sprintf("Waiting for post-connect condition (timeout: %v)...", timeout))
+	for attempt := 1; ; attempt++ {
+		code, output, err := s.comm.runScript(ctx, s.Config.PSRPPostConnectScript)
+		if err == nil && code == 0 {
+			return nil
+		}
+		if err != nil {
+			s.logger().Debug("post-connect script attempt failed", "attempt", attempt, "error", err)
+		} else {
+			s.logger().Debug("post-connect script attempt failed", "attempt", attempt, "exit_code", code, "output", strings.TrimSpace(output))
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("last exit code %d", code)
+			}
+			return fmt.Errorf("timeout waiting for psrp_post_connect_script to succeed (%v)", err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// refreshHost asks the builder for the current address(es). With a single
+// address that differs from the one the communicator was created for, the
+// communicator is replaced. With several, they are recorded for racing and
+// the communicator is created by whichever candidate connects first.
+func (s *StepConnect) refreshHost(state multistep.StateBag) error {
+	hosts, port, err := s.lookupHosts(state)
+	if err != nil {
+		return fmt.Errorf("error getting PSRP host: %w", err)
+	}
+
+	portChanged := false
+	if port > 0 && port != s.config.PSRPPort {
+		s.logger().Info("port changed", "from", s.config.PSRPPort, "to", port)
+		cfg := *s.config
+		cfg.PSRPPort = port
+		s.config = &cfg
+		portChanged = true
+	}
+
+	if len(hosts) > 1 {
+		s.candidates = hosts
+		if s.host == "" {
+			s.host = hosts[0]
+		}
+		return nil
+	}
+	s.candidates = nil
+
+	host := hosts[0]
+	if host == s.host && !portChanged && s.comm != nil {
+		return nil
+	}
+
+	if s.comm != nil {
+		s.logger().Info("endpoint changed; recreating communicator", "new_host", host, "port", s.config.PSRPPort)
+		s.comm.Close()
+		s.comm = nil
+	}
+
+	comm, err := New(host, s.config)
+	if err != nil {
+		return fmt.Errorf("error creating PSRP communicator: %w", err)
+	}
+	s.comm = comm
+	s.host = host
+	return nil
+}
+
+// connectAttempt makes a single connection attempt bounded by
+// PSRPConnectAttemptTimeout (when set) as well as the overall wait context.
+func (s *StepConnect) connectAttempt(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "psrp.connect_attempt",
+		attribute.String("psrp.host", s.host),
+		attribute.Int("psrp.attempt", s.metrics.Retries+1))
+	defer func() { endSpan(span, err) }()
+
+	if s.Config.PSRPConnectAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Config.PSRPConnectAttemptTimeout)
+		defer cancel()
+	}
+	if len(s.candidates) > 1 {
+		return s.raceConnect(ctx)
+	}
+	if s.comm.tunnel != nil {
+		// Surface SSH failures as such, not as a reset WSMan connection
+		if _, err := s.comm.tunnel.sshClient(); err != nil {
+			return err
+		}
+	}
+	if err := s.config.verifyCertificate(ctx, s.host, &s.fingerprint); err != nil {
+		return err
+	}
+	s.comm.trustCertificate(s.fingerprint)
+	return s.comm.Connect(ctx)
+}
+
+// raceConnect connects to every candidate address concurrently. The first
+// to succeed becomes s.comm; the rest are cancelled and closed.
+func (s *StepConnect) raceConnect(ctx context.Context) error {
+	type result struct {
+		host string
+		comm *Communicator
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Certificate checks run up front: they are quick and share s.fingerprint
+	results := make(chan result, len(s.candidates))
+	for _, host := range s.candidates {
+		if err := s.config.verifyCertificate(ctx, host, &s.fingerprint); err != nil {
+			results <- result{host: host, err: err}
+			continue
+		}
+		go func(host, fingerprint string) {
+			comm, err := New(host, s.config)
+			if err == nil {
+				comm.trustCertificate(fingerprint)
+				err = comm.Connect(ctx)
+			}
+			results <- result{host: host, comm: comm, err: err}
+		}(host, s.fingerprint)
+	}
+
+	var winner *result
+	var errs []error
+	for range s.candidates {
+		r := <-results
+		if r.err == nil && winner == nil {
+			winner = &r
+			cancel()
+			continue
+		}
+		if r.comm != nil {
+			r.comm.Close()
+		}
+		if r.err != nil && winner == nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.host, r.err))
+		}
+	}
+
+	if winner == nil {
+		return errors.Join(errs...)
+	}
+
+	if s.comm != nil {
+		s.comm.Close()
+	}
+	winner.comm.logger().Info("connected via fastest candidate", "op", "connect", "candidates", s.candidates)
+	s.comm = winner.comm
+	s.host = winner.host
+	return nil
+}
+
+// permanentConnectError returns an actionable error if err cannot be fixed
+// by retrying (bad credentials, TLS or DNS misconfiguration), or nil if the
+// connection should be retried.
+func (c *Config) permanentConnectError(err error) error {
+	class := classifyConnectError(err)
+	if class.retryable() {
+		return nil
+	}
+	hint := class.hint()
+	if class == classAuth {
+		hint += c.channelBindingHint()
+	}
+	return fmt.Errorf("%w, not retrying: %s: %w", class.sentinel(), hint, err)
+}
+
+// adoptSession takes over a registered session for the builder's current
+// host, if there is a live one opened with the same port, transport,
+// account and session configuration.
+func (s *StepConnect) adoptSession(state multistep.StateBag) bool {
+	hosts, _, err := s.lookupHosts(state)
+	if err != nil || len(hosts) != 1 {
+		return false
+	}
+	comm := takeSession(hosts[0], s.config)
+	if comm == nil {
+		return false
+	}
+	s.comm = comm
+	s.host = hosts[0]
+	return true
+}
+
+// Cleanup closes the PSRP connection if it was established, or with
+// psrp_keep_session registers it for reuse instead.
 func (s *StepConnect) Cleanup(state multistep.StateBag) {
 	if s.comm != nil {
 		ui := state.Get("ui").(packersdk.Ui)
+
+		if s.Config.PSRPKeepSession {
+			s.logger().Info("leaving session open for reuse")
+			RegisterSession(s.host, s.comm)
+			s.comm = nil
+			return
+		}
+
 		ui.Say("Closing PSRP connection...")
 
 		if err := s.comm.Close(); err != nil {
 			ui.Error(fmt.Sprintf("Error closing PSRP connection: %s", err))
 		}
+		state.Put("psrp_session_stats", s.comm.Stats())
+		if files := s.comm.TranscriptFiles(); len(files) > 0 {
+			ui.Say(fmt.Sprintf("PSRP session transcript saved to %s", strings.Join(files, ", ")))
+			state.Put("psrp_transcripts", files)
+		}
 		s.comm = nil
 	}
 }
@@ -0,0 +1,60 @@
+package psrp
+
+import "strings"
+
+// Target operating systems (psrp_target_os).
+const (
+	TargetWindows = "windows"
+	TargetLinux   = "linux"
+	TargetMacOS   = "macos"
+)
+
+// POSIXTarget reports whether the target runs PowerShell on Linux or macOS,
+// reached over WSMan (OMI with PSWSMan) or SSH. Paths there use forward
+// slashes, and the Windows-only features are unavailable.
+func (c *Config) POSIXTarget() bool {
+	return c != nil && (c.PSRPTargetOS == TargetLinux || c.PSRPTargetOS == TargetMacOS)
+}
+
+// RemoteJoin joins a remote directory and a path relative to it, written
+// with forward slashes, using the target's separator. A trailing separator
+// on dir is not doubled.
+func (c *Config) RemoteJoin(dir, rel string) string {
+	if c.POSIXTarget() {
+		return strings.TrimRight(dir, "/") + "/" + rel
+	}
+	return strings.TrimRight(dir, `/\`) + `\` + strings.ReplaceAll(rel, "/", `\`)
+}
+
+// RemoteTempDir returns where files are staged on the target.
+func (c *Config) RemoteTempDir() string {
+	if c.POSIXTarget() {
+		return "/tmp"
+	}
+	return "C:/Windows/Temp"
+}
+
+// POSIXTarget reports whether the communicator's target is Linux or macOS.
+func (c *Communicator) POSIXTarget() bool { return c.config.POSIXTarget() }
+
+// RemoteTempDir returns where files are staged on the communicator's
+// target.
+func (c *Communicator) RemoteTempDir() string { return c.config.RemoteTempDir() }
+
+// restartScript returns the command that reboots the target after a short
+// delay, so the command completes before the session drops. reason is
+// passed as a literal, never expanded.
+func (c *Config) restartScript(reason string) string {
+	if c.POSIXTarget() {
+		return `/bin/sh -c '(sleep 5; shutdown -r now) >/dev/null 2>&1 &'`
+	}
+	return `shutdown.exe /r /f /t 5 /c ` + psQuote(reason)
+}
+
+// bootTimeScript returns when the guest last booted, as a FILETIME.
+func (c *Config) bootTimeScript() string {
+	if c.POSIXTarget() {
+		return `ConvertTo-Json -Compress -InputObject (Get-Uptime -Since).ToFileTimeUtc()`
+	}
+	return `ConvertTo-Json -Compress -InputObject (Get-CimInstance -ClassName Win32_OperatingSystem).LastBootUpTime.ToFileTimeUtc()`
+}
@@ -0,0 +1,37 @@
+package psrp
+
+import "testing"
+
+func TestRemoteJoin(t *testing.T) {
+	cases := []struct {
+		os, dir, rel, want string
+	}{
+		{TargetWindows, `C:\Temp`, "a/b.txt", `C:\Temp\a\b.txt`},
+		{TargetWindows, `C:\Temp\`, "b.txt", `C:\Temp\b.txt`},
+		{TargetWindows, "C:/Temp/", "a/b.txt", `C:/Temp\a\b.txt`},
+		{TargetLinux, "/tmp", "a/b.txt", "/tmp/a/b.txt"},
+		{TargetMacOS, "/tmp/", "b.txt", "/tmp/b.txt"},
+	}
+	for _, tc := range cases {
+		c := &Config{PSRPTargetOS: tc.os}
+		if got := c.RemoteJoin(tc.dir, tc.rel); got != tc.want {
+			t.Errorf("%s: RemoteJoin(%q, %q) = %q, want %q", tc.os, tc.dir, tc.rel, got, tc.want)
+		}
+	}
+}
+
+// The restart reason comes from the template, so it must reach shutdown.exe
+// as a single literal argument.
+func TestRestartScriptQuotesReason(t *testing.T) {
+	c := &Config{PSRPTargetOS: TargetWindows}
+	got := c.restartScript(`it's "$(Remove-Item C:\)"`)
+	want := `shutdown.exe /r /f /t 5 /c 'it''s "$(Remove-Item C:\)"'`
+	if got != want {
+		t.Errorf("restartScript = %q, want %q", got, want)
+	}
+
+	c.PSRPTargetOS = TargetLinux
+	if got := c.restartScript("ignored"); got != `/bin/sh -c '(sleep 5; shutdown -r now) >/dev/null 2>&1 &'` {
+		t.Errorf("restartScript on Linux = %q", got)
+	}
+}
@@ -0,0 +1,81 @@
+package testutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// Environment variables naming a real endpoint for benchmarks and
+// acceptance tests. Only EnvHost is required; the others set the psrp_*
+// option of the same name.
+const (
+	EnvHost     = "PSRP_TEST_HOST"
+	EnvPort     = "PSRP_TEST_PORT"
+	EnvUsername = "PSRP_TEST_USERNAME"
+	EnvPassword = "PSRP_TEST_PASSWORD"
+	EnvAuthType = "PSRP_TEST_AUTH_TYPE"
+	EnvUseTLS   = "PSRP_TEST_USE_TLS"
+	EnvInsecure = "PSRP_TEST_INSECURE"
+	EnvDomain   = "PSRP_TEST_DOMAIN"
+	EnvRealm    = "PSRP_TEST_REALM"
+)
+
+// EndpointConfig returns a prepared config for the endpoint named by the
+// PSRP_TEST_* environment variables, or nil if EnvHost is unset. configure,
+// if non-nil, adjusts the config before it is prepared, e.g. to pick an
+// auth type.
+//
+//	cfg, err := testutil.EndpointConfig(nil)
+//	if cfg == nil {
+//		t.Skip(testutil.EnvHost + " not set")
+//	}
+func EndpointConfig(configure func(*psrp.Config)) (*psrp.Config, error) {
+	host := os.Getenv(EnvHost)
+	if host == "" {
+		return nil, nil
+	}
+
+	c := psrp.NewConfig()
+	c.PSRPHost = host
+	c.PSRPUsername = os.Getenv(EnvUsername)
+	c.PSRPPassword = os.Getenv(EnvPassword)
+	c.PSRPDomain = os.Getenv(EnvDomain)
+	c.PSRPRealm = os.Getenv(EnvRealm)
+	if v := os.Getenv(EnvAuthType); v != "" {
+		c.PSRPAuthType = psrp.AuthType(v)
+	}
+	for _, opt := range []struct {
+		env string
+		dst *bool
+	}{
+		{EnvUseTLS, &c.PSRPUseTLS},
+		{EnvInsecure, &c.PSRPInsecureSkipVerify},
+	} {
+		if v := os.Getenv(opt.env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", opt.env, err)
+			}
+			*opt.dst = b
+		}
+	}
+	if v := os.Getenv(EnvPort); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvPort, err)
+		}
+		c.PSRPPort = port
+	}
+
+	if configure != nil {
+		configure(c)
+	}
+	if errs := c.Prepare(nil); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
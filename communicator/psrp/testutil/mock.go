@@ -0,0 +1,212 @@
+// Package testutil provides a mock PSRP client for unit testing code built
+// on the psrp communicator without a Windows host.
+//
+//	mock := testutil.NewMockClient()
+//	mock.StreamFunc = testutil.StreamLines("hello", "__PACKER_EXIT_CODE__:0")
+//	comm, _ := psrp.NewWithClientFactory("host", cfg, mock.Factory())
+package testutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/smnsjas/go-psrp/client"
+	"github.com/smnsjas/go-psrpcore/messages"
+	"github.com/smnsjas/go-psrpcore/serialization"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// MockClient is an in-memory psrp.PSRPClient. Behavior is configured
+// through the exported func fields; every script is recorded in Scripts.
+type MockClient struct {
+	// ConnectErr is returned by Connect.
+	ConnectErr error
+
+	// ExecuteFunc handles Execute. If nil, Execute returns an empty result.
+	ExecuteFunc func(ctx context.Context, script string) (*client.Result, error)
+
+	// StreamFunc handles ExecuteStream. If nil, the stream completes
+	// immediately with no output.
+	StreamFunc func(ctx context.Context, script string) (*psrp.Stream, error)
+
+	mu        sync.Mutex
+	scripts   []string
+	connected bool
+	closed    bool
+}
+
+// NewMockClient returns a MockClient with default behavior.
+func NewMockClient() *MockClient {
+	return &MockClient{}
+}
+
+// Factory returns a psrp.ClientFactory that always hands out m, so the
+// communicator's reconnects reuse the same mock.
+func (m *MockClient) Factory() psrp.ClientFactory {
+	return func(string, *psrp.Config) (psrp.PSRPClient, error) {
+		m.mu.Lock()
+		m.closed = false
+		m.mu.Unlock()
+		return m, nil
+	}
+}
+
+// Connect marks the client connected unless ConnectErr is set.
+func (m *MockClient) Connect(ctx context.Context) error {
+	if m.ConnectErr != nil {
+		return m.ConnectErr
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("client is closed")
+	}
+	m.connected = true
+	return nil
+}
+
+// Close marks the client closed.
+func (m *MockClient) Close(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected = false
+	m.closed = true
+	return nil
+}
+
+// IsConnected reports whether Connect succeeded and Close wasn't called.
+func (m *MockClient) IsConnected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connected
+}
+
+// SetConnected simulates the session dropping (false) or recovering.
+func (m *MockClient) SetConnected(connected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected = connected
+}
+
+// Execute records script and calls ExecuteFunc.
+func (m *MockClient) Execute(ctx context.Context, script string) (*client.Result, error) {
+	m.record(script)
+	if m.ExecuteFunc == nil {
+		return &client.Result{}, nil
+	}
+	return m.ExecuteFunc(ctx, script)
+}
+
+// ExecuteStream records script and calls StreamFunc.
+func (m *MockClient) ExecuteStream(ctx context.Context, script string) (*psrp.Stream, error) {
+	m.record(script)
+	if m.StreamFunc == nil {
+		return NewStream(nil, nil, nil), nil
+	}
+	return m.StreamFunc(ctx, script)
+}
+
+// Scripts returns the scripts run so far, in order.
+func (m *MockClient) Scripts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.scripts...)
+}
+
+func (m *MockClient) record(script string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scripts = append(m.scripts, script)
+}
+
+// Result returns an Execute result with the given output objects.
+func Result(output ...interface{}) *client.Result {
+	return &client.Result{Output: output}
+}
+
+// StreamLines returns a StreamFunc whose streams emit lines on the output
+// stream and complete successfully. Include an exit marker line (e.g.
+// "__PACKER_EXIT_CODE__:3") to control the exit code Start reports.
+func StreamLines(lines ...string) func(context.Context, string) (*psrp.Stream, error) {
+	return func(context.Context, string) (*psrp.Stream, error) {
+		return NewStream(lines, nil, nil), nil
+	}
+}
+
+// StreamError returns a StreamFunc whose stream writes errLines to the
+// error stream and then completes with err (which may be nil).
+func StreamError(err error, errLines ...string) func(context.Context, string) (*psrp.Stream, error) {
+	return func(context.Context, string) (*psrp.Stream, error) {
+		return NewStream(nil, errLines, err), nil
+	}
+}
+
+// StreamBlocking returns a StreamFunc whose stream emits nothing and only
+// completes once cancelled (or ctx is done), for testing cancellation.
+func StreamBlocking() func(context.Context, string) (*psrp.Stream, error) {
+	return func(ctx context.Context, _ string) (*psrp.Stream, error) {
+		done := make(chan struct{})
+		var once sync.Once
+		stop := func() { once.Do(func() { close(done) }) }
+
+		s := emptyStream()
+		out := make(chan *messages.Message)
+		s.Output = out
+		s.CancelFunc = stop
+		s.WaitFunc = func() error {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+			close(out)
+			return context.Canceled
+		}
+		return s, nil
+	}
+}
+
+// NewStream returns a completed stream carrying output and error lines,
+// whose Wait returns err.
+func NewStream(output, errs []string, err error) *psrp.Stream {
+	s := emptyStream()
+	s.Output = messageChan(output)
+	s.Errors = messageChan(errs)
+	s.WaitFunc = func() error { return err }
+	return s
+}
+
+// emptyStream returns a stream whose channels are all closed.
+func emptyStream() *psrp.Stream {
+	return &psrp.Stream{
+		Output:      messageChan(nil),
+		Errors:      messageChan(nil),
+		Warnings:    messageChan(nil),
+		Verbose:     messageChan(nil),
+		Debug:       messageChan(nil),
+		Progress:    messageChan(nil),
+		Information: messageChan(nil),
+	}
+}
+
+// messageChan returns a closed, buffered channel holding one serialized
+// string message per line.
+func messageChan(lines []string) <-chan *messages.Message {
+	ch := make(chan *messages.Message, len(lines))
+	for _, line := range lines {
+		ch <- Message(line)
+	}
+	close(ch)
+	return ch
+}
+
+// Message returns a PSRP message carrying s serialized as CLIXML, as the
+// server would send a string written to a stream.
+func Message(s string) *messages.Message {
+	data, err := serialization.NewSerializer().Serialize(s)
+	if err != nil {
+		data = []byte(s)
+	}
+	return &messages.Message{Data: data}
+}
@@ -0,0 +1,653 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/smnsjas/go-psrpcore/messages"
+	"github.com/smnsjas/go-psrpcore/serialization"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// Credentials the fake server accepts over Basic auth.
+const (
+	ServerUsername = "packer"
+	ServerPassword = "packer"
+)
+
+// exitMarker mirrors the marker Start's wrapper script prints.
+const exitMarker = "__PACKER_EXIT_CODE__:"
+
+// fragmentHeaderSize and maxFragmentSize follow MS-PSRP 2.2.4; output is
+// split at the same 32KB boundary a real server uses.
+const (
+	fragmentHeaderSize = 21
+	maxFragmentSize    = 32768
+)
+
+// errTimedOut is the fault a receive with nothing to return ends with.
+var errTimedOut = errors.New("the WS-Management service cannot complete the operation within the time specified in OperationTimeout")
+
+// receiveWait bounds how long a Receive with nothing to return is held
+// open, standing in for the server's OperationTimeout.
+const receiveWait = 500 * time.Millisecond
+
+// Response is what a fake pipeline emits. Each string becomes one object on
+// the named stream.
+type Response struct {
+	Output      []string
+	Errors      []string
+	Warnings    []string
+	Verbose     []string
+	Information []string
+
+	// Failed ends the pipeline in the Failed state instead of Completed.
+	Failed bool
+}
+
+// Exit returns a Response that writes output followed by the exit marker
+// Start parses, so the command reports code.
+func Exit(code int, output ...string) Response {
+	return Response{Output: append(append([]string(nil), output...), exitMarker+strconv.Itoa(code))}
+}
+
+// Server is an httptest-backed WSMan endpoint that speaks enough of the
+// PSRP handshake and pipeline exchange to drive the real go-psrp client
+// end-to-end: shell creation with creationXml, Command/Send/Receive/Signal
+// and Delete. Scripts aren't executed; Handler decides what each pipeline
+// returns.
+//
+//	srv := testutil.NewServer()
+//	defer srv.Close()
+//	srv.Handler = func(string) testutil.Response { return testutil.Exit(0, "hello") }
+//	comm, _ := psrp.New(srv.Host(), srv.Config())
+type Server struct {
+	*httptest.Server
+
+	// Handler produces the response for each pipeline's script. If nil,
+	// the server applies upload chunks to its file map (see File), serves
+	// downloads from it, and otherwise returns no output.
+	Handler func(script string) Response
+
+	mu         sync.Mutex
+	failures   int
+	maxRequest int
+	shells     map[string]*fakeShell
+	created    int
+	scripts    []string
+	files      map[string][]byte
+}
+
+type fakeShell struct {
+	poolID  uuid.UUID
+	opened  bool
+	objects uint64
+	cmds    map[string]*fakeCommand
+}
+
+type fakeCommand struct {
+	pending [][]byte
+	done    bool
+}
+
+// NewServer starts a fake WSMan endpoint on a loopback port.
+func NewServer() *Server {
+	s := &Server{
+		shells: make(map[string]*fakeShell),
+		files:  make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Host returns the address the server listens on, without the port.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return host
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Config returns a prepared communicator config pointing at the server
+// with Basic auth over HTTP and short retry intervals.
+func (s *Server) Config() *psrp.Config {
+	c := psrp.NewConfig()
+	c.PSRPPort = s.Port()
+	c.PSRPAuthType = psrp.AuthBasic
+	c.PSRPAllowInsecureBasic = true // loopback only
+	c.PSRPUsername = ServerUsername
+	c.PSRPPassword = ServerPassword
+	c.PSRPTimeout = 30 * time.Second
+	c.PSRPRetryInterval = 10 * time.Millisecond
+	c.PSRPRetryMaxInterval = 50 * time.Millisecond
+	_ = c.Prepare(nil)
+	return c
+}
+
+// FailRequests makes the next n requests fail with 503 Service Unavailable,
+// as WinRM does while the service is still starting.
+func (s *Server) FailRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// ShellsCreated returns how many shells (runspace pools) were opened.
+func (s *Server) ShellsCreated() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.created
+}
+
+// Scripts returns the scripts received so far, in order.
+func (s *Server) Scripts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.scripts...)
+}
+
+// MaxRequestSize returns the size of the largest request body received.
+func (s *Server) MaxRequestSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxRequest
+}
+
+// File returns the contents the default handler assembled for path.
+func (s *Server) File(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[path]
+	return data, ok
+}
+
+// request holds the parts of a WSMan envelope the server acts on.
+type request struct {
+	Header struct {
+		Action    string `xml:"Action"`
+		Selectors []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"SelectorSet>Selector"`
+	} `xml:"Header"`
+	Body struct {
+		Shell struct {
+			CreationXML string `xml:"creationXml"`
+		} `xml:"Shell"`
+		CommandLine struct {
+			CommandID string `xml:"CommandId,attr"`
+			Arguments string `xml:"Arguments"`
+		} `xml:"CommandLine"`
+		Receive struct {
+			DesiredStream struct {
+				CommandID string `xml:"CommandId,attr"`
+			} `xml:"DesiredStream"`
+		} `xml:"Receive"`
+		Signal struct {
+			CommandID string `xml:"CommandId,attr"`
+		} `xml:"Signal"`
+	} `xml:"Body"`
+}
+
+func (r *request) shellID() string {
+	for _, sel := range r.Header.Selectors {
+		if sel.Name == "ShellId" {
+			return sel.Value
+		}
+	}
+	return ""
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != ServerUsername || pass != ServerPassword {
+		w.Header().Set("WWW-Authenticate", `Basic realm="WSMAN"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.maxRequest = max(s.maxRequest, len(body))
+	s.mu.Unlock()
+	var req request
+	if err := xml.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp string
+	action := req.Header.Action[strings.LastIndex(req.Header.Action, "/")+1:]
+	switch action {
+	case "Create":
+		resp, err = s.create(r, &req)
+	case "Command":
+		resp, err = s.command(&req)
+	case "Send":
+		resp = `<rsp:SendResponse/>`
+	case "Receive":
+		resp, err = s.receive(r, &req)
+	case "Signal":
+		resp, err = s.signal(&req)
+	case "Delete":
+		s.mu.Lock()
+		delete(s.shells, req.shellID())
+		s.mu.Unlock()
+	default:
+		err = fmt.Errorf("unsupported action %q", req.Header.Action)
+	}
+	if err != nil {
+		writeFault(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" `+
+		`xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" `+
+		`xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" `+
+		`xmlns:x="http://schemas.xmlsoap.org/ws/2004/09/transfer" `+
+		`xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell">`+
+		`<s:Header><a:Action>%sResponse</a:Action></s:Header><s:Body>%s</s:Body></s:Envelope>`,
+		req.Header.Action, resp)
+}
+
+func writeFault(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	subcode := "w:InternalError"
+	if errors.Is(err, errTimedOut) {
+		subcode = "w:TimedOut"
+	}
+	var msg bytes.Buffer
+	_ = xml.EscapeText(&msg, []byte(err.Error()))
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" `+
+		`xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"><s:Body><s:Fault>`+
+		`<s:Code><s:Value>s:Receiver</s:Value><s:Subcode><s:Value>%s</s:Value></s:Subcode></s:Code>`+
+		`<s:Reason><s:Text xml:lang="en-US">%s</s:Text></s:Reason>`+
+		`</s:Fault></s:Body></s:Envelope>`, subcode, msg.String())
+}
+
+// create opens a shell, queueing the replies to the SESSION_CAPABILITY
+// and INIT_RUNSPACEPOOL messages carried in creationXml.
+func (s *Server) create(r *http.Request, req *request) (string, error) {
+	msgs, err := decodeMessages(req.Body.Shell.CreationXML)
+	if err != nil {
+		return "", fmt.Errorf("creationXml: %w", err)
+	}
+	if len(msgs) == 0 {
+		return "", fmt.Errorf("creationXml: no PSRP messages")
+	}
+
+	shellID := strings.ToUpper(uuid.New().String())
+	sh := &fakeShell{poolID: msgs[0].RunspaceID, cmds: make(map[string]*fakeCommand)}
+
+	s.mu.Lock()
+	s.shells[shellID] = sh
+	s.created++
+	s.mu.Unlock()
+
+	return fmt.Sprintf(`<x:ResourceCreated><a:Address>http://%s/wsman</a:Address>`+
+		`<a:ReferenceParameters><w:ResourceURI>http://schemas.microsoft.com/powershell/Microsoft.PowerShell</w:ResourceURI>`+
+		`<w:SelectorSet><w:Selector Name="ShellId">%s</w:Selector></w:SelectorSet>`+
+		`</a:ReferenceParameters></x:ResourceCreated>`, r.Host, shellID), nil
+}
+
+// command starts a pipeline from the CREATE_PIPELINE message in the
+// arguments and queues everything the handler says it writes.
+func (s *Server) command(req *request) (string, error) {
+	msgs, err := decodeMessages(req.Body.CommandLine.Arguments)
+	if err != nil {
+		return "", fmt.Errorf("command arguments: %w", err)
+	}
+	if len(msgs) == 0 || msgs[0].Type != messages.MessageTypeCreatePipeline {
+		return "", fmt.Errorf("command arguments: expected CREATE_PIPELINE")
+	}
+	create := msgs[0]
+	script, err := pipelineScript(create.Data)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	sh, ok := s.shells[req.shellID()]
+	if !ok {
+		s.mu.Unlock()
+		return "", fmt.Errorf("the shell was not found")
+	}
+	s.scripts = append(s.scripts, script)
+	handler := s.Handler
+	s.mu.Unlock()
+
+	var resp Response
+	if handler != nil {
+		resp = handler(script)
+	} else {
+		resp = s.applyTransfer(script)
+	}
+
+	cmdID := req.Body.CommandLine.CommandID
+	if cmdID == "" {
+		cmdID = strings.ToUpper(create.PipelineID.String())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := &fakeCommand{}
+	emit := func(t messages.MessageType, data []byte) {
+		cmd.pending = append(cmd.pending, sh.fragment(&messages.Message{
+			Destination: messages.DestinationClient,
+			Type:        t,
+			RunspaceID:  sh.poolID,
+			PipelineID:  create.PipelineID,
+			Data:        data,
+		})...)
+	}
+	for _, stream := range []struct {
+		t     messages.MessageType
+		lines []string
+	}{
+		{messages.MessageTypePipelineOutput, resp.Output},
+		{messages.MessageTypeErrorRecord, resp.Errors},
+		{messages.MessageTypeWarningRecord, resp.Warnings},
+		{messages.MessageTypeVerboseRecord, resp.Verbose},
+		{messages.MessageTypeInformationRecord, resp.Information},
+	} {
+		for _, line := range stream.lines {
+			emit(stream.t, serializeString(line))
+		}
+	}
+	state := messages.PipelineStateCompleted
+	if resp.Failed {
+		state = messages.PipelineStateFailed
+	}
+	emit(messages.MessageTypePipelineState,
+		[]byte(fmt.Sprintf(`<Obj RefId="0"><MS><I32 N="PipelineState">%d</I32></MS></Obj>`, state)))
+	sh.cmds[cmdID] = cmd
+
+	return fmt.Sprintf(`<rsp:CommandResponse><rsp:CommandId>%s</rsp:CommandId></rsp:CommandResponse>`, cmdID), nil
+}
+
+// receive returns queued fragments for the shell or one of its commands.
+// Shell-level receives first deliver the runspace pool open replies, then
+// idle like a real server until the operation times out.
+func (s *Server) receive(r *http.Request, req *request) (string, error) {
+	cmdID := req.Body.Receive.DesiredStream.CommandID
+
+	s.mu.Lock()
+	sh, ok := s.shells[req.shellID()]
+	if !ok {
+		s.mu.Unlock()
+		return "", fmt.Errorf("the shell was not found")
+	}
+
+	var b strings.Builder
+	b.WriteString(`<rsp:ReceiveResponse>`)
+	streams := func(frags [][]byte) {
+		for _, f := range frags {
+			fmt.Fprintf(&b, `<rsp:Stream Name="stdout"`)
+			if cmdID != "" {
+				fmt.Fprintf(&b, ` CommandId="%s"`, cmdID)
+			}
+			fmt.Fprintf(&b, `>%s</rsp:Stream>`, base64.StdEncoding.EncodeToString(f))
+		}
+	}
+
+	if cmdID == "" {
+		if sh.opened {
+			s.mu.Unlock()
+			idle(r)
+			return "", errTimedOut
+		}
+		sh.opened = true
+		streams(sh.openReplies())
+		s.mu.Unlock()
+		b.WriteString(`</rsp:ReceiveResponse>`)
+		return b.String(), nil
+	}
+
+	cmd, ok := sh.cmds[cmdID]
+	if !ok || cmd.done {
+		s.mu.Unlock()
+		idle(r)
+		return "", errTimedOut
+	}
+	streams(cmd.pending)
+	cmd.pending = nil
+	cmd.done = true
+	s.mu.Unlock()
+
+	fmt.Fprintf(&b, `<rsp:CommandState CommandId="%s" `+
+		`State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done">`+
+		`<rsp:ExitCode>0</rsp:ExitCode></rsp:CommandState></rsp:ReceiveResponse>`, cmdID)
+	return b.String(), nil
+}
+
+func (s *Server) signal(req *request) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sh, ok := s.shells[req.shellID()]; ok {
+		delete(sh.cmds, req.Body.Signal.CommandID)
+	}
+	return `<rsp:SignalResponse/>`, nil
+}
+
+// idle holds a receive that has nothing to return.
+func idle(r *http.Request) {
+	select {
+	case <-time.After(receiveWait):
+	case <-r.Context().Done():
+	}
+}
+
+// openReplies returns the fragments a server sends when a pool opens.
+func (sh *fakeShell) openReplies() [][]byte {
+	var out [][]byte
+	for _, m := range []*messages.Message{
+		{
+			Type: messages.MessageTypeSessionCapability,
+			Data: []byte(`<Obj RefId="0"><MS><Version N="protocolversion">2.3</Version>` +
+				`<Version N="PSVersion">2.0</Version><Version N="SerializationVersion">1.1.0.1</Version></MS></Obj>`),
+		},
+		{
+			Type: messages.MessageTypeApplicationPrivate,
+			Data: []byte(`<Obj RefId="0"><MS><Obj N="ApplicationPrivateData" RefId="1"><DCT/></Obj></MS></Obj>`),
+		},
+		{
+			Type: messages.MessageTypeRunspacePoolState,
+			Data: []byte(fmt.Sprintf(`<Obj RefId="0"><MS><I32 N="RunspaceState">%d</I32></MS></Obj>`,
+				messages.RunspacePoolStateOpened)),
+		},
+	} {
+		m.Destination = messages.DestinationClient
+		m.RunspaceID = sh.poolID
+		out = append(out, sh.fragment(m)...)
+	}
+	return out
+}
+
+// fragment encodes m and splits it into PSRP fragments.
+func (sh *fakeShell) fragment(m *messages.Message) [][]byte {
+	data, err := m.Encode()
+	if err != nil {
+		return nil
+	}
+	sh.objects++
+	var out [][]byte
+	for id, off := uint64(0), 0; off < len(data) || id == 0; id++ {
+		end := off + maxFragmentSize - fragmentHeaderSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frag := make([]byte, fragmentHeaderSize+end-off)
+		binary.BigEndian.PutUint64(frag[0:8], sh.objects)
+		binary.BigEndian.PutUint64(frag[8:16], id)
+		if off == 0 {
+			frag[16] |= 1
+		}
+		if end == len(data) {
+			frag[16] |= 2
+		}
+		binary.BigEndian.PutUint32(frag[17:21], uint32(end-off))
+		copy(frag[fragmentHeaderSize:], data[off:end])
+		out = append(out, frag)
+		off = end
+	}
+	return out
+}
+
+// decodeMessages reassembles the PSRP messages in base64-encoded fragments.
+func decodeMessages(encoded string) ([]*messages.Message, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	var out []*messages.Message
+	var buf []byte
+	for len(raw) > 0 {
+		if len(raw) < fragmentHeaderSize {
+			return nil, fmt.Errorf("truncated fragment header")
+		}
+		flags := raw[16]
+		n := int(binary.BigEndian.Uint32(raw[17:21]))
+		if len(raw) < fragmentHeaderSize+n {
+			return nil, fmt.Errorf("truncated fragment")
+		}
+		if flags&1 != 0 {
+			buf = buf[:0]
+		}
+		buf = append(buf, raw[fragmentHeaderSize:fragmentHeaderSize+n]...)
+		raw = raw[fragmentHeaderSize+n:]
+		if flags&2 != 0 {
+			m, err := messages.Decode(buf)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// pipelineScript extracts the first command's text from CREATE_PIPELINE data.
+func pipelineScript(data []byte) (string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", fmt.Errorf("CREATE_PIPELINE has no command: %w", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "S" {
+			for _, attr := range el.Attr {
+				if attr.Name.Local == "N" && attr.Value == "Cmd" {
+					var script string
+					if err := dec.DecodeElement(&script, &el); err != nil {
+						return "", err
+					}
+					return script, nil
+				}
+			}
+		}
+	}
+}
+
+// serializeString returns s as the CLIXML a server writes for a string.
+func serializeString(s string) []byte {
+	data, err := serialization.NewSerializer().Serialize(s)
+	if err != nil {
+		return []byte(s)
+	}
+	return data
+}
+
+var (
+	uploadData   = regexp.MustCompile(`FromBase64String\('([^']*)'\)`)
+	uploadCreate = regexp.MustCompile(`WriteAllBytes\('((?:[^']|'')*)'`)
+	uploadAppend = regexp.MustCompile(`File\]::Open\('((?:[^']|'')*)', \[System\.IO\.FileMode\]::Append`)
+	downloadRead = regexp.MustCompile(`ReadAllBytes\('((?:[^']|'')*)'\)`)
+	uploadBatch  = regexp.MustCompile(`@\{ Path = '((?:[^']|'')*)'; Data = '([^']*)' \}`)
+)
+
+// applyTransfer handles the communicator's upload and download scripts
+// for the default handler.
+func (s *Server) applyTransfer(script string) Response {
+	m := downloadRead.FindStringSubmatch(script)
+	if m == nil {
+		s.applyUpload(script)
+		return Response{}
+	}
+	path := unquote(m[1])
+	data, ok := s.File(path)
+	if !ok {
+		return Response{Errors: []string{"File not found: " + path}}
+	}
+	return Response{Output: []string{base64.StdEncoding.EncodeToString(data)}}
+}
+
+// applyUpload mimics the communicator's upload chunk and batch scripts
+// against an in-memory file map.
+func (s *Server) applyUpload(script string) {
+	if batch := uploadBatch.FindAllStringSubmatch(script, -1); batch != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, m := range batch {
+			if data, err := base64.StdEncoding.DecodeString(m[2]); err == nil {
+				s.files[unquote(m[1])] = data
+			}
+		}
+		return
+	}
+
+	m := uploadData.FindStringSubmatch(script)
+	if m == nil {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := uploadCreate.FindStringSubmatch(script); p != nil {
+		s.files[unquote(p[1])] = data
+	} else if p := uploadAppend.FindStringSubmatch(script); p != nil {
+		path := unquote(p[1])
+		s.files[path] = append(s.files[path], data...)
+	}
+}
+
+func unquote(s string) string {
+	return strings.ReplaceAll(s, "''", "'")
+}
@@ -0,0 +1,88 @@
+package psrp
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies this package's spans.
+const tracerName = "github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+
+var (
+	tracingOnce     sync.Once
+	tracingTracer   trace.Tracer
+	tracingProvider *sdktrace.TracerProvider // set when this package exports spans itself
+)
+
+// tracer returns the tracer for the package's spans. When
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set,
+// spans are exported with OTLP over HTTP (the exporter reads the remaining
+// OTEL_EXPORTER_OTLP_* settings itself). Otherwise they go to the global
+// tracer provider, a no-op unless the host program installed one.
+func tracer() trace.Tracer {
+	tracingOnce.Do(func() {
+		tracingTracer = otel.Tracer(tracerName)
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			return
+		}
+
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			logger.Warn("OpenTelemetry exporter setup failed, tracing disabled", "error", err)
+			return
+		}
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+		res, err := resource.Merge(
+			resource.NewSchemaless(attribute.String("service.name", "packer-plugin-psrp")),
+			resource.Environment())
+		if err != nil {
+			logger.Debug("OpenTelemetry resource", "error", err)
+		}
+		tracingProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+		tracingTracer = tracingProvider.Tracer(tracerName)
+	})
+	return tracingTracer
+}
+
+// FlushTracing exports spans still buffered for export. Close calls it, so
+// a build's spans are out once its session closes.
+func FlushTracing(ctx context.Context) error {
+	tracer()
+	if tracingProvider == nil {
+		return nil
+	}
+	return tracingProvider.ForceFlush(ctx)
+}
+
+// ShutdownTracing flushes and stops span export. Programs that exit without
+// closing their sessions should call it first.
+func ShutdownTracing(ctx context.Context) error {
+	tracer()
+	if tracingProvider == nil {
+		return nil
+	}
+	return tracingProvider.Shutdown(ctx)
+}
+
+// startSpan starts a span named name as a child of any span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,208 @@
+package psrp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unsafeFileChars matches characters replaced when a target becomes part of
+// a file name (IPv6 colons, path separators).
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// transcript records a session for psrp_transcript_dir: a local mirror of
+// every command and its output, and the guest's own Start-Transcript log,
+// which is downloaded next to it when the session closes. A nil *transcript
+// records nothing.
+type transcript struct {
+	mu         sync.Mutex
+	local      *os.File
+	remotePath string // set once Start-Transcript has run on the guest
+	remoteFile string // where the guest transcript is saved locally
+	files      []string
+}
+
+// newTranscript opens the local mirror for a connection, or returns nil if
+// psrp_transcript_dir is unset or the mirror can't be created.
+func newTranscript(config *Config, connID, target string) *transcript {
+	if config == nil || config.PSRPTranscriptDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.PSRPTranscriptDir, 0o755); err != nil {
+		logger.Warn("session transcript disabled", "error", err)
+		return nil
+	}
+
+	base := filepath.Join(config.PSRPTranscriptDir, fmt.Sprintf("psrp-%s-%s",
+		unsafeFileChars.ReplaceAllString(target, "_"), connID))
+	local, err := os.OpenFile(base+".local.txt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		logger.Warn("session transcript disabled", "error", err)
+		return nil
+	}
+	t := &transcript{local: local, remoteFile: base + ".remote.txt", files: []string{local.Name()}}
+	t.printf("PSRP session transcript\nTarget: %s\nStarted: %s\n\n", target, time.Now().Format(time.RFC3339))
+	return t
+}
+
+func (t *transcript) printf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.local != nil {
+		io.WriteString(t.local, Redact(fmt.Sprintf(format, args...))) //nolint:errcheck // best effort
+	}
+}
+
+// command records a command about to run.
+func (t *transcript) command(command string) {
+	if t == nil {
+		return
+	}
+	t.printf("[%s] PS> %s\n", time.Now().Format(time.RFC3339), strings.ReplaceAll(command, "\n", "\n>> "))
+}
+
+// exited records how the last command finished.
+func (t *transcript) exited(exitCode int, err error) {
+	if t == nil {
+		return
+	}
+	if err != nil {
+		t.printf("[%s] exit code %d: %s\n\n", time.Now().Format(time.RFC3339), exitCode, err)
+		return
+	}
+	t.printf("[%s] exit code %d\n\n", time.Now().Format(time.RFC3339), exitCode)
+}
+
+// tee returns w extended to also write to the local mirror.
+func (t *transcript) tee(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	if w == nil {
+		return transcriptWriter{t}
+	}
+	return io.MultiWriter(w, transcriptWriter{t})
+}
+
+type transcriptWriter struct{ t *transcript }
+
+func (w transcriptWriter) Write(p []byte) (int, error) {
+	w.t.printf("%s", p)
+	return len(p), nil
+}
+
+// Files returns the transcript files written so far.
+func (t *transcript) Files() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.files...)
+}
+
+// startTranscriptLocked starts (or, after a reconnect, resumes) the guest
+// transcript in the newly connected runspace. Failures are logged: a missing
+// transcript shouldn't fail the build. The caller must hold c.mu.
+func (c *Communicator) startTranscriptLocked(ctx context.Context) {
+	t := c.transcript
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	path := t.remotePath
+	t.mu.Unlock()
+
+	target := "(Join-Path ([System.IO.Path]::GetTempPath()) 'packer-psrp-transcript-" + newConnID() + ".txt')"
+	if path != "" {
+		target = "'" + strings.ReplaceAll(path, "'", "''") + "'"
+	}
+	result, err := c.client.Execute(ctx, fmt.Sprintf(
+		"$p = %s; Start-Transcript -LiteralPath $p -Append -IncludeInvocationHeader | Out-Null; $p", target))
+	if err == nil && (result.HadErrors || len(result.Output) == 0) {
+		err = fmt.Errorf("Start-Transcript failed: %s", formatResultErrors(result))
+	}
+	if err != nil {
+		c.logger().Warn("guest transcript not started", "op", "transcript", "error", err)
+		return
+	}
+
+	path = strings.TrimSpace(fmt.Sprintf("%v", result.Output[0]))
+	t.mu.Lock()
+	t.remotePath = path
+	t.mu.Unlock()
+	t.printf("[%s] guest transcript: %s\n\n", time.Now().Format(time.RFC3339), path)
+}
+
+// finishTranscriptLocked stops the guest transcript, saves it locally,
+// removes it from the guest and closes the local mirror. The caller must
+// hold c.mu.
+func (c *Communicator) finishTranscriptLocked(ctx context.Context) {
+	t := c.transcript
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	path := t.remotePath
+	t.mu.Unlock()
+
+	if path != "" && c.connected {
+		if err := c.saveGuestTranscriptLocked(ctx, path); err != nil {
+			c.logger().Warn("guest transcript not saved", "op", "transcript", "path", path, "error", err)
+		}
+	}
+
+	t.printf("[%s] session closed\n", time.Now().Format(time.RFC3339))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.local != nil {
+		t.local.Close()
+		t.local = nil
+	}
+}
+
+func (c *Communicator) saveGuestTranscriptLocked(ctx context.Context, path string) error {
+	escaped := strings.ReplaceAll(path, "'", "''")
+	result, err := c.client.Execute(ctx, fmt.Sprintf(`
+		Stop-Transcript -ErrorAction SilentlyContinue | Out-Null
+		[System.Convert]::ToBase64String([System.IO.File]::ReadAllBytes('%s'))
+		Remove-Item -LiteralPath '%s' -Force -ErrorAction SilentlyContinue
+	`, escaped, escaped))
+	if err != nil {
+		return err
+	}
+	if result.HadErrors {
+		return fmt.Errorf("%s", formatResultErrors(result))
+	}
+
+	var parts []string
+	for _, obj := range result.Output {
+		parts = append(parts, fmt.Sprintf("%v", obj))
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.Join(parts, "")))
+	if err != nil {
+		return fmt.Errorf("failed to decode transcript: %w", err)
+	}
+	if err := os.WriteFile(c.transcript.remoteFile, []byte(Redact(string(data))), 0o600); err != nil {
+		return err
+	}
+
+	c.transcript.mu.Lock()
+	c.transcript.files = append(c.transcript.files, c.transcript.remoteFile)
+	c.transcript.mu.Unlock()
+	return nil
+}
+
+// TranscriptFiles returns the local paths of the session transcript: the
+// command mirror and, once the session has closed, the guest transcript.
+// It is empty unless psrp_transcript_dir is set.
+func (c *Communicator) TranscriptFiles() []string {
+	return c.transcript.Files()
+}
@@ -0,0 +1,162 @@
+package psrp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// benchRemoteDir is where the benchmarks write on a real endpoint. It is
+// removed afterwards.
+const benchRemoteDir = `C:\Windows\Temp\packer-psrp-bench`
+
+// benchSizes are the file sizes transferred, and benchChunkSizes the
+// upload chunk sizes compared (0 derives it from the envelope size).
+var (
+	benchSizes      = []int{64 << 10, 1 << 20, 8 << 20}
+	benchChunkSizes = []int{0, 64 << 10}
+)
+
+// benchDirSizes are the file sizes BenchmarkUploadDir sends
+// benchDirFiles of; small files are batched into shared requests.
+var benchDirSizes = []int{4 << 10, 64 << 10, 1 << 20}
+
+const benchDirFiles = 16
+
+// benchComm returns a connected communicator with the given upload chunk
+// size. It targets the endpoint named by the PSRP_TEST_* variables if
+// set, and otherwise an in-process fake server, which leaves out the
+// network and the remote disk so changes to the transfer engine itself
+// show up clearly.
+func benchComm(b *testing.B, chunkSize int) *psrp.Communicator {
+	b.Helper()
+	config, err := testutil.EndpointConfig(nil)
+	if err != nil {
+		b.Fatalf("endpoint config: %v", err)
+	}
+	host := ""
+	if config != nil {
+		host = config.PSRPHost
+	} else {
+		srv := testutil.NewServer()
+		b.Cleanup(srv.Close)
+		config, host = srv.Config(), srv.Host()
+	}
+	config.PSRPUploadChunkSize = chunkSize
+	config.PSRPFlightRecorderDir = b.TempDir()
+
+	comm, err := psrp.New(host, config)
+	if err != nil {
+		b.Fatalf("New: %v", err)
+	}
+	if err := comm.Connect(context.Background()); err != nil {
+		comm.Close()
+		b.Fatalf("Connect: %v", err)
+	}
+	b.Cleanup(func() {
+		if os.Getenv(testutil.EnvHost) != "" {
+			cmd := &packersdk.RemoteCmd{
+				Command: fmt.Sprintf("Remove-Item -LiteralPath '%s' -Recurse -Force -ErrorAction SilentlyContinue", benchRemoteDir),
+			}
+			if err := comm.Start(context.Background(), cmd); err == nil {
+				cmd.Wait()
+			}
+		}
+		comm.Close()
+	})
+	return comm
+}
+
+// benchData returns size random bytes.
+func benchData(b *testing.B, size int) []byte {
+	b.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// benchName labels a sub-benchmark by file and chunk size.
+func benchName(size, chunkSize int) string {
+	chunk := "auto"
+	if chunkSize > 0 {
+		chunk = fmt.Sprintf("%dKiB", chunkSize>>10)
+	}
+	if size >= 1<<20 {
+		return fmt.Sprintf("size=%dMiB/chunk=%s", size>>20, chunk)
+	}
+	return fmt.Sprintf("size=%dKiB/chunk=%s", size>>10, chunk)
+}
+
+func BenchmarkUpload(b *testing.B) {
+	for _, chunkSize := range benchChunkSizes {
+		comm := benchComm(b, chunkSize)
+		for _, size := range benchSizes {
+			b.Run(benchName(size, chunkSize), func(b *testing.B) {
+				data := benchData(b, size)
+				b.SetBytes(int64(size))
+				for b.Loop() {
+					if err := comm.Upload(benchRemoteDir+`\file.bin`, bytes.NewReader(data), nil); err != nil {
+						b.Fatalf("Upload: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	comm := benchComm(b, 0)
+	for _, size := range benchSizes {
+		b.Run(benchName(size, 0), func(b *testing.B) {
+			path := benchRemoteDir + `\file.bin`
+			if err := comm.Upload(path, bytes.NewReader(benchData(b, size)), nil); err != nil {
+				b.Fatalf("Upload: %v", err)
+			}
+			b.SetBytes(int64(size))
+			var out bytes.Buffer
+			for b.Loop() {
+				out.Reset()
+				if err := comm.Download(path, &out); err != nil {
+					b.Fatalf("Download: %v", err)
+				}
+				if out.Len() != size {
+					b.Fatalf("downloaded %d bytes, want %d", out.Len(), size)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUploadDir(b *testing.B) {
+	for _, chunkSize := range benchChunkSizes {
+		comm := benchComm(b, chunkSize)
+		for _, size := range benchDirSizes {
+			b.Run(benchName(size, chunkSize), func(b *testing.B) {
+				dir := b.TempDir()
+				data := benchData(b, size)
+				for i := 0; i < benchDirFiles; i++ {
+					if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%03d.bin", i)), data, 0o644); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.SetBytes(int64(size * benchDirFiles))
+				for b.Loop() {
+					if err := comm.UploadDir(benchRemoteDir+`\dir`, dir, nil); err != nil {
+						b.Fatalf("UploadDir: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package psrp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialTimeout bounds establishing the SSH connection to the tunnel host.
+const sshDialTimeout = 30 * time.Second
+
+// sshTunnel forwards a local port to the WSMan endpoint through an SSH
+// connection (psrp_ssh_tunnel_*). go-psrp connects to the local end as if it
+// were the guest. The SSH connection is made on the first forwarded
+// connection and made again if it drops, so the tunnel outlives guest
+// reboots and session reconnects.
+type sshTunnel struct {
+	config   *ssh.ClientConfig
+	addr     string // SSH host:port
+	remote   string // WSMan host:port, as seen from the SSH host
+	listener net.Listener
+	agent    io.Closer // SSH agent connection; nil without agent auth
+	log      hclog.Logger
+
+	mu     sync.Mutex // guards client
+	client *ssh.Client
+	wg     sync.WaitGroup
+}
+
+// openSSHTunnel starts listening on a loopback port that forwards to remote.
+func openSSHTunnel(c *Config, remote string) (*sshTunnel, error) {
+	sshConfig, agentConn, err := c.sshClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, fmt.Errorf("failed to open SSH tunnel listener: %w", err)
+	}
+
+	t := &sshTunnel{
+		config:   sshConfig,
+		addr:     net.JoinHostPort(c.PSRPSSHTunnelHost, strconv.Itoa(c.PSRPSSHTunnelPort)),
+		remote:   remote,
+		listener: listener,
+		agent:    agentConn,
+	}
+	t.log = logger.With("tunnel", t.addr, "remote", remote, "local", listener.Addr().String())
+	t.log.Debug("SSH tunnel listening")
+
+	t.wg.Add(1)
+	go t.serve()
+	return t, nil
+}
+
+// port returns the local port go-psrp should connect to.
+func (t *sshTunnel) port() int {
+	return t.listener.Addr().(*net.TCPAddr).Port
+}
+
+// clientFactory wraps factory so clients connect through the tunnel.
+func (t *sshTunnel) clientFactory(factory ClientFactory) ClientFactory {
+	return func(_ string, config *Config) (PSRPClient, error) {
+		local := *config
+		local.PSRPPort = t.port()
+		return factory("127.0.0.1", &local)
+	}
+}
+
+// endpointURL returns the tunnel's local URL for the WSMan endpoint, for
+// requests made outside a client, such as liveness probes.
+func (t *sshTunnel) endpointURL(config *Config) string {
+	local := *config
+	local.PSRPPort = t.port()
+	return local.EndpointURL("127.0.0.1")
+}
+
+func (t *sshTunnel) serve() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.forward(conn)
+		}()
+	}
+}
+
+// forward copies between a local connection and a channel to the remote
+// endpoint until either side closes.
+func (t *sshTunnel) forward(local net.Conn) {
+	defer local.Close()
+
+	remote, err := t.dial()
+	if err != nil {
+		t.log.Warn("forwarding through SSH tunnel failed", "error", err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// dial opens a channel to the remote endpoint, connecting to the SSH host
+// first if needed. A dead SSH connection is replaced once.
+func (t *sshTunnel) dial() (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := t.sshClient()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial("tcp", t.remote)
+		if err == nil {
+			return conn, nil
+		}
+
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) || attempt > 0 {
+			// The SSH host is fine; the endpoint isn't reachable from it
+			return nil, fmt.Errorf("SSH tunnel to %s: %w", t.remote, err)
+		}
+		t.log.Debug("SSH connection lost; reconnecting", "error", err)
+		t.dropClient(client)
+	}
+}
+
+func (t *sshTunnel) sshClient() (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+	client, err := ssh.Dial("tcp", t.addr, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH tunnel host %s: %w", t.addr, err)
+	}
+	t.log.Debug("SSH tunnel connected")
+	t.client = client
+	return client, nil
+}
+
+func (t *sshTunnel) dropClient(client *ssh.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client == client {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+// Close stops forwarding and closes the SSH connection.
+func (t *sshTunnel) Close() error {
+	err := t.listener.Close()
+	t.mu.Lock()
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	if t.agent != nil {
+		t.agent.Close()
+	}
+	return err
+}
+
+// sshAuth holds what an SSH connection authenticates and verifies the host
+// with. option is the prefix of the options the key, agent and known_hosts
+// settings came from, for errors.
+type sshAuth struct {
+	option         string
+	username       string
+	password       string
+	privateKeyFile string
+	knownHosts     string
+	agent          bool
+}
+
+// sshClientConfig builds the SSH client configuration from the
+// psrp_ssh_tunnel_* options. With agent auth it also returns the connection
+// to the agent, which must stay open while the tunnel is in use.
+func (c *Config) sshClientConfig() (*ssh.ClientConfig, io.Closer, error) {
+	return sshAuth{
+		option:         "psrp_ssh_tunnel",
+		username:       c.PSRPSSHTunnelUsername,
+		password:       c.PSRPSSHTunnelPassword,
+		privateKeyFile: c.PSRPSSHTunnelKeyFile,
+		knownHosts:     c.PSRPSSHTunnelKnownHosts,
+		agent:          c.PSRPSSHTunnelAgentAuth,
+	}.clientConfig()
+}
+
+// clientConfig builds the SSH client configuration. With agent auth it
+// also returns the connection to the agent, which must stay open while the
+// SSH connection is in use.
+func (a sshAuth) clientConfig() (*ssh.ClientConfig, io.Closer, error) {
+	var methods []ssh.AuthMethod
+	var agentConn net.Conn
+	if a.agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, nil, fmt.Errorf("%s_agent_auth is set but SSH_AUTH_SOCK is not", a.option)
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to SSH agent: %w", err)
+		}
+		agentConn = conn
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	fail := func(err error) (*ssh.ClientConfig, io.Closer, error) {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, nil, err
+	}
+
+	if a.privateKeyFile != "" {
+		key, err := os.ReadFile(a.privateKeyFile)
+		if err != nil {
+			return fail(fmt.Errorf("failed to read %s_private_key_file: %w", a.option, err))
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return fail(fmt.Errorf("failed to parse %s_private_key_file: %w", a.option, err))
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if a.password != "" {
+		methods = append(methods, ssh.Password(a.password))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if a.knownHosts != "" {
+		callback, err := knownhosts.New(a.knownHosts)
+		if err != nil {
+			return fail(fmt.Errorf("failed to read %s_known_hosts: %w", a.option, err))
+		}
+		hostKeyCallback = callback
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            a.username,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}
+	if agentConn == nil {
+		return sshConfig, nil, nil
+	}
+	return sshConfig, agentConn, nil
+}
+
+// validateSSHTunnel checks the psrp_ssh_tunnel_* options and what can't be
+// combined with them.
+func (c *Config) validateSSHTunnel() (warnings []string, errs []error) {
+	if c.PSRPTransport != TransportWSMan {
+		errs = append(errs, errors.New("psrp_ssh_tunnel_host requires psrp_transport 'wsman'"))
+	}
+	if c.PSRPSSHTunnelPort < 1 || c.PSRPSSHTunnelPort > 65535 {
+		errs = append(errs, errors.New("psrp_ssh_tunnel_port must be between 1 and 65535"))
+	}
+	if c.PSRPSSHTunnelUsername == "" {
+		errs = append(errs, errors.New("psrp_ssh_tunnel_username is required with psrp_ssh_tunnel_host"))
+	}
+	if c.PSRPSSHTunnelPassword == "" && c.PSRPSSHTunnelKeyFile == "" && !c.PSRPSSHTunnelAgentAuth {
+		errs = append(errs, errors.New("one of psrp_ssh_tunnel_password, psrp_ssh_tunnel_private_key_file or psrp_ssh_tunnel_agent_auth is required with psrp_ssh_tunnel_host"))
+	}
+	if c.PSRPSSHTunnelKnownHosts == "" {
+		warnings = append(warnings, "psrp_ssh_tunnel_known_hosts is not set; the SSH tunnel host key will not be verified")
+	}
+
+	// go-psrp sees the tunnel's loopback address, not the guest's name
+	if c.PSRPAuthType == AuthKerberos {
+		errs = append(errs, errors.New("kerberos authentication cannot be used through psrp_ssh_tunnel_host, as the service name would be the tunnel's loopback address; use ntlm or basic"))
+	}
+	if c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse || c.PSRPTLSServerName != "" {
+		errs = append(errs, errors.New("psrp_tls_fingerprint, psrp_tls_tofu and psrp_tls_server_name cannot be used with psrp_ssh_tunnel_host"))
+	}
+	if c.PSRPUseTLS && !c.PSRPInsecureSkipVerify {
+		warnings = append(warnings, "the listener certificate is verified against the tunnel's loopback address; set psrp_insecure, as the SSH tunnel already protects the connection")
+	}
+	if c.PSRPWinRMFallback {
+		errs = append(errs, errors.New("psrp_winrm_fallback cannot be used with psrp_ssh_tunnel_host"))
+	}
+	if c.PSRPHTTPProbe || c.PSRPCheckClockSkew {
+		warnings = append(warnings, "psrp_http_probe and psrp_check_clock_skew have no effect with psrp_ssh_tunnel_host")
+	}
+	return warnings, errs
+}
@@ -0,0 +1,85 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNewSessionClosesTunnel checks that a NewSession that fails to connect
+// closes the SSH tunnel New opened for it.
+func TestNewSessionClosesTunnel(t *testing.T) {
+	// An SSH host that hangs up at once, so every forward fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	c := NewConfig()
+	c.PSRPUsername = "user"
+	c.PSRPPassword = "pass"
+	c.PSRPSSHTunnelHost = "127.0.0.1"
+	c.PSRPSSHTunnelPort = l.Addr().(*net.TCPAddr).Port
+	c.PSRPSSHTunnelUsername = "jump"
+	c.PSRPSSHTunnelPassword = "secret"
+
+	comm, err := New("win.example.com", c)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer comm.Close()
+	// Let comm's tunnel start serving before counting
+	for deadline := time.Now().Add(5 * time.Second); tunnels() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := tunnels()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := comm.NewSession(ctx); err == nil {
+		t.Fatal("NewSession connected through a tunnel to nowhere")
+	}
+	if after := tunnels(); after != before {
+		t.Errorf("%d SSH tunnels serving after a failed NewSession, want %d", after, before)
+	}
+}
+
+// tunnels counts the goroutines serving an SSH tunnel's listener.
+func tunnels() int {
+	buf := make([]byte, 1<<20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]), "(*sshTunnel).serve")
+}
+
+// TestTunnelEndpointURL checks that requests made outside a client, such
+// as liveness probes, go to the tunnel's local end rather than the guest.
+func TestTunnelEndpointURL(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tunnel := &sshTunnel{listener: l}
+
+	c := NewConfig()
+	c.PSRPHost = "win.example.com"
+	c.PSRPUseTLS = true
+	c.PSRPPort = 5986
+	want := fmt.Sprintf("https://127.0.0.1:%d/wsman", l.Addr().(*net.TCPAddr).Port)
+	if got := tunnel.endpointURL(c); got != want {
+		t.Errorf("endpointURL = %q, want %q", got, want)
+	}
+}
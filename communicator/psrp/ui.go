@@ -0,0 +1,44 @@
+package psrp
+
+import (
+	"strings"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// SetUi sets where the communicator reports on long-running commands
+// (psrp_heartbeat_interval) and shows the warnings commands write. Without
+// one, heartbeats go to the log and warnings to the command's stderr. Call
+// it before starting commands; StepConnect sets the build's Ui.
+func (c *Communicator) SetUi(ui packersdk.Ui) {
+	c.ui = RedactUi(ui)
+}
+
+// warner is implemented by UIs that show warnings in their own style.
+// packersdk.Ui has no Warn method, so others get a "WARNING: " message,
+// the way PowerShell's own host prints them.
+type warner interface {
+	Warn(message string)
+}
+
+// uiWarn shows message on ui as a warning.
+func uiWarn(ui packersdk.Ui, message string) {
+	if w, ok := ui.(warner); ok {
+		w.Warn(message)
+		return
+	}
+	ui.Message("WARNING: " + message)
+}
+
+// warningWriter shows each warning record written to it on a Ui, so
+// warnings stand apart from the errors on the command's stderr.
+type warningWriter struct {
+	ui packersdk.Ui
+}
+
+func (w warningWriter) Write(p []byte) (int, error) {
+	if text := strings.TrimRight(string(p), "\r\n"); text != "" {
+		uiWarn(w.ui, text)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,230 @@
+package psrp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/smnsjas/go-psrp/wsman/auth"
+)
+
+// insecureBasic reports whether the password goes over plain HTTP with
+// basic auth.
+func (c *Config) insecureBasic() bool {
+	return c.effectiveAuthType() == AuthBasic && !c.PSRPUseTLS && c.PSRPTransport == TransportWSMan
+}
+
+// validateCombinations reports options that are individually valid but
+// conflict with, or are ignored because of, other options. It runs after
+// defaults are applied. Combinations that are merely unusual produce
+// warnings; combinations that cannot work produce errors.
+func (c *Config) validateCombinations() (warnings []string, errs []error) {
+	switch c.PSRPTransport {
+	case TransportWSMan:
+		if c.PSRPVMID != "" || c.PSRPVMName != "" || c.PSRPContainerID != "" {
+			errs = append(errs, errors.New("psrp_vmid, psrp_vm_name and psrp_container_id are only valid with psrp_transport 'hvsock'"))
+		}
+		if c.PSRPConfigurationName != "" {
+			errs = append(errs, errors.New("psrp_configuration_name is only supported with psrp_transport 'hvsock'"))
+		}
+		if c.PSRPPipeName != "" || c.PSRPPipeProcessID != 0 {
+			errs = append(errs, errors.New("psrp_pipe_name and psrp_pipe_process_id are only valid with psrp_transport 'namedpipe'"))
+		}
+	case TransportHvSocket:
+		if c.PSRPVMID != "" && c.PSRPVMName != "" {
+			warnings = append(warnings, "psrp_vm_name is ignored because psrp_vmid is set")
+		}
+		if c.PSRPContainerID != "" {
+			w, e := c.validateContainer()
+			warnings = append(warnings, w...)
+			errs = append(errs, e...)
+		}
+		if c.PSRPHost != "" {
+			warnings = append(warnings, "psrp_host is ignored with psrp_transport 'hvsock'; the VM is addressed by psrp_vmid")
+		}
+		if c.PSRPPort != 5985 && c.PSRPPort != 5986 {
+			errs = append(errs, fmt.Errorf("psrp_port (%d) cannot be used with psrp_transport 'hvsock'", c.PSRPPort))
+		}
+		if c.PSRPUseTLS || c.PSRPInsecureSkipVerify {
+			errs = append(errs, errors.New("psrp_use_tls and psrp_insecure cannot be used with psrp_transport 'hvsock'"))
+		}
+		if c.PSRPWSManPath != DefaultWSManPath {
+			errs = append(errs, errors.New("psrp_wsman_path cannot be used with psrp_transport 'hvsock'"))
+		}
+		if c.PSRPResumeOnDisconnect {
+			errs = append(errs, errors.New("psrp_resume_on_disconnect is only supported with psrp_transport 'wsman'"))
+		}
+	case TransportNamedPipe:
+		if c.PSRPVMID != "" || c.PSRPVMName != "" || c.PSRPContainerID != "" || c.PSRPConfigurationName != "" {
+			errs = append(errs, errors.New("psrp_vmid, psrp_vm_name, psrp_container_id and psrp_configuration_name cannot be used with psrp_transport 'namedpipe'"))
+		}
+		if c.PSRPPipeName != "" && c.PSRPPipeProcessID != 0 {
+			errs = append(errs, errors.New("only one of psrp_pipe_name or psrp_pipe_process_id may be set"))
+		}
+		if c.PSRPHost != "" {
+			warnings = append(warnings, "psrp_host is ignored with psrp_transport 'namedpipe'; the pipe is local")
+		}
+		if c.PSRPUseTLS || c.PSRPInsecureSkipVerify {
+			errs = append(errs, errors.New("psrp_use_tls and psrp_insecure cannot be used with psrp_transport 'namedpipe'"))
+		}
+		if c.PSRPWSManPath != DefaultWSManPath {
+			errs = append(errs, errors.New("psrp_wsman_path cannot be used with psrp_transport 'namedpipe'"))
+		}
+		if c.PSRPResumeOnDisconnect {
+			errs = append(errs, errors.New("psrp_resume_on_disconnect is only supported with psrp_transport 'wsman'"))
+		}
+		if c.PSRPUsername != "" || c.PSRPPassword != "" {
+			warnings = append(warnings, "psrp_username and psrp_password are ignored with psrp_transport 'namedpipe'; the pipe is opened as the Packer process's user")
+		}
+	case TransportSSH:
+		if c.PSRPVMID != "" || c.PSRPVMName != "" || c.PSRPContainerID != "" || c.PSRPConfigurationName != "" {
+			errs = append(errs, errors.New("psrp_vmid, psrp_vm_name, psrp_container_id and psrp_configuration_name cannot be used with psrp_transport 'ssh'"))
+		}
+		if c.PSRPPipeName != "" || c.PSRPPipeProcessID != 0 {
+			errs = append(errs, errors.New("psrp_pipe_name and psrp_pipe_process_id are only valid with psrp_transport 'namedpipe'"))
+		}
+		if c.PSRPUseTLS || c.PSRPInsecureSkipVerify || c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse {
+			errs = append(errs, errors.New("psrp_use_tls, psrp_insecure, psrp_tls_fingerprint and psrp_tls_tofu cannot be used with psrp_transport 'ssh'; use psrp_ssh_known_hosts"))
+		}
+		if c.PSRPWSManPath != DefaultWSManPath {
+			errs = append(errs, errors.New("psrp_wsman_path cannot be used with psrp_transport 'ssh'"))
+		}
+		if c.PSRPResumeOnDisconnect {
+			errs = append(errs, errors.New("psrp_resume_on_disconnect is only supported with psrp_transport 'wsman'"))
+		}
+		if c.PSRPUseMachineCredentials {
+			errs = append(errs, errors.New("psrp_use_machine_credentials cannot be used with psrp_transport 'ssh'"))
+		}
+		if c.PSRPHTTPProbe {
+			warnings = append(warnings, "psrp_http_probe has no effect with psrp_transport 'ssh'")
+		}
+		if c.PSRPSSHKnownHosts == "" {
+			warnings = append(warnings, "psrp_ssh_known_hosts is not set; the target's SSH host key will not be verified")
+		}
+	}
+
+	if c.PSRPTransport != TransportSSH && (c.PSRPSSHPrivateKeyFile != "" || c.PSRPSSHAgentAuth || c.PSRPSSHKnownHosts != "" || c.PSRPSSHSubsystem != "") {
+		errs = append(errs, errors.New("psrp_ssh_private_key_file, psrp_ssh_agent_auth, psrp_ssh_known_hosts and psrp_ssh_subsystem are only valid with psrp_transport 'ssh'; the SSH tunnel uses psrp_ssh_tunnel_*"))
+	}
+	if len(c.PSRPContainerExecCommand) > 0 && c.PSRPContainerID == "" {
+		warnings = append(warnings, "psrp_container_exec_command is ignored unless psrp_container_id is set")
+	}
+
+	if c.PSRPInsecureSkipVerify && (c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse) {
+		errs = append(errs, errors.New("psrp_insecure cannot be combined with psrp_tls_fingerprint or psrp_tls_tofu"))
+	}
+	if c.PSRPTLSFingerprint != "" && c.PSRPTLSTrustOnFirstUse {
+		errs = append(errs, errors.New("only one of psrp_tls_fingerprint or psrp_tls_tofu may be set"))
+	}
+	if c.PSRPTLSServerName != "" && (c.PSRPInsecureSkipVerify || c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse) {
+		errs = append(errs, errors.New("psrp_tls_server_name cannot be combined with psrp_insecure, psrp_tls_fingerprint or psrp_tls_tofu, which skip host name verification"))
+	}
+
+	if c.PSRPLazyConnect {
+		if c.PSRPPostConnectScript != "" {
+			errs = append(errs, errors.New("psrp_post_connect_script cannot be used with psrp_lazy_connect"))
+		}
+		if c.PSRPPendingReboot != "" && c.PSRPPendingReboot != PendingRebootIgnore {
+			errs = append(errs, errors.New("psrp_pending_reboot cannot be used with psrp_lazy_connect"))
+		}
+		if c.PSRPCheckClockSkew {
+			errs = append(errs, errors.New("psrp_check_clock_skew cannot be used with psrp_lazy_connect"))
+		}
+		if c.PSRPCollectFacts {
+			errs = append(errs, errors.New("psrp_collect_facts cannot be used with psrp_lazy_connect"))
+		}
+		if c.PSRPCheckQuotas {
+			errs = append(errs, errors.New("psrp_check_quotas cannot be used with psrp_lazy_connect"))
+		}
+	}
+
+	if c.PSRPSSHTunnelHost != "" {
+		w, e := c.validateSSHTunnel()
+		warnings = append(warnings, w...)
+		errs = append(errs, e...)
+	} else if c.PSRPSSHTunnelUsername != "" || c.PSRPSSHTunnelPassword != "" || c.PSRPSSHTunnelKeyFile != "" || c.PSRPSSHTunnelKnownHosts != "" || c.PSRPSSHTunnelAgentAuth {
+		warnings = append(warnings, "psrp_ssh_tunnel_* options are ignored unless psrp_ssh_tunnel_host is set")
+	}
+
+	if c.PSRPWinRMFallback {
+		errs = append(errs, c.validateWinRMFallback()...)
+	}
+
+	if c.POSIXTarget() {
+		if c.PSRPTransport != TransportWSMan && c.PSRPTransport != TransportSSH {
+			errs = append(errs, fmt.Errorf("psrp_target_os '%s' requires psrp_transport 'wsman' or 'ssh'", c.PSRPTargetOS))
+		}
+		if c.PSRPPendingReboot != "" && c.PSRPPendingReboot != PendingRebootIgnore {
+			errs = append(errs, errors.New("psrp_pending_reboot is only supported on Windows targets"))
+		}
+		if c.PSRPCollectFacts {
+			errs = append(errs, errors.New("psrp_collect_facts is only supported on Windows targets"))
+		}
+		if c.PSRPWinRMFallback {
+			errs = append(errs, errors.New("psrp_winrm_fallback is only supported on Windows targets"))
+		}
+	}
+
+	if c.PSRPCheckClockSkew {
+		if c.PSRPTransport != TransportWSMan {
+			warnings = append(warnings, fmt.Sprintf("psrp_check_clock_skew has no effect with psrp_transport '%s'", c.PSRPTransport))
+		} else if c.PSRPAuthType != AuthKerberos && c.PSRPAuthType != AuthNegotiate {
+			warnings = append(warnings, "psrp_check_clock_skew only matters for kerberos or negotiate authentication")
+		}
+	}
+
+	if c.PSRPCheckQuotas && (c.PSRPTransport != TransportWSMan || c.POSIXTarget()) {
+		warnings = append(warnings, "psrp_check_quotas only has an effect with psrp_transport 'wsman' to a Windows target")
+	}
+
+	if c.PSRPInsecureSkipVerify && !c.PSRPUseTLS {
+		warnings = append(warnings, "psrp_insecure has no effect unless psrp_use_tls is true")
+	}
+
+	switch c.PSRPAuthType {
+	case AuthBasic, AuthNTLM:
+		if c.PSRPKrb5ConfPath != "" || c.PSRPKeytabPath != "" || c.PSRPCCachePath != "" || c.PSRPRealm != "" {
+			errs = append(errs, fmt.Errorf("psrp_realm, psrp_krb5_conf_path, psrp_keytab_path and psrp_ccache_path require psrp_auth_type 'kerberos' or 'negotiate', not '%s'", c.PSRPAuthType))
+		}
+		if c.PSRPAuthType == AuthBasic && c.PSRPDomain != "" {
+			warnings = append(warnings, "psrp_domain is ignored with basic authentication; use 'DOMAIN\\user' in psrp_username if the server expects it")
+		}
+		if c.insecureBasic() && !c.PSRPAllowInsecureBasic {
+			errs = append(errs, errors.New("basic authentication without psrp_use_tls sends the password in the clear; "+
+				"enable TLS, or set psrp_allow_insecure_basic = true to accept that"))
+		} else if c.insecureBasic() {
+			warnings = append(warnings, "basic authentication without psrp_use_tls sends credentials unencrypted")
+		}
+	case AuthKerberos, AuthNegotiate:
+		if c.PSRPKeytabPath != "" && c.PSRPCCachePath != "" {
+			errs = append(errs, errors.New("only one of psrp_keytab_path or psrp_ccache_path may be set"))
+		}
+		if (c.PSRPKeytabPath != "" || c.PSRPCCachePath != "") && c.PSRPPassword != "" {
+			errs = append(errs, errors.New("psrp_password cannot be combined with psrp_keytab_path or psrp_ccache_path"))
+		}
+		if c.PSRPKeytabPath != "" && c.PSRPUsername == "" {
+			errs = append(errs, errors.New("psrp_username is required to select the principal in psrp_keytab_path"))
+		}
+		// go-psrp hands any credentials to SSPI on Windows and only uses
+		// gokrb5 elsewhere, so a keytab or ccache would never be read
+		if (c.PSRPKeytabPath != "" || c.PSRPCCachePath != "") && auth.SupportsSSO() && !c.PSRPForceGokrb5 {
+			errs = append(errs, errors.New("psrp_keytab_path and psrp_ccache_path are only read by gokrb5, which a Windows Packer host "+
+				"uses only with psrp_force_gokrb5 = true; set that, or set psrp_username and psrp_password to authenticate through SSPI"))
+		}
+	}
+
+	if c.PSRPForceGokrb5 {
+		switch {
+		case c.PSRPAuthType != AuthKerberos && c.PSRPAuthType != AuthNegotiate:
+			errs = append(errs, fmt.Errorf("psrp_force_gokrb5 requires psrp_auth_type 'kerberos' or 'negotiate', not '%s'", c.PSRPAuthType))
+		case c.PSRPTransport != TransportWSMan:
+			errs = append(errs, errors.New("psrp_force_gokrb5 requires psrp_transport 'wsman'"))
+		case c.PSRPUseMachineCredentials:
+			errs = append(errs, errors.New("psrp_force_gokrb5 cannot be combined with psrp_use_machine_credentials, which only SSPI can use"))
+		case c.PSRPUsername == "" && c.PSRPCCachePath == "" && c.credentialProvider() == nil:
+			// gokrb5 has no SSO: the principal comes from the username or the ccache
+			errs = append(errs, errors.New("psrp_force_gokrb5 requires psrp_username or psrp_ccache_path"))
+		}
+	}
+
+	return warnings, errs
+}
@@ -0,0 +1,161 @@
+package psrp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCombinations(t *testing.T) {
+	cases := []struct {
+		name    string
+		set     func(c *Config)
+		err     string
+		warning string
+	}{
+		{
+			name: "defaults",
+			set:  func(c *Config) {},
+		},
+		{
+			name: "vmid over wsman",
+			set:  func(c *Config) { c.PSRPVMID = "7c3e0b3a-0000-0000-0000-000000000000" },
+			err:  "psrp_vmid, psrp_vm_name and psrp_container_id are only valid",
+		},
+		{
+			name: "vm name and vmid over hvsock",
+			set: func(c *Config) {
+				c.PSRPTransport = TransportHvSocket
+				c.PSRPVMID = "7c3e0b3a-0000-0000-0000-000000000000"
+				c.PSRPVMName = "packer-win"
+			},
+			warning: "psrp_vm_name is ignored",
+		},
+		{
+			name: "tls over hvsock",
+			set: func(c *Config) {
+				c.PSRPTransport = TransportHvSocket
+				c.PSRPUseTLS = true
+			},
+			err: "cannot be used with psrp_transport 'hvsock'",
+		},
+		{
+			name: "host ignored over hvsock",
+			set: func(c *Config) {
+				c.PSRPTransport = TransportHvSocket
+				c.PSRPHost = "win.example.com"
+			},
+			warning: "psrp_host is ignored",
+		},
+		{
+			name:    "insecure without tls",
+			set:     func(c *Config) { c.PSRPInsecureSkipVerify = true },
+			warning: "psrp_insecure has no effect",
+		},
+		{
+			name: "kerberos options with ntlm",
+			set: func(c *Config) {
+				c.PSRPAuthType = AuthNTLM
+				c.PSRPRealm = "EXAMPLE.COM"
+			},
+			err: "require psrp_auth_type 'kerberos' or 'negotiate'",
+		},
+		{
+			name: "basic over http",
+			set: func(c *Config) {
+				c.PSRPAuthType = AuthBasic
+			},
+			err: "psrp_allow_insecure_basic",
+		},
+		{
+			name: "insecure basic allowed",
+			set: func(c *Config) {
+				c.PSRPAuthType = AuthBasic
+				c.PSRPAllowInsecureBasic = true
+			},
+			warning: "sends credentials unencrypted",
+		},
+		{
+			name: "keytab and ccache",
+			set: func(c *Config) {
+				c.PSRPUsername = "svc"
+				c.PSRPKeytabPath = "svc.keytab"
+				c.PSRPCCachePath = "/tmp/krb5cc"
+			},
+			err: "only one of psrp_keytab_path or psrp_ccache_path",
+		},
+		{
+			name: "keytab without username",
+			set:  func(c *Config) { c.PSRPKeytabPath = "svc.keytab" },
+			err:  "psrp_username is required",
+		},
+		{
+			name: "lazy connect with a post-connect script",
+			set: func(c *Config) {
+				c.PSRPLazyConnect = true
+				c.PSRPPostConnectScript = "Get-Service WinRM"
+			},
+			err: "psrp_post_connect_script cannot be used with psrp_lazy_connect",
+		},
+		{
+			name: "lazy connect with a clock skew check",
+			set: func(c *Config) {
+				c.PSRPLazyConnect = true
+				c.PSRPCheckClockSkew = true
+				c.PSRPAuthType = AuthKerberos
+			},
+			err: "psrp_check_clock_skew cannot be used with psrp_lazy_connect",
+		},
+		{
+			name: "lazy connect with guest facts",
+			set: func(c *Config) {
+				c.PSRPLazyConnect = true
+				c.PSRPCollectFacts = true
+			},
+			err: "psrp_collect_facts cannot be used with psrp_lazy_connect",
+		},
+		{
+			name: "lazy connect with a quota check",
+			set: func(c *Config) {
+				c.PSRPLazyConnect = true
+				c.PSRPCheckQuotas = true
+			},
+			err: "psrp_check_quotas cannot be used with psrp_lazy_connect",
+		},
+		{
+			name: "clock skew check with ntlm",
+			set: func(c *Config) {
+				c.PSRPCheckClockSkew = true
+				c.PSRPAuthType = AuthNTLM
+			},
+			warning: "psrp_check_clock_skew only matters",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewConfig()
+			tc.set(c)
+			warnings, errs := c.validateCombinations()
+			if tc.err == "" && len(errs) > 0 {
+				t.Errorf("unexpected errors: %v", errs)
+			}
+			if tc.err != "" && !hasError(errs, tc.err) {
+				t.Errorf("errors %v, want one matching %q", errs, tc.err)
+			}
+			if tc.warning == "" && len(warnings) > 0 {
+				t.Errorf("unexpected warnings: %v", warnings)
+			}
+			if tc.warning != "" && !hasWarning(warnings, tc.warning) {
+				t.Errorf("warnings %v, want one matching %q", warnings, tc.warning)
+			}
+		})
+	}
+}
+
+func hasWarning(warnings []string, substr string) bool {
+	for _, w := range warnings {
+		if strings.Contains(w, substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// lookupVMID returns the GUID of the local Hyper-V VM named name, using the
+// Hyper-V PowerShell module on the Packer host.
+func lookupVMID(ctx context.Context, name string) (string, error) {
+	script := fmt.Sprintf("(Get-VM -Name '%s' -ErrorAction Stop | Select-Object -First 1).Id.Guid",
+		strings.ReplaceAll(name, "'", "''"))
+
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Get-VM %q failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	id := strings.TrimSpace(string(out))
+	if _, err := uuid.Parse(id); err != nil {
+		return "", fmt.Errorf("Get-VM %q returned no VM ID", name)
+	}
+	return id, nil
+}
+
+// resolveVMID looks up the VM GUID for psrp_vm_name, retrying at
+// PSRPRetryInterval until ctx is done, since the builder may still be
+// registering the VM.
+func (c *Config) resolveVMID(ctx context.Context) (string, error) {
+	interval := c.PSRPRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	for {
+		id, err := lookupVMID(ctx, c.PSRPVMName)
+		if err == nil {
+			logger.Info("resolved Hyper-V VM", "vm_name", c.PSRPVMName, "vm_id", id)
+			return id, nil
+		}
+		logger.Debug("Hyper-V VM lookup failed", "vm_name", c.PSRPVMName, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("timeout resolving Hyper-V VM %q (last error: %w)", c.PSRPVMName, err)
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package psrp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Windows Update defaults.
+const (
+	defaultUpdateCriteria     = "IsInstalled=0 and IsHidden=0 and Type='Software'"
+	defaultUpdateMaxCycles    = 10
+	defaultUpdateCycleTimeout = 2 * time.Hour
+	defaultUpdateReboot       = 15 * time.Minute
+	updatePollInterval        = 5 * time.Second
+)
+
+// WindowsUpdateOptions controls InstallWindowsUpdates.
+type WindowsUpdateOptions struct {
+	// SearchCriteria is the Windows Update search query. Defaults to
+	// "IsInstalled=0 and IsHidden=0 and Type='Software'".
+	SearchCriteria string
+
+	// Include and Exclude are regular expressions matched against update
+	// titles. If Include is set, only matching updates are installed;
+	// updates matching Exclude are never installed.
+	Include []string
+	Exclude []string
+
+	// MaxCycles bounds the search-install-restart cycles. Defaults to 10.
+	MaxCycles int
+
+	// CycleTimeout bounds one cycle's search, download and install.
+	// Defaults to 2h.
+	CycleTimeout time.Duration
+
+	// RestartTimeout bounds each restart. Defaults to 15m.
+	RestartTimeout time.Duration
+}
+
+// WindowsUpdate is an update installed, or failed, by InstallWindowsUpdates.
+type WindowsUpdate struct {
+	Title   string `json:"title"`
+	KB      string `json:"kb"`
+	HResult int32  `json:"hresult"`
+}
+
+// WindowsUpdateResult is what InstallWindowsUpdates did.
+type WindowsUpdateResult struct {
+	Installed []WindowsUpdate
+	Restarts  int
+}
+
+// WindowsUpdateError is returned when updates fail to install. Result
+// holds what did install.
+type WindowsUpdateError struct {
+	Failed []WindowsUpdate
+	Result *WindowsUpdateResult
+}
+
+func (e *WindowsUpdateError) Error() string {
+	parts := make([]string, len(e.Failed))
+	for i, u := range e.Failed {
+		parts[i] = fmt.Sprintf("%s (0x%08X)", u.Title, uint32(u.HResult))
+	}
+	return fmt.Sprintf("%d Windows update(s) failed to install: %s", len(e.Failed), strings.Join(parts, "; "))
+}
+
+// windowsUpdateScript runs one cycle as SYSTEM from a scheduled task: the
+// Windows Update API refuses to download or install from a remote session.
+// It reads its options from params.json in the work directory, appends
+// progress to log.txt and writes the outcome to result.json.
+const windowsUpdateScript = `param([string]$Work)
+$ErrorActionPreference = 'Stop'
+$log = Join-Path $Work 'log.txt'
+function Log([string]$m) { Add-Content -LiteralPath $log -Value $m -Encoding UTF8 }
+$p = Get-Content -LiteralPath (Join-Path $Work 'params.json') -Raw | ConvertFrom-Json
+$result = @{ found = 0; installed = @(); failed = @(); reboot_required = $false; error = $null }
+try {
+	if ((New-Object -ComObject Microsoft.Update.SystemInfo).RebootRequired) {
+		Log 'A restart is pending from an earlier install'
+		$result.reboot_required = $true
+	} else {
+		$session = New-Object -ComObject Microsoft.Update.Session
+		$session.ClientApplicationID = 'packer-psrp'
+		Log "Searching for updates ($($p.criteria))..."
+		$search = $session.CreateUpdateSearcher().Search($p.criteria)
+		$updates = New-Object -ComObject Microsoft.Update.UpdateColl
+		foreach ($u in $search.Updates) {
+			if (@($p.include).Count -and -not (@($p.include) | Where-Object { $u.Title -match $_ })) { continue }
+			if (@($p.exclude) | Where-Object { $u.Title -match $_ }) { Log "Skipping excluded update: $($u.Title)"; continue }
+			if ($u.InstallationBehavior.CanRequestUserInput) { Log "Skipping interactive update: $($u.Title)"; continue }
+			if (-not $u.EulaAccepted) { $u.AcceptEula() }
+			[void]$updates.Add($u)
+		}
+		$result.found = $updates.Count
+		Log "Found $($updates.Count) update(s)"
+		if ($updates.Count -gt 0) {
+			foreach ($u in $updates) { Log "  $($u.Title)" }
+			$downloader = $session.CreateUpdateDownloader()
+			$downloader.Updates = $updates
+			Log 'Downloading...'
+			[void]$downloader.Download()
+			$installer = $session.CreateUpdateInstaller()
+			$installer.Updates = $updates
+			Log 'Installing...'
+			$install = $installer.Install()
+			for ($i = 0; $i -lt $updates.Count; $i++) {
+				$u = $updates.Item($i)
+				$r = $install.GetUpdateResult($i)
+				$entry = @{ title = $u.Title; kb = (@($u.KBArticleIDs) | ForEach-Object { "KB$_" }) -join ','; hresult = $r.HResult }
+				# 2 = succeeded, 3 = succeeded with errors
+				if ($r.ResultCode -eq 2 -or $r.ResultCode -eq 3) {
+					$result.installed += $entry
+					Log "Installed: $($u.Title)"
+				} else {
+					$result.failed += $entry
+					Log ('Failed: {0} (0x{1:X8})' -f $u.Title, $r.HResult)
+				}
+			}
+			$result.reboot_required = [bool]$install.RebootRequired
+		}
+	}
+} catch {
+	$result.error = "$_"
+	Log "Error: $_"
+}
+$result | ConvertTo-Json -Compress -Depth 4 | Set-Content -LiteralPath (Join-Path $Work 'result.json') -Encoding UTF8
+`
+
+// startUpdateTaskScript registers and starts the scheduled task running
+// windowsUpdateScript.
+const startUpdateTaskScript = `$ErrorActionPreference = 'Stop'
+$work = %s
+$action = New-ScheduledTaskAction -Execute 'powershell.exe' -Argument ('-NoProfile -NonInteractive -ExecutionPolicy Bypass -File "{0}\update.ps1" -Work "{0}"' -f $work)
+$principal = New-ScheduledTaskPrincipal -UserId 'SYSTEM' -LogonType ServiceAccount -RunLevel Highest
+$settings = New-ScheduledTaskSettingsSet -AllowStartIfOnBatteries -DontStopIfGoingOnBatteries -ExecutionTimeLimit ([TimeSpan]::Zero)
+Register-ScheduledTask -TaskName %s -Action $action -Principal $principal -Settings $settings -Force | Out-Null
+Start-ScheduledTask -TaskName %s
+# Don't return before the first poll can tell the task has started
+$deadline = (Get-Date).AddSeconds(30)
+while ((Get-ScheduledTask -TaskName %s).State -ne 'Running' -and -not (Test-Path -LiteralPath "$work/result.json") -and (Get-Date) -lt $deadline) {
+	Start-Sleep -Milliseconds 250
+}
+`
+
+// pollUpdateTaskScript reports whether the task is still running and the
+// log written since offset.
+const pollUpdateTaskScript = `$state = (Get-ScheduledTask -TaskName %s -ErrorAction Stop).State
+$log = Join-Path %s 'log.txt'
+$text = ''
+$offset = %d
+if (Test-Path -LiteralPath $log) {
+	$fs = [System.IO.File]::Open($log, 'Open', 'Read', 'ReadWrite')
+	try {
+		[void]$fs.Seek($offset, 'Begin')
+		$text = (New-Object System.IO.StreamReader($fs)).ReadToEnd()
+		$offset = $fs.Position
+	} finally { $fs.Close() }
+}
+$result = $null
+$path = Join-Path %s 'result.json'
+$running = "$state" -eq 'Running' -or "$state" -eq 'Queued'
+if (-not $running -and (Test-Path -LiteralPath $path)) { $result = Get-Content -LiteralPath $path -Raw }
+@{ running = $running; log = $text; offset = $offset; result = $result } | ConvertTo-Json -Compress
+`
+
+// updateCycle is the outcome of one run of windowsUpdateScript.
+type updateCycle struct {
+	Found          int             `json:"found"`
+	Installed      []WindowsUpdate `json:"installed"`
+	Failed         []WindowsUpdate `json:"failed"`
+	RebootRequired bool            `json:"reboot_required"`
+	Error          string          `json:"error"`
+}
+
+// InstallWindowsUpdates searches for, downloads and installs Windows
+// updates, restarting the guest and reconnecting whenever an install needs
+// it, until a search finds nothing left to install. Progress from each
+// cycle streams to progress. Updates that fail to install are reported as
+// a *WindowsUpdateError once a cycle makes no other progress.
+func (c *Communicator) InstallWindowsUpdates(ctx context.Context, opts *WindowsUpdateOptions, progress io.Writer) (*WindowsUpdateResult, error) {
+	if progress == nil {
+		progress = io.Discard
+	}
+	maxCycles := opts.MaxCycles
+	if maxCycles <= 0 {
+		maxCycles = defaultUpdateMaxCycles
+	}
+	restartTimeout := opts.RestartTimeout
+	if restartTimeout <= 0 {
+		restartTimeout = defaultUpdateReboot
+	}
+
+	result := &WindowsUpdateResult{}
+	for cycle := 1; cycle <= maxCycles; cycle++ {
+		fmt.Fprintf(progress, "Windows Update cycle %d of at most %d\n", cycle, maxCycles)
+		out, err := c.runUpdateCycle(ctx, opts, progress)
+		if err != nil {
+			return result, err
+		}
+		result.Installed = append(result.Installed, out.Installed...)
+		if out.Error != "" {
+			return result, fmt.Errorf("Windows Update failed: %s", out.Error)
+		}
+
+		if out.RebootRequired {
+			fmt.Fprintln(progress, "Restarting to finish installing updates...")
+			if err := c.Restart(ctx, restartTimeout); err != nil {
+				return result, err
+			}
+			result.Restarts++
+			continue
+		}
+		if len(out.Failed) > 0 && len(out.Installed) == 0 {
+			return result, &WindowsUpdateError{Failed: out.Failed, Result: result}
+		}
+		if out.Found == 0 {
+			return result, nil
+		}
+	}
+	return result, fmt.Errorf("updates still pending after %d cycles", maxCycles)
+}
+
+// runUpdateCycle runs windowsUpdateScript once in a scheduled task and
+// streams its log until it finishes.
+func (c *Communicator) runUpdateCycle(ctx context.Context, opts *WindowsUpdateOptions, progress io.Writer) (*updateCycle, error) {
+	timeout := opts.CycleTimeout
+	if timeout <= 0 {
+		timeout = defaultUpdateCycleTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	criteria := opts.SearchCriteria
+	if criteria == "" {
+		criteria = defaultUpdateCriteria
+	}
+	params, err := json.Marshal(map[string]interface{}{
+		"criteria": criteria,
+		"include":  append([]string{}, opts.Include...),
+		"exclude":  append([]string{}, opts.Exclude...),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id := uuid.New().String()
+	work := "C:/Windows/Temp/packer-windows-update-" + id
+	task := "packer-windows-update-" + id
+	defer c.execute(context.Background(), fmt.Sprintf( //nolint:errcheck // best effort
+		"Unregister-ScheduledTask -TaskName %s -Confirm:$false -ErrorAction SilentlyContinue\nRemove-Item -LiteralPath %s -Recurse -Force -ErrorAction SilentlyContinue",
+		psQuote(task), psQuote(work)))
+
+	if err := c.upload(ctx, work+"/update.ps1", strings.NewReader(windowsUpdateScript)); err != nil {
+		return nil, fmt.Errorf("failed to upload Windows Update script: %w", err)
+	}
+	if err := c.upload(ctx, work+"/params.json", bytes.NewReader(params)); err != nil {
+		return nil, fmt.Errorf("failed to upload Windows Update options: %w", err)
+	}
+	if err := c.executeChecked(ctx, fmt.Sprintf(startUpdateTaskScript,
+		psQuote(strings.ReplaceAll(work, "/", `\`)), psQuote(task), psQuote(task), psQuote(task))); err != nil {
+		return nil, fmt.Errorf("failed to start Windows Update task: %w", err)
+	}
+
+	var offset int64
+	for {
+		var poll struct {
+			Running bool   `json:"running"`
+			Log     string `json:"log"`
+			Offset  int64  `json:"offset"`
+			Result  string `json:"result"`
+		}
+		if err := c.queryJSON(ctx, fmt.Sprintf(pollUpdateTaskScript, psQuote(task), psQuote(work), offset, psQuote(work)), &poll); err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("timeout waiting for Windows Update: %w", ctx.Err())
+			}
+			// Some updates drop the network while installing; keep waiting
+			c.logger().Debug("polling Windows Update failed", "op", "windows-update", "error", err)
+		} else {
+			offset = poll.Offset
+			io.WriteString(progress, strings.TrimPrefix(poll.Log, "\ufeff")) //nolint:errcheck // progress is best effort
+			if !poll.Running {
+				if poll.Result == "" {
+					return nil, fmt.Errorf("Windows Update task stopped without a result")
+				}
+				var out updateCycle
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(poll.Result), "\ufeff")), &out); err != nil {
+					return nil, fmt.Errorf("failed to parse Windows Update result: %w", err)
+				}
+				return &out, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout waiting for Windows Update: %w", ctx.Err())
+		case <-time.After(updatePollInterval):
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package psrp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrRegistryValueNotFound is returned by Registry.GetValue when the key or
+// value doesn't exist.
+var ErrRegistryValueNotFound = errors.New("registry value not found")
+
+// RegistryValueKind is the type of a registry value, named as in
+// Microsoft.Win32.RegistryValueKind.
+type RegistryValueKind string
+
+const (
+	RegistryString       RegistryValueKind = "String"
+	RegistryExpandString RegistryValueKind = "ExpandString"
+	RegistryDWord        RegistryValueKind = "DWord"
+	RegistryQWord        RegistryValueKind = "QWord"
+	RegistryMultiString  RegistryValueKind = "MultiString"
+	RegistryBinary       RegistryValueKind = "Binary"
+)
+
+// RegistryValue is a typed registry value. Which field holds the data
+// depends on Kind: String for String and ExpandString, Integer for DWord
+// and QWord, Strings for MultiString and Binary for Binary (and for kinds
+// without a better representation).
+type RegistryValue struct {
+	Kind    RegistryValueKind `json:"kind"`
+	String  string            `json:"string,omitempty"`
+	Integer uint64            `json:"integer,omitempty"`
+	Strings []string          `json:"strings,omitempty"`
+	Binary  []byte            `json:"binary,omitempty"` // base64 in JSON
+}
+
+// StringValue returns a String registry value.
+func StringValue(s string) RegistryValue { return RegistryValue{Kind: RegistryString, String: s} }
+
+// ExpandStringValue returns an ExpandString registry value.
+func ExpandStringValue(s string) RegistryValue {
+	return RegistryValue{Kind: RegistryExpandString, String: s}
+}
+
+// DWordValue returns a DWord registry value.
+func DWordValue(v uint32) RegistryValue {
+	return RegistryValue{Kind: RegistryDWord, Integer: uint64(v)}
+}
+
+// QWordValue returns a QWord registry value.
+func QWordValue(v uint64) RegistryValue { return RegistryValue{Kind: RegistryQWord, Integer: v} }
+
+// MultiStringValue returns a MultiString registry value.
+func MultiStringValue(s []string) RegistryValue {
+	return RegistryValue{Kind: RegistryMultiString, Strings: s}
+}
+
+// BinaryValue returns a Binary registry value.
+func BinaryValue(b []byte) RegistryValue { return RegistryValue{Kind: RegistryBinary, Binary: b} }
+
+// registryHives maps key prefixes to .NET RegistryHive names.
+var registryHives = map[string]string{
+	"HKLM":                "LocalMachine",
+	"HKEY_LOCAL_MACHINE":  "LocalMachine",
+	"HKCU":                "CurrentUser",
+	"HKEY_CURRENT_USER":   "CurrentUser",
+	"HKU":                 "Users",
+	"HKEY_USERS":          "Users",
+	"HKCR":                "ClassesRoot",
+	"HKEY_CLASSES_ROOT":   "ClassesRoot",
+	"HKCC":                "CurrentConfig",
+	"HKEY_CURRENT_CONFIG": "CurrentConfig",
+}
+
+// Registry reads and writes the guest's registry. Keys are written as in
+// PowerShell or regedit, e.g. `HKLM:\SOFTWARE\Example` or
+// `HKEY_LOCAL_MACHINE\SOFTWARE\Example`, and always address the 64-bit
+// view. An empty value name means the key's default value.
+type Registry struct {
+	c *Communicator
+}
+
+// Registry returns the registry helpers for this session.
+func (c *Communicator) Registry() *Registry {
+	return &Registry{c: c}
+}
+
+// openRegistryKey returns PowerShell that opens key into $key (nil if it
+// doesn't exist), read-only unless writable, creating it first if create.
+func openRegistryKey(key string, writable, create bool) (string, error) {
+	hive, path, _ := strings.Cut(strings.ReplaceAll(key, "/", `\`), `\`)
+	name, ok := registryHives[strings.ToUpper(strings.TrimSuffix(hive, ":"))]
+	if !ok {
+		return "", fmt.Errorf("unknown registry hive in %q", key)
+	}
+	path = strings.Trim(path, `\`)
+
+	open := fmt.Sprintf("$base.OpenSubKey(%s, $%t)", psQuote(path), writable)
+	if create {
+		open = fmt.Sprintf("$base.CreateSubKey(%s)", psQuote(path))
+	}
+	return fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+$base = [Microsoft.Win32.RegistryKey]::OpenBaseKey('%s', 'Registry64')
+$key = %s
+`, name, open), nil
+}
+
+// getRegistryValueScript reads $name from $key as JSON. DWords and QWords
+// are read as signed .NET integers and reinterpreted as unsigned.
+const getRegistryValueScript = `$name = %s
+$kind = $null
+if ($key -and ($key.GetValueNames() -contains $name)) { $kind = $key.GetValueKind($name) }
+if ($kind -eq $null) { '{"found":false}'; return }
+$v = $key.GetValue($name, $null, 'DoNotExpandEnvironmentNames')
+$r = @{ found = $true; kind = "$kind" }
+switch ("$kind") {
+	'String'       { $r.string = [string]$v }
+	'ExpandString' { $r.string = [string]$v }
+	'DWord'        { $r.integer = [BitConverter]::ToUInt32([BitConverter]::GetBytes([int32]$v), 0) }
+	'QWord'        { $r.integer = [BitConverter]::ToUInt64([BitConverter]::GetBytes([int64]$v), 0) }
+	'MultiString'  { $r.strings = @($v) }
+	default        { $r.binary = [Convert]::ToBase64String([byte[]]$v) }
+}
+ConvertTo-Json -Compress -InputObject $r
+`
+
+// GetValue reads a value, returning ErrRegistryValueNotFound if the key or
+// value doesn't exist.
+func (r *Registry) GetValue(ctx context.Context, key, name string) (*RegistryValue, error) {
+	open, err := openRegistryKey(key, false, false)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Found bool `json:"found"`
+		RegistryValue
+	}
+	if err := r.c.queryJSON(ctx, open+fmt.Sprintf(getRegistryValueScript, psQuote(name)), &out); err != nil {
+		return nil, fmt.Errorf("failed to read registry value %s\\%s: %w", key, name, err)
+	}
+	if !out.Found {
+		return nil, fmt.Errorf("%s\\%s: %w", key, name, ErrRegistryValueNotFound)
+	}
+	return &out.RegistryValue, nil
+}
+
+// SetValue writes a value, creating the key if needed.
+func (r *Registry) SetValue(ctx context.Context, key, name string, value RegistryValue) error {
+	var literal string
+	switch value.Kind {
+	case RegistryString, RegistryExpandString:
+		literal = psQuote(value.String)
+	case RegistryDWord:
+		if value.Integer > 0xFFFFFFFF {
+			return fmt.Errorf("DWord value %d out of range", value.Integer)
+		}
+		literal = fmt.Sprintf("[int32]%d", int32(uint32(value.Integer)))
+	case RegistryQWord:
+		literal = fmt.Sprintf("[int64]%d", int64(value.Integer))
+	case RegistryMultiString:
+		literal = fmt.Sprintf("[string[]]@(%s)", psList(value.Strings))
+	case RegistryBinary:
+		literal = fmt.Sprintf("[Convert]::FromBase64String('%s')", base64.StdEncoding.EncodeToString(value.Binary))
+	default:
+		return fmt.Errorf("unsupported registry value kind %q", value.Kind)
+	}
+
+	open, err := openRegistryKey(key, true, true)
+	if err != nil {
+		return err
+	}
+	script := open + fmt.Sprintf("$key.SetValue(%s, %s, '%s')\n$key.Close()", psQuote(name), literal, value.Kind)
+	if err := r.c.executeChecked(ctx, script); err != nil {
+		return fmt.Errorf("failed to write registry value %s\\%s: %w", key, name, err)
+	}
+	return nil
+}
+
+// EnsureKey creates a key, and any missing parents, if it doesn't exist.
+func (r *Registry) EnsureKey(ctx context.Context, key string) error {
+	open, err := openRegistryKey(key, true, true)
+	if err != nil {
+		return err
+	}
+	if err := r.c.executeChecked(ctx, open+"$key.Close()"); err != nil {
+		return fmt.Errorf("failed to create registry key %s: %w", key, err)
+	}
+	return nil
+}
+
+// DeleteValue deletes a value. It is not an error if the key or value
+// doesn't exist.
+func (r *Registry) DeleteValue(ctx context.Context, key, name string) error {
+	open, err := openRegistryKey(key, true, false)
+	if err != nil {
+		return err
+	}
+	script := open + fmt.Sprintf("if ($key) { $key.DeleteValue(%s, $false); $key.Close() }", psQuote(name))
+	if err := r.c.executeChecked(ctx, script); err != nil {
+		return fmt.Errorf("failed to delete registry value %s\\%s: %w", key, name, err)
+	}
+	return nil
+}
+
+// executeChecked runs a script whose output doesn't matter, failing if it
+// wrote any errors.
+func (c *Communicator) executeChecked(ctx context.Context, script string) error {
+	result, err := c.execute(ctx, script)
+	if err != nil {
+		return err
+	}
+	if result.HadErrors {
+		return fmt.Errorf("%s", formatResultErrors(result))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package psrp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	sdkwinrm "github.com/hashicorp/packer-plugin-sdk/sdk-internals/communicator/winrm"
+	"github.com/masterzen/winrm"
+	"github.com/smnsjas/go-psrp/wsman"
+)
+
+// StateWinRMFallback is set to true in the state bag when StepConnect fell
+// back to the WinRM communicator.
+const StateWinRMFallback = "psrp_winrm_fallback"
+
+// winrmFallbackReason reports whether a connect failure means PSRP itself
+// is unusable on the target while plain WinRM may still work: the
+// PowerShell endpoint is missing, incompatible, or restricted to other
+// accounts. Credential, TLS and network failures would fail over WinRM too,
+// so they don't qualify.
+func winrmFallbackReason(err error) (string, bool) {
+	var fault *wsman.Fault
+	if errors.As(err, &fault) && fault.IsAccessDenied() {
+		// An HTTP 401 is a credential failure; an access-denied fault comes
+		// after authentication, from the session configuration's ACL
+		return "the PowerShell endpoint is restricted for this account", true
+	}
+	if reason := endpointUnavailable(err); reason != "" {
+		return reason, true
+	}
+	return "", false
+}
+
+// winrmConfig maps the psrp_* settings onto the SDK's WinRM communicator.
+// Negotiate is mapped to NTLM, the only SSP the WinRM client speaks besides
+// basic; Prepare rejects settings that have no WinRM equivalent.
+func (c *Config) winrmConfig(host string) *sdkwinrm.Config {
+	username := c.PSRPUsername
+	if c.PSRPDomain != "" && c.PSRPAuthType != AuthBasic && !strings.Contains(username, `\`) {
+		username = c.PSRPDomain + `\` + username
+	}
+	cfg := &sdkwinrm.Config{
+		Host:     host,
+		Port:     c.PSRPPort,
+		Username: username,
+		Password: c.PSRPPassword,
+		Timeout:  c.PSRPTimeout,
+		Https:    c.PSRPUseTLS,
+		Insecure: c.PSRPInsecureSkipVerify,
+	}
+	if c.PSRPAuthType == AuthNTLM || c.PSRPAuthType == AuthNegotiate {
+		cfg.TransportDecorator = func() winrm.Transporter { return &winrm.ClientNTLM{} }
+	}
+	return cfg
+}
+
+// validateWinRMFallback reports settings psrp_winrm_fallback cannot carry
+// over to the WinRM communicator.
+func (c *Config) validateWinRMFallback() (errs []error) {
+	if c.PSRPTransport != TransportWSMan {
+		errs = append(errs, errors.New("psrp_winrm_fallback requires psrp_transport 'wsman'"))
+	}
+	if c.PSRPAuthType == AuthKerberos || c.forbidsNTLM() {
+		errs = append(errs, errors.New("psrp_winrm_fallback does not support kerberos authentication; use negotiate, ntlm or basic"))
+	}
+	if c.PSRPUseMachineCredentials {
+		errs = append(errs, errors.New("psrp_winrm_fallback cannot be combined with psrp_use_machine_credentials"))
+	}
+	if c.PSRPWSManPath != DefaultWSManPath {
+		errs = append(errs, errors.New("psrp_winrm_fallback cannot be combined with psrp_wsman_path"))
+	}
+	if c.PSRPTLSFingerprint != "" || c.PSRPTLSTrustOnFirstUse || c.PSRPTLSServerName != "" {
+		errs = append(errs, errors.New("psrp_winrm_fallback cannot be combined with psrp_tls_fingerprint, psrp_tls_tofu or psrp_tls_server_name"))
+	}
+	if c.PSRPLazyConnect {
+		errs = append(errs, errors.New("psrp_winrm_fallback cannot be used with psrp_lazy_connect"))
+	}
+	return errs
+}
+
+// fallbackToWinRM replaces the failed PSRP connection with the SDK's WinRM
+// communicator. PSRP-only steps (identity check, pending reboot, post-connect
+// script, guest info and facts) are skipped, and provisioners that need a
+// PSRP session will fail; the SDK's own provisioners work as usual.
+func (s *StepConnect) fallbackToWinRM(state multistep.StateBag, ui packersdk.Ui, reason string, cause error) multistep.StepAction {
+	ui.Error(fmt.Sprintf("Warning: %s on %s; falling back to the WinRM communicator. "+
+		"PSRP-only features are disabled for this build.", reason, s.host))
+	s.logger().Warn("falling back to WinRM", "reason", reason, "error", cause)
+
+	if s.comm != nil {
+		s.comm.Close()
+		s.comm = nil
+	}
+
+	comm, err := sdkwinrm.New(s.config.winrmConfig(s.host))
+	if err != nil {
+		err = fmt.Errorf("WinRM fallback after PSRP failed (%s) also failed: %w", cause, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Connected to WinRM!")
+	s.metrics.connected()
+	s.metrics.publish(state)
+	state.Put(StateWinRMFallback, true)
+	state.Put("communicator", comm)
+	return multistep.ActionContinue
+}
@@ -0,0 +1,330 @@
+package psrp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smnsjas/go-psrpcore/messages"
+)
+
+// Environment variables that enable the wire trace without template changes.
+// They apply when psrp_trace_file / psrp_trace_payloads are unset.
+// PACKER_PSRP_TRACE on its own writes the trace into the plugin log and
+// raises the log level to trace; see traceEnabled.
+const (
+	envTrace         = "PACKER_PSRP_TRACE"
+	envTraceFile     = "PACKER_PSRP_TRACE_FILE"
+	envTracePayloads = "PACKER_PSRP_TRACE_PAYLOADS"
+)
+
+// traceEnabled reports whether PACKER_PSRP_TRACE asks for verbose
+// diagnostics. Any value but "", "0" and "false" turns them on.
+func traceEnabled() bool {
+	v := os.Getenv(envTrace)
+	return v != "" && v != "0" && !strings.EqualFold(v, "false")
+}
+
+// messageTypeNames names the PSRP message types (MS-PSRP 2.2.1) in traces.
+var messageTypeNames = map[messages.MessageType]string{
+	messages.MessageTypeSessionCapability:     "SESSION_CAPABILITY",
+	messages.MessageTypeInitRunspacePool:      "INIT_RUNSPACEPOOL",
+	messages.MessageTypePublicKey:             "PUBLIC_KEY",
+	messages.MessageTypeEncryptedSessionKey:   "ENCRYPTED_SESSION_KEY",
+	messages.MessageTypePublicKeyRequest:      "PUBLIC_KEY_REQUEST",
+	messages.MessageTypeConnectRunspacePool:   "CONNECT_RUNSPACEPOOL",
+	messages.MessageTypeRunspacePoolState:     "RUNSPACEPOOL_STATE",
+	messages.MessageTypeSetMaxRunspaces:       "SET_MAX_RUNSPACES",
+	messages.MessageTypeSetMinRunspaces:       "SET_MIN_RUNSPACES",
+	messages.MessageTypeRunspaceAvailability:  "RUNSPACE_AVAILABILITY",
+	messages.MessageTypeGetAvailableRunspaces: "GET_AVAILABLE_RUNSPACES",
+	messages.MessageTypeUserEvent:             "USER_EVENT",
+	messages.MessageTypeApplicationPrivate:    "APPLICATION_PRIVATE_DATA",
+	messages.MessageTypeGetCommandMetadata:    "GET_COMMAND_METADATA",
+	messages.MessageTypeRunspacePoolInitData:  "RUNSPACEPOOL_INIT_DATA",
+	messages.MessageTypeResetRunspaceState:    "RESET_RUNSPACE_STATE",
+	messages.MessageTypeRunspaceHostCall:      "RUNSPACEPOOL_HOST_CALL",
+	messages.MessageTypeRunspaceHostResponse:  "RUNSPACEPOOL_HOST_RESPONSE",
+	messages.MessageTypeCreatePipeline:        "CREATE_PIPELINE",
+	messages.MessageTypeSignal:                "SIGNAL",
+	messages.MessageTypePipelineInput:         "PIPELINE_INPUT",
+	messages.MessageTypeEndOfPipelineInput:    "END_OF_PIPELINE_INPUT",
+	messages.MessageTypePipelineOutput:        "PIPELINE_OUTPUT",
+	messages.MessageTypeErrorRecord:           "ERROR_RECORD",
+	messages.MessageTypePipelineState:         "PIPELINE_STATE",
+	messages.MessageTypeDebugRecord:           "DEBUG_RECORD",
+	messages.MessageTypeVerboseRecord:         "VERBOSE_RECORD",
+	messages.MessageTypeWarningRecord:         "WARNING_RECORD",
+	messages.MessageTypeProgressRecord:        "PROGRESS_RECORD",
+	messages.MessageTypeInformationRecord:     "INFORMATION_RECORD",
+	messages.MessageTypePipelineHostCall:      "PIPELINE_HOST_CALL",
+	messages.MessageTypePipelineHostResponse:  "PIPELINE_HOST_RESPONSE",
+}
+
+func messageTypeName(t messages.MessageType) string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08X", uint32(t))
+}
+
+// rawTypePattern matches the hex message types go-psrpcore logs, so the
+// trace can name them.
+var rawTypePattern = regexp.MustCompile(`type=0x([0-9A-Fa-f]{8})`)
+
+// traceFiles holds the open trace files by path. Every communicator in the
+// process that traces to a path shares one handle, so lines don't interleave
+// mid-write; the files stay open until the plugin exits.
+var traceFiles struct {
+	sync.Mutex
+	files map[string]*traceFile
+}
+
+// traceFile serializes writes to a trace file and redacts each line.
+type traceFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (t *traceFile) Write(p []byte) (int, error) {
+	line := nameMessageTypes(Redact(string(p)))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.f.WriteString(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// nameMessageTypes replaces the hex message types in a trace line with
+// their names.
+func nameMessageTypes(line string) string {
+	return rawTypePattern.ReplaceAllStringFunc(line, func(m string) string {
+		v, err := strconv.ParseUint(m[len("type=0x"):], 16, 32)
+		if err != nil {
+			return m
+		}
+		return "type=" + messageTypeName(messages.MessageType(v))
+	})
+}
+
+// traceLogWriter writes the wire trace into the plugin log, for
+// PACKER_PSRP_TRACE without a trace file.
+type traceLogWriter struct{}
+
+func (traceLogWriter) Write(p []byte) (int, error) {
+	if _, err := (redactingWriter{}).Write([]byte("[TRACE] psrp.wire: " + nameMessageTypes(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func openTraceFile(path string) (*traceFile, error) {
+	traceFiles.Lock()
+	defer traceFiles.Unlock()
+	if t, ok := traceFiles.files[path]; ok {
+		return t, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PSRP trace file: %w", err)
+	}
+	if traceFiles.files == nil {
+		traceFiles.files = make(map[string]*traceFile)
+	}
+	t := &traceFile{f: f}
+	traceFiles.files[path] = t
+	return t, nil
+}
+
+// wireTrace records one communicator's protocol traffic: runspace pool and
+// pipeline state changes, each message received with its type and size,
+// upload chunks, and with payloads enabled the scripts sent and the
+// deserialized records received. A nil *wireTrace records nothing.
+type wireTrace struct {
+	log       *slog.Logger
+	client    *slog.Logger // for go-psrp, which logs scripts in full
+	payloads  bool
+	pipelines atomic.Int64
+	recorder  *flightRecorder // keeps recent events for failure dumps
+
+	statsMu sync.Mutex
+	stats   map[int64]*streamStats // by pipeline sequence number
+}
+
+// streamStats counts what one pipeline received, for its pipeline.end line.
+type streamStats struct {
+	start    time.Time
+	messages map[string]int // by message type name
+	bytes    int
+}
+
+// newWireTrace opens the trace for a connection. Unless the flight recorder
+// is off, the trace always feeds it; otherwise it returns nil if tracing is
+// off or the file can't be opened (tracing must never fail a build).
+func newWireTrace(config *Config, connID, target string) *wireTrace {
+	path, payloads := os.Getenv(envTraceFile), os.Getenv(envTracePayloads) != ""
+	if config != nil && config.PSRPTraceFile != "" {
+		path, payloads = config.PSRPTraceFile, config.PSRPTracePayloads
+	}
+	var w io.Writer
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch {
+	case path != "":
+		f, err := openTraceFile(path)
+		if err != nil {
+			logger.Warn("wire trace disabled", "error", err)
+			break
+		}
+		w = f
+	case traceEnabled():
+		w = traceLogWriter{}
+		// The plugin log stamps each line already
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+
+	var handlers, clientHandlers teeHandler
+	if w != nil {
+		handler := slog.NewTextHandler(w, opts)
+		handlers = append(handlers, handler)
+		if payloads {
+			clientHandlers = append(clientHandlers, handler)
+		} else {
+			clientHandlers = append(clientHandlers, payloadFilter{handler})
+		}
+	}
+	recorder := newFlightRecorder(config, connID, target)
+	if recorder != nil {
+		handler := recorder.handler()
+		handlers = append(handlers, handler)
+		clientHandlers = append(clientHandlers, payloadFilter{handler})
+	}
+	if len(handlers) == 0 {
+		return nil
+	}
+	return &wireTrace{
+		log:      slog.New(handlers).With("conn", connID, "target", target),
+		client:   slog.New(clientHandlers).With("conn", connID, "target", target),
+		payloads: payloads && w != nil,
+		recorder: recorder,
+	}
+}
+
+// attach routes the client's own protocol logging (pool state transitions,
+// message dispatch) into the trace.
+func (t *wireTrace) attach(cl PSRPClient) {
+	if t == nil {
+		return
+	}
+	if c, ok := cl.(interface{ SetSlogLogger(*slog.Logger) }); ok {
+		c.SetSlogLogger(t.client)
+	}
+}
+
+// event records a communicator-level state transition.
+func (t *wireTrace) event(name string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.log.Info(name, args...)
+}
+
+// pipelineStart records a new pipeline and returns its trace sequence number.
+func (t *wireTrace) pipelineStart(script string) int64 {
+	if t == nil {
+		return 0
+	}
+	seq := t.pipelines.Add(1)
+	t.statsMu.Lock()
+	if t.stats == nil {
+		t.stats = make(map[int64]*streamStats)
+	}
+	t.stats[seq] = &streamStats{start: time.Now(), messages: make(map[string]int)}
+	t.statsMu.Unlock()
+	args := []any{"seq", seq, "bytes", len(script)}
+	if t.payloads {
+		args = append(args, "script", script)
+	}
+	t.log.Info("pipeline.start", args...)
+	return seq
+}
+
+// message records a message received for pipeline seq.
+func (t *wireTrace) message(seq int64, msg *messages.Message) {
+	if t == nil || msg == nil {
+		return
+	}
+	t.statsMu.Lock()
+	if st := t.stats[seq]; st != nil {
+		st.messages[messageTypeName(msg.Type)]++
+		st.bytes += len(msg.Data)
+	}
+	t.statsMu.Unlock()
+	args := []any{"seq", seq, "type", messageTypeName(msg.Type), "pipeline", msg.PipelineID, "bytes", len(msg.Data)}
+	if t.payloads {
+		args = append(args, "payload", deserializeMessage(msg))
+	}
+	t.log.Debug("message.recv", args...)
+}
+
+// pipelineEnd records how pipeline seq finished.
+func (t *wireTrace) pipelineEnd(seq int64, exitCode int, exitMarker bool, err error) {
+	if t == nil {
+		return
+	}
+	args := []any{"seq", seq, "exit_code", exitCode, "exit_marker", exitMarker}
+	t.statsMu.Lock()
+	if st := t.stats[seq]; st != nil {
+		delete(t.stats, seq)
+		counts := make([]string, 0, len(st.messages))
+		for name, n := range st.messages {
+			counts = append(counts, fmt.Sprintf("%s:%d", name, n))
+		}
+		sort.Strings(counts)
+		args = append(args, "duration", time.Since(st.start), "recv_bytes", st.bytes, "recv_messages", strings.Join(counts, ","))
+	}
+	t.statsMu.Unlock()
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	t.log.Info("pipeline.end", args...)
+}
+
+// payloadFilter replaces the script text in go-psrp's "Execute called: '...'"
+// style messages with its size, for traces without payloads.
+type payloadFilter struct{ slog.Handler }
+
+func (h payloadFilter) Handle(ctx context.Context, r slog.Record) error {
+	if name, payload, ok := strings.Cut(r.Message, ": '"); ok && strings.HasSuffix(name, " called") {
+		filtered := slog.NewRecord(r.Time, r.Level, name, r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			filtered.AddAttrs(a)
+			return true
+		})
+		filtered.AddAttrs(slog.Int("bytes", len(strings.TrimSuffix(payload, "'"))))
+		r = filtered
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h payloadFilter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return payloadFilter{h.Handler.WithAttrs(attrs)}
+}
+
+func (h payloadFilter) WithGroup(name string) slog.Handler {
+	return payloadFilter{h.Handler.WithGroup(name)}
+}
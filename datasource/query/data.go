@@ -0,0 +1,219 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,DatasourceOutput
+
+// Package query implements the psrp-query data source, which runs a
+// PowerShell script on a live machine before the build and exposes what
+// it returns to the template.
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/hcl2helper"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Output formats.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// resultMarker prefixes the line carrying the json format's result, so
+// verbose and information records the script writes to stdout around it
+// aren't taken for JSON.
+const resultMarker = "__PACKER_QUERY_RESULT__:"
+
+// Config is the data source configuration: the psrp_* connection options
+// and the script to run.
+type Config struct {
+	psrp.Config `mapstructure:",squash"`
+
+	// Inline is the script, one line per element.
+	Inline []string `mapstructure:"inline"`
+
+	// Script is a local file holding the script, in place of Inline.
+	Script string `mapstructure:"script"`
+
+	// Format is "json" (default), where the script's output objects are
+	// converted with ConvertTo-Json, or "text", where its output is taken
+	// as is.
+	Format string `mapstructure:"format"`
+
+	// Depth is the ConvertTo-Json depth for the json format. Defaults to 5.
+	Depth int `mapstructure:"depth"`
+}
+
+// DatasourceOutput is what the data source exposes to the template.
+type DatasourceOutput struct {
+	// Output is the script's output: JSON for the json format, which
+	// jsondecode() turns into HCL values, or trimmed text.
+	Output string `mapstructure:"output"`
+
+	// Values holds, for the json format, the top-level properties of an
+	// object the script returned. Strings are kept as is; other values are
+	// JSON-encoded.
+	Values map[string]string `mapstructure:"values"`
+}
+
+// Datasource runs a script over PSRP.
+type Datasource struct {
+	config Config
+	script string
+}
+
+// ConfigSpec returns the HCL2 spec of the data source's configuration.
+func (d *Datasource) ConfigSpec() hcldec.ObjectSpec { return d.config.FlatMapstructure().HCL2Spec() }
+
+// OutputSpec returns the HCL2 spec of the data source's output.
+func (d *Datasource) OutputSpec() hcldec.ObjectSpec {
+	return (&DatasourceOutput{}).FlatMapstructure().HCL2Spec()
+}
+
+// Configure decodes and validates the configuration.
+func (d *Datasource) Configure(raws ...interface{}) error {
+	if err := config.Decode(&d.config, nil, raws...); err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&d.config.Config, nil) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	switch {
+	case len(d.config.Inline) > 0 && d.config.Script != "":
+		errs = packersdk.MultiErrorAppend(errs, errors.New("only one of inline and script may be set"))
+	case len(d.config.Inline) > 0:
+		d.script = strings.Join(d.config.Inline, "\n")
+	case d.config.Script != "":
+		data, err := os.ReadFile(d.config.Script)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("failed to read script: %w", err))
+		}
+		d.script = string(data)
+	default:
+		errs = packersdk.MultiErrorAppend(errs, errors.New("one of inline or script is required"))
+	}
+
+	if d.config.Format == "" {
+		d.config.Format = FormatJSON
+	}
+	if d.config.Format != FormatJSON && d.config.Format != FormatText {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("format must be %q or %q", FormatJSON, FormatText))
+	}
+	if d.config.Depth == 0 {
+		d.config.Depth = 5
+	}
+	if d.config.Depth < 1 || d.config.Depth > 100 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("depth must be between 1 and 100"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Execute connects, runs the script and returns its output. A script that
+// exits non-zero fails the data source, with its error output.
+func (d *Datasource) Execute() (_ cty.Value, err error) {
+	defer func() { err = psrp.RedactError(err) }()
+
+	ctx := context.Background()
+	if d.config.PSRPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.PSRPTimeout)
+		defer cancel()
+	}
+	spec := d.OutputSpec()
+	null := cty.NullVal(cty.DynamicPseudoType)
+
+	// Data sources have no UI; connection progress goes to the log
+	ui := psrp.RedactUi(&packersdk.BasicUi{Writer: log.Writer(), ErrorWriter: log.Writer()})
+	comm, done, err := provisioner.Session(ctx, ui, &d.config.Config)
+	if err != nil {
+		return null, err
+	}
+	defer done()
+
+	script := d.script
+	if d.config.Format == FormatJSON {
+		script = fmt.Sprintf("$__packerResult = & {\n%s\n}\nWrite-Output ('%s' + (ConvertTo-Json -InputObject $__packerResult -Depth %d -Compress))",
+			d.script, resultMarker, d.config.Depth)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := &packersdk.RemoteCmd{Command: script, Stdout: &stdout, Stderr: &stderr}
+	if err := comm.Start(ctx, cmd); err != nil {
+		return null, err
+	}
+	if code := cmd.Wait(); code != 0 {
+		return null, fmt.Errorf("script exited with %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+
+	output := DatasourceOutput{Output: strings.TrimSpace(stdout.String())}
+	if d.config.Format == FormatJSON {
+		result, ok := markedResult(stdout.String())
+		if !ok {
+			return null, errors.New("script output has no result")
+		}
+		output.Output = result
+		values, err := topLevelValues(output.Output)
+		if err != nil {
+			return null, err
+		}
+		output.Values = values
+	}
+	return hcl2helper.HCL2ValueFromConfig(output, spec), nil
+}
+
+// markedResult returns what follows resultMarker on the last line that
+// starts with it.
+func markedResult(stdout string) (string, bool) {
+	lines := strings.Split(stdout, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if result, ok := strings.CutPrefix(strings.TrimRight(lines[i], "\r"), resultMarker); ok {
+			return strings.TrimSpace(result), true
+		}
+	}
+	return "", false
+}
+
+// topLevelValues returns the properties of a JSON object as strings, or
+// nil if data holds some other JSON value.
+func topLevelValues(data string) (map[string]string, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, fmt.Errorf("script output is not JSON: %w", err)
+	}
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	values := make(map[string]string, len(object))
+	for k, v := range object {
+		if s, ok := v.(string); ok {
+			values[k] = s
+			continue
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = string(encoded)
+	}
+	return values, nil
+}
@@ -0,0 +1,25 @@
+package query
+
+import "testing"
+
+func TestMarkedResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdout string
+		want   string
+		ok     bool
+	}{
+		{"result only", resultMarker + `{"a":1}` + "\r\n", `{"a":1}`, true},
+		{"with host output", "Checking switches...\n" + resultMarker + `{"a":1}` + "\nVERBOSE: done\n", `{"a":1}`, true},
+		{"marker in log text", "said " + resultMarker + "\n" + resultMarker + "[1]\n", "[1]", true},
+		{"no result", "Checking switches...\n", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := markedResult(tt.stdout)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("markedResult = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package manifest implements the manifest-psrp post-processor, which
+// attaches the image manifest written by the manifest-psrp provisioner to
+// the build's artifact. The guest is gone by the time post-processors run,
+// so the manifest has to be collected during provisioning.
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	provmanifest "github.com/smnsjas/packer-psrp-communicator/provisioner/manifest"
+)
+
+// Artifact state keys set on the artifact this post-processor returns.
+const (
+	// StateManifest holds the enriched manifest as a JSON string.
+	StateManifest = "psrp_image_manifest"
+	// StateManifestPath holds the path of the enriched manifest file.
+	StateManifestPath = "psrp_image_manifest_path"
+)
+
+// Config is the post-processor configuration.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	// Input is the manifest written by the manifest-psrp provisioner.
+	// Defaults to the provisioner's default output for this build.
+	Input string `mapstructure:"input"`
+
+	// Output is where the enriched manifest is written. Defaults to Input.
+	Output string `mapstructure:"output"`
+
+	ctx interpolate.Context
+}
+
+// Manifest is the image manifest together with the artifact it describes.
+type Manifest struct {
+	BuildName   string `json:"build_name"`
+	BuilderType string `json:"builder_type"`
+	BuilderID   string `json:"builder_id"`
+	ArtifactID  string `json:"artifact_id"`
+
+	// Files are the artifact's files, without the manifest itself.
+	Files []string `json:"files,omitempty"`
+
+	*psrp.ImageManifest
+}
+
+// PostProcessor attaches an image manifest to the artifact.
+type PostProcessor struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the post-processor's configuration.
+func (p *PostProcessor) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Configure decodes the configuration.
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "manifest-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.Input == "" {
+		p.config.Input = provmanifest.DefaultOutput(p.config.PackerBuildName)
+	}
+	if p.config.Output == "" {
+		p.config.Output = p.config.Input
+	}
+	return nil
+}
+
+// PostProcess reads the manifest, records the artifact's identity in it,
+// writes it out and returns the artifact with the manifest attached. The
+// input artifact itself is passed through, so it is always kept.
+func (p *PostProcessor) PostProcess(ctx context.Context, ui packersdk.Ui, source packersdk.Artifact) (packersdk.Artifact, bool, bool, error) {
+	data, err := os.ReadFile(p.config.Input)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, false, fmt.Errorf("no manifest at %s; run the manifest-psrp provisioner last in the build", p.config.Input)
+		}
+		return nil, false, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	manifest := &Manifest{ImageManifest: &psrp.ImageManifest{}}
+	if err := json.Unmarshal(data, manifest.ImageManifest); err != nil {
+		return nil, false, false, fmt.Errorf("failed to parse manifest %s: %w", p.config.Input, err)
+	}
+
+	manifest.BuildName = p.config.PackerBuildName
+	manifest.BuilderType = p.config.PackerBuilderType
+	manifest.BuilderID = source.BuilderId()
+	manifest.ArtifactID = source.Id()
+	manifest.Files = source.Files()
+
+	data, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, false, false, err
+	}
+	if dir := filepath.Dir(p.config.Output); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, false, false, fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(p.config.Output, data, 0o644); err != nil {
+		return nil, false, false, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	ui.Say(fmt.Sprintf("Attached image manifest %s to artifact %s", p.config.Output, manifest.ArtifactID))
+
+	return &Artifact{Artifact: source, path: p.config.Output, manifest: string(data)}, true, true, nil
+}
+
+// Artifact is the source artifact with the manifest file added to its
+// files and state.
+type Artifact struct {
+	packersdk.Artifact
+
+	path     string
+	manifest string
+}
+
+// Files returns the source artifact's files and the manifest.
+func (a *Artifact) Files() []string {
+	return append(append([]string(nil), a.Artifact.Files()...), a.path)
+}
+
+// State returns the manifest for StateManifest and StateManifestPath, and
+// the source artifact's state otherwise.
+func (a *Artifact) State(name string) interface{} {
+	switch name {
+	case StateManifest:
+		return a.manifest
+	case StateManifestPath:
+		return a.path
+	}
+	return a.Artifact.State(name)
+}
@@ -0,0 +1,157 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package dsc implements the dsc-psrp provisioner, which applies a Desired
+// State Configuration over a PSRP session and fails the build if any
+// resource doesn't converge.
+package dsc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Config is the provisioner configuration. As with powershell-psrp, the
+// psrp_* connection settings name the machine to connect to.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// ConfigurationScript is a local .ps1 file defining the configuration
+	// named ConfigurationName, which is compiled on the guest with the
+	// optional ConfigurationData (.psd1) and ConfigurationParameters.
+	ConfigurationScript     string            `mapstructure:"configuration_script"`
+	ConfigurationName       string            `mapstructure:"configuration_name"`
+	ConfigurationData       string            `mapstructure:"configuration_data"`
+	ConfigurationParameters map[string]string `mapstructure:"configuration_parameters"`
+
+	// MOFPath is a compiled .mof file, or a directory of them, to apply
+	// instead of a configuration script.
+	MOFPath string `mapstructure:"mof_path"`
+
+	// ConvergenceTimeout bounds the wait for the configuration to finish
+	// applying. Defaults to 30m.
+	ConvergenceTimeout time.Duration `mapstructure:"convergence_timeout"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner applies DSC configurations over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "dsc-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	if (p.config.ConfigurationScript == "") == (p.config.MOFPath == "") {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("exactly one of configuration_script or mof_path must be specified"))
+	}
+	if p.config.ConfigurationScript != "" && p.config.ConfigurationName == "" {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("configuration_name is required with configuration_script"))
+	}
+	if p.config.MOFPath != "" && (p.config.ConfigurationData != "" || len(p.config.ConfigurationParameters) > 0) {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("configuration_data and configuration_parameters require configuration_script"))
+	}
+	for _, path := range []string{p.config.ConfigurationScript, p.config.ConfigurationData, p.config.MOFPath} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("bad path %q: %w", path, err))
+		}
+	}
+
+	if p.config.ConvergenceTimeout < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("convergence_timeout must not be negative"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision applies the configuration and reports each resource that
+// failed to converge.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	session, done, err := provisioner.Session(ctx, ui, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	dsc := &psrp.DSCConfiguration{
+		Script:     p.config.ConfigurationScript,
+		Name:       p.config.ConfigurationName,
+		Data:       p.config.ConfigurationData,
+		Parameters: p.config.ConfigurationParameters,
+		MOF:        p.config.MOFPath,
+		Timeout:    p.config.ConvergenceTimeout,
+	}
+	if dsc.Script != "" {
+		ui.Say(fmt.Sprintf("Applying DSC configuration %s over PSRP...", dsc.Name))
+	} else {
+		ui.Say(fmt.Sprintf("Applying DSC MOF %s over PSRP...", dsc.MOF))
+	}
+
+	progress := provisioner.UiWriter(ui)
+	result, err := session.ApplyDSCConfiguration(ctx, dsc, progress)
+	progress.Close()
+
+	var dscErr *psrp.DSCError
+	if errors.As(err, &dscErr) {
+		for _, f := range dscErr.Failures {
+			if f.Error != "" {
+				ui.Error(fmt.Sprintf("%s: %s", f.ResourceID, f.Error))
+			} else {
+				ui.Error(fmt.Sprintf("%s: not in the desired state", f.ResourceID))
+			}
+		}
+		return fmt.Errorf("%d DSC resource(s) failed to converge", len(dscErr.Failures))
+	}
+	if err != nil {
+		return err
+	}
+
+	ui.Say(fmt.Sprintf("DSC configuration converged (%d resource(s) in the desired state)", len(result.InDesiredState)))
+	if len(result.InDesiredState) > 0 {
+		ui.Message(strings.Join(result.InDesiredState, ", "))
+	}
+	if result.RebootRequired {
+		ui.Say("DSC requested a reboot to finish; add a windows-restart provisioner before depending on it")
+	}
+	return nil
+}
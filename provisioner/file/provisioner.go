@@ -0,0 +1,270 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package file implements the file-psrp provisioner, which transfers files
+// and directories over a PSRP session like the stock file provisioner does
+// over the build's communicator, verifying each file's SHA-256 after the
+// transfer.
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Config is the provisioner configuration. As with powershell-psrp, the
+// psrp_* connection settings name the machine to connect to.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// Source is the path to transfer from: local for uploads, remote for
+	// downloads. Sources transfers several paths into Destination.
+	Source  string   `mapstructure:"source"`
+	Sources []string `mapstructure:"sources"`
+
+	// Destination is the path to transfer to. A trailing slash (or
+	// backslash) means "into this directory".
+	Destination string `mapstructure:"destination"`
+
+	// Direction is "upload" (default) or "download".
+	Direction string `mapstructure:"direction"`
+
+	// Generated skips checking that a local source exists at Prepare time,
+	// for files created earlier in the build.
+	Generated bool `mapstructure:"generated"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner transfers files over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "file-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	if p.config.Direction == "" {
+		p.config.Direction = "upload"
+	}
+	if p.config.Direction != "upload" && p.config.Direction != "download" {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("direction must be upload or download, got %q", p.config.Direction))
+	}
+
+	if p.config.Source != "" && len(p.config.Sources) > 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("only one of source or sources may be specified"))
+	}
+	if p.config.Source != "" {
+		p.config.Sources = []string{p.config.Source}
+	}
+	if len(p.config.Sources) == 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("source or sources must be specified"))
+	}
+	if p.config.Direction == "upload" && !p.config.Generated {
+		for _, src := range p.config.Sources {
+			if _, err := os.Stat(src); err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("bad source %q: %w", src, err))
+			}
+		}
+	}
+
+	if p.config.Destination == "" {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("destination must be specified"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision transfers each source in turn over the PSRP session.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	session, done, err := provisioner.Session(ctx, ui, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for _, src := range p.config.Sources {
+		if p.config.Direction == "download" {
+			err = p.download(ctx, ui, session, src)
+		} else {
+			err = p.upload(ctx, ui, session, src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload copies the local file or directory src to the destination. A
+// directory with a trailing slash has its contents copied; without one, the
+// directory itself is created under the destination.
+func (p *Provisioner) upload(ctx context.Context, ui packersdk.Ui, comm *psrp.Communicator, src string) error {
+	ui.Say(fmt.Sprintf("Uploading %s => %s", src, p.config.Destination))
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("error reading source: %w", err)
+	}
+
+	if !info.IsDir() {
+		dst := p.config.Destination
+		if isDirPath(dst) || len(p.config.Sources) > 1 {
+			dst = p.config.RemoteJoin(dst, filepath.Base(src))
+		}
+		return uploadFile(ctx, ui, comm, src, dst)
+	}
+
+	root := p.config.Destination
+	if !isDirPath(src) {
+		root = p.config.RemoteJoin(root, filepath.Base(src))
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return uploadFile(ctx, ui, comm, path, p.config.RemoteJoin(root, filepath.ToSlash(rel)))
+	})
+}
+
+// uploadFile uploads one file with progress, then checks that the remote
+// copy has the same SHA-256.
+func uploadFile(ctx context.Context, ui packersdk.Ui, comm *psrp.Communicator, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", src, err)
+	}
+
+	h := sha256.New()
+	progress := ui.TrackProgress(filepath.Base(src), 0, info.Size(), f)
+	defer progress.Close()
+
+	if err := comm.UploadContext(ctx, dst, io.TeeReader(progress, h), &info); err != nil {
+		return fmt.Errorf("error uploading %s: %w", src, err)
+	}
+
+	stat, err := comm.StatFile(ctx, dst)
+	if err != nil {
+		return err
+	}
+	return verify(dst, hex.EncodeToString(h.Sum(nil)), stat)
+}
+
+// download copies the remote file or directory src to the local
+// destination.
+func (p *Provisioner) download(ctx context.Context, ui packersdk.Ui, comm *psrp.Communicator, src string) error {
+	ui.Say(fmt.Sprintf("Downloading %s => %s", src, p.config.Destination))
+
+	stat, err := comm.StatFile(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !stat.Exists {
+		return fmt.Errorf("remote source %s does not exist", src)
+	}
+	if stat.Dir {
+		// Directory downloads go through the communicator's DownloadDir, which
+		// lists the files itself, so they aren't verified per file.
+		return comm.DownloadDirContext(ctx, src, p.config.Destination, nil)
+	}
+
+	dst := p.config.Destination
+	if info, err := os.Stat(dst); isDirPath(dst) || len(p.config.Sources) > 1 || (err == nil && info.IsDir()) {
+		dst = filepath.Join(dst, remoteBase(src))
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", dst, err)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", dst, err)
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(comm.DownloadContext(ctx, src, pw)) }()
+	progress := ui.TrackProgress(remoteBase(src), 0, stat.Size, pr)
+	defer progress.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), progress); err != nil {
+		return fmt.Errorf("error downloading %s: %w", src, err)
+	}
+	return verify(src, hex.EncodeToString(h.Sum(nil)), stat)
+}
+
+// verify compares the local SHA-256 of a transferred file with the remote
+// one.
+func verify(path, local string, remote *psrp.FileStat) error {
+	if !remote.Exists {
+		return fmt.Errorf("checksum verification failed for %s: remote file does not exist", path)
+	}
+	if !strings.EqualFold(local, remote.SHA256) {
+		return fmt.Errorf("checksum verification failed for %s: local sha256 %s, remote %s", path, local, remote.SHA256)
+	}
+	return nil
+}
+
+// isDirPath reports whether path names a directory by its trailing slash.
+func isDirPath(path string) bool {
+	return strings.HasSuffix(path, "/") || strings.HasSuffix(path, "\\")
+}
+
+// remoteBase returns the last element of a remote path.
+func remoteBase(path string) string {
+	path = strings.TrimRight(path, "/\\")
+	if i := strings.LastIndexAny(path, "/\\"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
@@ -0,0 +1,119 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package manifest implements the manifest-psrp provisioner, which records
+// what the build put on the guest in a local JSON file. The manifest-psrp
+// post-processor then attaches that file to the build's artifact.
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// DefaultOutput is where the manifest is written for a build unless output
+// is set. The manifest-psrp post-processor reads it from the same place.
+func DefaultOutput(buildName string) string {
+	if buildName == "" {
+		return "psrp-manifest.json"
+	}
+	return fmt.Sprintf("psrp-manifest-%s.json", buildName)
+}
+
+// Config is the provisioner configuration. As with powershell-psrp, the
+// psrp_* connection settings name the machine to connect to.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// Output is the local file the manifest is written to. Defaults to
+	// psrp-manifest-<build name>.json.
+	Output string `mapstructure:"output"`
+
+	// Software limits the software listed to names matching one of these
+	// wildcard patterns. Everything is listed if empty.
+	Software []string `mapstructure:"software"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner records an image manifest over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "manifest-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	if p.config.Output == "" {
+		p.config.Output = DefaultOutput(p.config.PackerBuildName)
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision collects the manifest and writes it to the output file.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	session, done, err := provisioner.Session(ctx, ui, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	ui.Say("Collecting image manifest over PSRP...")
+	manifest, err := session.ImageManifest(ctx, p.config.Software)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(p.config.Output); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(p.config.Output, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	ui.Say(fmt.Sprintf("Wrote manifest of %d update(s) and %d software package(s) to %s",
+		len(manifest.Updates), len(manifest.Software), p.config.Output))
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package packages implements the packages-psrp provisioner, which
+// installs packages with Chocolatey or winget over a PSRP session.
+package packages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Config is the provisioner configuration. As with powershell-psrp, the
+// psrp_* connection settings name the machine to connect to.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// Manager is "choco" (default) or "winget".
+	Manager string `mapstructure:"manager"`
+
+	// Packages are package names (winget IDs), optionally pinned to a
+	// version as "name@version".
+	Packages []string `mapstructure:"packages"`
+
+	// Source installs from this Chocolatey feed or winget source.
+	Source string `mapstructure:"source"`
+
+	// Retries is how many times to retry a package after a transient
+	// download failure. Defaults to 3.
+	Retries    int           `mapstructure:"retries"`
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+
+	// SkipRestart leaves a restart requested by an installer to a later
+	// provisioner.
+	SkipRestart    bool          `mapstructure:"skip_restart"`
+	RestartTimeout time.Duration `mapstructure:"restart_timeout"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner installs packages over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "packages-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	if p.config.Manager == "" {
+		p.config.Manager = string(psrp.PackageManagerChocolatey)
+	}
+	switch psrp.PackageManager(p.config.Manager) {
+	case psrp.PackageManagerChocolatey, psrp.PackageManagerWinget:
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("manager must be %q or %q", psrp.PackageManagerChocolatey, psrp.PackageManagerWinget))
+	}
+	if len(p.config.Packages) == 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("packages must contain at least one package"))
+	}
+	for _, pkg := range p.config.Packages {
+		if psrp.ParsePackage(pkg).Name == "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("bad package %q", pkg))
+		}
+	}
+	if p.config.Retries < 0 || p.config.RetryDelay < 0 || p.config.RestartTimeout < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("retries, retry_delay and restart_timeout must not be negative"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision installs the packages, restarting the guest afterwards if one
+// of them needs it.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	session, done, err := provisioner.Session(ctx, ui, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	packages := make([]psrp.Package, len(p.config.Packages))
+	for i, pkg := range p.config.Packages {
+		packages[i] = psrp.ParsePackage(pkg)
+	}
+
+	ui.Say(fmt.Sprintf("Installing %d package(s) with %s over PSRP...", len(packages), p.config.Manager))
+	progress := provisioner.UiWriter(ui)
+	result, err := session.InstallPackages(ctx, packages, &psrp.PackageOptions{
+		Manager:        psrp.PackageManager(p.config.Manager),
+		Source:         p.config.Source,
+		Retries:        p.config.Retries,
+		RetryDelay:     p.config.RetryDelay,
+		SkipRestart:    p.config.SkipRestart,
+		RestartTimeout: p.config.RestartTimeout,
+	}, progress)
+	progress.Close()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case result.Restarted:
+		ui.Say(fmt.Sprintf("Installed %d package(s) and restarted the guest", len(result.Installed)))
+	case result.RebootRequired:
+		ui.Say(fmt.Sprintf("Installed %d package(s); a restart is required to finish", len(result.Installed)))
+	default:
+		ui.Say(fmt.Sprintf("Installed %d package(s)", len(result.Installed)))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package pester implements the pester-psrp provisioner, which runs Pester
+// tests on the guest over a PSRP session and fails the build if any fail.
+package pester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Config is the provisioner configuration. As with powershell-psrp, the
+// psrp_* connection settings name the machine to connect to.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// Tests are local test files or directories of them. Directories are
+	// uploaded whole, so helpers and data files can sit next to the tests.
+	Tests []string `mapstructure:"tests"`
+
+	// PesterVersion is the minimum Pester version, installed from the
+	// PowerShell Gallery if missing. Defaults to 5.3.0.
+	PesterVersion string `mapstructure:"pester_version"`
+
+	// Tags and ExcludeTags filter the tests run.
+	Tags        []string `mapstructure:"tags"`
+	ExcludeTags []string `mapstructure:"exclude_tags"`
+
+	// ResultsFile saves the NUnit XML results locally.
+	ResultsFile string `mapstructure:"results_file"`
+
+	// Timeout bounds the test run, including installing Pester.
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner runs Pester tests over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "pester-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	if len(p.config.Tests) == 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("tests must contain at least one path"))
+	}
+	for _, path := range p.config.Tests {
+		if _, err := os.Stat(path); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("bad test path %q: %w", path, err))
+		}
+	}
+
+	if p.config.Timeout < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("timeout must not be negative"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision runs the tests and reports each failure.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	session, done, err := provisioner.Session(ctx, ui, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	ui.Say("Running Pester tests over PSRP...")
+	progress := provisioner.UiWriter(ui)
+	result, err := session.RunPester(ctx, &psrp.PesterRun{
+		Paths:          p.config.Tests,
+		MinimumVersion: p.config.PesterVersion,
+		Tags:           p.config.Tags,
+		ExcludeTags:    p.config.ExcludeTags,
+		ResultsFile:    p.config.ResultsFile,
+		Timeout:        p.config.Timeout,
+	}, progress)
+	progress.Close()
+
+	var pesterErr *psrp.PesterError
+	if errors.As(err, &pesterErr) {
+		for _, f := range pesterErr.Result.Failures {
+			ui.Error(fmt.Sprintf("[-] %s: %s", f.Name, f.Message))
+		}
+	} else if err != nil {
+		return err
+	}
+
+	ui.Say(fmt.Sprintf("Pester: %d passed, %d failed, %d skipped of %d in %.1fs",
+		result.Passed, result.Failed, result.Skipped, result.Total, result.Duration))
+	if p.config.ResultsFile != "" {
+		ui.Message(fmt.Sprintf("Test results: %s", p.config.ResultsFile))
+	}
+	if pesterErr != nil {
+		return fmt.Errorf("%d Pester test(s) failed", result.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package powershell implements the powershell-psrp provisioner, which runs
+// PowerShell scripts over a PSRP session like the stock powershell
+// provisioner does over WinRM.
+package powershell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Config is the provisioner configuration. If the psrp_* connection
+// settings name a machine, the provisioner opens its own session to it;
+// otherwise it runs over the build's communicator.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// Scripts to run: inline commands, or local script files.
+	Inline  []string `mapstructure:"inline"`
+	Script  string   `mapstructure:"script"`
+	Scripts []string `mapstructure:"scripts"`
+
+	// EnvVars are KEY=VALUE pairs set in the script's environment.
+	EnvVars []string `mapstructure:"environment_vars"`
+
+	// RemotePath is where scripts are uploaded before running (default
+	// C:/Windows/Temp/packer-ps-<uuid>.ps1, or /tmp/packer-ps-<uuid>.ps1 on
+	// Linux and macOS targets).
+	RemotePath string `mapstructure:"remote_path"`
+
+	// ExecutionPolicy applies to the uploaded script (default "bypass").
+	ExecutionPolicy string `mapstructure:"execution_policy"`
+
+	// ElevatedUser and ElevatedPassword run scripts as that user with
+	// administrative privileges, through a scheduled task.
+	ElevatedUser     string `mapstructure:"elevated_user"`
+	ElevatedPassword string `mapstructure:"elevated_password"`
+
+	// ValidExitCodes are the exit codes that count as success (default [0]).
+	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner runs PowerShell scripts over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+var executionPolicies = []string{"bypass", "allsigned", "default", "remotesigned", "restricted", "undefined", "unrestricted"}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "powershell-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.PrepareOptional(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	sources := 0
+	if len(p.config.Inline) > 0 {
+		sources++
+	}
+	if p.config.Script != "" {
+		sources++
+		p.config.Scripts = append([]string{p.config.Script}, p.config.Scripts...)
+	} else if len(p.config.Scripts) > 0 {
+		sources++
+	}
+	if sources != 1 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("exactly one of inline, script or scripts must be specified"))
+	}
+	for _, path := range p.config.Scripts {
+		if _, err := os.Stat(path); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("bad script %q: %w", path, err))
+		}
+	}
+
+	for _, kv := range p.config.EnvVars {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("environment variable %q is not in KEY=VALUE format", kv))
+		}
+	}
+
+	if p.config.ExecutionPolicy == "" {
+		p.config.ExecutionPolicy = "bypass"
+	}
+	p.config.ExecutionPolicy = strings.ToLower(p.config.ExecutionPolicy)
+	if !contains(executionPolicies, p.config.ExecutionPolicy) {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("execution_policy must be one of %s",
+			strings.Join(executionPolicies, ", ")))
+	}
+
+	if p.config.ElevatedPassword != "" && p.config.ElevatedUser == "" {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("elevated_password requires elevated_user"))
+	}
+	psrp.RegisterSecret(p.config.ElevatedPassword)
+
+	if len(p.config.ValidExitCodes) == 0 {
+		p.config.ValidExitCodes = []int{0}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision runs each script in turn over the provisioner's own PSRP
+// session, or the build's communicator if no target is configured.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	target, done, err := provisioner.Communicator(ctx, ui, comm, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if len(p.config.Inline) > 0 {
+		ui.Say("Provisioning with PowerShell over PSRP (inline)...")
+		return p.run(ctx, ui, target, strings.Join(p.config.Inline, "\n"))
+	}
+
+	for _, path := range p.config.Scripts {
+		ui.Say(fmt.Sprintf("Provisioning with PowerShell over PSRP: %s", path))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading script: %w", err)
+		}
+		if err := p.run(ctx, ui, target, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run uploads script with the environment prepended, runs it (elevated if
+// configured) and checks its exit code.
+func (p *Provisioner) run(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, script string) error {
+	remotePath := p.config.RemotePath
+	if remotePath == "" {
+		remotePath = fmt.Sprintf("%s/packer-ps-%s.ps1", p.config.RemoteTempDir(), uuid.New())
+	}
+	if p.config.ElevatedUser != "" && p.config.POSIXTarget() {
+		return errors.New("elevated_user is only supported on Windows targets")
+	}
+
+	content := p.environment() + script
+	if err := provisioner.Upload(ctx, comm, remotePath, strings.NewReader(content), nil); err != nil {
+		return fmt.Errorf("error uploading script: %w", err)
+	}
+
+	var command string
+	if p.config.ElevatedUser != "" {
+		command = elevatedCommand(remotePath, p.config.ExecutionPolicy, p.config.ElevatedUser, p.config.ElevatedPassword)
+	} else {
+		command = fmt.Sprintf(`try { & '%s' } finally { Remove-Item -LiteralPath '%s' -Force -ErrorAction SilentlyContinue }`,
+			quote(remotePath), quote(remotePath))
+		// Execution policies don't exist outside Windows
+		if !p.config.POSIXTarget() {
+			command = fmt.Sprintf("Set-ExecutionPolicy -Scope Process -ExecutionPolicy %s -Force\n%s", p.config.ExecutionPolicy, command)
+		}
+	}
+
+	cmd := &packersdk.RemoteCmd{Command: provisioner.Command(comm, &p.config.Config, command, p.config.ExecutionPolicy)}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return err
+	}
+	if status := cmd.ExitStatus(); !containsInt(p.config.ValidExitCodes, status) {
+		return fmt.Errorf("script exited with non-zero exit status: %d; allowed exit codes are %v",
+			status, p.config.ValidExitCodes)
+	}
+	return nil
+}
+
+// environment returns script lines setting the configured environment
+// variables, plus the PACKER_BUILD_NAME and PACKER_BUILDER_TYPE ones the
+// stock provisioner sets.
+func (p *Provisioner) environment() string {
+	env := map[string]string{
+		"PACKER_BUILD_NAME":   p.config.PackerBuildName,
+		"PACKER_BUILDER_TYPE": p.config.PackerBuilderType,
+	}
+	for _, kv := range p.config.EnvVars {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "$env:%s = '%s'\n", k, quote(env[k]))
+	}
+	return b.String()
+}
+
+// elevatedCommand runs the script at path as user through a scheduled task
+// with the highest run level, then replays its output and exit code.
+func elevatedCommand(path, policy, user, password string) string {
+	name := "packer-elevated-" + uuid.New().String()
+	return fmt.Sprintf(`$name = '%s'
+$log = Join-Path $env:SystemRoot "Temp\$name.log"
+$action = New-ScheduledTaskAction -Execute 'cmd.exe' -Argument "/c powershell.exe -NoProfile -NonInteractive -ExecutionPolicy %s -File ""%s"" > ""$log"" 2>&1"
+Register-ScheduledTask -TaskName $name -Action $action -User '%s' -Password '%s' -RunLevel Highest -Force | Out-Null
+try {
+	Start-ScheduledTask -TaskName $name
+	do {
+		Start-Sleep -Seconds 1
+		$info = Get-ScheduledTaskInfo -TaskName $name
+	} while ((Get-ScheduledTask -TaskName $name).State -eq 'Running' -or $info.LastTaskResult -in 267009, 267011)
+	if (Test-Path $log) { Get-Content $log }
+} finally {
+	Unregister-ScheduledTask -TaskName $name -Confirm:$false
+	Remove-Item -LiteralPath $log, '%s' -Force -ErrorAction SilentlyContinue
+}
+$global:LASTEXITCODE = $info.LastTaskResult`, name, policy, path, quote(user), quote(password), quote(path))
+}
+
+// quote escapes s for a single-quoted PowerShell string.
+func quote(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package powershell
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp/testutil"
+)
+
+// TestProvisionOverBuildCommunicator checks that without a target the
+// provisioner runs over the communicator Packer hands it, starting the
+// script through powershell.exe since that communicator runs command lines.
+func TestProvisionOverBuildCommunicator(t *testing.T) {
+	var p Provisioner
+	err := p.Prepare(map[string]interface{}{
+		"remote_path":      "C:/Windows/Temp/script.ps1",
+		"execution_policy": "RemoteSigned",
+		"inline":           []string{"Write-Output provisioned"},
+	})
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	comm := new(packersdk.MockCommunicator)
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, nil); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if comm.UploadPath != "C:/Windows/Temp/script.ps1" || !strings.Contains(comm.UploadData, "Write-Output provisioned") {
+		t.Errorf("uploaded %q to %q, want the inline command in the script", comm.UploadData, comm.UploadPath)
+	}
+	if !comm.StartCalled {
+		t.Fatal("script was not run over the build's communicator")
+	}
+
+	const prefix = "powershell.exe -NoProfile -NonInteractive -ExecutionPolicy remotesigned -EncodedCommand "
+	command := comm.StartCmd.Command
+	if !strings.HasPrefix(command, prefix) || strings.Contains(command, "\n") {
+		t.Fatalf("command = %q, want a single %q line", command, prefix+"...")
+	}
+	if script := decodeCommand(t, strings.TrimPrefix(command, prefix)); !strings.Contains(script, "& 'C:/Windows/Temp/script.ps1'") {
+		t.Errorf("encoded command %q doesn't run the uploaded script", script)
+	}
+}
+
+// TestProvisionOpensOwnSession checks the provisioner runs over a session
+// of its own, not the build's communicator, when psrp_host is set.
+func TestProvisionOpensOwnSession(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+
+	var p Provisioner
+	err := p.Prepare(map[string]interface{}{
+		"psrp_host":                 srv.Host(),
+		"psrp_port":                 srv.Port(),
+		"psrp_auth_type":            "basic",
+		"psrp_allow_insecure_basic": true,
+		"psrp_flight_recorder_dir":  t.TempDir(),
+		"psrp_username":             testutil.ServerUsername,
+		"psrp_password":             testutil.ServerPassword,
+		"psrp_skip_tcp_probe":       true,
+		"psrp_retry_interval":       "10ms",
+		"remote_path":               "C:/Windows/Temp/script.ps1",
+		"inline":                    []string{"Write-Output provisioned"},
+	})
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	comm := new(packersdk.MockCommunicator)
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, nil); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if comm.StartCalled || comm.UploadCalled {
+		t.Error("provisioner used the build's communicator")
+	}
+
+	data, ok := srv.File("C:/Windows/Temp/script.ps1")
+	if !ok || !strings.Contains(string(data), "Write-Output provisioned") {
+		t.Errorf("uploaded script = %q, want it to contain the inline command", data)
+	}
+	scripts := srv.Scripts()
+	if len(scripts) == 0 || strings.Contains(scripts[len(scripts)-1], "-EncodedCommand") {
+		t.Errorf("the session ran %q, want the script as is", scripts)
+	}
+}
+
+// decodeCommand reverses powershell.exe's -EncodedCommand encoding.
+func decodeCommand(t *testing.T, encoded string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw)%2 != 0 {
+		t.Fatalf("invalid -EncodedCommand %q: %v", encoded, err)
+	}
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = uint16(raw[2*i]) | uint16(raw[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
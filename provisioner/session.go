@@ -0,0 +1,133 @@
+// Package provisioner holds what the PSRP provisioners share: validating
+// their connection settings and opening the PSRP session they run over.
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+// ErrNoTarget is returned for a configuration that names nothing to
+// connect to.
+var ErrNoTarget = errors.New("one of psrp_host, psrp_vmid, psrp_vm_name, psrp_container_id, psrp_pipe_name or psrp_pipe_process_id is required")
+
+// Dials reports whether cfg names a host, VM, container or pipe to
+// connect to.
+func Dials(cfg *psrp.Config) bool {
+	return cfg.PSRPHost != "" || cfg.PSRPVMID != "" || cfg.PSRPVMName != "" ||
+		cfg.PSRPContainerID != "" || cfg.PSRPPipeName != "" || cfg.PSRPPipeProcessID != 0
+}
+
+// Prepare validates the connection settings of a provisioner that needs a
+// PSRP session of its own. A target is required: Packer hands provisioners
+// an RPC proxy for the build's communicator, which only starts commands
+// and transfers files, not the PSRP session itself. psrp_keep_session is
+// rejected, as nothing else in the plugin process would reuse the session.
+func Prepare(cfg *psrp.Config, ctx *interpolate.Context) []error {
+	if !Dials(cfg) {
+		return []error{ErrNoTarget}
+	}
+	errs := cfg.Prepare(ctx)
+	if cfg.PSRPKeepSession {
+		errs = append(errs, errors.New("psrp_keep_session only applies to builders"))
+	}
+	return errs
+}
+
+// PrepareOptional validates the connection settings of a provisioner that
+// can also run over the build's communicator. With a target, they are
+// validated as Prepare does. Without one there is no session to open, but
+// psrp_target_os still says how to run commands over the build's.
+func PrepareOptional(cfg *psrp.Config, ctx *interpolate.Context) []error {
+	if Dials(cfg) {
+		return Prepare(cfg, ctx)
+	}
+	var errs []error
+	if cfg.PSRPKeepSession {
+		errs = append(errs, errors.New("psrp_keep_session only applies to builders"))
+	}
+	switch cfg.PSRPTargetOS {
+	case "", psrp.TargetWindows, psrp.TargetLinux, psrp.TargetMacOS:
+	default:
+		errs = append(errs, errors.New("psrp_target_os must be 'windows', 'linux' or 'macos'"))
+	}
+	return errs
+}
+
+// Communicator returns what to provision over, and a func to call when done
+// with it: a session of its own if cfg names a target, otherwise comm, the
+// build's communicator as Packer hands it to the provisioner.
+func Communicator(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, cfg *psrp.Config) (packersdk.Communicator, func(), error) {
+	if Dials(cfg) {
+		return Session(ctx, ui, cfg)
+	}
+	if comm == nil {
+		return nil, nil, ErrNoTarget
+	}
+	return comm, func() {}, nil
+}
+
+// Command returns script as a command to start over comm. A PSRP session
+// runs it as is. Any other communicator, including the RPC proxy for the
+// build's, runs a command line in the guest's shell, so script is passed
+// with -EncodedCommand to powershell.exe under the execution policy, or to
+// pwsh if cfg names a Linux or macOS target.
+func Command(comm packersdk.Communicator, cfg *psrp.Config, script, executionPolicy string) string {
+	if _, ok := comm.(*psrp.Communicator); ok {
+		return script
+	}
+	if cfg.POSIXTarget() {
+		return "pwsh -NoProfile -NonInteractive -EncodedCommand " + psrp.EncodeCommand(script)
+	}
+	return fmt.Sprintf("powershell.exe -NoProfile -NonInteractive -ExecutionPolicy %s -EncodedCommand %s",
+		executionPolicy, psrp.EncodeCommand(script))
+}
+
+// Upload uploads r to path over comm. A PSRP session stops the upload when
+// ctx is done; any other communicator's Upload takes no context.
+func Upload(ctx context.Context, comm packersdk.Communicator, path string, r io.Reader, fi *os.FileInfo) error {
+	if c, ok := comm.(*psrp.Communicator); ok {
+		return c.UploadContext(ctx, path, r, fi)
+	}
+	return comm.Upload(path, r, fi)
+}
+
+// Session opens a PSRP session to the target cfg names, and returns it with
+// a func to call when done with it. The session is opened with StepConnect,
+// so the connect retry policy and credential helpers apply, and the func
+// closes it the way StepConnect's cleanup does.
+func Session(ctx context.Context, ui packersdk.Ui, cfg *psrp.Config) (*psrp.Communicator, func(), error) {
+	if !Dials(cfg) {
+		return nil, nil, ErrNoTarget
+	}
+
+	step := &psrp.StepConnect{
+		Config: cfg,
+		Host:   func(multistep.StateBag) (string, error) { return cfg.PSRPHost, nil },
+	}
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", ui)
+	if step.Run(ctx, state) != multistep.ActionContinue {
+		err, ok := state.Get("error").(error)
+		if !ok {
+			err = errors.New("PSRP connection failed")
+		}
+		step.Cleanup(state)
+		return nil, nil, err
+	}
+	c, ok := state.Get("communicator").(*psrp.Communicator)
+	if !ok {
+		step.Cleanup(state)
+		return nil, nil, errors.New("PSRP is unavailable on the target and this step cannot run over the WinRM fallback")
+	}
+	return c, func() { step.Cleanup(state) }, nil
+}
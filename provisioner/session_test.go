@@ -0,0 +1,98 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+)
+
+func TestPrepare(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*psrp.Config)
+		want      string
+	}{
+		{"no target", func(*psrp.Config) {}, ErrNoTarget.Error()},
+		{"host", func(c *psrp.Config) { c.PSRPHost = "guest" }, ""},
+		{"keep session", func(c *psrp.Config) {
+			c.PSRPHost = "guest"
+			c.PSRPKeepSession = true
+		}, "psrp_keep_session only applies to builders"},
+		{"rendered password", func(c *psrp.Config) {
+			c.PSRPHost = "guest"
+			c.PSRPPassword = "pa{{ss"
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &psrp.Config{PSRPUsername: "user", PSRPPassword: "pass"}
+			tt.configure(cfg)
+			err := errors.Join(Prepare(cfg, nil)...)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Prepare = %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Prepare = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareOptional(t *testing.T) {
+	if errs := PrepareOptional(&psrp.Config{}, nil); len(errs) > 0 {
+		t.Errorf("PrepareOptional without a target = %v, want no errors", errs)
+	}
+	if errs := PrepareOptional(&psrp.Config{PSRPKeepSession: true}, nil); len(errs) == 0 {
+		t.Error("PrepareOptional accepted psrp_keep_session")
+	}
+	if errs := PrepareOptional(&psrp.Config{PSRPTargetOS: psrp.TargetLinux}, nil); len(errs) > 0 {
+		t.Errorf("PrepareOptional with psrp_target_os linux = %v, want no errors", errs)
+	}
+	if errs := PrepareOptional(&psrp.Config{PSRPTargetOS: "solaris"}, nil); len(errs) == 0 {
+		t.Error("PrepareOptional accepted psrp_target_os solaris")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	script := "Write-Output 'a'\nWrite-Output 'b'"
+
+	cfg := psrp.NewConfig()
+	got := Command(new(packersdk.MockCommunicator), cfg, script, "bypass")
+	want := "powershell.exe -NoProfile -NonInteractive -ExecutionPolicy bypass -EncodedCommand " + psrp.EncodeCommand(script)
+	if got != want {
+		t.Errorf("Command over another communicator = %q, want %q", got, want)
+	}
+
+	posix := psrp.NewConfig()
+	posix.PSRPTargetOS = psrp.TargetLinux
+	got = Command(new(packersdk.MockCommunicator), posix, script, "bypass")
+	want = "pwsh -NoProfile -NonInteractive -EncodedCommand " + psrp.EncodeCommand(script)
+	if got != want {
+		t.Errorf("Command over another communicator to Linux = %q, want %q", got, want)
+	}
+
+	cfg.PSRPUsername = "user"
+	cfg.PSRPPassword = "pass"
+	comm, err := psrp.New("guest", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Command(comm, cfg, script, "bypass"); got != script {
+		t.Errorf("Command over a PSRP session = %q, want the script as is", got)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	comm := new(packersdk.MockCommunicator)
+	if err := Upload(context.Background(), comm, `C:\Windows\Temp\script.ps1`, strings.NewReader("exit 0"), nil); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if comm.UploadPath != `C:\Windows\Temp\script.ps1` || comm.UploadData != "exit 0" {
+		t.Errorf("uploaded %q to %q, want \"exit 0\" to the script path", comm.UploadData, comm.UploadPath)
+	}
+}
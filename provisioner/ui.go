@@ -0,0 +1,49 @@
+package provisioner
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// UiWriter returns a writer that shows each line written to it with
+// ui.Message, for streaming remote output into the build log. Close shows
+// any final line without a newline.
+func UiWriter(ui packersdk.Ui) io.WriteCloser {
+	return &uiWriter{ui: ui}
+}
+
+type uiWriter struct {
+	mu  sync.Mutex
+	ui  packersdk.Ui
+	buf bytes.Buffer
+}
+
+func (w *uiWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the partial line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.ui.Message(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (w *uiWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.ui.Message(strings.TrimRight(w.buf.String(), "\r\n"))
+		w.buf.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+// Package windowsupdate implements the windows-update-psrp provisioner,
+// which installs Windows updates over a PSRP session, restarting the guest
+// as often as the updates need until none are left.
+package windowsupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	"github.com/smnsjas/packer-psrp-communicator/communicator/psrp"
+	"github.com/smnsjas/packer-psrp-communicator/provisioner"
+)
+
+// Config is the provisioner configuration. As with powershell-psrp, the
+// psrp_* connection settings name the machine to connect to.
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+	psrp.Config         `mapstructure:",squash"`
+
+	// SearchCriteria is the Windows Update search query. Defaults to
+	// "IsInstalled=0 and IsHidden=0 and Type='Software'".
+	SearchCriteria string `mapstructure:"search_criteria"`
+
+	// Include and Exclude are regular expressions matched against update
+	// titles.
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+
+	// MaxCycles bounds the search-install-restart cycles. Defaults to 10.
+	MaxCycles int `mapstructure:"max_cycles"`
+
+	// CycleTimeout bounds one cycle's search, download and install.
+	// Defaults to 2h.
+	CycleTimeout time.Duration `mapstructure:"cycle_timeout"`
+
+	// RestartTimeout bounds each restart. Defaults to 15m.
+	RestartTimeout time.Duration `mapstructure:"restart_timeout"`
+
+	ctx interpolate.Context
+}
+
+// Provisioner installs Windows updates over PSRP.
+type Provisioner struct {
+	config Config
+}
+
+// ConfigSpec returns the HCL2 spec of the provisioner's configuration.
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+// Prepare decodes and validates the configuration.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "windows-update-psrp",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+
+	for _, err := range provisioner.Prepare(&p.config.Config, &p.config.ctx) {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	// .NET and Go regular expressions differ, but not in the common subset
+	// worth checking here
+	for _, pattern := range append(append([]string{}, p.config.Include...), p.config.Exclude...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("bad update title pattern %q: %w", pattern, err))
+		}
+	}
+	if p.config.MaxCycles < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("max_cycles must not be negative"))
+	}
+	if p.config.CycleTimeout < 0 || p.config.RestartTimeout < 0 {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("cycle_timeout and restart_timeout must not be negative"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Provision installs updates until none are left.
+func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) (err error) {
+	ui = psrp.RedactUi(ui)
+	defer func() { err = psrp.RedactError(err) }()
+
+	session, done, err := provisioner.Session(ctx, ui, &p.config.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	ui.Say("Installing Windows updates over PSRP...")
+	progress := provisioner.UiWriter(ui)
+	result, err := session.InstallWindowsUpdates(ctx, &psrp.WindowsUpdateOptions{
+		SearchCriteria: p.config.SearchCriteria,
+		Include:        p.config.Include,
+		Exclude:        p.config.Exclude,
+		MaxCycles:      p.config.MaxCycles,
+		CycleTimeout:   p.config.CycleTimeout,
+		RestartTimeout: p.config.RestartTimeout,
+	}, progress)
+	progress.Close()
+
+	var updateErr *psrp.WindowsUpdateError
+	if errors.As(err, &updateErr) {
+		for _, u := range updateErr.Failed {
+			ui.Error(fmt.Sprintf("%s failed to install (0x%08X)", u.Title, uint32(u.HResult)))
+		}
+	}
+	if result != nil {
+		ui.Say(fmt.Sprintf("Installed %d update(s) with %d restart(s)", len(result.Installed), result.Restarts))
+	}
+	return err
+}